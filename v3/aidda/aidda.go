@@ -247,7 +247,7 @@ func Do(g *core.Grokker, modelName string, args ...string) (err error) {
 			Pl(string(out))
 			// ...then generate the commit message
 			Pf("Generating commit message...\n")
-			summary, err := g.GitCommitMessage("o3-mini", "--staged")
+			summary, err := g.GitCommitMessage("o3-mini", core.GitCommitOpts{}, "--staged")
 			Ck(err)
 			Pl(summary)
 			// ...then commit
@@ -0,0 +1,218 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// Version is the Anthropic API version sent with each request.
+const Version = "2023-06-01"
+
+// DefaultMaxTokens is the output token limit sent with each request.
+// The Messages API requires one.
+const DefaultMaxTokens = 8192
+
+// Client encapsulates the API client for Anthropic's Messages API.
+// This client implements the ChatClient interface (as defined in the
+// client package) for generating chat completions.
+type Client struct {
+	APIKey    string
+	Endpoint  string
+	MaxTokens int
+	// HTTPClient, if not nil, sends the requests instead of a
+	// default client.
+	HTTPClient *http.Client
+}
+
+// NewClient creates a new instance of the Anthropic chat client.  It
+// loads the ANTHROPIC_API_KEY from the environment.  If
+// ANTHROPIC_BASE_URL is set, requests go there instead of to the
+// Anthropic API.
+func NewClient() *Client {
+	key := os.Getenv("ANTHROPIC_API_KEY")
+	if key == "" {
+		fmt.Fprintln(os.Stderr, "Warning: ANTHROPIC_API_KEY environment variable not set")
+	}
+	baseURL := os.Getenv("ANTHROPIC_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com"
+	}
+	return &Client{
+		APIKey:    key,
+		Endpoint:  strings.TrimSuffix(baseURL, "/") + "/v1/messages",
+		MaxTokens: DefaultMaxTokens,
+	}
+}
+
+// Request defines the payload sent to Anthropic.
+type Request struct {
+	Model       string    `json:"model"`
+	System      string    `json:"system,omitempty"`
+	Messages    []ChatMsg `json:"messages"`
+	MaxTokens   int       `json:"max_tokens"`
+	Temperature *float32  `json:"temperature,omitempty"`
+}
+
+// MaxTemperature is the highest sampling temperature Anthropic
+// accepts.  OpenAI's range goes up to 2.
+const MaxTemperature = 1
+
+// ChatMsg represents a single chat message.
+type ChatMsg struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Response defines Anthropic's response structure.
+type Response struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// CompleteChat sends a chat completion request to Anthropic and
+// returns the generated text.  This method conforms to the ChatClient
+// interface.
+func (c *Client) CompleteChat(model string, messagesIn []client.ChatMsg) (results client.Results, err error) {
+	return c.Chat(context.Background(), model, messagesIn, client.Options{})
+}
+
+// Chat is like CompleteChat, but gives up when ctx is done and sends
+// opts with the request.  Anthropic has no seed or JSON mode, so a
+// seed is ignored with a warning, a JSON schema is added to the
+// system prompt, and a JSON object is asked for by starting the reply
+// with "{".  Temperatures above MaxTemperature are lowered to it.
+// opts.HTTPClient, if not nil, is used instead of c.HTTPClient.  This
+// method conforms to the ChatProvider interface.
+func (c *Client) Chat(ctx context.Context, model string, messagesIn []client.ChatMsg, opts client.Options) (results client.Results, err error) {
+
+	reqPayload := Request{
+		Model:     model,
+		Messages:  []ChatMsg{},
+		MaxTokens: c.MaxTokens,
+	}
+	if opts.Temperature != nil {
+		temp := *opts.Temperature
+		if temp > MaxTemperature {
+			fmt.Fprintf(os.Stderr, "Warning: Anthropic's highest temperature is %v; using it instead of %v\n", MaxTemperature, temp)
+			temp = MaxTemperature
+		}
+		reqPayload.Temperature = &temp
+	}
+	if opts.Seed != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Anthropic does not support a seed; ignoring it")
+	}
+
+	// Anthropic takes the system prompt as a separate field, and
+	// only "user" and "assistant" roles in the messages.
+	var system []string
+	for _, m := range messagesIn {
+		if strings.TrimSpace(m.Content) == "" {
+			continue
+		}
+		role := strings.ToLower(m.Role)
+		switch role {
+		case "system":
+			system = append(system, m.Content)
+			continue
+		case "ai":
+			role = "assistant"
+		}
+		reqPayload.Messages = append(reqPayload.Messages, ChatMsg{
+			Role:    role,
+			Content: m.Content,
+		})
+	}
+	if len(opts.JSONSchema) > 0 {
+		system = append(system, fmt.Sprintf("Respond with only JSON matching this schema:\n%s", opts.JSONSchema))
+	}
+	reqPayload.System = strings.Join(system, "\n\n")
+	// prefill the reply so that it can only be a JSON object
+	prefill := ""
+	if len(opts.JSONSchema) == 0 && opts.ResponseFormat == client.ResponseFormatJSON {
+		prefill = "{"
+		reqPayload.Messages = append(reqPayload.Messages, ChatMsg{Role: "assistant", Content: prefill})
+	}
+
+	payloadBytes, err := json.Marshal(reqPayload)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Endpoint, strings.NewReader(string(payloadBytes)))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", c.APIKey)
+	req.Header.Set("Anthropic-Version", Version)
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = c.HTTPClient
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("Anthropic API returned status %d: %s", resp.StatusCode, string(body))
+		return
+	}
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	var response Response
+	if err = json.Unmarshal(respBytes, &response); err != nil {
+		return
+	}
+
+	var body strings.Builder
+	for _, block := range response.Content {
+		if block.Type == "text" {
+			body.WriteString(block.Text)
+		}
+	}
+	if body.Len() == 0 {
+		err = fmt.Errorf("no text in Anthropic response")
+		return
+	}
+
+	results.Body = prefill + body.String()
+	// report hitting the output limit the way OpenAI does, so
+	// callers can detect truncation the same way for both
+	results.FinishReason = response.StopReason
+	if response.StopReason == "max_tokens" {
+		results.FinishReason = "length"
+	}
+	results.Usage = client.Usage{
+		PromptTokens:     response.Usage.InputTokens,
+		CompletionTokens: response.Usage.OutputTokens,
+		TotalTokens:      response.Usage.InputTokens + response.Usage.OutputTokens,
+	}
+	results.Raw = response
+
+	return
+}
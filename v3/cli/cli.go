@@ -1,13 +1,18 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
+	"time"
 
+	"github.com/stevegt/grokker/v3/client"
 	"github.com/stevegt/grokker/v3/core"
 	"github.com/stevegt/grokker/v3/util"
 
@@ -100,15 +105,29 @@ It should correctly interpret `test` as a required `Chatfile`, rather than an un
 */
 
 type cmdAdd struct {
-	Paths []string `arg:"" type:"string" help:"Path to file to add to knowledge base."`
+	Paths  []string `arg:"" type:"string" help:"Path to file or directory to add to knowledge base.  Use '-' to read a document from stdin."`
+	Name   string   `short:"n" help:"Name to store a document read from stdin under."`
+	Force  bool     `short:"f" help:"Add files even if they look binary."`
+	Follow bool     `short:"L" name:"follow-symlinks" help:"Follow symlinks when adding a directory; by default they are skipped."`
+	Lines  string   `help:"Add only these lines of a file, e.g. 10-20, counting from 1."`
+	Bytes  string   `help:"Add only these bytes of a file, e.g. 0-4096, counting from 0 and excluding the end."`
 }
 
 type cmdAidda struct {
 	Subcommands []string `arg:"" type:"string" help:"AIDDA operation(s): init, commit, prompt"`
 }
 
+type cmdAltModel struct {
+	Model  string `arg:"" help:"Embedding model to keep embeddings from alongside the knowledge base's embedding model, e.g. text-embedding-3-large."`
+	Remove bool   `help:"Stop keeping embeddings from the model, dropping those already made."`
+}
+
 type cmdBackup struct{}
 
+type cmdChunks struct {
+	Path string `arg:"" help:"Path to document in knowledge base."`
+}
+
 // cmdChat is the struct for the chat subcommand.  The chat subcommand
 // is used to have a conversation with the knowledge base using
 // a chat history stored in a local file.
@@ -131,7 +150,24 @@ type cmdChat struct {
 }
 
 type cmdCommit struct {
-	Diffargs []string `arg:"" optional:"" type:"string" help:"Arguments to pass to git diff.  If not provided, defaults to '--staged'."`
+	Diffargs     []string `arg:"" optional:"" type:"string" help:"Arguments to pass to git diff.  If not provided, defaults to '--staged'."`
+	SubjectLen   int      `short:"l" default:"60" help:"Maximum length of the commit message subject line."`
+	NoBody       bool     `short:"B" help:"Generate only the subject line, without a bullet-pointed body."`
+	Conventional bool     `short:"c" help:"Generate a conventional commits subject, e.g. 'fix(parser): handle empty input'."`
+	PromptFile   string   `short:"p" type:"existingfile" help:"File containing instructions that replace the default ones for writing the message, e.g. to change its tone or language."`
+	DiffFile     string   `name:"diff" short:"d" help:"Read the diff from this file, or from stdin if '-', instead of running git diff."`
+	MsgFile      string   `name:"msg-file" short:"m" help:"Write the message to the start of this file, e.g. the file given to a prepare-commit-msg hook, instead of stdout."`
+	MsgSource    string   `name:"msg-source" help:"Source of the message already in --msg-file, as given to a prepare-commit-msg hook in its second argument.  The file is left alone unless this is empty or 'template', so messages from 'git commit -m', merges, squashes, and amends are kept."`
+	MaxCalls     int      `name:"max-summary-calls" help:"Maximum chat calls made to summarize a diff too large to send whole; 0 uses the default of 20."`
+	MaxTokens    int      `name:"max-summary-tokens" help:"Maximum total tokens sent to summarize a diff too large to send whole; 0 means no limit."`
+}
+
+type cmdDoctor struct {
+	Timeout time.Duration `default:"1m" help:"How long to wait for the APIs to answer."`
+}
+
+type cmdDups struct {
+	Threshold float64 `short:"t" default:"0.95" help:"Similarity above which documents are reported as duplicates."`
 }
 
 type cmdCtx struct {
@@ -140,15 +176,33 @@ type cmdCtx struct {
 	WithLineNumbers bool `short:"n" help:"Include line numbers in the context."`
 }
 
+type cmdDims struct {
+	Dims int `arg:"" help:"Number of dimensions to store for each embedding, or 0 for full embeddings."`
+}
+
 type cmdEmbed struct{}
 
+type cmdExtract struct {
+	Question string `arg:"" help:"What to extract from the knowledge base."`
+	Schema   string `short:"s" required:"" type:"existingfile" help:"File containing the JSON schema of the result."`
+}
+
+type cmdEmbModel struct {
+	Model string `arg:"" enum:"text-embedding-ada-002,text-embedding-3-small,text-embedding-3-large" help:"Embedding model: text-embedding-ada-002, text-embedding-3-small, or text-embedding-3-large."`
+	Dims  int    `short:"d" help:"Number of dimensions to request from a text-embedding-3 model; default is the model's full size."`
+}
+
 type cmdForget struct {
 	Paths []string `arg:"" type:"string" help:"Path to file to remove from knowledge base."`
 }
 
+type cmdHistory struct{}
+
 type cmdInit struct{}
 
-type cmdLs struct{}
+type cmdLs struct {
+	Long bool `short:"l" help:"Also show each document's chunk count, token count, and when it was last embedded."`
+}
 
 type cmdModels struct{}
 
@@ -161,7 +215,9 @@ type cmdMsg struct {
 }
 
 type cmdQ struct {
-	Question string `arg:"" help:"Question to ask the knowledge base."`
+	Question string   `arg:"" help:"Question to ask the knowledge base."`
+	Debug    bool     `help:"Show which chunks were retrieved as context, with their scores and token counts, and which were dropped to fit the context budget."`
+	Images   []string `name:"image" short:"i" help:"Image file or URL to send with the question, e.g. a diagram; needs a model that accepts images.  Can be repeated."`
 }
 
 type cmdQc struct{}
@@ -172,42 +228,144 @@ type cmdQr struct {
 	SysMsg bool `short:"s" help:"expect sysmsg in first paragraph of stdin, return same on stdout."`
 }
 
-type cmdRefresh struct{}
+type cmdQuantize struct {
+	Format string `arg:"" enum:"float64,float32,int8" help:"Storage format for embeddings: float64, float32, or int8."`
+}
+
+type cmdRebuild struct{}
+
+type cmdRechunk struct{}
+
+type cmdRefresh struct {
+	Paths []string `arg:"" optional:"" type:"string" help:"Documents to re-embed, even if unchanged; default is every document."`
+}
+
+type cmdWeight struct {
+	Path   string  `arg:"" help:"Document to get or set the weight of."`
+	Weight float64 `arg:"" optional:"" help:"Multiplier for the document's relevance scores; default 1."`
+}
+
+type cmdRelated struct {
+	Path string `arg:"" help:"Document to find related documents for."`
+	K    int    `short:"k" default:"5" help:"Number of documents to show."`
+}
+
+type cmdRepl struct {
+	History string `short:"H" default:".grok-repl.chat" help:"File to keep the conversation in between sessions."`
+}
+
+type cmdSearch struct {
+	Query string `arg:"" help:"Text to search the knowledge base for."`
+	K     int    `short:"k" default:"5" help:"Number of chunks to show."`
+}
+
+type cmdServe struct {
+	Addr string `arg:"" optional:"" default:"localhost:8080" help:"Address to listen on."`
+}
 
 type cmdSimilarity struct {
 	Refpath string   `arg:"" help:"Reference file path."`
 	Paths   []string `arg:"" help:"Files to compare to reference file."`
 }
 
+type cmdSuggest struct {
+	N int `short:"n" default:"5" help:"Number of questions to suggest."`
+}
+
+type cmdSummarize struct {
+	Path  string `arg:"" optional:"" help:"Path to file to summarize."`
+	All   bool   `short:"a" help:"Summarize every document in the knowledge base instead of a single file."`
+	Docs  bool   `short:"d" help:"With -a, also print the summary of each document."`
+	Words int    `short:"w" default:"150" help:"Target length of the summary in words."`
+}
+
 type cmdTc struct{}
 
+type cmdVerify struct {
+	Fix bool `help:"Repair the problems that can be fixed safely: remove orphaned chunks and duplicate documents, and embed chunks with bad embeddings again."`
+}
+
 type cmdVersion struct{}
 
 var cli struct {
 	Add        cmdAdd        `cmd:"" help:"Add a file to the knowledge base."`
 	Aidda      cmdAidda      `cmd:"" help:"Perform AIDDA operations."`
+	AltModel   cmdAltModel   `cmd:"" name:"alt-embedding-model" help:"Also embed every chunk with another embedding model, so that retrieval with the two can be compared with --retrieval-model (persistent)."`
+	AutoCont   int           `name:"auto-continue" help:"Most times to ask the model to continue a response cut off by its output token limit, default 0 (persistent)."`
+	AutoGlobal float64       `name:"auto-global" help:"Answer from the model's global knowledge as well, as with -g, when no chunk scores at least this, e.g. 0.3, saying so in the answer; default 0 is off (persistent)."`
 	Backup     cmdBackup     `cmd:"" help:"Backup the knowledge base."`
 	Chat       cmdChat       `cmd:"" help:"Have a conversation with the knowledge base; accepts prompt on stdin."`
+	Chunking   string        `help:"How to split documents with no file-type chunker into chunks: paragraph (the default) or sentence (persistent)."`
+	Chunks     cmdChunks     `cmd:"" help:"List the chunks of a document in the knowledge base."`
+	ChunkToks  int           `name:"chunk-tokens" help:"Most tokens in a chunk of a document, default the embedding model's limit (persistent)."`
 	Commit     cmdCommit     `cmd:"" help:"Generate a git commit message on stdout."`
+	Compress   *bool         `negatable:"" help:"Gzip-compress the knowledge base when saving; --no-compress turns it off (persistent)."`
+	CtxChunks  int           `name:"context-chunks" help:"Most chunks considered for context in queries, default 100 (persistent)."`
+	CtxFrac    float64       `name:"context-fraction" help:"Fraction of the model's token limit to use for context in queries, default 0.5 (persistent)."`
 	Ctx        cmdCtx        `cmd:"" help:"Extract the context from the knowledge base most closely related to stdin."`
+	Dedup      float64       `name:"dedup-threshold" help:"Drop context chunks whose embeddings are more similar than this, from 0 to 1, to a chunk already used, e.g. 0.95; default 0 keeps them all (persistent)."`
+	Dims       cmdDims       `cmd:"" help:"Shrink the knowledge base by storing embeddings with fewer dimensions (persistent)."`
+	Doctor     cmdDoctor     `cmd:"" help:"Check the API key, embedding and chat models, and knowledge base, and report any problems."`
+	Dups       cmdDups       `cmd:"" help:"List groups of duplicate or near-duplicate documents in the knowledge base."`
 	Embed      cmdEmbed      `cmd:"" help:"print the embedding vector for the given stdin text."`
+	EmbedHead  *bool         `name:"embed-headings" negatable:"" help:"Embed the markdown headings each chunk falls under along with its document's path; applies to chunks embedded afterwards, see rebuild (persistent)."`
+	EmbModel   cmdEmbModel   `cmd:"" name:"embedding-model" help:"Change the embedding model, re-embedding every document (persistent)."`
+	EmbRPM     *int          `name:"embedding-rpm" help:"Most embedding requests to send per minute, to stay under the account's rate limit; 0 is no limit (persistent)."`
+	EmbTPM     *int          `name:"embedding-tpm" help:"Most tokens to send for embedding per minute, to stay under the account's rate limit when adding many documents; 0 is no limit (persistent)."`
+	Exclude    []string      `help:"Document, directory, or glob pattern such as 'drafts/*.md', relative to the knowledge base's directory, to leave out of query context and search results for this run.  Can be repeated."`
+	Extract    cmdExtract    `cmd:"" help:"Extract structured data from the knowledge base as JSON matching a schema."`
+	FitCtx     *bool         `name:"fit-context" negatable:"" help:"Use as many of the most relevant chunks as fit in the context budget, counted in tokens, instead of at most --context-chunks; --no-fit-context turns it off (persistent)."`
 	Forget     cmdForget     `cmd:"" help:"Forget about a file, removing it from the knowledge base."`
 	Global     bool          `short:"g" help:"Include results from OpenAI's global knowledge base as well as from local documents."`
+	History    cmdHistory    `cmd:"" help:"Show when the knowledge base was created and when it was migrated to newer versions."`
+	HyDE       *bool         `name:"hyde" negatable:"" help:"Ask the chat model to draft a hypothetical answer to each query and retrieve chunks similar to it as well as to the question; --no-hyde turns it off (persistent)."`
 	Init       cmdInit       `cmd:"" help:"Initialize a new .grok file in the current directory."`
+	JSON       bool          `name:"json" help:"Print query, search, related, and suggest results as JSON, including the answer, sources, and token usage."`
+	JSONMode   bool          `name:"json-mode" help:"Ask the model to reply to q, qi, and msg with only a valid JSON object, asking again if a reply isn't one."`
+	KwWeight   *float64      `name:"keyword-weight" help:"Weight from 0 to 1 of exact keyword matches versus embedding similarity when retrieving context, default 0 (persistent)."`
+	Language   string        `help:"Natural language to write answers and commit messages in, e.g. Japanese."`
 	Ls         cmdLs         `cmd:"" help:"List all documents in the knowledge base."`
+	MaxFile    int64         `name:"max-file-size" help:"Largest file in bytes that is read as a document, default 10485760; -1 is no limit (persistent)."`
+	MaxPerDoc  int           `name:"max-chunks-per-doc" help:"Most chunks from any one document used as context in queries, so that answers draw on several documents; default 0 is no limit (persistent)."`
+	Metric     string        `help:"How to compare embeddings when ranking chunks: cosine (the default), dot, or euclidean (persistent)."`
+	MinChunk   int           `name:"min-chunk-tokens" help:"Fewest tokens in a chunk of a document; shorter chunks are merged into a neighbor, default 0 (persistent)."`
+	MinRel     float64       `name:"min-relevance" help:"Lowest relevance score of a chunk used as context, e.g. 0.3; questions nothing is relevant to fail unless -g is given, default 0 (persistent)."`
 	NewModel   string        `name:"model" help:"Model to use during this and later executions (persistent)."`
 	Model      cmdModel      `cmd:"" help:"Upgrade the model used by the knowledge base (persistent)."`
 	Models     cmdModels     `cmd:"" help:"List all available models."`
 	Msg        cmdMsg        `cmd:"" help:"Send message to openAI's API from stdin and print response on stdout."`
+	Overflow   string        `help:"What to do with chunks too long to embed: split (the default), truncate to embed only their start, or error (persistent)."`
 	Q          cmdQ          `cmd:"" help:"Ask the knowledge base a question."`
 	Qc         cmdQc         `cmd:"" help:"Continue text from stdin based on the context in the knowledge base."`
 	Qi         cmdQi         `cmd:"" help:"Ask the knowledge base a question on stdin."`
 	Qr         cmdQr         `cmd:"" help:"Revise stdin based on the context in the knowledge base."`
-	Refresh    cmdRefresh    `cmd:"" help:"Refresh the embeddings for all documents in the knowledge base."`
+	Quantize   cmdQuantize   `cmd:"" help:"Change how embeddings are stored; int8 makes the knowledge base about 4x smaller than float32 (persistent)."`
+	QueryVars  *int          `name:"query-variants" help:"Ask the chat model to rephrase each query this many ways and retrieve chunks matching any of them, helping terse questions; 0 turns it off (persistent)."`
+	Rebuild    cmdRebuild    `cmd:"" help:"Rebuild all chunks and embeddings from scratch, e.g. after suspected corruption."`
+	Rechunk    cmdRechunk    `cmd:"" help:"Split all documents into chunks again with the current chunking settings, embedding only chunks whose text changed."`
+	Refresh    cmdRefresh    `cmd:"" help:"Refresh the embeddings for all or the given documents in the knowledge base."`
+	RefWorkers int           `name:"refresh-workers" help:"Number of documents refresh embeds at once, default 4 (persistent)."`
+	RejEmpty   *bool         `name:"reject-empty" negatable:"" help:"Refuse to add or update documents that are empty or only whitespace instead of keeping them with a warning; --no-reject-empty turns it off (persistent)."`
+	Related    cmdRelated    `cmd:"" help:"List the documents most similar to a document in the knowledge base."`
+	Repl       cmdRepl       `cmd:"" help:"Ask successive questions interactively, keeping the conversation between sessions."`
+	Rerank     *bool         `negatable:"" help:"Ask the chat model to rerank retrieved chunks by relevance before answering; --no-rerank turns it off (persistent)."`
+	RerankN    int           `name:"rerank-candidates" help:"Number of chunks to rerank when --rerank is on, default 20 (persistent)."`
+	RetModel   string        `name:"retrieval-model" help:"Embedding model whose embeddings rank chunks for this run: the knowledge base's embedding model (the default) or one added with alt-embedding-model."`
+	Search     cmdSearch     `cmd:"" help:"Show the chunks most similar to a query, without asking the chat model."`
+	Seed       *int          `help:"Seed for deterministic sampling, where the model supports it."`
+	Serve      cmdServe      `cmd:"" help:"Serve the knowledge base over HTTP; see core.Server for the JSON endpoints."`
+	ShareEmb   *bool         `name:"share-embeddings" negatable:"" help:"Reuse the embedding of a chunk for chunks with the same text in other documents instead of embedding it again (persistent)."`
+	ShowPrompt bool          `name:"show-prompt" help:"Show the messages sent to the model, including the system message and context, and how their tokens add up, before the answer of q or qi."`
 	Similarity cmdSimilarity `cmd:"" help:"Calculate the similarity between two or more files in the knowledge base."`
+	Suggest    cmdSuggest    `cmd:"" help:"Suggest questions the knowledge base can answer."`
+	Summarize  cmdSummarize  `cmd:"" help:"Summarize a file or the entire knowledge base."`
 	Tc         cmdTc         `cmd:"" help:"Calculate the token count of stdin."`
+	Temp       *float32      `name:"temperature" help:"Sampling temperature; 0 is the most deterministic.  Not supported by o-series models."`
+	UseModel   string        `name:"use-model" help:"Model to use for this execution only, e.g. to try one question on a bigger model, without changing the knowledge base's model."`
 	Verbose    bool          `short:"v" help:"Show debug and progress information on stderr."`
+	Verify     cmdVerify     `cmd:"" help:"Check the knowledge base for inconsistencies, such as orphaned chunks or corrupt embeddings."`
 	Version    cmdVersion    `cmd:"" help:"Show version of grok and its database."`
+	Weight     cmdWeight     `cmd:"" help:"Show or set how much a document is favored when retrieving context, e.g. 1.5 for official docs (persistent)."`
 }
 
 // CliConfig contains the configuration for grokker's cli
@@ -298,7 +456,7 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 	}
 
 	// list of commands that can use a read-only db
-	roCmds := []string{"commit", "ls", "models", "version", "backup", "msg", "ctx"}
+	roCmds := []string{"chunks", "commit", "doctor", "history", "ls", "models", "version", "backup", "msg", "ctx", "summarize", "search", "suggest"}
 	readonly := false
 	if cmdInSlice(cmd, roCmds) {
 		Debug("command %s can use a read-only grok db", cmd)
@@ -332,7 +490,198 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 			Fpf(config.Stderr, "backup of old db saved to %s\n", fn)
 			save = true
 		}
+		// apply settings from .grokconfig and GROKKER_* environment
+		// variables; flags below override them.
+		cfg, cfgErr := core.LoadConfig(grok.Root)
+		if cfgErr == nil {
+			if cli.NewModel != "" {
+				cfg.Model = ""
+			}
+			cfgErr = grok.ApplyConfig(cfg)
+		}
+		if cfgErr != nil {
+			Fpf(config.Stderr, "Error: %v\n", cfgErr)
+			rc = 1
+			return
+		}
 		modelName = grok.Model
+		if cli.UseModel != "" {
+			var findErr error
+			modelName, _, findErr = grok.FindModel(cli.UseModel)
+			if findErr != nil {
+				Fpf(config.Stderr, "Error: --use-model: %v\n", findErr)
+				rc = 1
+				return
+			}
+		}
+		if cli.CtxFrac != 0 {
+			if cli.CtxFrac < 0 || cli.CtxFrac >= 1 {
+				Fpf(config.Stderr, "Error: --context-fraction must be between 0 and 1\n")
+				rc = 1
+				return
+			}
+			grok.ContextBudgetFraction = cli.CtxFrac
+		}
+		if cli.CtxChunks != 0 {
+			if cli.CtxChunks < 0 {
+				Fpf(config.Stderr, "Error: --context-chunks must be positive\n")
+				rc = 1
+				return
+			}
+			grok.ContextChunks = cli.CtxChunks
+		}
+		if cli.KwWeight != nil {
+			if *cli.KwWeight < 0 || *cli.KwWeight > 1 {
+				Fpf(config.Stderr, "Error: --keyword-weight must be between 0 and 1\n")
+				rc = 1
+				return
+			}
+			grok.KeywordWeight = *cli.KwWeight
+		}
+		if cli.Dedup != 0 {
+			if cli.Dedup < 0 || cli.Dedup > 1 {
+				Fpf(config.Stderr, "Error: --dedup-threshold must be between 0 and 1\n")
+				rc = 1
+				return
+			}
+			grok.DedupThreshold = cli.Dedup
+		}
+		if cli.MaxPerDoc != 0 {
+			if cli.MaxPerDoc < 0 {
+				Fpf(config.Stderr, "Error: --max-chunks-per-doc must be positive\n")
+				rc = 1
+				return
+			}
+			grok.MaxChunksPerDoc = cli.MaxPerDoc
+		}
+		if cli.MinRel != 0 {
+			grok.MinRelevance = cli.MinRel
+		}
+		if cli.AutoGlobal != 0 {
+			grok.AutoGlobal = cli.AutoGlobal
+		}
+		if cli.Rerank != nil {
+			grok.Rerank = *cli.Rerank
+		}
+		if cli.FitCtx != nil {
+			grok.FitContext = *cli.FitCtx
+		}
+		if cli.EmbedHead != nil {
+			grok.EmbedHeadings = *cli.EmbedHead
+		}
+		if cli.ShareEmb != nil {
+			grok.ShareEmbeddings = *cli.ShareEmb
+		}
+		if cli.RejEmpty != nil {
+			grok.RejectEmptyDocuments = *cli.RejEmpty
+		}
+		if cli.RerankN != 0 {
+			if cli.RerankN < 0 {
+				Fpf(config.Stderr, "Error: --rerank-candidates must be positive\n")
+				rc = 1
+				return
+			}
+			grok.RerankCandidates = cli.RerankN
+		}
+		if cli.HyDE != nil {
+			grok.HyDE = *cli.HyDE
+		}
+		if cli.QueryVars != nil {
+			if *cli.QueryVars < 0 {
+				Fpf(config.Stderr, "Error: --query-variants must not be negative\n")
+				rc = 1
+				return
+			}
+			grok.QueryVariants = *cli.QueryVars
+		}
+		if cli.MaxFile != 0 {
+			grok.MaxFileSize = cli.MaxFile
+		}
+		if cli.RefWorkers != 0 {
+			if cli.RefWorkers < 0 {
+				Fpf(config.Stderr, "Error: --refresh-workers must be positive\n")
+				rc = 1
+				return
+			}
+			grok.RefreshWorkers = cli.RefWorkers
+		}
+		if cli.EmbTPM != nil {
+			if *cli.EmbTPM < 0 {
+				Fpf(config.Stderr, "Error: --embedding-tpm must not be negative\n")
+				rc = 1
+				return
+			}
+			grok.EmbeddingTokensPerMinute = *cli.EmbTPM
+		}
+		if cli.EmbRPM != nil {
+			if *cli.EmbRPM < 0 {
+				Fpf(config.Stderr, "Error: --embedding-rpm must not be negative\n")
+				rc = 1
+				return
+			}
+			grok.EmbeddingRequestsPerMinute = *cli.EmbRPM
+		}
+		if cli.Compress != nil {
+			grok.Compress = *cli.Compress
+		}
+		if cli.AutoCont != 0 {
+			if cli.AutoCont < 0 {
+				Fpf(config.Stderr, "Error: --auto-continue must be positive\n")
+				rc = 1
+				return
+			}
+			grok.AutoContinue = cli.AutoCont
+		}
+		if cli.Chunking != "" {
+			if chunkErr := grok.SetChunking(cli.Chunking); chunkErr != nil {
+				Fpf(config.Stderr, "Error: %v\n", chunkErr)
+				rc = 1
+				return
+			}
+		}
+		if cli.ChunkToks != 0 || cli.MinChunk != 0 {
+			tokens, minTokens := grok.ChunkTokens, grok.MinChunkTokens
+			if cli.ChunkToks != 0 {
+				tokens = cli.ChunkToks
+			}
+			if cli.MinChunk != 0 {
+				minTokens = cli.MinChunk
+			}
+			if sizeErr := grok.SetChunkTokens(tokens, minTokens); sizeErr != nil {
+				Fpf(config.Stderr, "Error: %v\n", sizeErr)
+				rc = 1
+				return
+			}
+		}
+		if cli.Language != "" {
+			grok.Language = cli.Language
+		}
+		if cli.Metric != "" {
+			if metricErr := grok.SetMetric(cli.Metric); metricErr != nil {
+				Fpf(config.Stderr, "Error: %v\n", metricErr)
+				rc = 1
+				return
+			}
+		}
+		if cli.Overflow != "" {
+			if overflowErr := grok.SetEmbeddingOverflow(cli.Overflow); overflowErr != nil {
+				Fpf(config.Stderr, "Error: %v\n", overflowErr)
+				rc = 1
+				return
+			}
+		}
+		if cli.Seed != nil {
+			grok.ChatOptions.Seed = cli.Seed
+		}
+		if cli.Temp != nil {
+			grok.ChatOptions.Temperature = cli.Temp
+		}
+		if cli.JSONMode {
+			grok.ChatOptions.ResponseFormat = client.ResponseFormatJSON
+		}
+		grok.Exclude = cli.Exclude
+		grok.RetrievalModel = cli.RetModel
+		grok.Progress = progressBar(config.Stderr)
 	}
 
 	// XXX replace this with "command pattern" or "command object"
@@ -355,11 +704,103 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 			rc = 1
 			return
 		}
+		var span *core.Span
+		if cli.Add.Lines != "" || cli.Add.Bytes != "" {
+			if cli.Add.Lines != "" && cli.Add.Bytes != "" {
+				Fpf(config.Stderr, "Error: --lines and --bytes can't be used together\n")
+				rc = 1
+				return
+			}
+			var spanErr error
+			if cli.Add.Lines != "" {
+				span, spanErr = core.ParseSpan(cli.Add.Lines, true)
+			} else {
+				span, spanErr = core.ParseSpan(cli.Add.Bytes, false)
+			}
+			if spanErr != nil {
+				Fpf(config.Stderr, "Error: %v\n", spanErr)
+				rc = 1
+				return
+			}
+			if len(cli.Add.Paths) > 1 || cli.Add.Paths[0] == "-" {
+				Fpf(config.Stderr, "Error: --lines and --bytes apply to a single file\n")
+				rc = 1
+				return
+			}
+		}
 		// add the documents
 		for _, docfn := range cli.Add.Paths {
+			if docfn == "-" {
+				// add a synthetic document from stdin
+				if cli.Add.Name == "" {
+					Fpf(config.Stderr, "Error: adding from stdin requires a name given with -n\n")
+					rc = 1
+					return
+				}
+				Fpf(os.Stderr, " adding %s from stdin ...\n", cli.Add.Name)
+				err = grok.AddReader(cli.Add.Name, config.Stdin)
+				if err != nil {
+					return
+				}
+				continue
+			}
+			opts := core.AddOpts{
+				Force:          cli.Add.Force,
+				FollowSymlinks: cli.Add.Follow,
+				Span:           span,
+			}
+			fi, statErr := os.Stat(docfn)
+			if statErr == nil && fi.IsDir() {
+				if span != nil {
+					Fpf(config.Stderr, "Error: --lines and --bytes apply to a single file, not a directory\n")
+					rc = 1
+					return
+				}
+				// add the files in the directory
+				Fpf(os.Stderr, " adding directory %s ...\n", docfn)
+				added := 0
+				for res := range grok.AddDirectoryStream(context.Background(), docfn, opts) {
+					switch {
+					case errors.Is(res.Err, core.ErrBinaryDocument):
+						Fpf(os.Stderr, " %s looks binary, skipping; use --force to add it anyway\n", res.Path)
+					case errors.Is(res.Err, core.ErrDocumentTooLarge):
+						Fpf(os.Stderr, " %v, skipping; use --max-file-size or --lines to add it anyway\n", res.Err)
+					case errors.Is(res.Err, core.ErrEmptyDocument):
+						Fpf(os.Stderr, " %s is empty, skipping; use --no-reject-empty to add it anyway\n", res.Path)
+					case res.Err != nil:
+						Fpf(os.Stderr, " error adding %s: %v\n", res.Path, res.Err)
+						if err == nil {
+							err = res.Err
+						}
+					default:
+						Fpf(os.Stderr, " added %s (%d new chunks)\n", res.Path, res.Chunks)
+						added++
+					}
+				}
+				if err != nil {
+					return
+				}
+				Fpf(os.Stderr, " added %d files from %s\n", added, docfn)
+				continue
+			}
 			// add the document
 			Fpf(os.Stderr, " adding %s ...\n", docfn)
-			err = grok.AddDocument(docfn)
+			err = grok.AddDocumentWithOpts(docfn, opts)
+			if errors.Is(err, core.ErrBinaryDocument) {
+				Fpf(os.Stderr, " %s looks binary, skipping; use --force to add it anyway\n", docfn)
+				err = nil
+				continue
+			}
+			if errors.Is(err, core.ErrDocumentTooLarge) {
+				Fpf(os.Stderr, " %v, skipping; use --max-file-size or --lines to add it anyway\n", err)
+				err = nil
+				continue
+			}
+			if errors.Is(err, core.ErrEmptyDocument) {
+				Fpf(os.Stderr, " %s is empty, skipping; use --no-reject-empty to add it anyway\n", docfn)
+				err = nil
+				continue
+			}
 			if err != nil {
 				return
 			}
@@ -433,6 +874,21 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		Pl(outtxt)
 		// save the grok file
 		save = true
+	case "chunks <path>":
+		// list the chunks of a document with their token counts
+		chunks, err := grok.DocumentChunks(cli.Chunks.Path)
+		Ck(err)
+		for i, chunk := range chunks {
+			text, err := grok.ChunkText(chunk)
+			Ck(err)
+			tc, err := grok.TokenCount(text)
+			Ck(err)
+			preview := strings.TrimSpace(text)
+			if len(preview) > 60 {
+				preview = preview[:60] + "..."
+			}
+			Pf("%d: offset %d length %d tokens %d %q\n", i, chunk.Offset, chunk.Length, tc, preview)
+		}
 	case "ctx <tokenlimit>":
 		// get text from stdin and print the context
 		buf, err := ioutil.ReadAll(config.Stdin)
@@ -444,6 +900,16 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		outtxt, err := grok.Context(intxt, cli.Ctx.Tokenlimit, cli.Ctx.WithHeaders, cli.Ctx.WithLineNumbers)
 		Ck(err)
 		Pl(outtxt)
+	case "dims <dims>":
+		// reduce the stored embedding dimensions
+		err = grok.SetEmbeddingDims(cli.Dims.Dims)
+		Ck(err)
+		if grok.Projection == nil {
+			Pf("storing full embeddings\n")
+		} else {
+			Pf("storing %d of %d embedding dimensions\n", grok.Projection.Dims, grok.Projection.InputDims)
+		}
+		save = true
 	case "embed":
 		// get text from stdin and print the embedding vector
 		buf, err := ioutil.ReadAll(config.Stdin)
@@ -453,6 +919,33 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		outtxt, err := grok.Embed(intxt)
 		Ck(err)
 		Pl(outtxt)
+	case "alt-embedding-model <model>":
+		// add or drop an alternate embedding model
+		if cli.AltModel.Remove {
+			err = grok.RemoveEmbeddingModel(cli.AltModel.Model)
+		} else {
+			err = grok.AddEmbeddingModel(cli.AltModel.Model)
+		}
+		Ck(err)
+		save = true
+	case "embedding-model <model>":
+		// switch embedding models and re-embed everything
+		err = grok.SetEmbeddingModel(cli.EmbModel.Model, cli.EmbModel.Dims)
+		Ck(err)
+		save = true
+	case "extract <question>":
+		// print the extracted data as JSON
+		schema, err := ioutil.ReadFile(cli.Extract.Schema)
+		Ck(err)
+		updated, err := grok.UpdateEmbeddings()
+		Ck(warnFailed(config.Stderr, err))
+		var out json.RawMessage
+		err = grok.Extract(modelName, cli.Extract.Question, schema, &out)
+		Ck(err)
+		printJSON(out)
+		if updated {
+			save = true
+		}
 	case "forget <paths>":
 		if len(cli.Forget.Paths) < 1 {
 			Fpf(config.Stderr, "Error: forget command requires a filename argument\n")
@@ -471,11 +964,61 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 	case "refresh":
 		// refresh the embeddings for all documents
 		err = grok.RefreshEmbeddings()
+		Ck(warnFailed(config.Stderr, err))
+		// save the db
+		save = true
+	case "weight <path>":
+		// show the weight of a document
+		weight, err := grok.DocumentWeight(cli.Weight.Path)
+		Ck(err)
+		Pl(weight)
+	case "weight <path> <weight>":
+		// set the weight of a document
+		err = grok.SetDocumentWeight(cli.Weight.Path, cli.Weight.Weight)
 		Ck(err)
+		save = true
+	case "refresh <paths>":
+		// re-embed only the given documents
+		for _, path := range cli.Refresh.Paths {
+			err = grok.RefreshDocument(path)
+			Ck(err)
+		}
+		save = true
+	case "quantize <format>":
+		// change the embedding storage format
+		err = grok.SetEmbeddingFormat(cli.Quantize.Format)
+		Ck(err)
+		Pf("storing embeddings as %s\n", cli.Quantize.Format)
+		save = true
+	case "rebuild":
+		// rebuild all chunks and embeddings from scratch
+		added, removed, err := grok.Rebuild()
+		Ck(err)
+		Pf("rebuilt %d chunks: %d added, %d removed\n", len(grok.Chunks), added, removed)
 		// save the db
 		save = true
+	case "rechunk":
+		// re-chunk all documents, reusing unchanged embeddings
+		reused, embedded, err := grok.Rechunk(core.RechunkOpts{})
+		Ck(err)
+		Pf("rechunked %d documents: %d chunks reused, %d embedded\n", len(grok.Documents), reused, embedded)
+		save = true
 	case "ls":
 		// list the documents in the knowledge base
+		if cli.Ls.Long {
+			for _, doc := range grok.ListDocumentInfo() {
+				embedded := "-"
+				if !doc.Embedded.IsZero() {
+					embedded = doc.Embedded.Format("2006-01-02 15:04")
+				}
+				path := doc.Path
+				if doc.Span != nil {
+					path += Spf(" (%s)", doc.Span)
+				}
+				Pf("%6d %8d %-16s %s\n", doc.Chunks, doc.Tokens, embedded, path)
+			}
+			break
+		}
 		paths := grok.ListDocuments()
 		for _, path := range paths {
 			Pl(path)
@@ -488,9 +1031,22 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 			return
 		}
 		question := cli.Q.Question
-		resp, _, updated, err := answer(modelName, grok, question, cli.Global)
+		grok.ExplainRetrieval = cli.Q.Debug
+		res, updated, err := answer(modelName, grok, question, cli.Q.Images, cli.Global, config.Stderr)
 		Ck(err)
-		Pl(resp)
+		if !cli.ShowPrompt {
+			res.Messages, res.Tokens = nil, nil
+		} else if !cli.JSON {
+			printMessages(config.Stderr, res.Messages, res.Tokens)
+		}
+		if cli.Q.Debug && !cli.JSON {
+			printRetrieval(config.Stderr, res.Retrieval)
+		}
+		if cli.JSON {
+			printJSON(res)
+		} else {
+			Pl(res.Answer)
+		}
 		if updated {
 			save = true
 		}
@@ -501,7 +1057,7 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		txt := string(buf)
 		// trim whitespace
 		// txt = strings.TrimSpace(txt)
-		resp, _, updated, err := cont(modelName, grok, txt, cli.Global)
+		resp, _, updated, err := cont(modelName, grok, txt, cli.Global, config.Stderr)
 		Ck(err)
 		Pf("%s\n%s\n", txt, resp)
 		if updated {
@@ -514,10 +1070,18 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		question := string(buf)
 		// trim whitespace
 		question = strings.TrimSpace(question)
-		resp, query, updated, err := answer(modelName, grok, question, cli.Global)
+		res, updated, err := answer(modelName, grok, question, nil, cli.Global, config.Stderr)
 		Ck(err)
-		_ = query
-		Pf("\n%s\n\n%s\n\n", question, resp)
+		if !cli.ShowPrompt {
+			res.Messages, res.Tokens = nil, nil
+		} else if !cli.JSON {
+			printMessages(config.Stderr, res.Messages, res.Tokens)
+		}
+		if cli.JSON {
+			printJSON(res)
+		} else {
+			Pf("\n%s\n\n%s\n\n", question, res.Answer)
+		}
 		if updated {
 			save = true
 		}
@@ -527,7 +1091,7 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		Ck(err)
 		in := string(buf)
 		// in = strings.TrimSpace(in)
-		out, updated, err := revise(modelName, grok, in, cli.Global, cli.Qr.SysMsg)
+		out, updated, err := revise(modelName, grok, in, cli.Global, cli.Qr.SysMsg, config.Stderr)
 		Ck(err)
 		// Pf("%s\n\n%s\n", sysmsg, out)
 		// Pf("%s\n\n%s\n\n", in, out)
@@ -535,6 +1099,46 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		if updated {
 			save = true
 		}
+	case "repl":
+		// update the knowledge base, then converse until EOF
+		updated, err := grok.UpdateEmbeddings()
+		Ck(warnFailed(config.Stderr, err))
+		if updated {
+			err = grok.Save()
+			Ck(err)
+		}
+		err = repl(grok, modelName, cli.Repl.History, config)
+		Ck(err)
+	case "search <query>":
+		// show the most similar chunks, calling only the embeddings API
+		results, err := grok.Search(cli.Search.Query, cli.Search.K)
+		Ck(err)
+		if cli.JSON {
+			printJSON(results)
+			break
+		}
+		for i, res := range results {
+			Pf("%d: %.4f %s:%d-%d offset %d length %d\n%s\n\n", i+1, res.Score, res.Path, res.Line, res.EndLine, res.Offset, res.Length, strings.TrimSpace(res.Text))
+		}
+	case "related <path>":
+		// show the documents most similar to a document, calling
+		// no APIs
+		results, err := grok.RelatedDocuments(cli.Related.Path, cli.Related.K)
+		Ck(err)
+		if cli.JSON {
+			printJSON(results)
+			break
+		}
+		for _, res := range results {
+			Pf("%.4f %s\n", res.Score, res.Path)
+		}
+	case "serve":
+		fallthrough
+	case "serve <addr>":
+		// serve the knowledge base until killed; the server saves
+		// the db itself after each change
+		err = grok.Serve(cli.Serve.Addr)
+		Ck(err)
 	case "similarity <refpath> <paths>":
 		// get paths from args and print the similarity
 		if cli.Similarity.Refpath == "" || len(cli.Similarity.Paths) < 1 {
@@ -558,6 +1162,44 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		for i, sim := range sims {
 			Pf("%f %s\n", sim, paths[i])
 		}
+	case "suggest":
+		questions, err := grok.SuggestQuestions(cli.Suggest.N)
+		Ck(err)
+		if cli.JSON {
+			printJSON(questions)
+			break
+		}
+		for _, q := range questions {
+			Pl(q)
+		}
+	case "summarize":
+		fallthrough
+	case "summarize <path>":
+		opts := core.SummarizeOpts{
+			ModelName: modelName,
+			Words:     cli.Summarize.Words,
+		}
+		if cli.Summarize.All {
+			// summarize the whole knowledge base
+			summary, docSummaries, err := grok.SummarizeAll(opts)
+			Ck(err)
+			if cli.Summarize.Docs {
+				for _, ds := range docSummaries {
+					Pf("%s:\n%s\n\n", ds.RelPath, ds.Summary)
+				}
+			}
+			Pl(summary)
+			break
+		}
+		if cli.Summarize.Path == "" {
+			Fpf(config.Stderr, "Error: summarize command requires a filename argument or -a\n")
+			rc = 1
+			return
+		}
+		// summarize the file and print the summary
+		summary, err := grok.Summarize(cli.Summarize.Path, opts)
+		Ck(err)
+		Pl(summary)
 	case "tc":
 		// get content from stdin and emit token count on stdout
 		buf, err := ioutil.ReadAll(config.Stdin)
@@ -582,14 +1224,94 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		fallthrough
 	case "commit <diffargs>":
 		// generate a git commit message
+		switch {
+		case cli.Commit.MsgSource != "" && cli.Commit.MsgFile == "":
+			Fpf(config.Stderr, "Error: --msg-source needs --msg-file\n")
+			rc = 1
+			return
+		case cli.Commit.MsgSource != "" && cli.Commit.MsgSource != "template":
+			// git already has a message, e.g. from -m or --amend
+			return
+		}
 		if len(cli.Commit.Diffargs) < 1 {
 			cli.Commit.Diffargs = []string{"--staged"}
 		}
 		gitModelName := "o3-mini"
+		opts := core.GitCommitOpts{
+			SubjectLen:       cli.Commit.SubjectLen,
+			NoBody:           cli.Commit.NoBody,
+			Conventional:     cli.Commit.Conventional,
+			MaxSummaryCalls:  cli.Commit.MaxCalls,
+			MaxSummaryTokens: cli.Commit.MaxTokens,
+		}
+		if cli.Commit.PromptFile != "" {
+			buf, err := ioutil.ReadFile(cli.Commit.PromptFile)
+			Ck(err)
+			opts.CommitPrompt = string(buf)
+		}
 		// call grokker
-		summary, err := grok.GitCommitMessage(gitModelName, cli.Commit.Diffargs...)
+		var summary string
+		switch cli.Commit.DiffFile {
+		case "":
+			summary, err = grok.GitCommitMessage(gitModelName, opts, cli.Commit.Diffargs...)
+		case "-":
+			var buf []byte
+			buf, err = ioutil.ReadAll(config.Stdin)
+			Ck(err)
+			summary, err = grok.GitCommitMessageFromDiff(gitModelName, string(buf), opts)
+		default:
+			var buf []byte
+			buf, err = ioutil.ReadFile(cli.Commit.DiffFile)
+			Ck(err)
+			summary, err = grok.GitCommitMessageFromDiff(gitModelName, string(buf), opts)
+		}
+		if errors.Is(err, core.ErrEmptyDiff) || errors.Is(err, core.ErrNotDiff) {
+			Fpf(config.Stderr, "Error: %v\n", err)
+			err = nil
+			rc = 1
+			return
+		}
 		Ck(err)
-		Pl(summary)
+		if cli.Commit.MsgFile == "" {
+			Pl(summary)
+			break
+		}
+		// keep whatever git already put in the file, such as its
+		// comments, after the message
+		old, err := ioutil.ReadFile(cli.Commit.MsgFile)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		Ck(err)
+		err = ioutil.WriteFile(cli.Commit.MsgFile, []byte(strings.TrimSpace(summary)+"\n"+string(old)), 0644)
+		Ck(err)
+	case "doctor":
+		// check that grokker can work, and say what's wrong if not
+		ctx, cancel := context.WithTimeout(context.Background(), cli.Doctor.Timeout)
+		defer cancel()
+		checks, testErr := grok.SelfTest(ctx)
+		for _, check := range checks {
+			Pl(check)
+		}
+		if testErr != nil {
+			Fpf(config.Stderr, "Error: %v\n", testErr)
+			rc = 1
+			return
+		}
+	case "dups":
+		// list groups of similar documents, each member with its
+		// similarity to the first
+		groups, err := grok.FindDuplicates(cli.Dups.Threshold)
+		Ck(err)
+		for i, group := range groups {
+			if i > 0 {
+				Pl()
+			}
+			Pl(group[0].Path)
+			for _, doc := range group[1:] {
+				Pf("  %.4f %s\n", doc.Score, doc.Path)
+			}
+		}
 	case "models":
 		// list all available models
 		models := grok.ListModels()
@@ -602,6 +1324,36 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 		Ck(err)
 		Pf("Switched model from %s to %s\n", oldModel, cli.Model.Model)
 		save = true
+	case "verify":
+		// list inconsistencies in the db, repairing what's safe
+		var problems []core.Problem
+		if cli.Verify.Fix {
+			problems, err = grok.Repair()
+			Ck(err)
+			save = true
+		} else {
+			problems, err = grok.Verify()
+			Ck(err)
+		}
+		var unfixed int
+		for _, problem := range problems {
+			Pl(problem)
+			if !problem.Fixed {
+				unfixed++
+			}
+		}
+		if unfixed > 0 {
+			// fall through to save whatever was fixed
+			Fpf(config.Stderr, "Error: %d of %d problems not fixed\n", unfixed, len(problems))
+			rc = 1
+		} else if len(problems) == 0 {
+			Pl("no problems found")
+		}
+	case "history":
+		// print the db's creation and migrations, oldest first
+		for _, m := range grok.VersionHistory() {
+			Pl(m)
+		}
 	case "version":
 		// print the version of grokker
 		Pf("grokker version %s\n", core.CodeVersion())
@@ -630,28 +1382,110 @@ func Cli(args []string, config *CliConfig) (rc int, err error) {
 	return
 }
 
-// answer a question
-func answer(modelName string, grok *core.Grokker, question string, global bool) (resp, query string, updated bool, err error) {
+// answer a question, sending any images with it.  Warnings go to
+// stderr.
+func answer(modelName string, grok *core.Grokker, question string, images []string, global bool, stderr io.Writer) (res *core.Result, updated bool, err error) {
 	defer Return(&err)
 
 	// update the knowledge base
 	updated, err = grok.UpdateEmbeddings()
-	Ck(err)
+	Ck(warnFailed(stderr, err))
 
 	// answer the question
-	resp, err = grok.Answer(modelName, question, false, false, global)
+	res, err = grok.AnswerImages(modelName, question, images, false, false, global)
 	Ck(err)
+	if res.FinishReason == core.FinishReasonLength {
+		Fpf(stderr, "warning: the answer was cut off by the model's output token limit; see --auto-continue\n")
+	}
 
 	return
 }
 
+// warnFailed prints a warning on w for each document that a
+// *core.RefreshError says couldn't be updated, and returns nil so that
+// the rest of the update is used and saved.  Other errors are
+// returned as they are.
+func warnFailed(w io.Writer, err error) error {
+	var refreshErr *core.RefreshError
+	if !errors.As(err, &refreshErr) {
+		return err
+	}
+	for _, failed := range refreshErr.Failed {
+		Fpf(w, "warning: skipped %s: %v\n", failed.RelPath, failed.Err)
+	}
+	return nil
+}
+
+// progressBar returns a core.ProgressFunc that draws a progress bar on
+// w, or nil if w is not a terminal.
+func progressBar(w io.Writer) core.ProgressFunc {
+	f, ok := w.(*os.File)
+	if !ok {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	const width = 30
+	return func(done, total int, currentDoc string) {
+		if total == 0 {
+			return
+		}
+		n := done * width / total
+		bar := strings.Repeat("=", n) + strings.Repeat(" ", width-n)
+		// \033[K clears the rest of the line
+		Fpf(w, "\r[%s] %d/%d %s\033[K", bar, done, total, currentDoc)
+		if done == total {
+			Fpf(w, "\n")
+		}
+	}
+}
+
+// printMessages prints the messages sent to a model on w, each
+// preceded by its role, followed by the token breakdown if tokens is
+// not nil.
+func printMessages(w io.Writer, msgs []client.ChatMsg, tokens *core.TokenBreakdown) {
+	for _, msg := range msgs {
+		Fpf(w, "--- %s ---\n%s\n\n", msg.Role, msg.Content)
+	}
+	Fpf(w, "--- end of prompt ---\n")
+	if tokens != nil {
+		Fpf(w, "--- tokens: %s ---\n", tokens)
+	}
+}
+
+// printRetrieval prints the chunks considered as context for a
+// query on w, marking those dropped to fit the context budget.
+func printRetrieval(w io.Writer, chunks []core.RetrievedChunk) {
+	var used, total int
+	for i, chunk := range chunks {
+		status := "used"
+		if chunk.Selected {
+			used += chunk.Tokens
+		} else {
+			status = "dropped"
+		}
+		total += chunk.Tokens
+		Fpf(w, "%2d. %-7s %.4f %5d tokens  %s@%d+%d\n", i+1, status, chunk.Score, chunk.Tokens, chunk.Path, chunk.Offset, chunk.Length)
+	}
+	Fpf(w, "--- %d of %d candidate tokens used as context ---\n", used, total)
+}
+
+// printJSON prints v on stdout as indented JSON.
+func printJSON(v interface{}) {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	Ck(err)
+	Pl(string(buf))
+}
+
 // continue text
-func cont(modelName string, grok *core.Grokker, in string, global bool) (resp, query string, updated bool, err error) {
+func cont(modelName string, grok *core.Grokker, in string, global bool, stderr io.Writer) (resp, query string, updated bool, err error) {
 	defer Return(&err)
 
 	// update the knowledge base
 	updated, err = grok.UpdateEmbeddings()
-	Ck(err)
+	Ck(warnFailed(stderr, err))
 
 	// continue the text
 	Debug("cont: in: %s", in)
@@ -662,12 +1496,12 @@ func cont(modelName string, grok *core.Grokker, in string, global bool) (resp, q
 }
 
 // revise text
-func revise(modelName string, grok *core.Grokker, in string, global, sysmsgin bool) (out string, updated bool, err error) {
+func revise(modelName string, grok *core.Grokker, in string, global, sysmsgin bool, stderr io.Writer) (out string, updated bool, err error) {
 	defer Return(&err)
 
 	// update the knowledge base
 	updated, err = grok.UpdateEmbeddings()
-	Ck(err)
+	Ck(warnFailed(stderr, err))
 
 	// return revised text
 	out, _, err = grok.Revise(modelName, in, global, sysmsgin)
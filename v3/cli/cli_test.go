@@ -421,6 +421,13 @@ func TestCli(t *testing.T) {
 	// Tassert(t, match, "CLI did not return expected output: %s", stdout.String())
 	match = strings.Contains(stdout.String(), "test.txt")
 	Tassert(t, match, "CLI did not return expected output: %s", stdout.String())
+	// messages from git commit -m are left alone
+	err = os.WriteFile("COMMIT_EDITMSG", []byte("my message\n"), 0644)
+	Tassert(t, err == nil, "error writing message file: %v", err)
+	stdout, stderr, err = grok(emptyStdin, "commit", "-m", "COMMIT_EDITMSG", "--msg-source", "message")
+	Tassert(t, err == nil, "CLI returned unexpected error: %v\nstdout: %v\nstderr: %v", err, stdout.String(), stderr.String())
+	buf, err := os.ReadFile("COMMIT_EDITMSG")
+	Tassert(t, err == nil && string(buf) == "my message\n", "expected message file to be unchanged, got %q, %v", buf, err)
 
 	// test locking
 	fmt.Println("testing locking...")
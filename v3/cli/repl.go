@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"bufio"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// replHelp describes the meta-commands accepted by repl.
+const replHelp = `Type a question to ask the knowledge base, or:
+  :sources       list the documents the last answer drew on
+  :model NAME    switch to the named chat model
+  :reset         forget the earlier questions and answers
+  :help          show this help
+  :quit          save the history and exit (or end of input)
+`
+
+// repl runs an interactive conversation with the knowledge base,
+// reading questions from config.Stdin and streaming answers to
+// config.Stdout.  The conversation is kept in the chat history file
+// at path, so it resumes where it left off the next time.
+func repl(grok *core.Grokker, modelName, path string, config *CliConfig) (err error) {
+	defer Return(&err)
+	if modelName == "" {
+		modelName = grok.Model
+	}
+	conv, err := grok.OpenConversation(modelName, path)
+	Ck(err)
+	defer func() {
+		saveErr := conv.Save()
+		if err == nil {
+			err = saveErr
+		}
+	}()
+	Fpf(config.Stderr, "Ask questions about the knowledge base; :help for commands.\n")
+	scanner := bufio.NewScanner(config.Stdin)
+	for {
+		Fpf(config.Stderr, "grok> ")
+		if !scanner.Scan() {
+			Fpf(config.Stderr, "\n")
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case ":sources":
+				for _, source := range conv.Sources {
+					Fpf(config.Stdout, "%s\n", source)
+				}
+			case ":model":
+				if len(fields) != 2 {
+					Fpf(config.Stderr, "usage: :model NAME\n")
+					continue
+				}
+				err := conv.SetModel(fields[1])
+				if err != nil {
+					Fpf(config.Stderr, "%v\n", err)
+					continue
+				}
+				Fpf(config.Stderr, "using %s\n", conv.Model)
+			case ":reset":
+				conv.Reset()
+				Fpf(config.Stderr, "conversation reset\n")
+			case ":help":
+				Fpf(config.Stderr, "%s", replHelp)
+			case ":quit", ":q":
+				return
+			default:
+				Fpf(config.Stderr, "unknown command %s; :help for commands\n", fields[0])
+			}
+			continue
+		}
+		_, err := conv.Ask(line, config.Stdout)
+		if err != nil {
+			// keep the session alive after e.g. a network error
+			Fpf(config.Stderr, "\nerror: %v\n", err)
+			continue
+		}
+		Fpf(config.Stdout, "\n\n")
+	}
+	err = scanner.Err()
+	Ck(err)
+	return
+}
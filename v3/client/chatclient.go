@@ -1,5 +1,11 @@
 package client
 
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
 // ChatClient defines the interface for chat operations.
 // Implementations of ChatClient (such as OpenAIChatClient and PerplexityChatClient)
 // must implement this method to generate a complete chat response.
@@ -7,14 +13,75 @@ type ChatClient interface {
 	CompleteChat(model string, messages []ChatMsg) (Results, error)
 }
 
+// ChatProvider defines the interface for chat operations that take a
+// context and per-request options.  Grokker sends requests through
+// Chat rather than CompleteChat when a client implements both, so
+// that cancelling ctx abandons the request and the client receives
+// the generation options, such as the temperature, seed, and response
+// format, set for that request.  Providers should ignore options they
+// can't honor rather than fail, warning if the reply may differ.
+type ChatProvider interface {
+	Chat(ctx context.Context, model string, messages []ChatMsg, opts Options) (Results, error)
+}
+
 // ChatMsg represents a single chat message.
 type ChatMsg struct {
 	Role    string
 	Content string
+	// Images are the URLs of images sent with the message, either
+	// http(s) URLs or data: URLs holding the image itself.  Only
+	// providers and models that accept images use them.
+	Images []string `json:",omitempty"`
 }
 
 // Results represents the results of a chat operation.
 type Results struct {
 	Body      string
 	Citations []string
+	// Usage is the token usage reported by the provider, if any.
+	Usage Usage
+	// FinishReason is why the model stopped generating, e.g. "stop"
+	// or, if it hit its output token limit, "length".  It is empty if
+	// the provider doesn't report it.
+	FinishReason string
+	// Raw is the provider's own response, e.g. a go-openai
+	// ChatCompletionResponse, for callers that need more than the
+	// fields above.  It may be nil.
+	Raw interface{}
+}
+
+// Usage reports the number of tokens used by a chat operation.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Options contains optional generation parameters, and the HTTP
+// client to send requests with.  Nil fields use the provider's
+// defaults.
+type Options struct {
+	// Seed asks the provider to sample deterministically, so repeated
+	// requests with the same seed and parameters return the same
+	// result where the provider supports it.
+	Seed *int
+	// Temperature is the sampling temperature.  Zero is the most
+	// deterministic.
+	Temperature *float32
+	// JSONSchema, if not empty, asks the provider to respond with
+	// JSON matching this schema.  Providers without structured
+	// output ignore it, so callers should still validate the reply.
+	JSONSchema json.RawMessage
+	// ResponseFormat, if ResponseFormatJSON, asks the provider to
+	// respond with a JSON object.  JSONSchema takes precedence if
+	// both are set.  Providers without a JSON mode ignore it.
+	ResponseFormat string
+	// HTTPClient, if not nil, sends the provider's requests, e.g.
+	// through a corporate proxy, trusting a private CA, or with
+	// instrumentation.
+	HTTPClient *http.Client
 }
+
+// ResponseFormatJSON is the Options.ResponseFormat that asks for a
+// JSON object, as OpenAI's response_format type of the same name does.
+const ResponseFormatJSON = "json_object"
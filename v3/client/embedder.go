@@ -0,0 +1,9 @@
+package client
+
+// Embedder defines the interface for embedding operations.
+// Implementations of Embedder return one embedding vector for each
+// of the given texts, in the same order.  Grokker.RefreshEmbeddings
+// calls CreateEmbeddings from several goroutines at once.
+type Embedder interface {
+	CreateEmbeddings(texts []string) ([][]float64, error)
+}
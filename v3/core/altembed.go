@@ -0,0 +1,208 @@
+package core
+
+import (
+	"fmt"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+	"github.com/stevegt/grokker/v3/openai"
+)
+
+// SetModelEmbedder is like SetEmbedder, but sets the client used to
+// create embeddings for one of AltEmbeddingModels, e.g. a fake for
+// testing or a model served by another provider.  model need not be
+// one grokker knows.
+func (g *Grokker) SetModelEmbedder(model string, e client.Embedder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.altEmbedders == nil {
+		g.altEmbedders = make(map[string]client.Embedder)
+	}
+	g.altEmbedders[model] = e
+}
+
+// altEmbedder returns the client for an alternate embedding model:
+// the one set with SetModelEmbedder, or else the OpenAI embeddings
+// API.
+func (g *Grokker) altEmbedder(model string) client.Embedder {
+	if e, ok := g.altEmbedders[model]; ok {
+		return e
+	}
+	return &openaiEmbedder{
+		client: openai.NewClientWithHTTP(g.ChatOptions.HTTPClient),
+		model:  model,
+		keyErr: openai.CheckAPIKey(),
+	}
+}
+
+// AddEmbeddingModel keeps embeddings from model for every chunk
+// alongside those of the embedding model, so that retrieval with the
+// two can be compared in one db; see RetrievalModel.  Every chunk is
+// embedded with model now, and new chunks are embedded with it as
+// they are added.  Calling it again for a model already added embeds
+// any chunks that were missed, e.g. because of an API error.
+func (g *Grokker) AddEmbeddingModel(model string) (err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, known := embeddingModels[model]
+	_, custom := g.altEmbedders[model]
+	switch {
+	case !known && !custom:
+		err = fmt.Errorf("%q: %w", model, ErrModelNotFound)
+		return
+	case model == g.embeddingModel():
+		err = fmt.Errorf("%s is already the embedding model", model)
+		return
+	}
+	if !g.isAltEmbeddingModel(model) {
+		g.AltEmbeddingModels = append(g.AltEmbeddingModels, model)
+	}
+	missing := make(map[string][]*Chunk)
+	for _, chunk := range g.Chunks {
+		if chunk.Embedding != nil && chunk.Embeddings[model] == nil {
+			path := chunk.Document.RelPath
+			missing[path] = append(missing[path], chunk)
+		}
+	}
+	for i, doc := range g.Documents {
+		chunks := missing[doc.RelPath]
+		if len(chunks) == 0 {
+			continue
+		}
+		g.progress(i, len(g.Documents), doc.RelPath)
+		for start := 0; start < len(chunks); start += embedGroupSize {
+			group := chunks[start:min(start+embedGroupSize, len(chunks))]
+			var texts []string
+			for _, chunk := range group {
+				text, err := g.embeddingText(chunk)
+				Ck(err)
+				texts = append(texts, text)
+			}
+			err = g.embedAlt(group, texts, []string{model})
+			Ck(err)
+		}
+		g.touch(doc.RelPath)
+	}
+	return
+}
+
+// RemoveEmbeddingModel drops model from AltEmbeddingModels, along
+// with its embeddings.
+func (g *Grokker) RemoveEmbeddingModel(model string) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.isAltEmbeddingModel(model) {
+		return fmt.Errorf("%q is not an added embedding model: %w", model, ErrModelNotFound)
+	}
+	g.removeAltEmbeddingModel(model)
+	return
+}
+
+// removeAltEmbeddingModel implements RemoveEmbeddingModel.  The
+// caller must hold g.mu for writing.
+func (g *Grokker) removeAltEmbeddingModel(model string) {
+	var models []string
+	for _, m := range g.AltEmbeddingModels {
+		if m != model {
+			models = append(models, m)
+		}
+	}
+	g.AltEmbeddingModels = models
+	for _, chunk := range g.Chunks {
+		delete(chunk.Embeddings, model)
+		if len(chunk.Embeddings) == 0 {
+			chunk.Embeddings = nil
+		}
+	}
+	// every chunk may have changed, so rewrite the db on the next
+	// save
+	g.savedHeader = nil
+}
+
+// isAltEmbeddingModel returns true if model is one of
+// g.AltEmbeddingModels.
+func (g *Grokker) isAltEmbeddingModel(model string) bool {
+	for _, m := range g.AltEmbeddingModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// embedAlt embeds texts, the embedding texts of chunks, with each of
+// models, storing the results in the chunks' Embeddings.  Chunks with
+// empty texts get no embedding.
+func (g *Grokker) embedAlt(chunks []*Chunk, texts []string, models []string) (err error) {
+	defer Return(&err)
+	for _, model := range models {
+		var embeddings [][]float64
+		embeddings, err = g.createEmbeddingsWith(g.altEmbedder(model), texts, nil)
+		Ck(err)
+		for i, chunk := range chunks {
+			if embeddings[i] == nil {
+				continue
+			}
+			err = validateEmbedding(embeddings[i], len(embeddings[i]))
+			if err != nil {
+				err = fmt.Errorf("%s: chunk at offset %d of %s: %v", model, chunk.Offset, chunk.Document.RelPath, err)
+				return
+			}
+			if chunk.Embeddings == nil {
+				chunk.Embeddings = make(map[string][]float64)
+			}
+			chunk.Embeddings[model] = embeddings[i]
+		}
+	}
+	return
+}
+
+// copyEmbeddings returns a deep copy of a chunk's Embeddings.
+func copyEmbeddings(embeddings map[string][]float64) (out map[string][]float64) {
+	if embeddings == nil {
+		return
+	}
+	out = make(map[string][]float64, len(embeddings))
+	for model, embedding := range embeddings {
+		out[model] = append([]float64(nil), embedding...)
+	}
+	return
+}
+
+// retrievalModel returns g.RetrievalModel if it names one of
+// AltEmbeddingModels, or "" if chunks are ranked by the embedding
+// model's embeddings.  It returns an error if g.RetrievalModel names
+// neither.
+func (g *Grokker) retrievalModel() (model string, err error) {
+	switch {
+	case g.RetrievalModel == "" || g.RetrievalModel == g.embeddingModel():
+		return "", nil
+	case g.isAltEmbeddingModel(g.RetrievalModel):
+		return g.RetrievalModel, nil
+	}
+	err = fmt.Errorf("retrieval model %q is neither the embedding model nor an added one: %w", g.RetrievalModel, ErrModelNotFound)
+	return
+}
+
+// vector returns the embedding of chunk that queries are compared
+// with: the one from g.RetrievalModel if that is an alternate model,
+// and otherwise chunk.Embedding.
+func (g *Grokker) vector(chunk *Chunk) []float64 {
+	model, err := g.retrievalModel()
+	if err != nil || model == "" {
+		return chunk.Embedding
+	}
+	return chunk.Embeddings[model]
+}
+
+// vectorDims returns the number of dimensions of the embeddings that
+// vector returns, or 0 if there are none.
+func (g *Grokker) vectorDims() int {
+	for _, chunk := range g.Chunks {
+		if v := g.vector(chunk); v != nil {
+			return len(v)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// keywordEmbedder is a client.Embedder whose embeddings say which of
+// its words each text contains.
+type keywordEmbedder struct {
+	words []string
+}
+
+func (e *keywordEmbedder) CreateEmbeddings(texts []string) (embeddings [][]float64, err error) {
+	for _, text := range texts {
+		embedding := []float64{0.1}
+		for _, word := range e.words {
+			v := 0.0
+			if strings.Contains(strings.ToLower(text), word) {
+				v = 1
+			}
+			embedding = append(embedding, v)
+		}
+		embeddings = append(embeddings, embedding)
+	}
+	return
+}
+
+func TestAltEmbeddingModel(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.SetEmbedder(&countingEmbedder{})
+	alt := &keywordEmbedder{words: []string{"cat", "dog"}}
+	grok.SetModelEmbedder("keywords", alt)
+	add := func(name, content string) {
+		fn := filepath.Join(dir, name)
+		err := ioutil.WriteFile(fn, []byte(content), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	add("cats.txt", "The cat sat on the mat.")
+
+	err = grok.AddEmbeddingModel("no-such-model")
+	Tassert(t, errors.Is(err, ErrModelNotFound), "expected ErrModelNotFound, got %v", err)
+	err = grok.AddEmbeddingModel(DefaultEmbeddingModel)
+	Tassert(t, err != nil, "expected error adding the embedding model")
+	err = grok.AddEmbeddingModel("keywords")
+	Tassert(t, err == nil, "error adding embedding model: %v", err)
+	Tassert(t, len(grok.AltEmbeddingModels) == 1, "expected 1 alt model, got %v", grok.AltEmbeddingModels)
+	for _, chunk := range grok.Chunks {
+		Tassert(t, len(chunk.Embeddings["keywords"]) == 3, "chunk not embedded with keywords: %v", chunk.Embeddings)
+	}
+
+	// documents added later get both embeddings; the db is saved once
+	// in full and once through the journal
+	err = grok.SetEmbeddingFormat(EmbeddingFloat32)
+	Tassert(t, err == nil, "error setting format: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	add("dogs.txt", "The dog chased the ball.")
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, len(g.Chunks) == 2, "expected 2 chunks, got %d", len(g.Chunks))
+	for _, chunk := range g.Chunks {
+		Tassert(t, chunk.Embedding != nil, "chunk lost its embedding")
+		Tassert(t, len(chunk.Embeddings["keywords"]) == 3, "chunk lost its keywords embedding: %v", chunk.Embeddings)
+		Tassert(t, chunk.Vecs == nil, "chunk kept encoded vecs")
+	}
+
+	// the embedding model can't tell the documents apart; the
+	// keywords model can
+	g.SetEmbedder(&countingEmbedder{})
+	g.SetModelEmbedder("keywords", alt)
+	g.RetrievalModel = "keywords"
+	for _, query := range []string{"dog", "cat"} {
+		results, err := g.Search(query, 1)
+		Tassert(t, err == nil, "error searching: %v", err)
+		Tassert(t, len(results) == 1 && results[0].Path == query+"s.txt", "expected %ss.txt for %q, got %v", query, query, results)
+	}
+	// subsets keep the alternate embeddings and their embedder
+	sub, err := g.Subset(func(doc *Document) bool { return doc.RelPath == "dogs.txt" })
+	Tassert(t, err == nil, "error making subset: %v", err)
+	sub.RetrievalModel = "keywords"
+	results, err := sub.Search("dog", 1)
+	Tassert(t, err == nil, "error searching subset: %v", err)
+	Tassert(t, len(results) == 1 && results[0].Path == "dogs.txt", "expected dogs.txt, got %v", results)
+	g.RetrievalModel = "other"
+	_, err = g.Search("dog", 1)
+	Tassert(t, errors.Is(err, ErrModelNotFound), "expected ErrModelNotFound, got %v", err)
+
+	g.RetrievalModel = ""
+	err = g.RemoveEmbeddingModel("keywords")
+	Tassert(t, err == nil, "error removing embedding model: %v", err)
+	Tassert(t, len(g.AltEmbeddingModels) == 0, "expected no alt models, got %v", g.AltEmbeddingModels)
+	for _, chunk := range g.Chunks {
+		Tassert(t, chunk.Embeddings == nil, "chunk kept alt embeddings: %v", chunk.Embeddings)
+	}
+	err = g.RemoveEmbeddingModel("keywords")
+	Tassert(t, err != nil, "expected error removing a model twice")
+}
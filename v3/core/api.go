@@ -1,12 +1,19 @@
 package core
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,7 +21,6 @@ import (
 	. "github.com/stevegt/goadapt"
 	"github.com/stevegt/grokker/v3/client"
 	"github.com/stevegt/grokker/v3/util"
-	"github.com/stevegt/semver"
 	"github.com/tiktoken-go/tokenizer"
 )
 
@@ -23,29 +29,90 @@ import (
 // XXX move to api/api.go
 
 // AddDocument adds a document to the Grokker database. It creates the
-// embeddings for the document and adds them to the database.
+// embeddings for the document and adds them to the database.  It
+// returns an error wrapping ErrBinaryDocument, without adding the
+// document, if the document looks like a binary file, or
+// ErrDocumentTooLarge if it is larger than g.MaxFileSize.  A document
+// that is empty or only whitespace is added with a warning, or, if
+// g.RejectEmptyDocuments is set, not added, returning an error
+// wrapping ErrEmptyDocument.
 func (g *Grokker) AddDocument(path string) (err error) {
+	return g.AddDocumentWithOpts(path, AddOpts{})
+}
+
+// AddOpts contains options for AddDocumentWithOpts.
+type AddOpts struct {
+	// Force adds documents even if they look like binary files.
+	Force bool
+	// FollowSymlinks makes AddDirectory descend into symlinked
+	// directories and add symlinked files.  It defaults to false,
+	// in which case symlinks found during the walk are skipped.
+	// Paths named directly by the caller are always followed.
+	FollowSymlinks bool
+	// Span, if not nil, adds only that part of a file, e.g. one
+	// section of a large manual, and is recorded on the Document so
+	// that refreshes read the same part.  Adding a file again
+	// replaces its span.  It is ignored when adding a directory.
+	Span *Span
+}
+
+// AddDocumentWithOpts is like AddDocument, but takes options.
+func (g *Grokker) AddDocumentWithOpts(path string, opts AddOpts) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, err = g.addDocument(path, opts)
+	return
+}
+
+// addDocument implements AddDocumentWithOpts, returning the number of
+// new chunks embedded for the document.  The caller must hold g.mu
+// for writing.
+func (g *Grokker) addDocument(path string, opts AddOpts) (chunks int, err error) {
 	defer Return(&err)
 	// assume we're in an arbitrary directory, so we need to
 	// convert the path to an absolute path.
 	absPath, err := filepath.Abs(path)
 	Ck(err)
-	// always convert path to a relative path for consistency
-	relpath, err := filepath.Rel(g.Root, absPath)
 	doc := &Document{
-		RelPath: relpath,
+		RelPath: g.docPath(absPath),
+		Span:    opts.Span,
 	}
 	// ensure the document exists
-	_, err = os.Stat(g.absPath(doc))
+	fi, err := os.Stat(g.absPath(doc))
 	if os.IsNotExist(err) {
 		return
 	}
 	Ck(err)
-	// find out if the document is already in the database.
+	if opts.Span == nil {
+		err = g.tooLarge(fi.Size())
+		if err != nil {
+			err = fmt.Errorf("%s: %w", doc.RelPath, err)
+			return
+		}
+	}
+	if !opts.Force || opts.Span != nil {
+		// this also checks that the span is in bounds
+		var buf []byte
+		if g.streamable(doc) {
+			buf, err = readHead(g.absPath(doc), sniffLen)
+		} else {
+			buf, err = g.readDocument(doc)
+		}
+		Ck(err)
+		if !opts.Force && looksBinary(buf) {
+			err = fmt.Errorf("%s: %w", doc.RelPath, ErrBinaryDocument)
+			return
+		}
+	}
+	// find out if the document is already in the database, maybe
+	// under another form of its path, e.g. a ../ path stored by an
+	// older version.
 	found := false
 	for _, d := range g.Documents {
-		if d.RelPath == doc.RelPath {
+		if g.absPath(d) == g.absPath(doc) {
 			found = true
+			d.Span = opts.Span
+			doc = d
 			break
 		}
 	}
@@ -53,14 +120,244 @@ func (g *Grokker) AddDocument(path string) (err error) {
 		// add the document to the database.
 		g.Documents = append(g.Documents, doc)
 	}
-	// update the embeddings for the document.
-	_, err = g.updateDocument(doc)
+	g.touch(doc.RelPath)
+	// update the embeddings for the document.  New chunks are
+	// appended to g.Chunks, and stale ones aren't removed until gc.
+	before := len(g.Chunks)
+	_, err = g.tryUpdateDocument(doc, g.embeddingProgress(doc))
+	if errors.Is(err, ErrEmptyDocument) && !found {
+		g.dropDocument(doc)
+	}
+	Ck(err)
+	chunks = len(g.Chunks) - before
+	return
+}
+
+// AddDirectory walks dir and adds every regular file beneath it,
+// returning the paths of the files it added.  Hidden files and
+// directories, whose names start with a dot, are skipped, as are
+// files that look binary unless opts.Force is set, files larger
+// than g.MaxFileSize, and empty files when g.RejectEmptyDocuments is
+// set.  Symlinks are
+// skipped unless opts.FollowSymlinks is set; when they are followed,
+// each file and directory is visited only once no matter how many
+// links lead to it, so symlink loops cannot cause infinite recursion
+// and a shared file is stored under the first path that reaches it.
+func (g *Grokker) AddDirectory(dir string, opts AddOpts) (paths []string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.walkDirectory(context.Background(), dir, opts, func(res AddResult) bool {
+		switch {
+		case errors.Is(res.Err, ErrBinaryDocument), errors.Is(res.Err, ErrDocumentTooLarge), errors.Is(res.Err, ErrEmptyDocument):
+		case res.Err != nil:
+			err = res.Err
+			return false
+		default:
+			paths = append(paths, res.Path)
+		}
+		return true
+	})
+	return
+}
+
+// AddResult is the outcome of adding one file; see
+// AddDirectoryStream.
+type AddResult struct {
+	// Path is the path of the file, as found by the walk.
+	Path string
+	// Chunks is the number of new chunks embedded for the file.  It
+	// is zero if the file was already up to date.
+	Chunks int
+	// Err is the error adding the file, if any.  It wraps
+	// ErrBinaryDocument if the file was skipped because it looks
+	// binary.
+	Err error
+}
+
+// AddDirectoryStream is like AddDirectory, but returns at once and
+// sends the result of each file on the returned channel as it is
+// added, so that callers can show progress while large trees are
+// indexed.  An error adding one file doesn't stop the walk.  The
+// channel is closed when the walk is done, or when ctx is done, which
+// stops the walk after the file being added.  The Grokker is locked
+// until then, so callers must either receive every result or cancel
+// ctx before calling Save or any other method.
+func (g *Grokker) AddDirectoryStream(ctx context.Context, dir string, opts AddOpts) <-chan AddResult {
+	results := make(chan AddResult)
+	go func() {
+		defer close(results)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.walkDirectory(ctx, dir, opts, func(res AddResult) bool {
+			select {
+			case results <- res:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return results
+}
+
+// walkDirectory implements AddDirectory and AddDirectoryStream,
+// adding the files beneath dir and calling report with the result of
+// each.  The walk stops if report returns false or ctx is done.  The
+// caller must hold g.mu for writing.
+func (g *Grokker) walkDirectory(ctx context.Context, dir string, opts AddOpts, report func(AddResult) bool) {
+	// a span only makes sense for a single file
+	opts.Span = nil
+	seen := fileSet{}
+	stopped := false
+	var walk func(path string, named bool)
+	walk = func(path string, named bool) {
+		if stopped || ctx.Err() != nil {
+			return
+		}
+		fail := func(err error) {
+			stopped = !report(AddResult{Path: path, Err: err})
+		}
+		fi, err := os.Lstat(path)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if !named && !opts.FollowSymlinks {
+				return
+			}
+			fi, err = os.Stat(path)
+			if os.IsNotExist(err) {
+				// dangling link
+				return
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+		}
+		if seen.visit(fi) {
+			return
+		}
+		switch {
+		case fi.IsDir():
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				fail(err)
+				return
+			}
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), ".") {
+					continue
+				}
+				walk(filepath.Join(path, entry.Name()), false)
+			}
+		case fi.Mode().IsRegular():
+			chunks, err := g.addDocument(path, opts)
+			stopped = !report(AddResult{Path: path, Chunks: chunks, Err: err})
+		}
+	}
+	walk(dir, true)
+}
+
+// fileSet records the files and directories visited during a walk.
+// Entries are compared with os.SameFile, which matches on device and
+// inode, and are bucketed by size to keep the comparisons few.
+type fileSet map[int64][]os.FileInfo
+
+// visit adds fi to the set and reports whether it was already there.
+func (s fileSet) visit(fi os.FileInfo) bool {
+	for _, other := range s[fi.Size()] {
+		if os.SameFile(fi, other) {
+			return true
+		}
+	}
+	s[fi.Size()] = append(s[fi.Size()], fi)
+	return false
+}
+
+// AddReader adds a synthetic document to the Grokker database, reading
+// its content from r and storing it under the given name.  Unlike
+// AddDocument, there is no file on disk; the content is stored in the
+// database and chunked and embedded like any other document.  Adding
+// the same name again replaces the content.
+func (g *Grokker) AddReader(name string, r io.Reader) (err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// read one byte past the limit to find out if it's exceeded
+	limit := g.maxFileSize()
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	buf, err := ioutil.ReadAll(r)
+	Ck(err)
+	err = g.tooLarge(int64(len(buf)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	var doc *Document
+	for _, d := range g.Documents {
+		if d.RelPath == name {
+			doc = d
+			break
+		}
+	}
+	found := doc != nil
+	if !found {
+		doc = &Document{RelPath: name, Synthetic: true}
+		g.Documents = append(g.Documents, doc)
+	}
+	if !doc.Synthetic {
+		err = fmt.Errorf("document %q is already in the database as a file", name)
+		return
+	}
+	oldContent, oldChecked := doc.Content, doc.Checked
+	doc.Content = string(buf)
+	g.touch(doc.RelPath)
+	// update the embeddings for the document.  If that fails, a
+	// replaced document keeps its old content and chunks, and a new
+	// one is dropped, since UpdateEmbeddings never retries synthetic
+	// documents.
+	_, err = g.tryUpdateDocument(doc, g.embeddingProgress(doc))
+	if err != nil {
+		if found {
+			doc.Content, doc.Checked = oldContent, oldChecked
+		} else {
+			g.dropDocument(doc)
+		}
+	}
 	Ck(err)
+	if found {
+		// drop the chunks of the replaced content
+		err = g.gc()
+		Ck(err)
+	}
 	return
 }
 
+// dropDocument removes doc, which was just added, from the database
+// after it was rejected, so that no document without chunks is left
+// behind.  The caller must hold g.mu for writing.
+func (g *Grokker) dropDocument(doc *Document) {
+	for i, d := range g.Documents {
+		if d == doc {
+			g.Documents = append(g.Documents[:i], g.Documents[i+1:]...)
+			break
+		}
+	}
+}
+
 // ForgetDocument removes a document from the Grokker database.
 func (g *Grokker) ForgetDocument(path string) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.forgetDocument(path)
+}
+
+// forgetDocument implements ForgetDocument.  The caller must hold
+// g.mu for writing.
+func (g *Grokker) forgetDocument(path string) (err error) {
 	defer Return(&err)
 	// remove the document from the database.
 	for i, d := range g.Documents {
@@ -83,6 +380,7 @@ func (g *Grokker) ForgetDocument(path string) (err error) {
 		if match {
 			Debug("forgetting document %s ...", path)
 			g.Documents = append(g.Documents[:i], g.Documents[i+1:]...)
+			g.touch(d.RelPath)
 			break
 		}
 	}
@@ -144,17 +442,496 @@ func (g *Grokker) Continue(modelName, in string, global bool) (out, sysmsg strin
 	return
 }
 
-// Answer returns the answer to a question.
+// Answer returns the answer to a question.  If the chat API fails,
+// it returns the context retrieved for the question instead; see
+// Result.Degraded.
 func (g *Grokker) Answer(modelName, question string, withHeaders, withLineNumbers, global bool) (out string, err error) {
 	defer Return(&err)
+	res, err := g.AnswerResult(modelName, question, withHeaders, withLineNumbers, global)
+	Ck(err)
+	out = res.Answer
+	return
+}
+
+// ScoredChunk is a chunk returned by Search along with its similarity
+// to the query.
+type ScoredChunk struct {
+	// Path is the path of the chunk's document, relative to the
+	// repository root.
+	Path string `json:"path"`
+	// Offset and Length locate the chunk in its document, in bytes.
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+	// Line and EndLine are the first and last lines of the document
+	// the chunk spans, counting from 1, e.g. for linking to it; see
+	// Chunk.Line.  They are zero if the document has been removed.
+	Line    int `json:"line"`
+	EndLine int `json:"end_line"`
+	// Score is the cosine similarity of the chunk to the query,
+	// blended with its keyword score if Grokker.KeywordWeight is
+	// set, and multiplied by its document's weight.
+	Score float64 `json:"score"`
+	// Text is the text of the chunk.
+	Text  string `json:"text"`
+	chunk *Chunk
+}
+
+// Search returns the K chunks most similar to query, most similar
+// first, without calling the chat model.  It's useful for finding
+// passages cheaply and for debugging retrieval.
+func (g *Grokker) Search(query string, K int) (results []ScoredChunk, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if K < 1 {
+		err = fmt.Errorf("K must be at least 1, got %d", K)
+		return
+	}
+	err = g.checkExclude()
+	Ck(err)
+	_, err = g.retrievalModel()
+	Ck(err)
+	embedding, err := g.queryEmbedding(query)
+	Ck(err)
+	if embedding == nil {
+		err = fmt.Errorf("empty query")
+		return
+	}
+	scorer, err := g.queryScorer(query, embedding)
+	Ck(err)
+	excluded := g.excluder()
+	for _, chunk := range g.Chunks {
+		if g.vector(chunk) == nil || (excluded != nil && excluded(chunk.Document.RelPath)) {
+			continue
+		}
+		score := scorer(chunk)
+		if math.IsInf(score, -1) {
+			continue
+		}
+		results = append(results, ScoredChunk{
+			Path:   chunk.Document.RelPath,
+			Offset: chunk.Offset,
+			Length: chunk.Length,
+			Score:  score,
+			chunk:  chunk,
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > K {
+		results = results[:K]
+	}
+	// only read the text of the chunks we return
+	for i := range results {
+		results[i].Text, err = g.chunkText(results[i].chunk, false, false)
+		Ck(err)
+		results[i].Line, results[i].EndLine, err = g.chunkLines(results[i].chunk)
+		Ck(err)
+	}
+	return
+}
+
+// ScoredDocument is a document returned by RelatedDocuments or
+// FindDuplicates along with its similarity score.
+type ScoredDocument struct {
+	// Path is the path of the document, relative to the repository
+	// root.
+	Path string `json:"path"`
+	// Score is the similarity of the document's centroid to that of
+	// the given document, using Grokker.Metric, or for
+	// FindDuplicates the cosine similarity to the first member of
+	// the document's group.
+	Score float64 `json:"score"`
+}
+
+// RelatedDocuments returns the K documents most similar to the
+// document at relpath, most similar first, without calling any API.
+// Each document is represented by its centroid, the mean of its
+// chunks' embeddings, so that overlapping or duplicated documents
+// can be found in a large knowledge base.
+func (g *Grokker) RelatedDocuments(relpath string, K int) (results []ScoredDocument, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if K < 1 {
+		err = fmt.Errorf("K must be at least 1, got %d", K)
+		return
+	}
+	doc, err := g.findDocument(relpath)
+	Ck(err)
+	if doc == nil {
+		err = fmt.Errorf("%q: %w", relpath, ErrDocumentNotFound)
+		return
+	}
+	centroids := g.centroids()
+	ref := centroids[doc.RelPath]
+	if ref == nil {
+		err = fmt.Errorf("%s has no embeddings", doc.RelPath)
+		return
+	}
+	for _, d := range g.Documents {
+		centroid := centroids[d.RelPath]
+		if d == doc || centroid == nil {
+			continue
+		}
+		results = append(results, ScoredDocument{
+			Path:  d.RelPath,
+			Score: g.similarity(ref, centroid),
+		})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > K {
+		results = results[:K]
+	}
+	return
+}
+
+// FindDuplicates returns groups of documents that are duplicates or
+// near-duplicates of each other, such as copies with small edits.
+// Two documents are grouped if the cosine similarity of their
+// centroids is above threshold, e.g. 0.95, whatever Grokker.Metric; a document
+// similar to any member of a group joins it.  Groups and the
+// documents in them are in the order the documents were added, each
+// scored by its cosine similarity to the group's first member, which
+// scores 1.
+func (g *Grokker) FindDuplicates(threshold float64) (groups [][]ScoredDocument, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	centroids := g.centroids()
+	var docs []*Document
+	for _, doc := range g.Documents {
+		if centroids[doc.RelPath] != nil {
+			docs = append(docs, doc)
+		}
+	}
+	// union-find over the documents, linking each similar pair
+	parent := make([]int, len(docs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range docs {
+		for j := i + 1; j < len(docs); j++ {
+			sim := util.Similarity(centroids[docs[i].RelPath], centroids[docs[j].RelPath])
+			if sim > threshold {
+				ri, rj := root(i), root(j)
+				if ri < rj {
+					parent[rj] = ri
+				} else {
+					parent[ri] = rj
+				}
+			}
+		}
+	}
+	// collect the groups, each keyed by its earliest member
+	members := make(map[int][]*Document)
+	for i, doc := range docs {
+		r := root(i)
+		members[r] = append(members[r], doc)
+	}
+	for i := range docs {
+		group := members[i]
+		if len(group) < 2 {
+			continue
+		}
+		first := centroids[group[0].RelPath]
+		scored := []ScoredDocument{{Path: group[0].RelPath, Score: 1}}
+		for _, doc := range group[1:] {
+			scored = append(scored, ScoredDocument{
+				Path:  doc.RelPath,
+				Score: util.Similarity(first, centroids[doc.RelPath]),
+			})
+		}
+		groups = append(groups, scored)
+	}
+	return
+}
+
+// DocumentSimilarity returns the cosine similarity of the centroids
+// of the two documents at the given paths, as used by FindDuplicates.
+func (g *Grokker) DocumentSimilarity(path1, path2 string) (sim float64, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	centroids := g.centroids()
+	var vecs [][]float64
+	for _, path := range []string{path1, path2} {
+		doc, err := g.findDocument(path)
+		Ck(err)
+		if doc == nil {
+			return 0, fmt.Errorf("%q: %w", path, ErrDocumentNotFound)
+		}
+		vec := centroids[doc.RelPath]
+		if vec == nil {
+			return 0, fmt.Errorf("%s has no embeddings", doc.RelPath)
+		}
+		vecs = append(vecs, vec)
+	}
+	sim = util.Similarity(vecs[0], vecs[1])
+	return
+}
+
+// centroids returns the mean of the embeddings of each document's
+// chunks, keyed by the document's RelPath.  Chunks with missing or
+// corrupt embeddings are left out.
+func (g *Grokker) centroids() (centroids map[string][]float64) {
+	dims := g.embeddingDims()
+	vectors := make(map[string][][]float64)
+	for _, chunk := range g.Chunks {
+		if chunk.Embedding == nil || validateEmbedding(chunk.Embedding, dims) != nil {
+			continue
+		}
+		path := chunk.Document.RelPath
+		vectors[path] = append(vectors[path], chunk.Embedding)
+	}
+	centroids = make(map[string][]float64)
+	for path, vecs := range vectors {
+		centroids[path] = util.MeanVector(vecs)
+	}
+	return
+}
+
+// Result is the structured result of a query, suitable for encoding
+// as JSON.
+type Result struct {
+	// Answer is the model's response.
+	Answer string `json:"answer"`
+	// Sources are the paths of the documents the context was drawn
+	// from, most relevant first.
+	Sources []string `json:"sources"`
+	// Citations are any references returned by the provider, e.g.
+	// perplexity's web citations.
+	Citations []string `json:"citations,omitempty"`
+	// Usage is the token usage reported by the provider.
+	Usage client.Usage `json:"usage"`
+	// FinishReason is why the model stopped generating, e.g. "stop",
+	// or "length" if the answer was cut off by the model's output
+	// token limit.  It is empty if the provider doesn't report it.
+	FinishReason string `json:"finish_reason,omitempty"`
+	// Model is the name of the model that generated the answer.
+	Model string `json:"model"`
+	// Messages are the messages sent to the model for the answer,
+	// including the system message and the retrieved context, for
+	// debugging and auditing.
+	Messages []client.ChatMsg `json:"messages,omitempty"`
+	// Degraded is set if an API failed but the query could still
+	// return something useful, and Notice says what happened.  If
+	// the chat API failed, Answer holds the notice followed by the
+	// passages retrieved for the question instead of an answer.  If
+	// the embedding API failed and global knowledge was asked for,
+	// Answer holds the notice followed by an answer from global
+	// knowledge alone.  Other API failures are returned as errors
+	// wrapping ErrChatAPI or ErrEmbeddingAPI.  Notice also says when
+	// Grokker.AutoGlobal turned on global knowledge.
+	Degraded bool   `json:"degraded,omitempty"`
+	Notice   string `json:"notice,omitempty"`
+	// Global is set if the answer drew on the model's global
+	// knowledge, whether it was asked for or turned on by
+	// Grokker.AutoGlobal.
+	Global bool `json:"global,omitempty"`
+	// Tokens shows how the tokens of the request for the answer were
+	// split between the system message, context, and question, and
+	// how many were left for the answer.
+	Tokens *TokenBreakdown `json:"tokens,omitempty"`
+	// Retrieval lists the chunks considered as context, in the order
+	// they were ranked, and whether each was used or dropped to fit
+	// the context budget.  It is only filled in if
+	// Grokker.ExplainRetrieval is set.
+	Retrieval []RetrievedChunk `json:"retrieval,omitempty"`
+	// Raw is the provider's own response, for advanced callers.  It
+	// is not included in JSON output.
+	Raw interface{} `json:"-"`
+}
+
+// AnswerResult is like Answer, but returns a structured Result
+// including the sources used and the token usage.
+func (g *Grokker) AnswerResult(modelName, question string, withHeaders, withLineNumbers, global bool) (res *Result, err error) {
+	return g.AnswerImages(modelName, question, nil, withHeaders, withLineNumbers, global)
+}
+
+// AnswerImages is like AnswerResult, but sends images with the
+// question, e.g. to ask about a diagram.  Each image is a file path
+// or an http(s) or data: URL.  Context is still retrieved from the
+// knowledge base using the text of the question.  The model must
+// accept images; see ErrNoVision.
+func (g *Grokker) AnswerImages(modelName, question string, images []string, withHeaders, withLineNumbers, global bool) (res *Result, err error) {
+	return g.answerImages(context.Background(), modelName, question, images, withHeaders, withLineNumbers, global)
+}
+
+// answerImages implements AnswerImages, giving up on the chat
+// requests when ctx is done.
+func (g *Grokker) answerImages(ctx context.Context, modelName, question string, images []string, withHeaders, withLineNumbers, global bool) (res *Result, err error) {
+	defer Return(&err)
+	// check the model before reading the images
+	modelName, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	err = g.checkVision(modelName, images)
+	Ck(err)
+	urls, err := imageURLs(images)
+	Ck(err)
 	// tokenize the question
 	qtokens, err := g.tokens(question)
 	Ck(err)
-	maxTokens := int(float64(g.ModelObj.TokenLimit)*0.5) - len(qtokens)
-	context, err := g.getContext(question, maxTokens, withHeaders, withLineNumbers, nil)
+	maxTokens := g.contextBudget(m.TokenLimit) - len(qtokens) - len(urls)*ImageTokens
+	// AutoGlobal needs the scores of the candidates
+	autoGlobal := g.AutoGlobal != 0 && !global
+	ctxt, chunks, explained, err := g.explainContext(ctx, question, maxTokens, withHeaders, withLineNumbers, nil, g.ExplainRetrieval || autoGlobal)
+	var notices []string
+	var degraded bool
+	if errors.Is(err, ErrEmbeddingAPI) && global {
+		// the model can still answer from its global knowledge
+		notices = append(notices, Spf("No context was retrieved from the knowledge base (%v); this answer is from the model's global knowledge alone.", err))
+		degraded = true
+		ctxt, chunks, explained, err = "", nil, nil, nil
+	}
 	Ck(err)
+	if autoGlobal {
+		best := math.Inf(-1)
+		for _, ex := range explained {
+			best = math.Max(best, ex.Score)
+		}
+		if best < g.AutoGlobal {
+			global = true
+			notices = append(notices, Spf("Little in the knowledge base matches this question (best score %.2f, below %.2f); this answer also draws on the model's global knowledge.", best, g.AutoGlobal))
+		}
+		if !g.ExplainRetrieval {
+			explained = nil
+		}
+	}
+	if len(chunks) == 0 && g.MinRelevance != 0 && !global {
+		err = fmt.Errorf("%w: no chunk scored at least %v", ErrNoRelevantContext, g.MinRelevance)
+		return
+	}
 	// generate the answer.
-	out, err = g.AnswerWithRAG(modelName, SysMsgChat, question, context, global)
+	results, messages, tokens, err := g.answerWithRAG(ctx, modelName, g.sysMsgChat(), question, ctxt, urls, global, g.ChatOptions)
+	if errors.Is(err, ErrChatAPI) && len(chunks) > 0 && ctx.Err() == nil {
+		// the retrieved passages are better than nothing
+		notices = append(notices, Spf("The chat model could not be reached (%v); these are the passages of the knowledge base most relevant to the question, without an answer.", err))
+		degraded = true
+		results = client.Results{}
+		results.Body, err = g.passages(chunks, withLineNumbers)
+	}
+	Ck(err)
+	res = &Result{
+		Messages:     messages,
+		Answer:       results.Body,
+		Sources:      chunkSources(chunks),
+		Citations:    results.Citations,
+		Usage:        results.Usage,
+		FinishReason: results.FinishReason,
+		Model:        modelName,
+		Tokens:       tokens,
+		Retrieval:    explained,
+		Raw:          results.Raw,
+		Global:       global,
+		Degraded:     degraded,
+	}
+	if len(notices) > 0 {
+		res.Notice = strings.Join(notices, "  ")
+		res.Answer = res.Notice + "\n\n" + res.Answer
+	}
+	return
+}
+
+// passages returns the text of chunks, each preceded by the path of
+// its document, for when they can't be used to answer a question.
+func (g *Grokker) passages(chunks []*Chunk, withLineNumbers bool) (text string, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var texts []string
+	for _, chunk := range chunks {
+		t, err := g.chunkText(chunk, true, withLineNumbers)
+		Ck(err)
+		texts = append(texts, strings.TrimSpace(t))
+	}
+	text = strings.Join(texts, "\n\n")
+	return
+}
+
+// chunkSources returns the unique document paths of chunks, in
+// order of first appearance.
+func chunkSources(chunks []*Chunk) (sources []string) {
+	sources = []string{}
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		path := chunk.Document.RelPath
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		sources = append(sources, path)
+	}
+	return
+}
+
+// AnswerOpts contains options for AnswerWithContext.
+type AnswerOpts struct {
+	// ModelName is the chat model to use.  If empty, the current
+	// default model is used.
+	ModelName string
+	// Sysmsg is the system message.  If empty, Grokker.SystemPrompt
+	// or else SysMsgChat is used.
+	Sysmsg string
+	// Language is the natural language of the answer.  If empty,
+	// Grokker.Language is used.
+	Language string
+	// Global includes results from the model's global knowledge as
+	// well as from the supplied context.
+	Global bool
+	// Images are file paths or http(s) or data: URLs of images to
+	// send with the question.  The model must accept images.
+	Images []string
+}
+
+// AnswerWithContext returns the answer to a question using the given
+// context instead of retrieving context from the knowledge base, so
+// callers can supply their own passages and skip embeddings
+// entirely.  The context is truncated if it doesn't fit in the
+// model's context budget.
+func (g *Grokker) AnswerWithContext(question, ctxt string, opts AnswerOpts) (out string, err error) {
+	defer Return(&err)
+	modelName := opts.ModelName
+	if modelName == "" {
+		modelName = g.Model
+	}
+	lang := opts.Language
+	if lang == "" {
+		lang = g.Language
+	}
+	sysmsg := opts.Sysmsg + languagePrompt(lang)
+	if opts.Sysmsg == "" {
+		sysmsg = g.sysMsgChatIn(lang)
+	}
+	_, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	err = g.checkVision(modelName, opts.Images)
+	Ck(err)
+	urls, err := imageURLs(opts.Images)
+	Ck(err)
+	sysmsgTc, err := g.TokenCount(sysmsg)
+	Ck(err)
+	qtc, err := g.TokenCount(question)
+	Ck(err)
+	maxTokens := g.contextBudget(m.TokenLimit) - sysmsgTc - qtc - len(urls)*ImageTokens
+	ctxt, truncated, err := g.truncateTokens(ctxt, maxTokens)
+	Ck(err)
+	if truncated {
+		Fpf(os.Stderr, "warning: context truncated to %d tokens\n", maxTokens)
+	}
+	results, _, _, err := g.answerWithRAG(context.Background(), modelName, sysmsg, question, ctxt, urls, opts.Global, g.ChatOptions)
+	Ck(err)
+	out = results.Body
 	return
 }
 
@@ -179,7 +956,7 @@ func (g *Grokker) Revise(modelName, in string, global, sysmsgin bool) (out, sysm
 	}
 
 	// get context
-	maxTokens := int(float64(g.ModelObj.TokenLimit)*0.5) - len(inTokens)
+	maxTokens := g.contextBudget(g.ModelObj.TokenLimit) - len(inTokens)
 	context, err := g.getContext(in, maxTokens, false, false, nil)
 	Ck(err)
 
@@ -206,14 +983,105 @@ func (g *Grokker) Backup() (backpath string, err error) {
 	backpath = fmt.Sprintf("%s/grokker-backup-%s%s", tmpdir, time.Now().Format("20060102-150405"), deslashed)
 	err = util.CopyFile(g.grokpath, backpath)
 	Ck(err, "failed to backup %q to %q", g.grokpath, backpath)
+	_, err = os.Stat(g.journalPath())
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	Ck(err)
+	err = util.CopyFile(g.journalPath(), backpath+".journal")
+	Ck(err, "failed to backup %q to %q", g.journalPath(), backpath+".journal")
 	return
 }
 
-// Save saves the Grokker database to the stored path.
+// Save saves the Grokker database to the stored path.  If only
+// documents have changed since the last save, the changes are
+// appended to the journal rather than rewriting the whole db; see
+// journal.go.
 func (g *Grokker) Save() (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.save()
+}
+
+// save implements Save.  The caller must hold g.mu for writing.
+func (g *Grokker) save() (err error) {
 	defer Return(&err)
+	if g.grokpath == "" {
+		err = fmt.Errorf("db has no path; use SaveAs")
+		return
+	}
+	saved, err := g.saveJournal()
+	Ck(err)
+	if saved {
+		return
+	}
 	err = g.saveToFile()
 	Ck(err)
+	err = g.removeJournal()
+	Ck(err)
+	err = g.markSaved()
+	Ck(err)
+	return
+}
+
+// Close saves any changes made since the last save, unless the db was
+// loaded read-only, closes any chat clients or embedder that implement
+// io.Closer, and releases the lock taken by Load or LoadFrom.  Library
+// callers should defer Close rather than unlocking that lock
+// themselves.  Calling Close again does nothing.
+func (g *Grokker) Close() (err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	g.closed = true
+	defer func() {
+		if g.lock == nil {
+			return
+		}
+		unlockErr := g.lock.Unlock()
+		if err == nil {
+			err = unlockErr
+		}
+	}()
+	if !g.readonly && g.grokpath != "" {
+		var unsaved bool
+		unsaved, err = g.unsaved()
+		Ck(err)
+		if unsaved {
+			err = g.save()
+			Ck(err)
+		}
+	}
+	var closers []io.Closer
+	if c, ok := g.embedder.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+	for _, chat := range g.chatClients {
+		if c, ok := chat.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+	}
+	for _, c := range closers {
+		err = c.Close()
+		Ck(err)
+	}
+	return
+}
+
+// unsaved returns true if g has changes that haven't been saved.
+func (g *Grokker) unsaved() (unsaved bool, err error) {
+	defer Return(&err)
+	if g.savedHeader == nil || len(g.dirty) > 0 {
+		unsaved = true
+		return
+	}
+	hdr, err := g.header()
+	Ck(err)
+	unsaved = !bytes.Equal(hdr, g.savedHeader)
 	return
 }
 
@@ -225,30 +1093,92 @@ func (g *Grokker) saveToFile() (err error) {
 	tmpfn := g.grokpath + ".tmp"
 	fh, err := os.Create(tmpfn)
 	Ck(err)
-	// write
+	// write, as a new generation so that any journal left from the
+	// old one is ignored; see journal.go
+	restore, err := g.encodeEmbeddings()
+	Ck(err)
+	restoreOverrides := g.persistOverrides()
+	g.Generation++
 	data, err := json.Marshal(g)
+	g.Generation--
+	restoreOverrides()
+	restore()
 	Ck(err)
-	_, err = fh.Write(data)
+	var w io.WriteCloser = fh
+	if g.Compress {
+		w = gzip.NewWriter(fh)
+	}
+	_, err = w.Write(data)
 	Ck(err)
 	// close
+	if g.Compress {
+		err = w.Close()
+		Ck(err)
+	}
 	err = fh.Close()
 	Ck(err)
 	// move
 	err = os.Rename(tmpfn, g.grokpath)
 	Ck(err)
+	g.Generation++
 	Debug(" done!")
 	return
 }
 
 // UpdateEmbeddings updates the embeddings for any documents that have
-// changed since the last time the embeddings were updated.  It returns
-// true if any embeddings were updated.
+// changed since the last time their embeddings were updated, as
+// recorded in the database; see Document.Checked.  It returns true if
+// any embeddings were updated.  Documents that can't be updated are
+// skipped and reported in a *RefreshError; API errors stop the
+// update.
 func (g *Grokker) UpdateEmbeddings() (update bool, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.updateEmbeddings(nil)
+}
+
+// UpdateEmbeddingsSince is like UpdateEmbeddings, but updates the
+// documents whose files changed after since, whatever the database
+// recorded.  A zero since checks every document, e.g. after files
+// were restored with their old modification times.  Checking an
+// unchanged document costs no API calls.
+func (g *Grokker) UpdateEmbeddingsSince(since time.Time) (update bool, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.updateEmbeddings(&since)
+}
+
+// updateEmbeddings implements UpdateEmbeddings and
+// UpdateEmbeddingsSince.  If since is nil, each document's Checked
+// time is used.  The caller must hold g.mu for writing.
+func (g *Grokker) updateEmbeddings(since *time.Time) (update bool, err error) {
 	defer Return(&err)
-	// we use the timestamp of the grokfn as the last embedding update time.
-	lastUpdate, err := g.mtime()
-	Ck(err)
-	for _, doc := range g.Documents {
+	// documents embedded by older versions have no Checked time;
+	// for those we use the timestamp of the grokfn, which is looked
+	// up only if needed
+	var dbTime *time.Time
+	lastUpdate := func(doc *Document) time.Time {
+		switch {
+		case doc.Checked == checkFailed:
+			return time.Time{}
+		case since != nil:
+			return *since
+		case doc.Checked != 0:
+			return time.Unix(doc.Checked, 0)
+		case dbTime == nil:
+			mtime, err := g.mtime()
+			Ck(err)
+			dbTime = &mtime
+		}
+		return *dbTime
+	}
+	var failed []DocumentError
+	for i, doc := range g.Documents {
+		g.progress(i, len(g.Documents), doc.RelPath)
+		// synthetic documents only change when AddReader is called
+		if doc.Synthetic {
+			continue
+		}
 		// check if the document has changed.
 		fi, err := os.Stat(g.absPath(doc))
 		if os.IsNotExist(err) {
@@ -261,18 +1191,30 @@ func (g *Grokker) UpdateEmbeddings() (update bool, err error) {
 			err = nil
 			continue
 		}
-		Ck(err)
-		if fi.ModTime().After(lastUpdate) {
+		if err != nil {
+			failed = append(failed, DocumentError{doc.RelPath, err})
+			continue
+		}
+		if fi.ModTime().After(lastUpdate(doc)) {
 			// update the embeddings.
 			Debug("updating embeddings for %s ...", doc.RelPath)
-			updated, err := g.updateDocument(doc)
-			Ck(err)
+			updated, err := g.tryUpdateDocument(doc, nil)
+			// the API failing for one document will fail them all
+			Ck(apiOnly(err))
+			if err != nil {
+				failed = append(failed, DocumentError{doc.RelPath, err})
+				continue
+			}
 			Debug("done\n")
 			update = update || updated
 		}
 	}
+	g.progress(len(g.Documents), len(g.Documents), "")
 	// garbage collect any chunks that are no longer referenced.
 	g.gc()
+	if len(failed) > 0 {
+		err = &RefreshError{Failed: failed}
+	}
 	return
 }
 
@@ -290,7 +1232,7 @@ func (g *Grokker) DBVersion() string {
 func (g *Grokker) Embed(text string) (jsonEmbedding string, err error) {
 	defer Return(&err)
 	// call createEmbeddings() to get the embedding.
-	embedding, err := g.createEmbeddings([]string{text})
+	embedding, err := g.createEmbeddings([]string{text}, nil)
 	Ck(err)
 	// convert the embedding to an indented JSON string.
 	buf, err := json.MarshalIndent(embedding, "", "  ")
@@ -299,6 +1241,81 @@ func (g *Grokker) Embed(text string) (jsonEmbedding string, err error) {
 	return
 }
 
+// EmbedText returns the embeddings of texts, in the same order, with
+// nil embeddings for empty texts.  Texts are sent to the embedding
+// model in batches.  If the database stores projected embeddings,
+// see SetEmbeddingDims, the embeddings are projected the same way so
+// that they can be compared with those returned by ChunkEmbeddings.
+func (g *Grokker) EmbedText(texts []string) (embeddings [][]float64, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	embeddings, err = g.createEmbeddings(texts, nil)
+	Ck(err)
+	for i, embedding := range embeddings {
+		if embedding == nil {
+			continue
+		}
+		embeddings[i], err = g.projectEmbedding(embedding)
+		Ck(err)
+	}
+	return
+}
+
+// EmbeddingRecord is a chunk returned by ChunkEmbeddings along with
+// its embedding.
+type EmbeddingRecord struct {
+	// Path is the path of the chunk's document, relative to the
+	// repository root.
+	Path string `json:"path"`
+	// Offset and Length locate the chunk in its document, in bytes.
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+	// Text is the text of the chunk.  It is empty if the document's
+	// file has been removed.
+	Text string `json:"text"`
+	// Embedding is the chunk's embedding as stored in the database.
+	Embedding []float64 `json:"embedding"`
+}
+
+// ChunkEmbeddings returns every chunk that has an embedding, along
+// with its text and source, so that the embeddings can be used
+// outside grokker, e.g. for clustering or classification.  Records
+// are ordered by document, in the order the documents were added,
+// and then by offset, so the order is stable as long as the
+// documents don't change.  The embeddings are copies.
+func (g *Grokker) ChunkEmbeddings() (records []EmbeddingRecord, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	byDoc := make(map[string][]*Chunk)
+	for _, chunk := range g.Chunks {
+		if chunk.Embedding == nil || chunk.Document == nil {
+			continue
+		}
+		path := chunk.Document.RelPath
+		byDoc[path] = append(byDoc[path], chunk)
+	}
+	for _, doc := range g.Documents {
+		chunks := byDoc[doc.RelPath]
+		sort.SliceStable(chunks, func(i, j int) bool {
+			return chunks[i].Offset < chunks[j].Offset
+		})
+		for _, chunk := range chunks {
+			text, err := g.chunkText(chunk, false, false)
+			Ck(err)
+			records = append(records, EmbeddingRecord{
+				Path:      doc.RelPath,
+				Offset:    chunk.Offset,
+				Length:    chunk.Length,
+				Text:      text,
+				Embedding: append([]float64(nil), chunk.Embedding...),
+			})
+		}
+	}
+	return
+}
+
 // Similarity returns the similarity between two or more texts.  Each text
 // is compared to the reference text, and the similarities are returned as
 // a float64 slice.
@@ -313,7 +1330,7 @@ func (g *Grokker) Similarity(reftext string, texts ...string) (sims []float64, e
 		vec, err := g.meanVectorFromLongString(text)
 		Ck(err)
 		// calculate the similarity
-		sim := util.Similarity(refVec, vec)
+		sim := g.similarity(refVec, vec)
 		sims = append(sims, sim)
 	}
 	return
@@ -329,56 +1346,298 @@ func (g *Grokker) TokenCount(text string) (count int, err error) {
 }
 
 // RefreshEmbeddings refreshes the embeddings for all documents in the
-// database.
+// database, forgetting any that no longer exist.  Up to
+// g.RefreshWorkers documents are embedded at once.  Documents that
+// can't be refreshed are skipped and reported in a *RefreshError; API
+// errors stop the refresh.
 func (g *Grokker) RefreshEmbeddings() (err error) {
 	defer Return(&err)
-	// regenerate the embeddings for each document.
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// every document changes, so journaling would only double the
+	// size of the write
+	g.savedHeader = nil
+	// forget missing documents, then regenerate the embeddings for
+	// the rest.  Iterate over a copy because missing documents are
+	// removed from g.Documents.
+	var docs []*Document
+	var failed []DocumentError
+	for _, doc := range append([]*Document{}, g.Documents...) {
+		if !doc.Synthetic {
+			// remove file from list if it doesn't exist.
+			absPath := g.absPath(doc)
+			Debug("absPath: %s", absPath)
+			_, err := os.Stat(absPath)
+			Debug("stat err: %v", err)
+			if os.IsNotExist(err) {
+				// remove the document from the database.
+				g.forgetDocument(doc.RelPath)
+				continue
+			}
+			if err != nil {
+				failed = append(failed, DocumentError{doc.RelPath, err})
+				continue
+			}
+		}
+		docs = append(docs, doc)
+	}
+	refreshFailed, err := g.refreshDocuments(docs)
+	Ck(err)
+	failed = append(failed, refreshFailed...)
+	g.progress(len(docs), len(docs), "")
+	g.gc()
+	if len(failed) > 0 {
+		err = &RefreshError{Failed: failed}
+	}
+	return
+}
+
+// RefreshDocument re-reads the document at relpath and re-embeds all
+// of its chunks, even if its modification time hasn't changed, then
+// garbage collects its orphaned chunks.  Other documents are not
+// touched.  It returns an error if the document is not in the
+// database or is missing from disk.
+func (g *Grokker) RefreshDocument(relpath string) (err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	doc, err := g.findDocument(relpath)
+	Ck(err)
+	if doc == nil {
+		err = fmt.Errorf("%q: %w", relpath, ErrDocumentNotFound)
+		return
+	}
+	if !doc.Synthetic {
+		_, err = os.Stat(g.absPath(doc))
+		Ck(err)
+	}
+	// drop the document's chunks so that every chunk is embedded
+	// again rather than reused
+	for _, chunk := range g.Chunks {
+		if chunk.Document.RelPath == doc.RelPath {
+			chunk.stale = true
+		}
+	}
+	err = g.gc()
+	Ck(err)
+	_, err = g.updateDocument(doc, g.embeddingProgress(doc))
+	Ck(err)
+	err = g.gc()
+	Ck(err)
+	return
+}
+
+// Rebuild discards every chunk and embedding in the database and
+// regenerates them from the current content of each document, keeping
+// the document list as-is.  Chunks of documents that are missing from
+// disk are kept unchanged, since the documents might be on a different
+// branch in e.g. git.  It returns the number of chunks that were added
+// and removed compared to the database before the rebuild.
+func (g *Grokker) Rebuild() (added, removed int, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rebuild()
+}
+
+// rebuild implements Rebuild.  The caller must hold g.mu for writing.
+func (g *Grokker) rebuild() (added, removed int, err error) {
+	defer Return(&err)
+	// every document changes, so rewrite the db on the next save
+	g.savedHeader = nil
+	key := func(c *Chunk) string {
+		return c.Document.RelPath + ":" + c.Hash
+	}
+	// remember the old chunks, and keep only those of missing
+	// documents
+	oldKeys := make(map[string]bool)
+	var keepChunks []*Chunk
+	missing := make(map[string]bool)
 	for _, doc := range g.Documents {
-		Fpf(os.Stderr, "refreshing embeddings for %s\n", doc.RelPath)
-		// remove file from list if it doesn't exist.
-		absPath := g.absPath(doc)
-		Debug("absPath: %s", absPath)
-		_, err := os.Stat(absPath)
-		Debug("stat err: %v", err)
+		if doc.Synthetic {
+			continue
+		}
+		_, err := os.Stat(g.absPath(doc))
 		if os.IsNotExist(err) {
-			// remove the document from the database.
-			g.ForgetDocument(doc.RelPath)
+			Fpf(os.Stderr, "warning: %s not found, keeping its chunks\n", doc.RelPath)
+			missing[doc.RelPath] = true
 			continue
 		}
-		_, err = g.updateDocument(doc)
 		Ck(err)
 	}
-	g.gc()
+	for _, chunk := range g.Chunks {
+		oldKeys[key(chunk)] = true
+		if missing[chunk.Document.RelPath] {
+			keepChunks = append(keepChunks, chunk)
+		}
+	}
+	g.Chunks = keepChunks
+	// regenerate chunks and embeddings for each document
+	for i, doc := range g.Documents {
+		g.progress(i, len(g.Documents), doc.RelPath)
+		if missing[doc.RelPath] {
+			continue
+		}
+		if g.Progress == nil {
+			Fpf(os.Stderr, "rebuilding %s\n", doc.RelPath)
+		}
+		_, err = g.updateDocument(doc, nil)
+		Ck(err)
+	}
+	g.progress(len(g.Documents), len(g.Documents), "")
+	// drop chunks of documents that are no longer in the database
+	err = g.gc()
+	Ck(err)
+	// compare with the old chunks
+	newKeys := make(map[string]bool)
+	for _, chunk := range g.Chunks {
+		k := key(chunk)
+		newKeys[k] = true
+		if !oldKeys[k] {
+			added++
+		}
+	}
+	for k := range oldKeys {
+		if !newKeys[k] {
+			removed++
+		}
+	}
+	return
+}
+
+// RechunkOpts are the chunking settings for Rechunk.  Zero values
+// keep the current settings.
+type RechunkOpts struct {
+	// Chunking names the chunker; see SetChunking.
+	Chunking string
+	// ChunkTokens and MinChunkTokens limit the size of chunks; see
+	// SetChunkTokens.
+	ChunkTokens    int
+	MinChunkTokens int
+}
+
+// Rechunk applies the chunking settings in opts, then splits every
+// document into chunks again from its current content.  Unlike
+// Rebuild, it keeps the embeddings of chunks whose text is unchanged
+// and only embeds the new ones, so trying a different chunking costs
+// little when most chunks come out the same.  Chunks of documents
+// that are missing from disk are kept unchanged.  It returns the
+// number of chunks whose embeddings were reused and the number that
+// were embedded.
+func (g *Grokker) Rechunk(opts RechunkOpts) (reused, embedded int, err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if opts.Chunking != "" {
+		err = g.setChunking(opts.Chunking)
+		Ck(err)
+	}
+	if opts.ChunkTokens != 0 || opts.MinChunkTokens != 0 {
+		tokens, minTokens := g.ChunkTokens, g.MinChunkTokens
+		if opts.ChunkTokens != 0 {
+			tokens = opts.ChunkTokens
+		}
+		if opts.MinChunkTokens != 0 {
+			minTokens = opts.MinChunkTokens
+		}
+		err = g.setChunkTokens(tokens, minTokens)
+		Ck(err)
+	}
+	embeddings := make(map[*Chunk]bool)
+	for _, chunk := range g.Chunks {
+		embeddings[chunk] = true
+	}
+	for i, doc := range g.Documents {
+		g.progress(i, len(g.Documents), doc.RelPath)
+		if !doc.Synthetic {
+			_, err := os.Stat(g.absPath(doc))
+			if os.IsNotExist(err) {
+				Fpf(os.Stderr, "warning: %s not found, keeping its chunks\n", doc.RelPath)
+				continue
+			}
+			Ck(err)
+		}
+		// updateDocument reuses the chunks, and so the
+		// embeddings, of text it has seen before
+		_, err = g.updateDocument(doc, g.embeddingProgress(doc))
+		Ck(err)
+	}
+	g.progress(len(g.Documents), len(g.Documents), "")
+	err = g.gc()
+	Ck(err)
+	for _, chunk := range g.Chunks {
+		if embeddings[chunk] {
+			reused++
+		} else {
+			embedded++
+		}
+	}
 	return
 }
 
 // ListDocuments returns a list of all documents in the knowledge base.
 // XXX this is a bit of a hack, since we're using the document name as
 // the document ID.
-// XXX this is also a bit of a hack since we're trying to make this
-// work for multiple versions -- we should be able to simplify this
-// after migration is automatic during Load().
 func (g *Grokker) ListDocuments() (paths []string) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	for _, doc := range g.Documents {
-		path := doc.Path
-		v100, err := semver.Parse([]byte("1.0.0"))
-		current, err := semver.Parse([]byte(g.Version))
-		Ck(err)
-		cmp, err := semver.Cmp(current, v100)
-		Ck(err)
-		if cmp > 0 {
-			path = doc.RelPath
+		paths = append(paths, doc.RelPath)
+	}
+	return
+}
+
+// DocumentInfo describes a document in the knowledge base.
+type DocumentInfo struct {
+	// Path is the document's path relative to the knowledge base
+	// root, or absolute for documents outside it.
+	Path string
+	// Chunks is the number of chunks the document is split into.
+	Chunks int
+	// Tokens is the total number of tokens in those chunks.
+	Tokens int
+	// Embedded is when the document was last embedded, or the zero
+	// time if that isn't known.
+	Embedded time.Time
+	// Span is the part of the file that was added, or nil if the
+	// whole file was.
+	Span *Span
+}
+
+// ListDocumentInfo returns information about each document in the
+// knowledge base, in the order they were added.
+func (g *Grokker) ListDocumentInfo() (docs []DocumentInfo) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	index := make(map[string]int)
+	for _, doc := range g.Documents {
+		info := DocumentInfo{Path: doc.RelPath, Span: doc.Span}
+		if doc.Embedded != 0 {
+			info.Embedded = time.Unix(doc.Embedded, 0)
 		}
-		paths = append(paths, path)
+		index[doc.RelPath] = len(docs)
+		docs = append(docs, info)
+	}
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	for _, chunk := range g.Chunks {
+		i, ok := index[chunk.Document.RelPath]
+		if !ok {
+			continue
+		}
+		docs[i].Chunks++
+		docs[i].Tokens += chunk.Tokens
 	}
 	return
 }
 
 // LoadFrom loads a Grokker database from a given path.
-// XXX replace the json db with a kv store, store vectors as binary
-// floating point values.
-func LoadFrom(grokpath string, newModel string, readonly bool) (g *Grokker, migrated bool, oldver, newver string, lock *flock.Flock, err error) {
+// XXX replace the json db with a kv store.  Vectors are already stored
+// as binary floating point values; see EmbeddingFormat.
+func LoadFrom(grokpath string, newModel string, readonly bool, opts ...Option) (g *Grokker, migrated bool, oldver, newver string, lock *flock.Flock, err error) {
 	g = &Grokker{}
+	for _, opt := range opts {
+		opt(g)
+	}
 	g.grokpath = grokpath
 	lockpath := grokpath + ".lock"
 	// ensure the lock file exists
@@ -387,6 +1646,8 @@ func LoadFrom(grokpath string, newModel string, readonly bool) (g *Grokker, migr
 	err = lockfh.Close()
 	Ck(err)
 	lock = flock.New(lockpath)
+	g.lock = lock
+	g.readonly = readonly
 	if readonly {
 		// get a shared lock
 		Debug("locking %s ro...", lockpath)
@@ -394,7 +1655,6 @@ func LoadFrom(grokpath string, newModel string, readonly bool) (g *Grokker, migr
 		Ck(err)
 	} else {
 		// get an exclusive lock
-		lock = flock.New(lockpath)
 		Debug("locking %s rw...", lockpath)
 		err = lock.Lock()
 		Ck(err)
@@ -404,8 +1664,22 @@ func LoadFrom(grokpath string, newModel string, readonly bool) (g *Grokker, migr
 	Ck(err)
 	buf, err := ioutil.ReadAll(fh)
 	Ck(err)
+	err = fh.Close()
+	Ck(err)
+	// detect compressed dbs by the gzip magic number, so that
+	// uncompressed dbs from older versions still load
+	if bytes.HasPrefix(buf, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		Ck(err)
+		buf, err = ioutil.ReadAll(zr)
+		Ck(err)
+	}
 	err = json.Unmarshal(buf, g)
 	Ck(err)
+	rewrite, err := g.replayJournal()
+	Ck(err)
+	err = g.decodeEmbeddings()
+	Ck(err)
 	// set the root directory, overriding whatever was in the db
 	// - this is necessary because the db might have been moved
 	g.Root, err = filepath.Abs(filepath.Dir(g.grokpath))
@@ -413,6 +1687,12 @@ func LoadFrom(grokpath string, newModel string, readonly bool) (g *Grokker, migr
 
 	migrated, oldver, newver, err = g.migrate()
 	Ck(err)
+	// a migrated db or a damaged or stale journal needs a full
+	// rewrite
+	if !migrated && !rewrite {
+		err = g.markSaved()
+		Ck(err)
+	}
 
 	// XXX this is janky -- we're getting the model from the db, but
 	// then in Setup() we're setting it in the db.
@@ -427,15 +1707,19 @@ func LoadFrom(grokpath string, newModel string, readonly bool) (g *Grokker, migr
 	return
 }
 
+// Option configures a Grokker as Init or Load makes it, before it
+// sends any request; see WithHTTPClient.
+type Option func(*Grokker)
+
 // Init creates a Grokker database in the given root directory.
-func Init(rootdir, model string) (g *Grokker, err error) {
+func Init(rootdir, model string, opts ...Option) (g *Grokker, err error) {
 	defer Return(&err)
-	g, err = InitNamed(rootdir, ".grok", model)
+	g, err = InitNamed(rootdir, ".grok", model, opts...)
 	return
 }
 
 // InitNamed creates a named Grokker database in the given root directory.
-func InitNamed(rootdir, name, model string) (g *Grokker, err error) {
+func InitNamed(rootdir, name, model string, opts ...Option) (g *Grokker, err error) {
 	// ensure rootdir is absolute and exists
 	rootdir, err = filepath.Abs(rootdir)
 	Ck(err)
@@ -443,12 +1727,18 @@ func InitNamed(rootdir, name, model string) (g *Grokker, err error) {
 	Ck(err)
 	// create the db
 	g = &Grokker{
-		Root:    rootdir,
-		Version: Version,
+		Root:            rootdir,
+		Version:         Version,
+		EmbeddingFormat: DefaultEmbeddingFormat,
+		Migrations:      []Migration{{Time: time.Now().Unix(), To: Version}},
+	}
+	for _, opt := range opts {
+		opt(g)
 	}
 	// initialize other bits
 	err = g.Setup(model)
 	Ck(err)
+	g.lookupTokenLimit(g.ModelObj)
 	// ensure there is no existing db
 	g.grokpath = filepath.Join(rootdir, name)
 	_, err = os.Stat(g.grokpath)
@@ -468,21 +1758,41 @@ func InitNamed(rootdir, name, model string) (g *Grokker, err error) {
 }
 
 // Load loads a Grokker database from the current or any parent directory.
-func Load(newModel string, readonly bool) (g *Grokker, migrated bool, oldver, newver string, lock *flock.Flock, err error) {
+func Load(newModel string, readonly bool, opts ...Option) (g *Grokker, migrated bool, oldver, newver string, lock *flock.Flock, err error) {
 	defer Return(&err)
+	wd, err := os.Getwd()
+	Ck(err)
+	grokpath, err := FindGrokDB(wd)
+	Ck(err)
+	g, migrated, oldver, newver, lock, err = LoadFrom(grokpath, newModel, readonly, opts...)
+	Ck(err)
+	return
+}
 
-	// find the .grok file in the current or any parent directory
-	grokfnbase := ".grok"
-	grokpath := ""
-	for level := 0; level < 99; level++ {
-		path := strings.Repeat("../", level) + grokfnbase
-		if _, err := os.Stat(path); err == nil {
-			grokpath = path
+// FindGrokDB returns the path of the .grok file in startDir or the
+// nearest of its parent directories, the way git finds .git, so that
+// commands work from anywhere in the document tree.  It returns an
+// error wrapping ErrDBNotFound if there is none.
+func FindGrokDB(startDir string) (grokpath string, err error) {
+	defer Return(&err)
+	dir, err := filepath.Abs(startDir)
+	Ck(err)
+	for {
+		path := filepath.Join(dir, ".grok")
+		fi, err := os.Stat(path)
+		if err == nil && !fi.IsDir() {
+			return path, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			Ck(err)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
 			break
 		}
+		dir = parent
 	}
-	g, migrated, oldver, newver, lock, err = LoadFrom(grokpath, newModel, readonly)
-	Ck(err)
+	err = fmt.Errorf("%w in %s or any parent directory -- try 'grok init'", ErrDBNotFound, startDir)
 	return
 }
 
@@ -494,8 +1804,23 @@ func (g *Grokker) ListModels() (models []*Model) {
 // SetModel sets the default chat completion model for queries.
 func (g *Grokker) SetModel(model string) (oldModel string, err error) {
 	defer Return(&err)
-	model, _, err = g.models.FindModel(model)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	oldModel, err = g.setModel(model)
 	Ck(err)
+	g.lookupTokenLimit(g.ModelObj)
+	return
+}
+
+// setModel is SetModel without the token limit lookup.  The caller
+// must hold g.mu for writing.
+func (g *Grokker) setModel(model string) (oldModel string, err error) {
+	defer Return(&err)
+	model, m, err := g.models.FindModel(model)
+	Ck(err)
+	if m.deprecated {
+		Fpf(os.Stderr, "warning: model %s is deprecated by its provider\n", model)
+	}
 	oldModel, _, err = g.GetModel()
 	Ck(err)
 	err = g.Setup(model)
@@ -503,13 +1828,13 @@ func (g *Grokker) SetModel(model string) (oldModel string, err error) {
 	return
 }
 
-// GitCommitMessage generates a git commit message given a diff. It
-// appends a reasonable prompt, and then uses the result as a grokker
-// query.
-func (g *Grokker) GitCommitMessage(modelName string, args ...string) (msg string, err error) {
+// GitCommitMessage generates a git commit message for the output of
+// `git diff` run with args, e.g. "--staged".  See
+// GitCommitMessageFromDiff.
+func (g *Grokker) GitCommitMessage(modelName string, opts GitCommitOpts, args ...string) (msg string, err error) {
 	defer Return(&err)
 
-	Debug("GitCommitMessage(%s, %v)", modelName, args)
+	Debug("GitCommitMessage(%s, %+v, %v)", modelName, opts, args)
 
 	// run `git diff @args
 	args = append([]string{"diff"}, args...)
@@ -517,48 +1842,53 @@ func (g *Grokker) GitCommitMessage(modelName string, args ...string) (msg string
 	cmd.Stderr = os.Stderr
 	out, err := cmd.Output()
 	Ck(err)
-	diff := string(out)
+	msg, err = g.GitCommitMessageFromDiff(modelName, string(out), opts)
+	Ck(err)
+	return
+}
 
-	if false {
-		// summarize the diff
-		sumLines, msg, err := g.summarizeDiff(modelName, diff)
-		Ck(err)
+// GitCommitMessageFromDiff generates a git commit message given a
+// diff, such as the output of `git diff --staged`.  It appends a
+// reasonable prompt, and then uses the result as a grokker query.  The
+// opts control the subject length, body, and tone of the message.  A
+// diff too large for the model is summarized file by file first; see
+// GitCommitOpts.MaxSummaryCalls.  It returns an error wrapping
+// ErrEmptyDiff or ErrNotDiff, without calling the model, if diff is
+// empty or isn't a diff.
+func (g *Grokker) GitCommitMessageFromDiff(modelName, diff string, opts GitCommitOpts) (msg string, err error) {
+	defer Return(&err)
+	err = checkDiff(diff)
+	Ck(err)
+	if opts.Language == "" {
+		opts.Language = g.Language
+	}
 
-		// summarize the sumLines to create the first line of the commit
-		// message
-		// resp, err := g.generate(SysMsgChat, GitSummaryPrompt, sumLines, false)
-		// Ck(err)
-		_ = sumLines
-		//
-		// summarize the entire commit message to create the first line
-		summary, err := g.AnswerWithRAG(modelName, SysMsgChat, GitSummaryPrompt, msg, false)
+	// a diff too large to send whole is summarized piece by piece
+	// first, within the budget given by opts
+	_, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	tc, err := g.TokenCount(diff)
+	Ck(err)
+	if tc > gitDiffTokens(m) {
+		_, diff, err = g.summarizeDiff(modelName, diff, opts)
 		Ck(err)
-
-		// glue it all together
-		msg = Spf("%s\n\n%s", summary, msg)
 	}
 
-	if true {
-		// experimental: take advantage of more modern models that have
-		// larger context windows and know what a commit message is
-		sysmsg := "Write a git commit message for the given diff. Use present tense, active, imperative statements as if giving directions.  Do not use extra adjectives or marketing hype.  The first line of the commit message must be a summary of 60 characters or less, followed by a blank line, followed by bullet-pointed details.  Make a separate bullet list for each changed file."
-
-		// Yes, we're giving the model the instructions twice -- once in the
-		// sysmsg and once in the prompt.
-		userMsg := Spf("%s\n\n%s", sysmsg, diff)
+	sysmsg := gitCommitSysmsg(opts)
 
-		msgs := []client.ChatMsg{
-			client.ChatMsg{
-				Role:    "User",
-				Content: userMsg,
-			},
-		}
+	// Yes, we're giving the model the instructions twice -- once in the
+	// sysmsg and once in the prompt.
+	userMsg := Spf("%s\n\n%s", sysmsg, diff)
 
-		res, _, err := g.CompleteChat(modelName, sysmsg, msgs)
-		Ck(err)
-		msg = res
+	msgs := []client.ChatMsg{
+		client.ChatMsg{
+			Role:    "User",
+			Content: userMsg,
+		},
 	}
 
+	msg, _, err = g.completeChat(context.Background(), modelName, sysmsg, msgs, g.textOptions())
+	Ck(err)
 	return
 }
 
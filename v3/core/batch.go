@@ -0,0 +1,161 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// DefaultBatchWorkers is the default of BatchOpts.Workers.
+const DefaultBatchWorkers = 4
+
+// BatchOpts contains options for AnswerBatch.
+type BatchOpts struct {
+	// ModelName is the chat model to use.  If empty, the current
+	// default model is used.
+	ModelName string
+	// WithHeaders and WithLineNumbers format the context as for
+	// Answer.
+	WithHeaders     bool
+	WithLineNumbers bool
+	// Global includes results from the model's global knowledge as
+	// well as from local documents.
+	Global bool
+	// Workers is the most questions answered at once.  Zero means
+	// DefaultBatchWorkers; 1 answers one question at a time.
+	Workers int
+}
+
+// AnswerBatch answers each of questions as AnswerResult does and
+// returns the results in the same order.  The questions are embedded
+// together, in as few embedding requests as possible, and up to
+// opts.Workers of them are answered at once.  Questions that can't be
+// answered get a nil result and are reported in a *BatchError; the
+// rest are answered anyway.  Progress is reported through
+// Grokker.Progress, with each question as the current document.
+func (g *Grokker) AnswerBatch(questions []string, opts BatchOpts) (results []*Result, err error) {
+	defer Return(&err)
+	modelName := opts.ModelName
+	if modelName == "" {
+		modelName = g.Model
+	}
+	_, _, err = g.models.FindModel(modelName)
+	Ck(err)
+	results = make([]*Result, len(questions))
+	if len(questions) == 0 {
+		return
+	}
+
+	ctx, err := g.embedBatch(context.Background(), questions)
+	if errors.Is(err, ErrEmbeddingAPI) && opts.Global {
+		// each question can still be answered from global
+		// knowledge; see AnswerImages
+		ctx, err = context.Background(), nil
+	}
+	Ck(err)
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultBatchWorkers
+	}
+	errs := make([]error, len(questions))
+	var mu sync.Mutex
+	var started, done int
+	// next returns the index of the next question to answer, or -1
+	// if there are none left
+	next := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		if started == len(questions) {
+			return -1
+		}
+		i := started
+		started++
+		g.progress(done, len(questions), questions[i])
+		return i
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(questions)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := next(); i >= 0; i = next() {
+				res, err := g.answerImages(ctx, modelName, questions[i], nil, opts.WithHeaders, opts.WithLineNumbers, opts.Global)
+				mu.Lock()
+				results[i], errs[i] = res, err
+				done++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	g.progress(len(questions), len(questions), "")
+
+	var failed []QuestionError
+	for i, e := range errs {
+		if e != nil {
+			failed = append(failed, QuestionError{Index: i, Question: questions[i], Err: e})
+		}
+	}
+	if len(failed) > 0 {
+		err = &BatchError{Failed: failed}
+	}
+	return
+}
+
+// batchEmbeddings holds the embeddings of the questions of one
+// AnswerBatch call, along with the retrieval settings they were made
+// with, so that they aren't used if the settings change mid-batch.
+type batchEmbeddings struct {
+	embeddings     map[string][]float64
+	embeddingModel string
+	retrievalModel string
+	projection     *Projection
+}
+
+// batchEmbeddingsKey is the context key for a *batchEmbeddings.
+type batchEmbeddingsKey struct{}
+
+// embedBatch embeds questions together and returns a copy of ctx
+// that carries their embeddings to questionEmbedding.
+func (g *Grokker) embedBatch(ctx context.Context, questions []string) (out context.Context, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	embeddings, err := g.queryEmbeddings(questions)
+	Ck(err)
+	retrievalModel, err := g.retrievalModel()
+	Ck(err)
+	batch := &batchEmbeddings{
+		embeddings:     make(map[string][]float64),
+		embeddingModel: g.embeddingModel(),
+		retrievalModel: retrievalModel,
+		projection:     g.Projection,
+	}
+	for i, question := range questions {
+		batch.embeddings[question] = embeddings[i]
+	}
+	out = context.WithValue(ctx, batchEmbeddingsKey{}, batch)
+	return
+}
+
+// questionEmbedding is like queryEmbedding, but reuses the embedding
+// made by embedBatch if ctx carries one for question and the
+// retrieval settings haven't changed since.  The caller must hold
+// g.mu for reading.
+func (g *Grokker) questionEmbedding(ctx context.Context, question string) (embedding []float64, err error) {
+	batch, ok := ctx.Value(batchEmbeddingsKey{}).(*batchEmbeddings)
+	if ok {
+		retrievalModel, err := g.retrievalModel()
+		if err != nil {
+			return nil, err
+		}
+		embedding, found := batch.embeddings[question]
+		if found && batch.embeddingModel == g.embeddingModel() && batch.retrievalModel == retrievalModel && batch.projection == g.Projection {
+			return embedding, nil
+		}
+	}
+	return g.queryEmbedding(question)
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// echoChat is a client.ChatClient that replies with the last message
+// it was sent, and records the most requests it handled at once.
+type echoChat struct {
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (c *echoChat) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	c.mu.Lock()
+	c.active++
+	c.maxActive = max(c.maxActive, c.active)
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+	results.Body = messages[len(messages)-1].Content
+	return
+}
+
+func TestAnswerBatch(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &batchCountingEmbedder{}
+	grok.SetEmbedder(embedder)
+	err = grok.AddReader("notes.txt", strings.NewReader("first note\n\nsecond note\n"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chat := &echoChat{}
+	grok.SetChatClient("openai", chat)
+	var questions []string
+	for i := 0; i < 7; i++ {
+		questions = append(questions, fmt.Sprintf("question number %d?", i))
+	}
+
+	embedder.sizes = nil
+	results, err := grok.AnswerBatch(questions, BatchOpts{Workers: 3})
+	Tassert(t, err == nil, "error answering batch: %v", err)
+	Tassert(t, len(embedder.sizes) == 1 && embedder.sizes[0] == len(questions), "expected one embedding request for every question, got %v", embedder.sizes)
+	Tassert(t, len(results) == len(questions), "expected %d results, got %d", len(questions), len(results))
+	for i, res := range results {
+		Tassert(t, strings.Contains(res.Answer, questions[i]), "result %d out of order: %q", i, res.Answer)
+		Tassert(t, len(res.Sources) == 1, "expected a source for result %d, got %v", i, res.Sources)
+	}
+	Tassert(t, chat.maxActive > 1 && chat.maxActive <= 3, "expected 2 or 3 requests at once, got %d", chat.maxActive)
+
+	// the batch's embeddings are only used while the retrieval
+	// settings they were made with are unchanged
+	ctx, err := grok.embedBatch(context.Background(), questions[:1])
+	Tassert(t, err == nil, "error embedding batch: %v", err)
+	embedding := func() []float64 {
+		grok.mu.RLock()
+		defer grok.mu.RUnlock()
+		embedder.sizes = nil
+		embedding, err := grok.questionEmbedding(ctx, questions[0])
+		Tassert(t, err == nil, "error embedding question: %v", err)
+		return embedding
+	}
+	Tassert(t, len(embedding()) == 3 && len(embedder.sizes) == 0, "expected the batch's embedding, got %v", embedder.sizes)
+	err = grok.SetEmbeddingDims(2)
+	Tassert(t, err == nil, "error setting dimensions: %v", err)
+	Tassert(t, len(embedding()) == 2 && len(embedder.sizes) == 1, "expected a new projected embedding, got %v", embedder.sizes)
+	err = grok.SetEmbeddingDims(0)
+	Tassert(t, err == nil, "error setting dimensions: %v", err)
+
+	// failed questions are reported without stopping the rest
+	grok.MinRelevance = 2
+	results, err = grok.AnswerBatch(questions[:2], BatchOpts{})
+	var batchErr *BatchError
+	Tassert(t, errors.As(err, &batchErr), "expected a BatchError, got %v", err)
+	Tassert(t, len(batchErr.Failed) == 2 && batchErr.Failed[1].Index == 1, "unexpected failures %v", batchErr.Failed)
+	Tassert(t, errors.Is(err, ErrNoRelevantContext), "expected ErrNoRelevantContext, got %v", err)
+	Tassert(t, len(results) == 2 && results[0] == nil && results[1] == nil, "expected nil results, got %v", results)
+
+	_, err = grok.AnswerBatch(questions, BatchOpts{ModelName: "no-such-model"})
+	Tassert(t, errors.Is(err, ErrModelNotFound), "expected ErrModelNotFound, got %v", err)
+}
@@ -1,14 +1,16 @@
 package core
 
 import (
+	"container/heap"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"os"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
 	. "github.com/stevegt/goadapt"
 	"github.com/stevegt/grokker/v3/util"
@@ -22,14 +24,40 @@ type Chunk struct {
 	Offset int
 	// The length of the chunk in the document.
 	Length int
-	// XXX store tokenLength in database and stop recomputing it
-	tokenLength int
+	// Line and EndLine are the first and last lines of the document
+	// that the chunk spans, counting from 1, for showing where it
+	// came from.  Lines of a document added with a byte Span count
+	// from the start of the span.  Zero means unknown, e.g. for
+	// chunks made by older versions; see chunkLines.
+	Line    int `json:",omitempty"`
+	EndLine int `json:",omitempty"`
+	// Tokens is the number of tokens in the text of the chunk,
+	// counted with Tokenizer when the chunk is added to the db.  Zero
+	// means not yet counted.
+	Tokens int `json:",omitempty"`
 	// sha256 hash of the text of the chunk.
 	Hash string
+	// TextHash is the sha256 hash of the text of the chunk alone,
+	// without its document's path, so that chunks with the same text
+	// in different documents can share an embedding; see
+	// Grokker.ShareEmbeddings.  It is empty for chunks made by older
+	// versions until their documents are updated or refreshed.
+	TextHash string `json:",omitempty"`
 	// The text of the chunk.  This is not stored in the db.
 	text string
 	// The embedding of the chunk.
-	Embedding []float64
+	Embedding []float64 `json:",omitempty"`
+	// Embeddings holds the chunk's embeddings from each of
+	// Grokker.AltEmbeddingModels, keyed by model name, so that
+	// retrieval can be compared across models; see
+	// AddEmbeddingModel.
+	Embeddings map[string][]float64 `json:",omitempty"`
+	// Vec is the embedding encoded in the database's
+	// EmbeddingFormat.  It is only set while the database is being
+	// saved or loaded.
+	Vec string `json:",omitempty"`
+	// Vecs are the Embeddings encoded like Vec.
+	Vecs map[string]string `json:",omitempty"`
 	// The grokker that this chunk belongs to.
 	// g *Grokker
 	// true if needs to be garbage collected
@@ -41,11 +69,13 @@ type Chunk struct {
 // not compute the embedding or add the chunk to the db.
 func newChunk(doc *Document, offset, length int, text string) (c *Chunk) {
 	var prefixedText string
-	var hashStr string
+	var hashStr, textHashStr string
 	if doc != nil {
 		prefixedText = fmt.Sprintf("from %s:\n%s\n", doc.RelPath, text)
 		hash := sha256.Sum256([]byte(prefixedText))
 		hashStr = hex.EncodeToString(hash[:])
+		textHash := sha256.Sum256([]byte(text))
+		textHashStr = hex.EncodeToString(textHash[:])
 	}
 	c = &Chunk{
 		// g:        g,
@@ -53,12 +83,38 @@ func newChunk(doc *Document, offset, length int, text string) (c *Chunk) {
 		Offset:   offset,
 		Length:   length,
 		Hash:     hashStr,
+		TextHash: textHashStr,
 		text:     text,
 	}
 	// Debug("NewChunk: %#v", c)
 	return
 }
 
+// setLines records the lines a chunk spans, given the line its text
+// starts on.  Trailing newlines, such as the blank line ending a
+// paragraph, don't count.
+func (chunk *Chunk) setLines(line int, text string) {
+	chunk.Line = line
+	chunk.EndLine = line + strings.Count(strings.TrimRight(text, "\n"), "\n")
+}
+
+// chunkLines returns the lines of its document that a chunk spans,
+// as recorded when it was made or, for chunks made by older
+// versions, counted now.  Both are zero if the document has been
+// removed.
+func (g *Grokker) chunkLines(c *Chunk) (line, endLine int, err error) {
+	if c.Line > 0 {
+		return c.Line, c.EndLine, nil
+	}
+	buf, start, stop, err := g.docSpan(c)
+	if err != nil || buf == nil {
+		return
+	}
+	var lines Chunk
+	lines.setLines(strings.Count(string(buf[:start]), "\n")+c.Document.Span.firstLine(), string(buf[start:stop]))
+	return lines.Line, lines.EndLine, nil
+}
+
 // splitChunk recursively splits a Chunk into smaller chunks until
 // each chunk is no longer than the token limit.
 func (chunk *Chunk) splitChunk(g *Grokker, tokenLimit int) (newChunks []*Chunk, err error) {
@@ -72,61 +128,167 @@ func (chunk *Chunk) splitChunk(g *Grokker, tokenLimit int) (newChunks []*Chunk,
 		Debug("chunk is short enough")
 		return
 	}
-	// split chunk into smaller segments of roughly equal size
-	// XXX could be made smarter by splitting on sentence or context boundaries
+	if chunk.Length < 2 {
+		// a single byte can't be split any further
+		newChunks = append(newChunks, chunk)
+		return
+	}
+	// split chunk into smaller segments of roughly equal size, ending
+	// each segment at a sentence or word boundary where possible
 	numChunks := int(math.Ceil(float64(tc) / float64(tokenLimit)))
+	if numChunks < 2 {
+		numChunks = 2
+	}
 	chunkSize := int(math.Ceil(float64(chunk.Length) / float64(numChunks)))
-	Debug("splitting chunk into %d chunks of size %d ...", numChunks, chunkSize)
-	for i := 0; i < numChunks; i++ {
-		start := i * chunkSize
+	var text string
+	if chunk.Document == nil {
+		text = chunk.text
+	} else {
+		// read the document itself; chunkText may add a table
+		// header
+		buf, ok, err := g.readChunk(chunk)
+		Ck(err)
+		if !ok {
+			var start, stop int
+			buf, start, stop, err = g.docSpan(chunk)
+			Ck(err)
+			buf = buf[start:stop]
+		}
+		text = string(buf)
+	}
+	length := chunk.Length
+	if length > len(text) {
+		length = len(text)
+	}
+	Debug("splitting chunk into about %d chunks of size %d ...", numChunks, chunkSize)
+	for start := 0; start < length; {
 		end := start + chunkSize
-		if end > chunk.Length {
-			end = chunk.Length
+		if end >= length {
+			end = length
+		} else {
+			end = splitPoint(text, start, end)
+		}
+		subChunk := newChunk(chunk.Document, chunk.Offset+start, end-start, text[start:end])
+		if chunk.Line > 0 {
+			subChunk.setLines(chunk.Line+strings.Count(text[:start], "\n"), text[start:end])
 		}
-		docOffset := chunk.Offset + start
-		var text string
-		text, err = g.chunkText(chunk, false, false)
-		Ck(err)
-		subChunk := newChunk(chunk.Document, docOffset, end-start, text[start:end])
 		// recurse
-		Debug("splitting subChunk %d of %d ...", i+1, numChunks)
+		Debug("splitting subChunk at offset %d ...", start)
 		var newSubChunks []*Chunk
 		newSubChunks, err = subChunk.splitChunk(g, tokenLimit)
 		Ck(err)
 		newChunks = append(newChunks, newSubChunks...)
+		start = end
 	}
 	return
 }
 
-// chunkText returns the text of a chunk.
-func (g *Grokker) chunkText(c *Chunk, withHeader, withLineNumbers bool) (text string, err error) {
-	// Debug("ChunkText(%#v)", c)
-	if c.Document == nil {
-		Assert(c.text != "", "ChunkText: c.Document == nil && c.text == \"\"")
-		text = c.text
-		return
+// splitPoint returns the offset at which to end a segment of text
+// that starts at start and would otherwise end at end.  It backs off
+// to the nearest preceding sentence end or, failing that, whitespace,
+// as long as that keeps at least half of the segment.  A segment with
+// no whitespace in that range, such as a single very long token, is
+// cut at end, backed off to the start of a UTF-8 character.
+func splitPoint(text string, start, end int) int {
+	min := start + (end-start)/2
+	if min <= start {
+		min = start + 1
+	}
+	space := -1
+	for i := end - 1; i >= min; i-- {
+		if !isSpace(text[i]) {
+			continue
+		}
+		if strings.IndexByte(".!?", text[i-1]) >= 0 {
+			// end the segment after the whitespace that
+			// follows the sentence
+			return i + 1
+		}
+		if space < 0 {
+			space = i + 1
+		}
 	}
+	if space > 0 {
+		return space
+	}
+	for i := end; i > start; i-- {
+		if utf8.RuneStart(text[i]) {
+			return i
+		}
+	}
+	return end
+}
 
-	// read the chunk from the document
-	var buf []byte
-	buf, err = ioutil.ReadFile(g.absPath(c.Document))
+// isSpace reports whether b is an ASCII whitespace character.
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+// ChunkText returns the text of a chunk as it currently appears in its
+// document.  Chunks of CSV and TSV documents are preceded by the
+// document's header row.
+func (g *Grokker) ChunkText(c *Chunk) (text string, err error) {
+	return g.chunkText(c, false, false)
+}
+
+// docSpan reads a chunk's document and returns its content along with
+// the chunk's start and stop offsets, clamped to the document's
+// current length.  buf is nil if the document has been removed.
+func (g *Grokker) docSpan(c *Chunk) (buf []byte, start, stop int, err error) {
+	buf, err = g.readDocument(c.Document)
 	if os.IsNotExist(err) {
 		// document has been removed; don't remove it from the
 		// database, but don't return any text either.  The
 		// document might be on a different branch in e.g. git.
 		err = nil
+		buf = nil
 		Debug("ChunkText: document %q not found", c.Document.RelPath)
 		return
 	}
-	Ck(err)
-	start := c.Offset
-	stop := c.Offset + c.Length
+	if err != nil {
+		return
+	}
+	start = c.Offset
+	stop = c.Offset + c.Length
 	if start >= len(buf) {
 		start = len(buf) - 1
 	}
 	if stop > len(buf) {
 		stop = len(buf)
 	}
+	return
+}
+
+// chunkText returns the text of a chunk.
+func (g *Grokker) chunkText(c *Chunk, withHeader, withLineNumbers bool) (text string, err error) {
+	// Debug("ChunkText(%#v)", c)
+	if c.Document == nil {
+		Assert(c.text != "", "ChunkText: c.Document == nil && c.text == \"\"")
+		text = c.text
+		return
+	}
+
+	if !withLineNumbers && tableDelimiter(c.Document) == 0 {
+		// read only the chunk's bytes if we can
+		var buf []byte
+		var ok bool
+		buf, ok, err = g.readChunk(c)
+		Ck(err)
+		if ok {
+			text = string(buf)
+			if withHeader && buf != nil {
+				text = fmt.Sprintf("from %s:\n%s\n", c.Document.RelPath, text)
+			}
+			return
+		}
+	}
+
+	// read the chunk from the document
+	buf, start, stop, err := g.docSpan(c)
+	Ck(err)
+	if buf == nil {
+		return
+	}
 	rawText := string(buf[start:stop])
 	if withLineNumbers {
 		// count the lines before start
@@ -135,7 +297,7 @@ func (g *Grokker) chunkText(c *Chunk, withHeader, withLineNumbers bool) (text st
 		// the whole document and store that in the db or at least
 		// cache it during a single grok run.
 		docLines := strings.Split(string(buf[:start]), "\n")
-		startLine := len(docLines)
+		startLine := len(docLines) + c.Document.Span.firstLine() - 1
 		// add line numbers to the text
 		chunkLines := strings.Split(rawText, "\n")
 		for i := startLine; i < startLine+len(chunkLines); i++ {
@@ -147,6 +309,18 @@ func (g *Grokker) chunkText(c *Chunk, withHeader, withLineNumbers bool) (text st
 	} else {
 		text = rawText
 	}
+	// repeat the column names in front of each chunk of a table
+	if delim := tableDelimiter(c.Document); delim != 0 && start > 0 {
+		header := tableHeader(string(buf), delim)
+		if withLineNumbers {
+			var numbered string
+			for i, line := range strings.Split(strings.TrimSuffix(header, "\n"), "\n") {
+				numbered += fmt.Sprintf("%d: %s\n", i+1, line)
+			}
+			header = numbered
+		}
+		text = header + text
+	}
 	if withHeader {
 		text = fmt.Sprintf("from %s:\n%s\n", c.Document.RelPath, text)
 	}
@@ -155,6 +329,31 @@ func (g *Grokker) chunkText(c *Chunk, withHeader, withLineNumbers bool) (text st
 	return
 }
 
+// embeddingText returns the text that is embedded for a chunk: the
+// chunk's text preceded by its document's path and, if
+// g.EmbedHeadings is set and the document is markdown, the headings
+// the chunk falls under, so that queries can match on where a chunk
+// came from as well as what it says.
+func (g *Grokker) embeddingText(c *Chunk) (text string, err error) {
+	defer Return(&err)
+	if !g.EmbedHeadings || !isMarkdown(c.Document) {
+		return g.chunkText(c, true, false)
+	}
+	buf, start, _, err := g.docSpan(c)
+	Ck(err)
+	var breadcrumb string
+	if buf != nil {
+		trail := headingTrail(string(buf[:start]))
+		if len(trail) > 0 {
+			breadcrumb = Spf(" (%s)", strings.Join(trail, " > "))
+		}
+	}
+	text, err = g.chunkText(c, false, false)
+	Ck(err)
+	text = fmt.Sprintf("from %s%s:\n%s\n", c.Document.RelPath, breadcrumb, text)
+	return
+}
+
 // splitIntoChunks splits a string into a slice of chunks using the
 // given delimiter, returning each string as a partially populated
 // Chunk with the offset set to the start of the string.
@@ -186,19 +385,58 @@ func splitIntoChunks(doc *Document, txt, delimiter string) (chunks []*Chunk) {
 	return
 }
 
+// chunkSim is a chunk and its similarity score.
+type chunkSim struct {
+	chunk *Chunk
+	score float64
+}
+
+// simHeap is a min-heap of chunkSims, used to keep the top K.
+type simHeap []chunkSim
+
+func (h simHeap) Len() int            { return len(h) }
+func (h simHeap) Less(i, j int) bool  { return h[i].score < h[j].score }
+func (h simHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *simHeap) Push(x interface{}) { *h = append(*h, x.(chunkSim)) }
+func (h *simHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
 // similarChunks returns the most similar chunks to an embedding,
-// limited by tokenLimit.
+// limited by tokenLimit and by g.contextChunks().
 func (g *Grokker) similarChunks(embedding []float64, tokenLimit int, files []string) (chunks []*Chunk, err error) {
-	defer Return(&err)
-	Debug("chunks in database: %d", len(g.Chunks))
-	// Assert(tokenLimit > 100, tokenLimit)
-	// find the most similar chunks.
-	type Sim struct {
-		chunk *Chunk
-		score float64
+	weights := g.docWeights()
+	score := func(chunk *Chunk) float64 {
+		return weights.apply(chunk, g.chunkScore(embedding, chunk))
 	}
-	sims := make([]Sim, 0, len(g.Chunks))
+	return g.rankedChunks(score, tokenLimit, files)
+}
+
+// rankedChunks returns the highest scoring chunks, limited by
+// tokenLimit and by g.contextChunks().
+func (g *Grokker) rankedChunks(score func(*Chunk) float64, tokenLimit int, files []string) (chunks []*Chunk, err error) {
+	return g.budgetChunks(g.topChunks(score, g.contextChunks(), files), tokenLimit)
+}
+
+// topChunks returns the K highest scoring chunks, highest first,
+// using a heap so that large databases don't sort every chunk.  If
+// files is not nil, only chunks from those files are considered.
+// Chunks of documents excluded by g.Exclude are never scored.  If
+// g.MaxChunksPerDoc is set, only that many of the highest scoring
+// chunks of each document are considered.
+func (g *Grokker) topChunks(score func(*Chunk) float64, K int, files []string) (top []*Chunk) {
+	Debug("chunks in database: %d", len(g.Chunks))
+	scores := make(map[*Chunk]float64)
+	docSims := make(map[string]*simHeap)
+	perDoc := g.MaxChunksPerDoc
+	excluded := g.excluder()
 	for _, chunk := range g.Chunks {
+		if excluded != nil && excluded(chunk.Document.RelPath) {
+			continue
+		}
 		// skip chunks from other files if files is not nil
 		if files != nil {
 			var found bool
@@ -212,18 +450,56 @@ func (g *Grokker) similarChunks(embedding []float64, tokenLimit int, files []str
 				continue
 			}
 		}
-		score := util.Similarity(embedding, chunk.Embedding)
-		sims = append(sims, Sim{chunk, score})
+		scores[chunk] = score(chunk)
+		if perDoc <= 0 {
+			continue
+		}
+		// keep the best perDoc chunks of each document
+		path := chunk.Document.RelPath
+		docHeap, ok := docSims[path]
+		if !ok {
+			docHeap = &simHeap{}
+			docSims[path] = docHeap
+		}
+		heap.Push(docHeap, chunkSim{chunk, scores[chunk]})
+		if docHeap.Len() > perDoc {
+			dropped := heap.Pop(docHeap).(chunkSim)
+			delete(scores, dropped.chunk)
+		}
+	}
+	sims := make(simHeap, 0, K+1)
+	for _, chunk := range g.Chunks {
+		score, ok := scores[chunk]
+		if !ok {
+			continue
+		}
+		if len(sims) == K && score <= sims[0].score {
+			continue
+		}
+		heap.Push(&sims, chunkSim{chunk, score})
+		if len(sims) > K {
+			heap.Pop(&sims)
+		}
 	}
 	// sort the chunks by similarity.
 	sort.Slice(sims, func(i, j int) bool {
 		return sims[i].score > sims[j].score
 	})
+	for _, sim := range sims {
+		top = append(top, sim.chunk)
+	}
+	return
+}
+
+// budgetChunks returns the leading chunks of candidates that fit in
+// tokenLimit, splitting any that are too big.
+func (g *Grokker) budgetChunks(candidates []*Chunk, tokenLimit int) (chunks []*Chunk, err error) {
+	defer Return(&err)
+	// Assert(tokenLimit > 100, tokenLimit)
 	// collect the top chunks until we pass the token limit
 	var totalTokens int
 	var bigChunks []*Chunk
-	for _, sim := range sims {
-		chunk := sim.chunk
+	for _, chunk := range candidates {
 		tc, err := chunk.tokenCount(g)
 		Ck(err)
 		totalTokens += tc
@@ -252,33 +528,340 @@ func (g *Grokker) similarChunks(embedding []float64, tokenLimit int, files []str
 			break
 		}
 	}
-	Debug("sims len: %d", len(sims))
+	Debug("candidates: %d", len(candidates))
 	Debug("total tokens: %d", totalTokens)
 	Debug("found %d similar chunks", len(chunks))
 	return
 }
 
+// docWeights holds the weights of documents, keyed by RelPath.
+type docWeights map[string]float64
+
+// docWeights returns the weights of the documents whose weight isn't
+// 1.  Chunks loaded from the db hold their own copies of their
+// documents, so weights are looked up by path in g.Documents.
+func (g *Grokker) docWeights() (weights docWeights) {
+	weights = make(docWeights)
+	for _, doc := range g.Documents {
+		if doc.weight() != 1 {
+			weights[doc.RelPath] = doc.weight()
+		}
+	}
+	return
+}
+
+// apply returns score multiplied by the weight of chunk's document.
+// Only positive scores are weighted, so that a weight above 1 can't
+// push a dissimilar chunk further down or a -Inf score up.
+func (w docWeights) apply(chunk *Chunk, score float64) float64 {
+	weight, ok := w[chunk.Document.RelPath]
+	if !ok || score <= 0 {
+		return score
+	}
+	return score * weight
+}
+
+// chunkScore returns the similarity of a chunk to the query
+// embedding.  Chunks with missing or corrupt embeddings get the lowest
+// possible score, with a warning for corrupt ones, so they can't
+// outrank good chunks.
+func (g *Grokker) chunkScore(embedding []float64, chunk *Chunk) float64 {
+	vector := g.vector(chunk)
+	if vector == nil {
+		return math.Inf(-1)
+	}
+	err := validateEmbedding(vector, len(embedding))
+	if err != nil {
+		Fpf(os.Stderr, "warning: chunk at offset %d of %s: %v -- try 'grok refresh'\n", chunk.Offset, chunk.Document.RelPath, err)
+		return math.Inf(-1)
+	}
+	return g.similarity(embedding, vector)
+}
+
+// validateEmbedding returns an error if embedding doesn't have dims
+// dimensions, contains NaN or Inf values, or is all zeros.
+func validateEmbedding(embedding []float64, dims int) (err error) {
+	if len(embedding) != dims {
+		return fmt.Errorf("embedding has %d dimensions, expected %d", len(embedding), dims)
+	}
+	zero := true
+	for _, v := range embedding {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("embedding contains %v", v)
+		}
+		if v != 0 {
+			zero = false
+		}
+	}
+	if zero {
+		return fmt.Errorf("embedding is all zeros")
+	}
+	return
+}
+
+// embeddingDims returns the number of dimensions of the embeddings in
+// the database, or 0 if there are none.
+func (g *Grokker) embeddingDims() int {
+	for _, chunk := range g.Chunks {
+		if chunk.Embedding != nil {
+			return len(chunk.Embedding)
+		}
+	}
+	return 0
+}
+
 // findChunks returns the most relevant chunks for a query, limited by tokenLimit.
 func (g *Grokker) findChunks(query string, tokenLimit int, files []string) (chunks []*Chunk, err error) {
+	chunks, _, err = g.retrieve(context.Background(), query, tokenLimit, files, false, false, false)
+	return
+}
+
+// retrieve is like findChunks, but if explain is true it also returns
+// every candidate chunk, marking those that fit in tokenLimit.  If
+// g.FitContext is set, chunks are measured as chunkText formats them
+// with withHeaders and withLineNumbers; see fitChunks.  The chat
+// requests made for HyDE, query expansion, and reranking give up
+// when ctx is done.
+func (g *Grokker) retrieve(ctx context.Context, query string, tokenLimit int, files []string, withHeaders, withLineNumbers, explain bool) (chunks []*Chunk, explained []RetrievedChunk, err error) {
 	defer Return(&err)
-	// break the query into chunks.
-	queryChunks, err := g.chunksFromString(nil, query, g.EmbeddingTokenLimit)
+	err = g.checkExclude()
 	Ck(err)
-	// get the embeddings for the chunks.
-	var queryStrings []string
-	for _, chunk := range queryChunks {
-		queryStrings = append(queryStrings, chunk.text)
+	_, err = g.retrievalModel()
+	Ck(err)
+	queryEmbedding, err := g.questionEmbedding(ctx, query)
+	Ck(err)
+	if queryEmbedding == nil {
+		return
+	}
+	if g.HyDE {
+		queryEmbedding, err = g.hydeEmbedding(ctx, query, queryEmbedding)
+		Ck(err)
 	}
-	embeddings, err := g.createEmbeddings(queryStrings)
+	// find the most similar chunks to the query or any of its
+	// variants.
+	variants, err := g.expandQuery(ctx, query)
+	Ck(err)
+	score, err := g.expandedScorer(query, queryEmbedding, variants)
 	Ck(err)
-	if len(embeddings) == 0 {
+	var candidates []*Chunk
+	switch {
+	case g.Rerank:
+		candidates = g.topChunks(score, g.rerankCandidates(), files)
+		candidates, err = g.rerank(ctx, query, candidates)
+		Ck(err)
+	case g.FitContext:
+		candidates = g.topChunks(score, len(g.Chunks), files)
+	default:
+		candidates = g.topChunks(score, g.contextChunks(), files)
+	}
+	relevant := g.relevantChunks(candidates, score)
+	if g.FitContext {
+		var considered int
+		chunks, considered, err = g.fitChunks(relevant, tokenLimit, withHeaders, withLineNumbers)
+		Ck(err)
+		candidates = relevant[:considered]
+	} else {
+		chunks, err = g.budgetChunks(g.dedupChunks(relevant, g.DedupThreshold), tokenLimit)
+		Ck(err)
+	}
+	if explain {
+		explained, err = g.explainChunks(candidates, chunks, score)
+		Ck(err)
+	}
+	return
+}
+
+// fitChunks returns as many of candidates, in order, as fit in
+// tokenLimit tokens when formatted by chunkText with withHeaders and
+// withLineNumbers, stopping at the first that doesn't fit rather than
+// cutting it short, and skipping near duplicates as dedupChunks does.
+// Only the first candidate is cut to fit if it is larger than the
+// whole budget, so that there is some context.  considered is the
+// number of candidates looked at, including the one that didn't fit.
+func (g *Grokker) fitChunks(candidates []*Chunk, tokenLimit int, withHeaders, withLineNumbers bool) (chunks []*Chunk, considered int, err error) {
+	defer Return(&err)
+	var totalTokens int
+	for _, candidate := range candidates {
+		considered++
+		if g.duplicate(candidate, chunks, g.DedupThreshold) {
+			continue
+		}
+		text, err := g.chunkText(candidate, withHeaders, withLineNumbers)
+		Ck(err)
+		tokens, err := g.tokens(text)
+		Ck(err)
+		if totalTokens+len(tokens) > tokenLimit {
+			if len(chunks) == 0 {
+				chunks, err = g.budgetChunks([]*Chunk{candidate}, tokenLimit)
+				Ck(err)
+			}
+			break
+		}
+		totalTokens += len(tokens)
+		chunks = append(chunks, candidate)
+	}
+	Debug("fit %d of %d candidates in %d tokens", len(chunks), considered, totalTokens)
+	return
+}
+
+// relevantChunks returns the candidates that score at least
+// g.MinRelevance.
+func (g *Grokker) relevantChunks(candidates []*Chunk, score func(*Chunk) float64) (relevant []*Chunk) {
+	if g.MinRelevance == 0 {
+		return candidates
+	}
+	for _, chunk := range candidates {
+		if score(chunk) >= g.MinRelevance {
+			relevant = append(relevant, chunk)
+		}
+	}
+	return
+}
+
+// dedupChunks returns candidates without any chunk whose embedding's
+// cosine similarity to an earlier chunk that was kept is above
+// threshold.  A threshold of zero keeps every chunk.
+func (g *Grokker) dedupChunks(candidates []*Chunk, threshold float64) (kept []*Chunk) {
+	if threshold <= 0 {
+		return candidates
+	}
+	for _, candidate := range candidates {
+		if !g.duplicate(candidate, kept, threshold) {
+			kept = append(kept, candidate)
+		}
+	}
+	return
+}
+
+// duplicate returns true if the cosine similarity of candidate's
+// embedding to that of any of kept is above threshold.  Cosine is used
+// whatever g's metric, since it's direction, not length or distance,
+// that says two embeddings are of the same text, and so that a
+// threshold such as 0.95 means the same for every metric.  A
+// threshold of zero makes no chunk a duplicate.
+func (g *Grokker) duplicate(candidate *Chunk, kept []*Chunk, threshold float64) bool {
+	if threshold <= 0 {
+		return false
+	}
+	for _, chunk := range kept {
+		if util.Similarity(g.vector(candidate), g.vector(chunk)) > threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// RetrievedChunk describes a chunk that was considered as context for
+// a query; see Grokker.ExplainRetrieval.
+type RetrievedChunk struct {
+	// ScoredChunk locates the chunk and gives its score.  Text is
+	// left empty.
+	ScoredChunk
+	// Tokens is the number of tokens in the chunk.
+	Tokens int `json:"tokens"`
+	// Selected is true if the chunk, or the part of it that fit, was
+	// included in the context, and false if it was dropped to stay
+	// within the context budget or as a near duplicate of a chunk
+	// that was used; see Grokker.DedupThreshold.
+	Selected bool `json:"selected"`
+}
+
+// explainChunks returns a RetrievedChunk for each of candidates, in
+// order, marking those that budgetChunks kept in chunks.  Chunks that
+// budgetChunks split are matched by offset.
+func (g *Grokker) explainChunks(candidates, chunks []*Chunk, score func(*Chunk) float64) (explained []RetrievedChunk, err error) {
+	defer Return(&err)
+	for _, candidate := range candidates {
+		tc, err := candidate.tokenCount(g)
+		Ck(err)
+		var selected bool
+		for _, chunk := range chunks {
+			if chunk.Document.RelPath == candidate.Document.RelPath &&
+				chunk.Offset >= candidate.Offset &&
+				chunk.Offset < candidate.Offset+candidate.Length {
+				selected = true
+				break
+			}
+		}
+		line, endLine, err := g.chunkLines(candidate)
+		Ck(err)
+		explained = append(explained, RetrievedChunk{
+			ScoredChunk: ScoredChunk{
+				Path:    candidate.Document.RelPath,
+				Offset:  candidate.Offset,
+				Length:  candidate.Length,
+				Line:    line,
+				EndLine: endLine,
+				Score:   score(candidate),
+				chunk:   candidate,
+			},
+			Tokens:   tc,
+			Selected: selected,
+		})
+	}
+	return
+}
+
+// queryEmbedding returns the embedding of a query, averaging the
+// embeddings of its pieces if it's longer than the embedding token
+// limit.  It returns nil if the query is empty.
+func (g *Grokker) queryEmbedding(query string) (embedding []float64, err error) {
+	embeddings, err := g.queryEmbeddings([]string{query})
+	if err != nil {
 		return
 	}
-	// average the embeddings.
-	queryEmbedding := util.MeanVector(embeddings)
-	// find the most similar chunks.
-	chunks, err = g.similarChunks(queryEmbedding, tokenLimit, files)
+	return embeddings[0], nil
+}
+
+// queryEmbeddings is like queryEmbedding, but embeds several queries
+// with as few embedding requests as possible.
+func (g *Grokker) queryEmbeddings(queries []string) (embeddings [][]float64, err error) {
+	defer Return(&err)
+	// break the queries into chunks, remembering which query each
+	// came from
+	var queryStrings []string
+	var owners []int
+	for i, query := range queries {
+		queryChunks, err := g.chunksFromString(nil, query, g.EmbeddingTokenLimit)
+		Ck(err)
+		for _, chunk := range queryChunks {
+			queryStrings = append(queryStrings, chunk.text)
+			owners = append(owners, i)
+		}
+	}
+	alt, err := g.retrievalModel()
 	Ck(err)
+	var pieces [][]float64
+	if alt == "" {
+		pieces, err = g.createEmbeddings(queryStrings, nil)
+	} else {
+		pieces, err = g.createEmbeddingsWith(g.altEmbedder(alt), queryStrings, nil)
+	}
+	Ck(err)
+	grouped := make([][][]float64, len(queries))
+	for i, piece := range pieces {
+		grouped[owners[i]] = append(grouped[owners[i]], piece)
+	}
+	dims := g.vectorDims()
+	embeddings = make([][]float64, len(queries))
+	for i := range queries {
+		if len(grouped[i]) == 0 {
+			continue
+		}
+		// average the embeddings.
+		embedding := util.MeanVector(grouped[i])
+		// compare in the same space as the stored embeddings, which
+		// are only projected for the embedding model
+		if alt == "" {
+			embedding, err = g.projectEmbedding(embedding)
+			Ck(err)
+		}
+		if dims != 0 && len(embedding) != dims {
+			err = fmt.Errorf("query embedding has %d dimensions but stored embeddings have %d -- try 'grok rebuild'", len(embedding), dims)
+			return
+		}
+		embeddings[i] = embedding
+	}
 	return
 }
 
@@ -300,23 +883,8 @@ func (g *Grokker) stringsFromString(txt string, tokenLimit int) (strings []strin
 // chunk will be no longer than tokenLimit tokens.
 func (g *Grokker) chunksFromString(doc *Document, txt string, tokenLimit int) (chunks []*Chunk, err error) {
 	defer Return(&err)
-	Assert(tokenLimit > 0)
-
-	/*
-		lang, _, _ := Ext2Lang(doc.RelPath)
-		switch lang {
-		case "go":
-			chunks = lang.SplitGo(doc, txt)
-		default:
-			// split the text into paragraphs
-			// XXX splitting on paragraphs is not ideal.  smarter splitting
-			// might look at the structure of the text and split on
-			// sections, chapters, etc.  it might also be useful to include
-			// metadata such as file names.
-			chunks = splitIntoChunks(doc, txt, "\n\n")
-		}
-	*/
-	chunks = splitIntoChunks(doc, txt, "\n\n")
+	chunks, err = g.chunkString(doc, txt, tokenLimit)
+	Ck(err)
 
 	// ensure no chunk is longer than the token limit
 	var newChunks []*Chunk
@@ -331,18 +899,56 @@ func (g *Grokker) chunksFromString(doc *Document, txt string, tokenLimit int) (c
 	return
 }
 
-// chunksFromDoc returns a slice containing the chunks for a document.
-func (g *Grokker) chunksFromDoc(doc *Document) (chunks []*Chunk, err error) {
+// chunkString is like chunksFromString, but returns the chunks as
+// the chunker made them, even if some are longer than tokenLimit.
+func (g *Grokker) chunkString(doc *Document, txt string, tokenLimit int) (chunks []*Chunk, err error) {
 	defer Return(&err)
-	// read the document.
-	buf, err := ioutil.ReadFile(g.absPath(doc))
+	Assert(tokenLimit > 0)
+	// split the text using the chunker for the document's language
+	texts, err := g.chunker(doc).Chunk(doc, txt, tokenLimit)
 	Ck(err)
-	// break the document up into chunks.
-	chunks, err = g.chunksFromString(doc, string(buf), g.EmbeddingTokenLimit)
+	if doc != nil && g.minChunkTokens() > 0 {
+		texts, err = g.mergeRunts(txt, texts, g.minChunkTokens(), tokenLimit)
+		Ck(err)
+	}
+	chunks, err = chunksFromTexts(doc, txt, texts)
 	Ck(err)
-	// add the document to each chunk.
+	return
+}
+
+// chunksFromDoc returns a slice containing the chunks for a document.
+func (g *Grokker) chunksFromDoc(doc *Document) (chunks []*Chunk, err error) {
+	defer Return(&err)
+	// break the document up into chunks, splitting those that are
+	// too long to embed unless the overflow policy says otherwise.
+	// Large plain text documents are chunked as they are read.
+	if g.streamable(doc) {
+		chunks, err = g.streamChunks(doc)
+		Ck(err)
+	} else {
+		var buf []byte
+		buf, err = g.readDocument(doc)
+		Ck(err)
+		if g.embeddingOverflow() == OverflowSplit {
+			chunks, err = g.chunksFromString(doc, string(buf), g.chunkTokens())
+			Ck(err)
+		} else {
+			chunks, err = g.chunkString(doc, string(buf), g.chunkTokens())
+			Ck(err)
+		}
+	}
+	if g.embeddingOverflow() == OverflowError {
+		err = g.checkOverflow(doc, chunks)
+		Ck(err)
+	}
+	// add the document to each chunk, and count lines from the start
+	// of the file rather than of a line span
 	for _, chunk := range chunks {
 		chunk.Document = doc
+		if chunk.Line > 0 {
+			chunk.Line += doc.Span.firstLine() - 1
+			chunk.EndLine += doc.Span.firstLine() - 1
+		}
 	}
 	return
 }
@@ -360,6 +966,9 @@ func (g *Grokker) setChunk(chunk *Chunk) (newChunk *Chunk) {
 			foundChunk = c
 			foundChunk.Offset = chunk.Offset
 			foundChunk.Length = chunk.Length
+			foundChunk.Line = chunk.Line
+			foundChunk.EndLine = chunk.EndLine
+			foundChunk.TextHash = chunk.TextHash
 			foundChunk.stale = false
 		}
 	}
@@ -401,32 +1010,53 @@ func (g *Grokker) gc() (err error) {
 }
 
 // getContext returns the context for a query.
-func (g *Grokker) getContext(query string, tokenLimit int, withHeaders, withLineNumbers bool, files []string) (context string, err error) {
+func (g *Grokker) getContext(query string, tokenLimit int, withHeaders, withLineNumbers bool, files []string) (ctxt string, err error) {
+	ctxt, _, err = g.getContextChunks(query, tokenLimit, withHeaders, withLineNumbers, files)
+	return
+}
+
+// getContextChunks is like getContext, but also returns the chunks
+// the context was built from.
+func (g *Grokker) getContextChunks(query string, tokenLimit int, withHeaders, withLineNumbers bool, files []string) (ctxt string, chunks []*Chunk, err error) {
+	ctxt, chunks, _, err = g.explainContext(context.Background(), query, tokenLimit, withHeaders, withLineNumbers, files, false)
+	return
+}
+
+// explainContext is like getContextChunks, but if explain is true it
+// also returns the candidate chunks; see retrieve.
+func (g *Grokker) explainContext(ctx context.Context, query string, tokenLimit int, withHeaders, withLineNumbers bool, files []string, explain bool) (ctxt string, chunks []*Chunk, explained []RetrievedChunk, err error) {
 	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	// Debug("getting context, tokenLimit: %d, query: %q", tokenLimit, query)
 	// get chunks, sorted by similarity to the query.
-	chunks, err := g.findChunks(query, tokenLimit, files)
+	chunks, explained, err = g.retrieve(ctx, query, tokenLimit, files, withHeaders, withLineNumbers, explain)
 	Ck(err)
 	for _, chunk := range chunks {
 		text, err := g.chunkText(chunk, withHeaders, withLineNumbers)
 		Ck(err)
-		context += text
+		ctxt += text
 	}
 	Debug("using %d chunks as context", len(chunks))
 	return
 }
 
-// tokenCount returns the number of tokens in a chunk, and caches the
-// result in the chunk.
+// tokenCount returns the number of tokens in a chunk, counting them
+// and storing the count in chunk.Tokens if that isn't set yet.
 func (chunk *Chunk) tokenCount(g *Grokker) (count int, err error) {
 	defer Return(&err)
-	if chunk.tokenLength == 0 {
+	g.cacheMu.Lock()
+	count = chunk.Tokens
+	g.cacheMu.Unlock()
+	if count == 0 {
 		text, err := g.chunkText(chunk, false, false)
 		Ck(err)
 		tokens, err := g.tokens(text)
 		Ck(err)
-		chunk.tokenLength = len(tokens)
+		count = len(tokens)
+		g.cacheMu.Lock()
+		chunk.Tokens = count
+		g.cacheMu.Unlock()
 	}
-	count = chunk.tokenLength
 	return
 }
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/util"
+)
+
+// Chunker splits the content of a document into chunks.  The chunks
+// must be non-overlapping substrings of content, in order; gaps
+// between them are allowed and are left out of the database.  Chunks
+// longer than tokenLimit tokens are split further by the caller, so
+// tokenLimit is only a hint.  doc may be nil when the content is not
+// from a stored document, e.g. a query.
+type Chunker interface {
+	Chunk(doc *Document, content string, tokenLimit int) (chunks []string, err error)
+}
+
+// ChunkerFunc adapts an ordinary function to the Chunker interface.
+type ChunkerFunc func(doc *Document, content string, tokenLimit int) ([]string, error)
+
+// Chunk calls f.
+func (f ChunkerFunc) Chunk(doc *Document, content string, tokenLimit int) ([]string, error) {
+	return f(doc, content, tokenLimit)
+}
+
+// ParagraphChunker splits content on blank lines.  It is used for
+// documents that have no chunker registered for their language.
+var ParagraphChunker Chunker = ChunkerFunc(func(doc *Document, content string, tokenLimit int) (chunks []string, err error) {
+	for _, c := range splitIntoChunks(nil, content, "\n\n") {
+		chunks = append(chunks, c.text)
+	}
+	return
+})
+
+var (
+	chunkersMu sync.RWMutex
+	chunkers   = map[string]Chunker{
+		"csv": tableChunker{delimiter: ','},
+		"tsv": tableChunker{delimiter: '\t'},
+	}
+)
+
+// RegisterChunker registers the chunker used for documents of the
+// given language, as returned by util.Ext2Lang; for extensions that
+// Ext2Lang doesn't know, the language is the lowercased extension,
+// e.g. "log".  Registering a nil chunker restores the default.
+func RegisterChunker(lang string, c Chunker) {
+	chunkersMu.Lock()
+	defer chunkersMu.Unlock()
+	if c == nil {
+		delete(chunkers, lang)
+		return
+	}
+	chunkers[lang] = c
+}
+
+// chunkings maps the values of Grokker.Chunking to chunkers.
+var chunkings = map[string]Chunker{
+	"paragraph": ParagraphChunker,
+	"sentence":  SentenceChunker,
+}
+
+// SetChunking sets the chunker used for documents that have no
+// chunker registered for their language: "paragraph" or "sentence".
+// Documents already in the database keep their chunks until they
+// change or the database is rebuilt.
+func (g *Grokker) SetChunking(name string) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.setChunking(name)
+}
+
+// setChunking implements SetChunking.  The caller must hold g.mu for
+// writing.
+func (g *Grokker) setChunking(name string) (err error) {
+	if _, ok := chunkings[name]; !ok {
+		err = fmt.Errorf("unknown chunking %q, want paragraph or sentence", name)
+		return
+	}
+	if name == "paragraph" {
+		name = ""
+	}
+	g.Chunking = name
+	return
+}
+
+// SetChunkTokens sets the most and fewest tokens in a chunk of a
+// document; see ChunkTokens and MinChunkTokens.  Zero means the
+// default for either.  Documents already in the database keep their
+// chunks until they change or the database is rebuilt.
+func (g *Grokker) SetChunkTokens(tokens, minTokens int) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.setChunkTokens(tokens, minTokens)
+}
+
+// setChunkTokens implements SetChunkTokens.  The caller must hold g.mu
+// for writing.
+func (g *Grokker) setChunkTokens(tokens, minTokens int) (err error) {
+	limit := tokens
+	if limit == 0 {
+		limit = g.EmbeddingTokenLimit
+	}
+	switch {
+	case tokens < 0 || tokens > g.EmbeddingTokenLimit:
+		err = fmt.Errorf("chunk tokens must be between 1 and %d, got %d", g.EmbeddingTokenLimit, tokens)
+	case minTokens < 0 || minTokens > limit:
+		err = fmt.Errorf("minimum chunk tokens must be between 0 and %d, got %d", limit, minTokens)
+	}
+	if err != nil {
+		return
+	}
+	g.ChunkTokens = tokens
+	g.MinChunkTokens = minTokens
+	return
+}
+
+// chunker returns the chunker for a document: the one registered for
+// its language if there is one, or else the one named by g.Chunking.
+func (g *Grokker) chunker(doc *Document) Chunker {
+	if c, ok := registeredChunker(doc); ok {
+		return c
+	}
+	if c, ok := chunkings[g.Chunking]; ok {
+		return c
+	}
+	return ParagraphChunker
+}
+
+// chunkerFor returns the chunker registered for a document's
+// language, or ParagraphChunker if there is none.
+func chunkerFor(doc *Document) Chunker {
+	c, ok := registeredChunker(doc)
+	if !ok {
+		return ParagraphChunker
+	}
+	return c
+}
+
+// registeredChunker returns the chunker registered for a document's
+// language, if any.
+func registeredChunker(doc *Document) (c Chunker, ok bool) {
+	if doc == nil {
+		return
+	}
+	lang, _, err := util.Ext2Lang(doc.RelPath)
+	if err != nil {
+		return
+	}
+	chunkersMu.RLock()
+	defer chunkersMu.RUnlock()
+	c, ok = chunkers[lang]
+	return
+}
+
+// mergeRunts returns texts with each text shorter than minTokens
+// joined to its neighbor, along with the content between them, as
+// long as the joined text has no more than tokenLimit tokens.  The
+// texts must be non-overlapping substrings of txt, in order, as
+// returned by a Chunker.
+func (g *Grokker) mergeRunts(txt string, texts []string, minTokens, tokenLimit int) (merged []string, err error) {
+	defer Return(&err)
+	// start and stop are the offsets of merged's last text in txt,
+	// and tc its token count
+	var start, stop, tc int
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+		i := strings.Index(txt[stop:], text)
+		if i < 0 {
+			err = fmt.Errorf("chunker returned text that doesn't follow the previous chunk in the document: %.40q", text)
+			return
+		}
+		textStart := stop + i
+		textStop := textStart + len(text)
+		tokens, err := g.tokens(text)
+		Ck(err)
+		if len(merged) > 0 && (len(tokens) < minTokens || tc < minTokens) {
+			joined, err := g.tokens(txt[start:textStop])
+			Ck(err)
+			if len(joined) <= tokenLimit {
+				stop = textStop
+				tc = len(joined)
+				merged[len(merged)-1] = txt[start:stop]
+				continue
+			}
+		}
+		start, stop, tc = textStart, textStop, len(tokens)
+		merged = append(merged, text)
+	}
+	return
+}
+
+// chunksFromTexts locates each text returned by a chunker in txt and
+// returns the corresponding Chunks.
+func chunksFromTexts(doc *Document, txt string, texts []string) (chunks []*Chunk, err error) {
+	pos := 0
+	// line is the line pos is on
+	line := 1
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+		i := strings.Index(txt[pos:], text)
+		if i < 0 {
+			err = fmt.Errorf("chunker returned text that doesn't follow the previous chunk in the document: %.40q", text)
+			return
+		}
+		offset := pos + i
+		hashText := text
+		if delim := tableDelimiter(doc); delim != 0 && offset > 0 {
+			// the header is embedded with every chunk, so it
+			// must be part of the hash
+			hashText = tableHeader(txt, delim) + text
+		}
+		line += strings.Count(txt[pos:offset], "\n")
+		chunk := newChunk(doc, offset, len(text), hashText)
+		chunk.setLines(line, text)
+		chunks = append(chunks, chunk)
+		line += strings.Count(text, "\n")
+		pos = offset + len(text)
+	}
+	return
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestRegisterChunker(t *testing.T) {
+	// one chunk per log line, skipping blank lines
+	RegisterChunker("log", ChunkerFunc(func(doc *Document, content string, tokenLimit int) (chunks []string, err error) {
+		for _, line := range strings.SplitAfter(content, "\n") {
+			if strings.TrimSpace(line) != "" {
+				chunks = append(chunks, line)
+			}
+		}
+		return
+	}))
+	defer RegisterChunker("log", nil)
+
+	dir := TmpTestDir()
+	fn := filepath.Join(dir, "app.LOG")
+	err := ioutil.WriteFile(fn, []byte("start\n\nconnect db\nstop\n"), 0644)
+	Tassert(t, err == nil, "error writing log: %v", err)
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chunks, err := grok.DocumentChunks("app.LOG")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	Tassert(t, len(chunks) == 3, "expected 3 chunks, got %d", len(chunks))
+	text, err := grok.ChunkText(chunks[1])
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, text == "connect db\n", "unexpected chunk text %q", text)
+
+	// chunks must come from the document, in order
+	RegisterChunker("log", ChunkerFunc(func(doc *Document, content string, tokenLimit int) ([]string, error) {
+		return []string{"stop", "start"}, nil
+	}))
+	_, err = grok.chunksFromString(&Document{RelPath: "x.log"}, "start\nstop\n", 100)
+	Tassert(t, err != nil, "expected error for out-of-order chunks")
+
+	// unregistered types use the paragraph chunker
+	RegisterChunker("log", nil)
+	chunks, err = grok.chunksFromString(&Document{RelPath: "x.log"}, "start\n\nconnect db\nstop\n", 100)
+	Tassert(t, err == nil, "error chunking: %v", err)
+	Tassert(t, len(chunks) == 2, "expected 2 paragraphs, got %d", len(chunks))
+}
+
+func TestMinChunkTokens(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	para := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 5)
+	txt := "Intro.\n\n" + para + "\n\n" + para + "\n\nThe end.\n"
+	doc := &Document{RelPath: "story.txt"}
+	chunks, err := grok.chunksFromString(doc, txt, 1000)
+	Tassert(t, err == nil, "error chunking: %v", err)
+	Tassert(t, len(chunks) == 4, "expected 4 paragraphs, got %d", len(chunks))
+	paraTc, err := chunks[1].tokenCount(grok)
+	Tassert(t, err == nil, "error counting tokens: %v", err)
+
+	// runts at either end are merged into their neighbors
+	err = grok.SetChunkTokens(0, 10)
+	Tassert(t, err == nil, "error setting chunk tokens: %v", err)
+	chunks, err = grok.chunksFromString(doc, txt, 1000)
+	Tassert(t, err == nil, "error chunking: %v", err)
+	Tassert(t, len(chunks) == 2, "expected 2 chunks, got %d", len(chunks))
+	Tassert(t, strings.HasPrefix(chunks[0].text, "Intro.\n\n"+para), "unexpected first chunk %q", chunks[0].text)
+	Tassert(t, strings.HasSuffix(chunks[1].text, "\n\nThe end.\n"), "unexpected last chunk %q", chunks[1].text)
+	Tassert(t, chunks[1].Offset+chunks[1].Length <= len(txt), "last chunk runs past the text")
+
+	// but not if the result would be too big
+	chunks, err = grok.chunksFromString(doc, txt, paraTc+1)
+	Tassert(t, err == nil, "error chunking: %v", err)
+	Tassert(t, len(chunks) == 4, "expected 4 chunks under a tight limit, got %d", len(chunks))
+
+	// the minimum must fit in a chunk
+	err = grok.SetChunkTokens(100, 200)
+	Tassert(t, err != nil, "expected error for a minimum above the maximum")
+	err = grok.SetChunkTokens(-1, 0)
+	Tassert(t, err != nil, "expected error for negative chunk tokens")
+}
+
+func TestRechunk(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	para := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 5)
+	txt := para + "\n\nOne. " + para + "\n\nTwo. " + para + "\n\nThe end.\n"
+	fn := filepath.Join(dir, "story.txt")
+	err = ioutil.WriteFile(fn, []byte(txt), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	embedder := &batchCountingEmbedder{}
+	grok.SetEmbedder(embedder)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Chunks) == 4, "expected 4 chunks, got %d", len(grok.Chunks))
+
+	// only the chunk the runt is merged into is embedded again
+	embedder.texts = nil
+	reused, embedded, err := grok.Rechunk(RechunkOpts{MinChunkTokens: 10})
+	Tassert(t, err == nil, "error rechunking: %v", err)
+	Tassert(t, grok.MinChunkTokens == 10, "expected the setting to be kept, got %d", grok.MinChunkTokens)
+	Tassert(t, reused == 2 && embedded == 1, "expected 2 reused and 1 embedded, got %d and %d", reused, embedded)
+	Tassert(t, len(embedder.texts) == 1 && strings.Contains(embedder.texts[0], "The end."), "unexpected embedded texts %q", embedder.texts)
+	Tassert(t, len(grok.Chunks) == 3, "expected 3 chunks, got %d", len(grok.Chunks))
+
+	// nothing changes the second time
+	reused, embedded, err = grok.Rechunk(RechunkOpts{})
+	Tassert(t, err == nil, "error rechunking: %v", err)
+	Tassert(t, reused == 3 && embedded == 0, "expected 3 reused and 0 embedded, got %d and %d", reused, embedded)
+
+	_, _, err = grok.Rechunk(RechunkOpts{Chunking: "nosuch"})
+	Tassert(t, err != nil, "expected error for unknown chunking")
+}
@@ -0,0 +1,298 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// ConfigFile is the name of the settings file that LoadConfig looks
+// for in the directory holding the db.  Committing it to a repository
+// makes grokker behave the same for everyone who uses the repository.
+const ConfigFile = ".grokconfig"
+
+// Config holds settings read from a .grokconfig file, which is JSON,
+// e.g.
+//
+//	{
+//	    "model": "gpt-4o",
+//	    "context_fraction": 0.4,
+//	    "chunk_tokens": 512,
+//	    "temperature": 0.2,
+//	    "system_prompt": "You are a careful technical writer."
+//	}
+//
+// Each setting can be overridden by an environment variable named
+// after it, e.g. GROKKER_MODEL or GROKKER_CHUNK_TOKENS; values other
+// than strings are given as JSON.  Settings that are not set leave
+// the Grokker unchanged.
+type Config struct {
+	// Model is the default chat model.
+	Model string `json:"model,omitempty"`
+	// ContextFraction sets Grokker.ContextBudgetFraction.
+	ContextFraction float64 `json:"context_fraction,omitempty"`
+	// ContextChunks sets Grokker.ContextChunks.
+	ContextChunks int `json:"context_chunks,omitempty"`
+	// KeywordWeight sets Grokker.KeywordWeight.
+	KeywordWeight *float64 `json:"keyword_weight,omitempty"`
+	// DedupThreshold sets Grokker.DedupThreshold.
+	DedupThreshold float64 `json:"dedup_threshold,omitempty"`
+	// MaxChunksPerDoc sets Grokker.MaxChunksPerDoc.
+	MaxChunksPerDoc int `json:"max_chunks_per_doc,omitempty"`
+	// MinRelevance sets Grokker.MinRelevance.
+	MinRelevance float64 `json:"min_relevance,omitempty"`
+	// AutoGlobal sets Grokker.AutoGlobal.
+	AutoGlobal float64 `json:"auto_global,omitempty"`
+	// MaxFileSize sets Grokker.MaxFileSize.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// RefreshWorkers sets Grokker.RefreshWorkers.
+	RefreshWorkers int `json:"refresh_workers,omitempty"`
+	// EmbeddingTPM sets Grokker.EmbeddingTokensPerMinute.
+	EmbeddingTPM int `json:"embedding_tpm,omitempty"`
+	// EmbeddingRPM sets Grokker.EmbeddingRequestsPerMinute.
+	EmbeddingRPM int `json:"embedding_rpm,omitempty"`
+	// Metric sets the similarity metric; see SetMetric.
+	Metric string `json:"metric,omitempty"`
+	// ChunkTokens sets Grokker.ChunkTokens.
+	ChunkTokens int `json:"chunk_tokens,omitempty"`
+	// MinChunkTokens sets Grokker.MinChunkTokens.
+	MinChunkTokens int `json:"min_chunk_tokens,omitempty"`
+	// Chunking sets the chunker; see SetChunking.
+	Chunking string `json:"chunking,omitempty"`
+	// Temperature sets the sampling temperature of chat requests.
+	Temperature *float32 `json:"temperature,omitempty"`
+	// Seed sets the sampling seed of chat requests.
+	Seed *int `json:"seed,omitempty"`
+	// SystemPrompt sets Grokker.SystemPrompt.
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// Language sets Grokker.Language.
+	Language string `json:"language,omitempty"`
+}
+
+// LoadConfig reads the .grokconfig file in dir, if there is one,
+// applies any GROKKER_* environment variable overrides, and validates
+// the result.  Unknown settings are an error, so that typos don't go
+// unnoticed.  If there is no file and no overrides, the returned
+// Config is empty.
+func LoadConfig(dir string) (cfg *Config, err error) {
+	defer Return(&err)
+	cfg = &Config{}
+	path := filepath.Join(dir, ConfigFile)
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+		Ck(err, "reading %s", path)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	Ck(err)
+	err = cfg.applyEnv()
+	Ck(err)
+	err = cfg.Validate()
+	Ck(err, path)
+	return
+}
+
+// applyEnv overrides the settings in cfg with those given in
+// GROKKER_* environment variables.
+func (cfg *Config) applyEnv() (err error) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		envName := "GROKKER_" + strings.ToUpper(name)
+		val, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		field := v.Field(i).Addr().Interface()
+		if s, ok := field.(*string); ok {
+			*s = val
+			continue
+		}
+		err = json.Unmarshal([]byte(val), field)
+		if err != nil {
+			return fmt.Errorf("%s: %v", envName, err)
+		}
+	}
+	return
+}
+
+// Validate returns an error if any setting in cfg is out of range.
+// Models are checked when the Config is applied.
+func (cfg *Config) Validate() (err error) {
+	switch {
+	case cfg.ContextFraction < 0 || cfg.ContextFraction >= 1:
+		err = fmt.Errorf("context_fraction must be between 0 and 1, got %v", cfg.ContextFraction)
+	case cfg.ContextChunks < 0:
+		err = fmt.Errorf("context_chunks must not be negative, got %d", cfg.ContextChunks)
+	case cfg.KeywordWeight != nil && (*cfg.KeywordWeight < 0 || *cfg.KeywordWeight > 1):
+		err = fmt.Errorf("keyword_weight must be between 0 and 1, got %v", *cfg.KeywordWeight)
+	case cfg.DedupThreshold < 0 || cfg.DedupThreshold > 1:
+		err = fmt.Errorf("dedup_threshold must be between 0 and 1, got %v", cfg.DedupThreshold)
+	case cfg.MaxChunksPerDoc < 0:
+		err = fmt.Errorf("max_chunks_per_doc must not be negative, got %d", cfg.MaxChunksPerDoc)
+	case cfg.EmbeddingTPM < 0:
+		err = fmt.Errorf("embedding_tpm must not be negative, got %d", cfg.EmbeddingTPM)
+	case cfg.EmbeddingRPM < 0:
+		err = fmt.Errorf("embedding_rpm must not be negative, got %d", cfg.EmbeddingRPM)
+	case cfg.ChunkTokens < 0:
+		err = fmt.Errorf("chunk_tokens must not be negative, got %d", cfg.ChunkTokens)
+	case cfg.MinChunkTokens < 0:
+		err = fmt.Errorf("min_chunk_tokens must not be negative, got %d", cfg.MinChunkTokens)
+	case cfg.ChunkTokens != 0 && cfg.MinChunkTokens > cfg.ChunkTokens:
+		err = fmt.Errorf("min_chunk_tokens must be at most chunk_tokens, got %d", cfg.MinChunkTokens)
+	case cfg.Temperature != nil && (*cfg.Temperature < 0 || *cfg.Temperature > 2 || math.IsNaN(float64(*cfg.Temperature))):
+		err = fmt.Errorf("temperature must be between 0 and 2, got %v", *cfg.Temperature)
+	}
+	if err != nil {
+		return
+	}
+	if _, ok := chunkings[cfg.Chunking]; !ok && cfg.Chunking != "" {
+		err = fmt.Errorf("unknown chunking %q, want paragraph or sentence", cfg.Chunking)
+	}
+	switch cfg.Metric {
+	case "", MetricCosine, MetricDot, MetricEuclidean:
+	default:
+		err = fmt.Errorf("unknown metric %q, want cosine, dot, or euclidean", cfg.Metric)
+	}
+	return
+}
+
+// ApplyConfig applies the settings in cfg to g, overriding those
+// stored in the db for this run only:  saving the db keeps its own
+// values, so that a .grokconfig shared by a team changes nobody's db.
+// A setting that is changed again after ApplyConfig, e.g. by a
+// persistent command line flag, is saved as usual.  Callers that also
+// take settings from the command line should apply those afterwards
+// so that they win.
+func (g *Grokker) ApplyConfig(cfg *Config) (err error) {
+	defer Return(&err)
+	err = cfg.Validate()
+	Ck(err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if cfg.Model != "" {
+		stored := g.Model
+		_, err = g.setModel(cfg.Model)
+		Ck(err)
+		g.overrides = append(g.overrides, override{reflect.ValueOf(&g.Model).Elem(), stored, g.Model})
+	}
+	if cfg.Chunking != "" {
+		stored := g.Chunking
+		err = g.setChunking(cfg.Chunking)
+		Ck(err)
+		g.overrides = append(g.overrides, override{reflect.ValueOf(&g.Chunking).Elem(), stored, g.Chunking})
+	}
+	if cfg.Metric != "" {
+		g.setOverride(&g.Metric, cfg.Metric)
+	}
+	if cfg.ContextFraction != 0 {
+		g.setOverride(&g.ContextBudgetFraction, cfg.ContextFraction)
+	}
+	if cfg.ContextChunks != 0 {
+		g.setOverride(&g.ContextChunks, cfg.ContextChunks)
+	}
+	if cfg.KeywordWeight != nil {
+		g.setOverride(&g.KeywordWeight, *cfg.KeywordWeight)
+	}
+	if cfg.DedupThreshold != 0 {
+		g.setOverride(&g.DedupThreshold, cfg.DedupThreshold)
+	}
+	if cfg.MaxChunksPerDoc != 0 {
+		g.setOverride(&g.MaxChunksPerDoc, cfg.MaxChunksPerDoc)
+	}
+	if cfg.MinRelevance != 0 {
+		g.setOverride(&g.MinRelevance, cfg.MinRelevance)
+	}
+	if cfg.AutoGlobal != 0 {
+		g.setOverride(&g.AutoGlobal, cfg.AutoGlobal)
+	}
+	if cfg.MaxFileSize != 0 {
+		g.setOverride(&g.MaxFileSize, cfg.MaxFileSize)
+	}
+	if cfg.RefreshWorkers != 0 {
+		g.setOverride(&g.RefreshWorkers, cfg.RefreshWorkers)
+	}
+	if cfg.EmbeddingTPM != 0 {
+		g.setOverride(&g.EmbeddingTokensPerMinute, cfg.EmbeddingTPM)
+	}
+	if cfg.EmbeddingRPM != 0 {
+		g.setOverride(&g.EmbeddingRequestsPerMinute, cfg.EmbeddingRPM)
+	}
+	if cfg.ChunkTokens != 0 {
+		if cfg.ChunkTokens > g.EmbeddingTokenLimit {
+			err = fmt.Errorf("chunk_tokens must be at most %d, got %d", g.EmbeddingTokenLimit, cfg.ChunkTokens)
+			return
+		}
+		g.setOverride(&g.ChunkTokens, cfg.ChunkTokens)
+	}
+	if cfg.MinChunkTokens != 0 {
+		if cfg.MinChunkTokens > g.chunkTokens() {
+			err = fmt.Errorf("min_chunk_tokens must be at most %d, got %d", g.chunkTokens(), cfg.MinChunkTokens)
+			return
+		}
+		g.setOverride(&g.MinChunkTokens, cfg.MinChunkTokens)
+	}
+	if cfg.Temperature != nil {
+		g.ChatOptions.Temperature = cfg.Temperature
+	}
+	if cfg.Seed != nil {
+		g.ChatOptions.Seed = cfg.Seed
+	}
+	if cfg.SystemPrompt != "" {
+		g.setOverride(&g.SystemPrompt, cfg.SystemPrompt)
+	}
+	if cfg.Language != "" {
+		g.setOverride(&g.Language, cfg.Language)
+	}
+	return
+}
+
+// override is a db field that ApplyConfig set for this run only.
+type override struct {
+	field           reflect.Value
+	stored, applied interface{}
+}
+
+// setOverride sets the db field that ptr points to to value for this
+// run only; see persistOverrides.  The caller must hold g.mu for
+// writing.
+func (g *Grokker) setOverride(ptr, value interface{}) {
+	field := reflect.ValueOf(ptr).Elem()
+	g.overrides = append(g.overrides, override{field, field.Interface(), value})
+	field.Set(reflect.ValueOf(value))
+}
+
+// persistOverrides puts back the db's own value of each field that
+// ApplyConfig set, so that the db can be saved without them, and
+// returns a func that sets them again.  Fields changed since then
+// keep their new values.  The caller must hold g.mu for writing.
+func (g *Grokker) persistOverrides() (restore func()) {
+	var undone []override
+	// latest first, so that a field set twice gets its first stored
+	// value back
+	for i := len(g.overrides) - 1; i >= 0; i-- {
+		o := g.overrides[i]
+		if o.field.Interface() != o.applied {
+			continue
+		}
+		o.field.Set(reflect.ValueOf(o.stored))
+		undone = append(undone, o)
+	}
+	return func() {
+		for i := len(undone) - 1; i >= 0; i-- {
+			undone[i].field.Set(reflect.ValueOf(undone[i].applied))
+		}
+	}
+}
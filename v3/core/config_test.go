@@ -0,0 +1,120 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := TmpTestDir()
+
+	// no file means no settings
+	cfg, err := LoadConfig(dir)
+	Tassert(t, err == nil, "error loading config: %v", err)
+	Tassert(t, cfg.Model == "" && cfg.Temperature == nil, "expected empty config, got %+v", cfg)
+
+	fn := filepath.Join(dir, ConfigFile)
+	buf := []byte(`{"model": "gpt-4", "context_chunks": 3, "chunk_tokens": 100, "min_chunk_tokens": 20, "temperature": 0.5, "system_prompt": "Be brief."}`)
+	err = ioutil.WriteFile(fn, buf, 0644)
+	Tassert(t, err == nil, "error writing config: %v", err)
+	cfg, err = LoadConfig(dir)
+	Tassert(t, err == nil, "error loading config: %v", err)
+	Tassert(t, cfg.Model == "gpt-4", "unexpected model %q", cfg.Model)
+	Tassert(t, cfg.Temperature != nil && *cfg.Temperature == 0.5, "unexpected temperature %v", cfg.Temperature)
+
+	// environment variables override the file
+	os.Setenv("GROKKER_MODEL", "gpt-4o")
+	os.Setenv("GROKKER_CONTEXT_CHUNKS", "7")
+	defer os.Unsetenv("GROKKER_MODEL")
+	defer os.Unsetenv("GROKKER_CONTEXT_CHUNKS")
+	cfg, err = LoadConfig(dir)
+	Tassert(t, err == nil, "error loading config: %v", err)
+	Tassert(t, cfg.Model == "gpt-4o", "expected env to override model, got %q", cfg.Model)
+	Tassert(t, cfg.ContextChunks == 7, "expected env to override context_chunks, got %d", cfg.ContextChunks)
+
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.ApplyConfig(cfg)
+	Tassert(t, err == nil, "error applying config: %v", err)
+	Tassert(t, grok.Model == "gpt-4o", "unexpected model %q", grok.Model)
+	Tassert(t, grok.contextChunks() == 7, "unexpected context chunks %d", grok.contextChunks())
+	Tassert(t, grok.chunkTokens() == 100, "unexpected chunk tokens %d", grok.chunkTokens())
+	Tassert(t, grok.minChunkTokens() == 20, "unexpected min chunk tokens %d", grok.minChunkTokens())
+	Tassert(t, grok.sysMsgChat() == "Be brief.", "unexpected system prompt %q", grok.sysMsgChat())
+	Tassert(t, *grok.ChatOptions.Temperature == 0.5, "unexpected temperature %v", *grok.ChatOptions.Temperature)
+
+	// bad settings are rejected on load
+	os.Setenv("GROKKER_CONTEXT_CHUNKS", "seven")
+	_, err = LoadConfig(dir)
+	Tassert(t, err != nil, "expected error for bad env value")
+	os.Unsetenv("GROKKER_CONTEXT_CHUNKS")
+	bad := []string{
+		`{"context_fraction": 1.5}`,
+		`{"temperature": 3}`,
+		`{"chunking": "word"}`,
+		`{"metric": "manhattan"}`,
+		`{"max_chunks_per_doc": -1}`,
+		`{"modle": "gpt-4"}`,
+		`{"model": `,
+	}
+	for _, b := range bad {
+		err = ioutil.WriteFile(fn, []byte(b), 0644)
+		Tassert(t, err == nil, "error writing config: %v", err)
+		_, err = LoadConfig(dir)
+		Tassert(t, err != nil, "expected error for %s", b)
+	}
+
+	// unknown models are rejected when applied
+	err = grok.ApplyConfig(&Config{Model: "no-such-model"})
+	Tassert(t, err != nil, "expected error for unknown model")
+}
+
+// test that settings from .grokconfig aren't saved in the db
+func TestApplyConfigNotSaved(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.ContextChunks = 4
+	weight := 0.5
+	cfg := &Config{
+		Model:           "gpt-4",
+		ContextChunks:   7,
+		KeywordWeight:   &weight,
+		MaxFileSize:     1000,
+		Metric:          MetricDot,
+		Chunking:        "sentence",
+		SystemPrompt:    "Be brief.",
+		ContextFraction: 0.3,
+		MaxChunksPerDoc: 2,
+		MinRelevance:    0.2,
+		AutoGlobal:      0.3,
+		RefreshWorkers:  2,
+		EmbeddingTPM:    1000,
+		EmbeddingRPM:    10,
+		ChunkTokens:     100,
+		MinChunkTokens:  20,
+		Language:        "French",
+	}
+	err = grok.ApplyConfig(cfg)
+	Tassert(t, err == nil, "error applying config: %v", err)
+	err = grok.ApplyConfig(&Config{ContextChunks: 9})
+	Tassert(t, err == nil, "error applying config: %v", err)
+	// a setting changed after the config is saved as usual
+	grok.DedupThreshold = 0.9
+	grok.MaxFileSize = 2000
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	Tassert(t, grok.Model == "gpt-4" && grok.ContextChunks == 9 && grok.KeywordWeight == 0.5, "expected the config to stay in effect, got %s %d %v", grok.Model, grok.ContextChunks, grok.KeywordWeight)
+
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, g.Model == "gpt-3.5-turbo", "expected the db's model, got %q", g.Model)
+	Tassert(t, g.ContextChunks == 4, "expected the db's context chunks, got %d", g.ContextChunks)
+	Tassert(t, g.KeywordWeight == 0 && g.Metric == "" && g.Chunking == "" && g.SystemPrompt == "" && g.ContextBudgetFraction == 0, "expected the db's settings")
+	Tassert(t, g.ChunkTokens == 0 && g.EmbeddingTokensPerMinute == 0 && g.Language == "", "expected the db's settings")
+	Tassert(t, g.DedupThreshold == 0.9 && g.MaxFileSize == 2000, "expected later changes to be saved, got %v %d", g.DedupThreshold, g.MaxFileSize)
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// Conversation is a multi-turn conversation with the knowledge base.
+// Each question is answered using context retrieved for it along with
+// the earlier questions and answers, which are kept in a chat history
+// file so that the conversation can be resumed later.
+type Conversation struct {
+	// Model is the chat model used for answers.
+	Model string
+	// Sources are the documents the context of the last answer was
+	// drawn from, most relevant first.
+	Sources []string
+	history *ChatHistory
+	g       *Grokker
+}
+
+// OpenConversation opens or creates the conversation stored in the
+// chat history file at path, answering with the given model.  Call
+// Save to write the conversation back to the file.
+func (g *Grokker) OpenConversation(modelName, path string) (c *Conversation, err error) {
+	defer Return(&err)
+	modelName, _, err = g.models.FindModel(modelName)
+	Ck(err)
+	history, err := g.OpenChatHistory(g.sysMsgChat(), path)
+	Ck(err)
+	c = &Conversation{
+		Model:   modelName,
+		history: history,
+		g:       g,
+	}
+	return
+}
+
+// SetModel changes the chat model used for later answers.
+func (c *Conversation) SetModel(modelName string) (err error) {
+	defer Return(&err)
+	modelName, _, err = c.g.models.FindModel(modelName)
+	Ck(err)
+	c.Model = modelName
+	return
+}
+
+// Reset forgets the earlier questions and answers.
+func (c *Conversation) Reset() {
+	c.history.msgs = nil
+	c.Sources = nil
+}
+
+// Save writes the conversation to its chat history file.
+func (c *Conversation) Save() error {
+	return c.history.Save(false)
+}
+
+// Ask answers question in the context of the conversation, writing
+// the answer to w as it arrives if w is not nil.  The oldest
+// questions and answers are left out of the request if they don't fit
+// in the model's token limit.
+func (c *Conversation) Ask(question string, w io.Writer) (res *Result, err error) {
+	defer Return(&err)
+	g := c.g
+	if w == nil {
+		w = ioutil.Discard
+	}
+	_, m, err := g.models.FindModel(c.Model)
+	Ck(err)
+	qtc, err := g.TokenCount(question)
+	Ck(err)
+	maxTokens := g.contextBudget(m.TokenLimit) - qtc
+	ctxt, chunks, err := g.getContextChunks(question, maxTokens, false, false, nil)
+	Ck(err)
+	var head []client.ChatMsg
+	head = initMessages(g, c.Model, c.history.Sysmsg, g.ChatOptions)
+	if ctxt != "" {
+		head = append(head, []client.ChatMsg{
+			{Role: RoleUser, Content: Spf("Context:\n\n%s", ctxt)},
+			{Role: RoleAI, Content: "Great! I've read the context."},
+		}...)
+	}
+	prompt := client.ChatMsg{Role: RoleUser, Content: question}
+	past := c.history.msgs
+	var messages []client.ChatMsg
+	for {
+		messages = append(append(append([]client.ChatMsg{}, head...), past...), prompt)
+		tc, err := g.messagesTokenCount(messages)
+		Ck(err)
+		if tc <= m.TokenLimit {
+			break
+		}
+		if len(past) == 0 {
+			err = fmt.Errorf("%w: token count %d exceeds token limit %d", ErrTokenLimitExceeded, tc, m.TokenLimit)
+			return nil, err
+		}
+		// drop the oldest question and answer
+		past = past[min(2, len(past)):]
+	}
+	results, err := g.gatewayStream(context.Background(), c.Model, messages, g.ChatOptions, w)
+	Ck(err)
+	results, err = g.continueResults(context.Background(), c.Model, messages, results, g.ChatOptions, w)
+	Ck(err)
+	c.history.msgs = append(c.history.msgs,
+		prompt,
+		client.ChatMsg{Role: RoleAI, Content: results.Body},
+	)
+	c.Sources = chunkSources(chunks)
+	res = &Result{
+		Answer:       results.Body,
+		Sources:      c.Sources,
+		Citations:    results.Citations,
+		Usage:        results.Usage,
+		FinishReason: results.FinishReason,
+		Model:        c.Model,
+		Messages:     messages,
+		Raw:          results.Raw,
+	}
+	return
+}
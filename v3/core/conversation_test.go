@@ -0,0 +1,59 @@
+package core
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// countingChat is a client.ChatClient that answers with the number of
+// messages it was sent.
+type countingChat struct{}
+
+func (countingChat) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	results.Body = Spf("%d messages", len(messages))
+	return
+}
+
+func TestConversation(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	grok.SetChatClient("openai", countingChat{})
+	path := filepath.Join(dir, "repl.chat")
+	conv, err := grok.OpenConversation("gpt-4", path)
+	Tassert(t, err == nil, "error opening conversation: %v", err)
+
+	// system message, context and acknowledgement, question
+	var buf bytes.Buffer
+	res, err := conv.Ask("What is this about?", &buf)
+	Tassert(t, err == nil, "error asking: %v", err)
+	Tassert(t, res.Answer == "4 messages", "unexpected answer %q", res.Answer)
+	Tassert(t, buf.String() == res.Answer, "expected answer written to w, got %q", buf.String())
+	Tassert(t, len(conv.Sources) == 1, "expected 1 source, got %v", conv.Sources)
+	// the first question and answer come along
+	res, err = conv.Ask("Tell me more.", nil)
+	Tassert(t, err == nil, "error asking: %v", err)
+	Tassert(t, res.Answer == "6 messages", "unexpected answer %q", res.Answer)
+
+	// the history is kept between sessions
+	err = conv.Save()
+	Tassert(t, err == nil, "error saving conversation: %v", err)
+	conv, err = grok.OpenConversation("gpt-4", path)
+	Tassert(t, err == nil, "error reopening conversation: %v", err)
+	res, err = conv.Ask("And then?", nil)
+	Tassert(t, err == nil, "error asking: %v", err)
+	Tassert(t, res.Answer == "8 messages", "unexpected answer %q", res.Answer)
+
+	conv.Reset()
+	res, err = conv.Ask("Start over.", nil)
+	Tassert(t, err == nil, "error asking: %v", err)
+	Tassert(t, res.Answer == "4 messages", "unexpected answer %q", res.Answer)
+	err = conv.SetModel("no-such-model")
+	Tassert(t, err != nil, "expected error for unknown model")
+}
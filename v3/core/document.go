@@ -1,7 +1,19 @@
 package core
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stevegt/envi"
 	. "github.com/stevegt/goadapt"
@@ -9,24 +21,381 @@ import (
 
 // Document is a single document in a document repository.
 type Document struct {
-	// XXX deprecated because we weren't precise about what it meant.
-	Path string
-	// The path to the document file, relative to g.Root
+	// The path to the document file, relative to g.Root, or
+	// absolute for documents outside g.Root; see docPath.
 	RelPath string
+	// Synthetic is true if the document was added from a reader
+	// rather than a file, in which case RelPath is only a name and
+	// the content is stored in Content.
+	Synthetic bool `json:",omitempty"`
+	// The content of a synthetic document.
+	Content string `json:",omitempty"`
+	// Weight multiplies the relevance scores of the document's
+	// chunks during retrieval.  Zero means 1.  See
+	// SetDocumentWeight.
+	Weight float64 `json:",omitempty"`
+	// Embedded is when embeddings were last created for the
+	// document's chunks, in Unix seconds.  Zero means unknown, e.g.
+	// for documents embedded by older versions.
+	Embedded int64 `json:",omitempty"`
+	// Checked is when the document's embeddings were last brought up
+	// to date with its file, in Unix seconds, whether or not any
+	// chunks changed.  UpdateEmbeddings only reads documents whose
+	// files have changed since.  Zero means unknown, in which case
+	// the modification time of the db is used instead, and
+	// checkFailed means the last update failed.
+	Checked int64 `json:",omitempty"`
+	// Span, if not nil, is the only part of the file that is chunked
+	// and embedded; chunk offsets are relative to its start.  See
+	// AddOpts.Span.
+	Span *Span `json:",omitempty"`
+	// oldPath is the Path field of databases older than version
+	// 1.0.0, which migrate converts to RelPath.
+	oldPath string
+}
+
+// UnmarshalJSON decodes a Document, keeping the Path field of old
+// databases in oldPath.
+func (doc *Document) UnmarshalJSON(buf []byte) (err error) {
+	type document Document
+	var d struct {
+		document
+		Path string
+	}
+	err = json.Unmarshal(buf, &d)
+	if err != nil {
+		return
+	}
+	*doc = Document(d.document)
+	doc.oldPath = d.Path
+	return
 }
 
 // absPath returns the absolute path of a document.
 func (g *Grokker) absPath(doc *Document) string {
+	if filepath.IsAbs(doc.RelPath) {
+		return doc.RelPath
+	}
 	return filepath.Join(g.Root, doc.RelPath)
 }
 
+// docPath returns the path to store in Document.RelPath for the file
+// at absPath:  relative to g.Root if the file is inside it, and
+// otherwise absolute, so that documents kept elsewhere don't get
+// fragile ../../ paths that break when the database is moved.
+func (g *Grokker) docPath(absPath string) string {
+	rel, err := filepath.Rel(g.Root, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.Clean(absPath)
+	}
+	return rel
+}
+
+// readDocument returns the content of a document, either from its
+// file or, for synthetic documents, from the database.  The text of
+// Word documents is extracted from the file.  Only the document's
+// Span of the file, if it has one, is returned.
+func (g *Grokker) readDocument(doc *Document) (buf []byte, err error) {
+	if doc.Synthetic {
+		buf = []byte(doc.Content)
+		return
+	}
+	if doc.Span != nil && !isDocx(doc) {
+		// read only the span, so that part of a file too large to
+		// read whole can still be added
+		buf, err = g.readFileSpan(g.absPath(doc), doc.Span)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", doc.RelPath, err)
+		}
+		return
+	}
+	buf, err = g.readFile(g.absPath(doc))
+	if err != nil {
+		return
+	}
+	if isDocx(doc) {
+		var text string
+		text, err = docxText(buf)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", doc.RelPath, err)
+			return
+		}
+		buf = []byte(text)
+	}
+	if doc.Span != nil {
+		buf, err = doc.Span.slice(buf)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", doc.RelPath, err)
+		}
+	}
+	return
+}
+
+// DefaultMaxFileSize is the default of Grokker.MaxFileSize.
+const DefaultMaxFileSize = 10 << 20
+
+// maxFileSize returns g.MaxFileSize or its default, or zero if there
+// is no limit.
+func (g *Grokker) maxFileSize() int64 {
+	switch {
+	case g.MaxFileSize == 0:
+		return DefaultMaxFileSize
+	case g.MaxFileSize < 0:
+		return 0
+	}
+	return g.MaxFileSize
+}
+
+// tooLarge returns an error wrapping ErrDocumentTooLarge if size
+// exceeds g's file size limit, and nil otherwise.
+func (g *Grokker) tooLarge(size int64) error {
+	limit := g.maxFileSize()
+	if limit > 0 && size > limit {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrDocumentTooLarge, size, limit)
+	}
+	return nil
+}
+
+// readFile reads the file at path, returning an error wrapping
+// ErrDocumentTooLarge, without reading it, if it is larger than
+// g.MaxFileSize.
+func (g *Grokker) readFile(path string) (buf []byte, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	err = g.tooLarge(fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// readFileSpan reads the part of the file at path selected by span,
+// streaming through the file rather than reading it whole.  It
+// returns an error if the span is out of bounds or if the part is
+// larger than g.MaxFileSize.
+func (g *Grokker) readFileSpan(path string, span *Span) (buf []byte, err error) {
+	defer Return(&err)
+	err = span.check()
+	Ck(err)
+	fh, err := os.Open(path)
+	Ck(err)
+	defer fh.Close()
+	fi, err := fh.Stat()
+	Ck(err)
+	if !span.Lines {
+		if int64(span.End) > fi.Size() {
+			err = fmt.Errorf("%s: out of bounds, the file has %d bytes", span, fi.Size())
+			return
+		}
+		err = g.tooLarge(int64(span.End - span.Start))
+		Ck(err)
+		buf = make([]byte, span.End-span.Start)
+		_, err = fh.ReadAt(buf, int64(span.Start))
+		Ck(err)
+		return
+	}
+	r := bufio.NewReader(fh)
+	lines := 0
+	for lines < span.End {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			lines++
+			if lines >= span.Start {
+				buf = append(buf, line...)
+				err := g.tooLarge(int64(len(buf)))
+				Ck(err)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		Ck(err)
+	}
+	if lines < span.End {
+		return nil, fmt.Errorf("%s: out of bounds, the file has %d lines", span, lines)
+	}
+	return
+}
+
+// sniffLen is the number of bytes looksBinary examines.
+const sniffLen = 8000
+
+// looksBinary returns true if buf looks like the content of a binary
+// file rather than text:  if its first sniffLen bytes contain a null
+// byte, or if more than 10% of them are control characters or
+// invalid UTF-8.
+func looksBinary(buf []byte) bool {
+	if len(buf) > sniffLen {
+		buf = buf[:sniffLen]
+	}
+	var bad int
+	for i := 0; i < len(buf); {
+		r, size := utf8.DecodeRune(buf[i:])
+		switch {
+		case r == 0:
+			return true
+		case r == utf8.RuneError && size == 1:
+			if !utf8.FullRune(buf[i:]) {
+				// a multibyte rune cut off at the end of
+				// the sample
+				i = len(buf)
+				continue
+			}
+			bad++
+		case r < ' ' && r != '\n' && r != '\r' && r != '\t' && r != '\f' && r != '\b' && r != 0x1b:
+			bad++
+		}
+		i += size
+	}
+	return bad*10 > len(buf)
+}
+
+// findDocument returns the document in the database matching path,
+// which may be either relative to g.Root or absolute, or nil if the
+// document is not in the database.
+func (g *Grokker) findDocument(path string) (doc *Document, err error) {
+	defer Return(&err)
+	absPath, err := filepath.Abs(path)
+	Ck(err)
+	for _, d := range g.Documents {
+		if d.RelPath == path || g.absPath(d) == absPath {
+			doc = d
+			return
+		}
+	}
+	return
+}
+
+// SetDocumentWeight sets the weight of the document at path.  The
+// positive relevance scores of the document's chunks are multiplied by
+// its weight during retrieval, so that e.g. official specs with a
+// weight of 1.5 surface ahead of forum posts with a weight of 0.5 when
+// relevance is close.  Weights must be positive; the default is 1.
+func (g *Grokker) SetDocumentWeight(path string, weight float64) (err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if weight <= 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		err = fmt.Errorf("weight must be positive, got %v", weight)
+		return
+	}
+	doc, err := g.findDocument(path)
+	Ck(err)
+	if doc == nil {
+		err = fmt.Errorf("%q: %w", path, ErrDocumentNotFound)
+		return
+	}
+	if weight == 1 {
+		weight = 0
+	}
+	doc.Weight = weight
+	g.touch(doc.RelPath)
+	return
+}
+
+// DocumentWeight returns the weight of the document at path; see
+// SetDocumentWeight.
+func (g *Grokker) DocumentWeight(path string) (weight float64, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	doc, err := g.findDocument(path)
+	Ck(err)
+	if doc == nil {
+		err = fmt.Errorf("%q: %w", path, ErrDocumentNotFound)
+		return
+	}
+	weight = doc.weight()
+	return
+}
+
+// weight returns the weight of a document, which is 1 unless set
+// otherwise.
+func (doc *Document) weight() float64 {
+	if doc.Weight <= 0 {
+		return 1
+	}
+	return doc.Weight
+}
+
+// DocumentChunks returns the chunks belonging to the document at
+// relpath, in the order they appear in the document.  It returns an
+// error if the document is not in the database.
+func (g *Grokker) DocumentChunks(relpath string) (chunks []*Chunk, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	doc, err := g.findDocument(relpath)
+	Ck(err)
+	if doc == nil {
+		err = fmt.Errorf("%q: %w", relpath, ErrDocumentNotFound)
+		return
+	}
+	for _, chunk := range g.Chunks {
+		if chunk.Document.RelPath == doc.RelPath {
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Offset < chunks[j].Offset
+	})
+	return
+}
+
+// checkFailed is the Checked time of a document whose last update
+// failed, e.g. because the embedding API was down, which makes
+// UpdateEmbeddings read it again whatever its file's modification
+// time.
+const checkFailed = -1
+
+// tryUpdateDocument is like updateDocument, but if the update fails
+// it puts the document's chunks back the way they were, so that a
+// document that can't be read keeps its old embeddings rather than
+// losing them to gc, and records the failure in doc.Checked so that
+// the update is tried again next time.
+func (g *Grokker) tryUpdateDocument(doc *Document, progress func(done, total int)) (updated bool, err error) {
+	type chunkState struct {
+		offset, length int
+		stale          bool
+	}
+	chunks := append([]*Chunk(nil), g.Chunks...)
+	states := make(map[*Chunk]chunkState)
+	for _, chunk := range chunks {
+		if chunk.Document.RelPath == doc.RelPath {
+			states[chunk] = chunkState{chunk.Offset, chunk.Length, chunk.stale}
+		}
+	}
+	updated, err = g.updateDocument(doc, progress)
+	if err == nil {
+		return
+	}
+	g.Chunks = chunks
+	for chunk, state := range states {
+		chunk.Offset, chunk.Length, chunk.stale = state.offset, state.length, state.stale
+	}
+	doc.Checked = checkFailed
+	updated = false
+	return
+}
+
 // updateDocument updates the embeddings for a document and returns
-// true if the document was updated.
-func (g *Grokker) updateDocument(doc *Document) (updated bool, err error) {
+// true if the document was updated.  If progress is not nil, it is
+// called as each embedding is created.
+func (g *Grokker) updateDocument(doc *Document, progress func(done, total int)) (updated bool, err error) {
 	defer Return(&err)
 	// XXX much of this code is inefficient and will be replaced
 	// when we have a kv store.
 	Debug("updating embeddings for %s ...", doc.RelPath)
+	// note the time before reading the document, so that changes made
+	// while it is embedded are seen next time
+	checked := time.Now().Unix()
+
+	// break the current doc up into chunks before touching the
+	// existing ones, so that an error leaves them as they were.
+	chunks, err := g.docChunks(doc)
+	Ck(err)
 
 	// mark all existing chunks as stale
 	for _, chunk := range g.Chunks {
@@ -35,21 +404,18 @@ func (g *Grokker) updateDocument(doc *Document) (updated bool, err error) {
 		}
 	}
 
-	// break the current doc up into chunks.
-	chunks, err := g.chunksFromDoc(doc)
-	Ck(err)
 	// For each chunk, ensure it exists in the database with the right
 	// hash, offset, and length.  We'll get embeddings later.
 	var newChunks []*Chunk
 	for _, chunk := range chunks {
-		if envi.Bool("DEBUG", false) {
+		if envi.Bool("DEBUG", false) && g.embeddingOverflow() == OverflowSplit {
 			// verify chunk text length
-			txt, err := g.chunkText(chunk, true, false)
+			txt, err := g.embeddingText(chunk)
 			Ck(err)
 			_, tokens, err := Tokenizer.Encode(txt)
 			Ck(err)
 			tc := len(tokens)
-			Assert(tc < g.EmbeddingTokenLimit, "chunk tokens %d exceeds limit %d: %v", tc, g.EmbeddingTokenLimit, chunk)
+			Assert(tc <= g.EmbeddingTokenLimit, "chunk tokens %d exceeds limit %d: %v", tc, g.EmbeddingTokenLimit, chunk)
 		}
 		// setChunk unsets the stale bit if the chunk is already in the
 		// database.
@@ -62,37 +428,153 @@ func (g *Grokker) updateDocument(doc *Document) (updated bool, err error) {
 	}
 	Debug("found %d new chunks", len(newChunks))
 	// orphaned chunks will be garbage collected.
+	// offsets may have moved even if no chunks are new
+	g.touch(doc.RelPath)
 
 	if envi.Bool("DEBUG", false) {
 		// verify newChunks text length
 		for _, chunk := range newChunks {
-			txt, err := g.chunkText(chunk, true, false)
+			txt, err := g.embeddingText(chunk)
 			Ck(err)
 			_, tokens, err := Tokenizer.Encode(txt)
 			Ck(err)
 			tc := len(tokens)
-			Assert(tc < g.EmbeddingTokenLimit, "chunk tokens %d exceeds limit %d: %v", tc, g.EmbeddingTokenLimit, chunk)
+			Assert(tc <= g.EmbeddingTokenLimit, "chunk tokens %d exceeds limit %d: %v", tc, g.EmbeddingTokenLimit, chunk)
 		}
 	}
 
-	// For each new chunk, generate an embedding using the
-	// openai.Embedding.create() function. Store the embeddings for each
-	// chunk in a data structure such as a list or dictionary.
-	var newChunkStrings []string
+	err = g.embedChunks(doc, newChunks, progress)
+	Ck(err)
+	if len(newChunks) > 0 {
+		doc.Embedded = time.Now().Unix()
+	}
+	doc.Checked = checked
+	return
+}
+
+// docChunks splits doc into chunks, as chunksFromDoc does, and
+// checks that they have text to embed:  it warns about a blank
+// document, or returns an error wrapping ErrEmptyDocument if
+// g.RejectEmptyDocuments is set.  updateDocument and refreshChunks
+// both use it, so that documents are checked the same way however
+// they are refreshed.
+func (g *Grokker) docChunks(doc *Document) (chunks []*Chunk, err error) {
+	chunks, err = g.chunksFromDoc(doc)
+	if err != nil {
+		return
+	}
+	if blankChunks(chunks) {
+		if g.RejectEmptyDocuments {
+			return nil, fmt.Errorf("%s: %w", doc.RelPath, ErrEmptyDocument)
+		}
+		Fpf(os.Stderr, "warning: %s: no text to embed; the document is empty or only whitespace\n", doc.RelPath)
+	}
+	return
+}
+
+// blankChunks returns true if chunks have no text worth embedding:
+// there are none, or they are only whitespace.  Streamed chunks don't
+// keep their text, so they are never blank.
+func blankChunks(chunks []*Chunk) bool {
+	for _, chunk := range chunks {
+		if len(chunk.text) != chunk.Length || strings.TrimSpace(chunk.text) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// shareable returns true if doc's new chunks can reuse the
+// embeddings of chunks with the same text; see
+// Grokker.ShareEmbeddings.
+func (g *Grokker) shareable(doc *Document) bool {
+	return g.ShareEmbeddings && !(g.EmbedHeadings && isMarkdown(doc))
+}
+
+// shareEmbeddings sets the embeddings of those of newChunks whose text
+// is the same as that of an embedded chunk in the db, and returns the
+// rest, which still need embedding.
+func (g *Grokker) shareEmbeddings(newChunks []*Chunk) (rest []*Chunk) {
+	embedded := make(map[string]*Chunk)
+	for _, chunk := range g.Chunks {
+		if chunk.TextHash == "" || chunk.Embedding == nil || !g.shareable(chunk.Document) {
+			continue
+		}
+		embedded[chunk.TextHash] = chunk
+	}
 	for _, chunk := range newChunks {
-		Assert(chunk.Document.RelPath == doc.RelPath, "chunk document does not match")
-		Assert(len(chunk.text) > 0, "chunk text is empty")
-		Assert(chunk.Embedding == nil, "chunk embedding is not nil")
-		Assert(chunk.stale == false, "chunk is stale")
-		Assert(chunk.Hash != "", "chunk hash is empty")
-		text, err := g.chunkText(chunk, true, false)
-		Ck(err)
-		newChunkStrings = append(newChunkStrings, text)
+		from, ok := embedded[chunk.TextHash]
+		if !ok || chunk.TextHash == "" {
+			rest = append(rest, chunk)
+			continue
+		}
+		chunk.Embedding = append([]float64(nil), from.Embedding...)
+		chunk.Embeddings = copyEmbeddings(from.Embeddings)
 	}
-	embeddings, err := g.createEmbeddings(newChunkStrings)
-	Ck(err)
-	for i, chunk := range newChunks {
-		chunk.Embedding = embeddings[i]
+	Debug("reused %d embeddings", len(newChunks)-len(rest))
+	return
+}
+
+// embedChunks sets the embeddings of a document's new chunks.  If
+// progress is not nil, it is called as each embedding is created.
+func (g *Grokker) embedChunks(doc *Document, newChunks []*Chunk, progress func(done, total int)) (err error) {
+	defer Return(&err)
+	if g.shareable(doc) {
+		newChunks = g.shareEmbeddings(newChunks)
+	}
+	// For each new chunk, generate an embedding using the
+	// openai.Embedding.create() function.  Chunks are embedded a
+	// group at a time so that the texts of a large document aren't
+	// all held in memory at once.
+	dims := g.embeddingDims()
+	for start := 0; start < len(newChunks); start += embedGroupSize {
+		group := newChunks[start:min(start+embedGroupSize, len(newChunks))]
+		var texts []string
+		for _, chunk := range group {
+			Assert(chunk.Document.RelPath == doc.RelPath, "chunk document does not match")
+			Assert(chunk.Length > 0, "chunk is empty")
+			Assert(chunk.Embedding == nil, "chunk embedding is not nil")
+			Assert(chunk.stale == false, "chunk is stale")
+			Assert(chunk.Hash != "", "chunk hash is empty")
+			_, err = chunk.tokenCount(g)
+			Ck(err)
+			text, err := g.embeddingText(chunk)
+			Ck(err)
+			texts = append(texts, text)
+		}
+		var groupProgress func(done, total int)
+		if progress != nil {
+			groupProgress = func(done, total int) {
+				progress(start+done, len(newChunks))
+			}
+		}
+		var embeddings [][]float64
+		embeddings, err = g.createEmbeddings(texts, groupProgress)
+		Ck(err)
+		// reject corrupt embeddings rather than letting them into
+		// the database, where they would poison rankings
+		for i, embedding := range embeddings {
+			if embedding == nil {
+				// empty text
+				continue
+			}
+			embedding, err = g.projectEmbedding(embedding)
+			Ck(err)
+			embeddings[i] = embedding
+			if dims == 0 {
+				dims = len(embedding)
+			}
+			err = validateEmbedding(embedding, dims)
+			if err != nil {
+				err = fmt.Errorf("chunk at offset %d of %s: %v", group[i].Offset, doc.RelPath, err)
+				return
+			}
+		}
+		for i, chunk := range group {
+			chunk.Embedding = embeddings[i]
+		}
+		err = g.embedAlt(group, texts, g.AltEmbeddingModels)
+		Ck(err)
 	}
 	return
 }
@@ -0,0 +1,604 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestLooksBinary(t *testing.T) {
+	cases := []struct {
+		in   string
+		want bool
+	}{
+		{"", false},
+		{"plain text\nwith lines\tand tabs\n", false},
+		{"héllo wörld, 日本語", false},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", true},
+		{strings.Repeat("\x01\x02\x03abcdefg", 10), true},
+		{strings.Repeat("\xff\xfe", 10) + "text", true},
+		// a multibyte rune cut off at the end of the sample
+		{strings.Repeat("a", sniffLen-1) + "日", false},
+	}
+	for _, c := range cases {
+		got := looksBinary([]byte(c.in))
+		Tassert(t, got == c.want, "looksBinary(%.20q) = %v, want %v", c.in, got, c.want)
+	}
+}
+
+func TestAddBinaryDocument(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	fn := filepath.Join(dir, "image.png")
+	err = ioutil.WriteFile(fn, []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, errors.Is(err, ErrBinaryDocument), "expected ErrBinaryDocument, got %v", err)
+	Tassert(t, len(grok.Documents) == 0, "expected no documents, got %d", len(grok.Documents))
+	err = grok.AddDocumentWithOpts(fn, AddOpts{Force: true})
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Documents) == 1, "expected 1 document, got %d", len(grok.Documents))
+}
+
+func TestAddDocumentSpan(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	fn := filepath.Join(dir, "manual.txt")
+	err = ioutil.WriteFile(fn, []byte("Copyright boilerplate.\n\nThe API has one endpoint.\n\nLicense boilerplate.\n"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	text := func() string {
+		chunks, err := grok.DocumentChunks("manual.txt")
+		Tassert(t, err == nil, "error getting chunks: %v", err)
+		var text string
+		for _, chunk := range chunks {
+			txt, err := grok.ChunkText(chunk)
+			Tassert(t, err == nil, "error getting chunk text: %v", err)
+			text += txt
+		}
+		return text
+	}
+
+	// out of bounds spans are rejected
+	err = grok.AddDocumentWithOpts(fn, AddOpts{Span: &Span{Lines: true, Start: 3, End: 9}})
+	Tassert(t, err != nil, "expected error for out of bounds span")
+	Tassert(t, len(grok.Documents) == 0, "expected no documents, got %d", len(grok.Documents))
+
+	// only the span is chunked
+	err = grok.AddDocumentWithOpts(fn, AddOpts{Span: &Span{Lines: true, Start: 3, End: 3}})
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, text() == "The API has one endpoint.\n", "unexpected text %q", text())
+	chunks, err := grok.DocumentChunks("manual.txt")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	numbered, err := grok.chunkText(chunks[0], false, true)
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, strings.HasPrefix(numbered, "3: The API"), "expected file line numbers, got %q", numbered)
+
+	// the span is kept across a reload and a refresh
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	grok, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	err = ioutil.WriteFile(fn, []byte("Copyright boilerplate.\n\nThe API has two endpoints.\n\nLicense boilerplate.\n"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	_, err = grok.UpdateEmbeddingsSince(time.Time{})
+	Tassert(t, err == nil, "error updating: %v", err)
+	Tassert(t, text() == "The API has two endpoints.\n", "unexpected text %q", text())
+
+	// adding the file again without a span adds all of it
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Documents) == 1, "expected 1 document, got %d", len(grok.Documents))
+	Tassert(t, strings.Contains(text(), "Copyright"), "expected the whole file, got %q", text())
+}
+
+func TestAddReader(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &countingEmbedder{}
+	grok.SetEmbedder(embedder)
+	text := func(name string) string {
+		chunks, err := grok.DocumentChunks(name)
+		Tassert(t, err == nil && len(chunks) == 1, "expected 1 chunk: %v, %v", chunks, err)
+		txt, err := grok.chunkText(chunks[0], false, false)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		return txt
+	}
+
+	// the content is stored in the db, with no file on disk
+	err = grok.AddReader("generated.txt", strings.NewReader("Apples are red."))
+	Tassert(t, err == nil, "error adding reader: %v", err)
+	Tassert(t, len(grok.Documents) == 1 && grok.Documents[0].Synthetic, "expected 1 synthetic document: %v", grok.Documents)
+	Tassert(t, text("generated.txt") == "Apples are red.", "unexpected text %q", text("generated.txt"))
+	_, err = os.Stat(filepath.Join(dir, "generated.txt"))
+	Tassert(t, os.IsNotExist(err), "expected no file, got %v", err)
+
+	// updates leave synthetic documents alone
+	embedder.count = 0
+	update, err := grok.UpdateEmbeddingsSince(time.Time{})
+	Tassert(t, err == nil, "error updating: %v", err)
+	Tassert(t, !update && embedder.count == 0, "expected no update, got %v with %d embeddings", update, embedder.count)
+
+	// adding the same name again replaces the content
+	err = grok.AddReader("generated.txt", strings.NewReader("Bananas are yellow."))
+	Tassert(t, err == nil, "error adding reader: %v", err)
+	Tassert(t, len(grok.Documents) == 1, "expected 1 document, got %d", len(grok.Documents))
+	Tassert(t, text("generated.txt") == "Bananas are yellow.", "unexpected text %q", text("generated.txt"))
+
+	// failed updates leave the document as it was, and new
+	// documents out
+	grok.SetEmbedder(failingEmbedder{})
+	err = grok.AddReader("generated.txt", strings.NewReader("Cherries are red."))
+	Tassert(t, err != nil, "expected error replacing content")
+	Tassert(t, grok.Documents[0].Content == "Bananas are yellow.", "expected the old content, got %q", grok.Documents[0].Content)
+	Tassert(t, text("generated.txt") == "Bananas are yellow.", "unexpected text %q", text("generated.txt"))
+	err = grok.AddReader("new.txt", strings.NewReader("Dates are brown."))
+	Tassert(t, err != nil, "expected error adding reader")
+	Tassert(t, len(grok.Documents) == 1, "expected the new document to be dropped, got %v", grok.ListDocuments())
+	grok.SetEmbedder(embedder)
+
+	// the content is kept across a reload
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	grok, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	grok.SetEmbedder(embedder)
+	Tassert(t, text("generated.txt") == "Bananas are yellow.", "unexpected text %q", text("generated.txt"))
+
+	// a name can't be used for both a file and a reader
+	fn := filepath.Join(dir, "file.txt")
+	err = ioutil.WriteFile(fn, []byte("Cherries are red.\n"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.AddReader("file.txt", strings.NewReader("Dates are brown."))
+	Tassert(t, err != nil, "expected error adding a reader over a file")
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.MaxFileSize = 100
+	sub := filepath.Join(dir, "logs")
+	err = os.MkdirAll(sub, 0755)
+	Tassert(t, err == nil, "error creating directory: %v", err)
+	big := filepath.Join(sub, "big.log")
+	err = ioutil.WriteFile(big, []byte(strings.Repeat("a log line\n", 20)), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	small := filepath.Join(sub, "small.txt")
+	err = ioutil.WriteFile(small, []byte("a small file\n"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+
+	// large files are rejected, even with Force
+	err = grok.AddDocument(big)
+	Tassert(t, errors.Is(err, ErrDocumentTooLarge), "expected ErrDocumentTooLarge, got %v", err)
+	err = grok.AddDocumentWithOpts(big, AddOpts{Force: true})
+	Tassert(t, errors.Is(err, ErrDocumentTooLarge), "expected ErrDocumentTooLarge, got %v", err)
+	Tassert(t, len(grok.Documents) == 0, "expected no documents, got %d", len(grok.Documents))
+	err = grok.AddReader("stdin", strings.NewReader(strings.Repeat("x", 101)))
+	Tassert(t, errors.Is(err, ErrDocumentTooLarge), "expected ErrDocumentTooLarge, got %v", err)
+
+	// and skipped when adding a directory
+	paths, err := grok.AddDirectory(sub, AddOpts{})
+	Tassert(t, err == nil, "error adding directory: %v", err)
+	Tassert(t, len(paths) == 1 && paths[0] == small, "expected only the small file, got %v", paths)
+
+	// a span that fits can be added
+	err = grok.AddDocumentWithOpts(big, AddOpts{Span: &Span{Lines: true, Start: 19, End: 20}})
+	Tassert(t, err == nil, "error adding span: %v", err)
+	err = grok.AddDocumentWithOpts(big, AddOpts{Span: &Span{Lines: true, Start: 1, End: 20}})
+	Tassert(t, errors.Is(err, ErrDocumentTooLarge), "expected ErrDocumentTooLarge, got %v", err)
+	err = grok.AddDocumentWithOpts(big, AddOpts{Span: &Span{Start: 11, End: 33}})
+	Tassert(t, err == nil, "error adding span: %v", err)
+	chunks, err := grok.DocumentChunks(big)
+	Tassert(t, err == nil && len(chunks) == 1, "unexpected chunks %v, %v", chunks, err)
+	text, err := grok.ChunkText(chunks[0])
+	Tassert(t, err == nil && text == "a log line\na log line\n", "unexpected text %q, %v", text, err)
+
+	// a negative limit means none
+	grok.MaxFileSize = -1
+	err = grok.AddDocument(big)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+}
+
+func TestEmptyDocument(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.SetEmbedder(&countingEmbedder{})
+	blank := filepath.Join(dir, "blank.txt")
+	err = ioutil.WriteFile(blank, []byte(" \n\t\n"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+
+	// empty documents are added with a warning
+	err = grok.AddDocument(blank)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Documents) == 1, "expected 1 document, got %d", len(grok.Documents))
+
+	// or rejected without leaving a document behind
+	grok.RejectEmptyDocuments = true
+	empty := filepath.Join(dir, "empty.txt")
+	err = ioutil.WriteFile(empty, nil, 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(empty)
+	Tassert(t, errors.Is(err, ErrEmptyDocument), "expected ErrEmptyDocument, got %v", err)
+	err = grok.AddReader("stdin", strings.NewReader("\n\n"))
+	Tassert(t, errors.Is(err, ErrEmptyDocument), "expected ErrEmptyDocument, got %v", err)
+	Tassert(t, len(grok.Documents) == 1, "expected 1 document, got %d", len(grok.Documents))
+
+	// an existing document emptied out keeps its chunks
+	notes := filepath.Join(dir, "notes.txt")
+	err = ioutil.WriteFile(notes, []byte("some notes\n"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(notes)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = ioutil.WriteFile(notes, []byte("\n"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(notes)
+	Tassert(t, errors.Is(err, ErrEmptyDocument), "expected ErrEmptyDocument, got %v", err)
+	Tassert(t, len(grok.Documents) == 2, "expected 2 documents, got %d", len(grok.Documents))
+	chunks, err := grok.DocumentChunks(notes)
+	Tassert(t, err == nil && len(chunks) == 1 && !chunks[0].stale, "unexpected chunks %v, %v", chunks, err)
+
+	// and empty files are skipped when adding a directory
+	sub := filepath.Join(dir, "sub")
+	err = os.MkdirAll(sub, 0755)
+	Tassert(t, err == nil, "error creating directory: %v", err)
+	err = ioutil.WriteFile(filepath.Join(sub, "empty.txt"), nil, 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	paths, err := grok.AddDirectory(sub, AddOpts{})
+	Tassert(t, err == nil && len(paths) == 0, "expected no files added, got %v, %v", paths, err)
+}
+
+func TestDocumentOutsideRoot(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	// inside the root
+	inside := filepath.Join(dir, "sub", "inside.txt")
+	err = os.MkdirAll(filepath.Dir(inside), 0755)
+	Tassert(t, err == nil, "error creating directory: %v", err)
+	err = ioutil.WriteFile(inside, []byte("inside the root"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(inside)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	// outside the root
+	outside, err := filepath.Abs("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error getting absolute path: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	paths := grok.ListDocuments()
+	Tassert(t, len(paths) == 2, "expected 2 documents, got %v", paths)
+	Tassert(t, paths[0] == filepath.Join("sub", "inside.txt"), "expected relative path, got %q", paths[0])
+	Tassert(t, paths[1] == outside, "expected absolute path %q, got %q", outside, paths[1])
+	// a document stored with a ../ path by an older version isn't
+	// added again
+	rel, err := filepath.Rel(dir, outside)
+	Tassert(t, err == nil, "error getting relative path: %v", err)
+	grok.Documents[1].RelPath = rel
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Documents) == 2, "expected 2 documents, got %v", grok.ListDocuments())
+	grok.Documents[1].RelPath = outside
+	// the outside document survives moving the db
+	grok.Root = TmpTestDir()
+	chunks, err := grok.DocumentChunks(outside)
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	text, err := grok.ChunkText(chunks[0])
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, text != "", "expected chunk text after moving the db")
+	err = grok.ForgetDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error forgetting doc: %v", err)
+	Tassert(t, len(grok.Documents) == 1, "expected 1 document, got %d", len(grok.Documents))
+}
+
+func TestAddDirectorySymlinks(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	// docs/a.txt, docs/.hidden.txt, shared/b.txt, plus links
+	// docs/b.txt -> shared/b.txt and docs/loop -> docs
+	files := map[string]string{
+		"docs/a.txt":       "alpha",
+		"docs/.hidden.txt": "hidden",
+		"shared/b.txt":     "bravo",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		Tassert(t, err == nil, "error creating directory: %v", err)
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+	}
+	err = os.Symlink(filepath.Join(dir, "shared", "b.txt"), filepath.Join(dir, "docs", "b.txt"))
+	Tassert(t, err == nil, "error creating symlink: %v", err)
+	err = os.Symlink(filepath.Join(dir, "docs"), filepath.Join(dir, "docs", "loop"))
+	Tassert(t, err == nil, "error creating symlink: %v", err)
+
+	// symlinks are skipped by default
+	paths, err := grok.AddDirectory(filepath.Join(dir, "docs"), AddOpts{})
+	Tassert(t, err == nil, "error adding directory: %v", err)
+	Tassert(t, len(paths) == 1, "expected 1 file, got %v", paths)
+	Tassert(t, strings.HasSuffix(paths[0], "a.txt"), "expected a.txt, got %v", paths)
+
+	// following them terminates in spite of the loop
+	paths, err = grok.AddDirectory(filepath.Join(dir, "docs"), AddOpts{FollowSymlinks: true})
+	Tassert(t, err == nil, "error adding directory: %v", err)
+	Tassert(t, len(paths) == 2, "expected 2 files, got %v", paths)
+	Tassert(t, strings.HasSuffix(paths[1], filepath.Join("docs", "b.txt")), "expected docs/b.txt, got %v", paths)
+	Tassert(t, len(grok.Documents) == 2, "expected 2 documents, got %d", len(grok.Documents))
+
+	// a shared file reached through several links is added once
+	err = os.Symlink(filepath.Join(dir, "shared"), filepath.Join(dir, "docs", "z-shared"))
+	Tassert(t, err == nil, "error creating symlink: %v", err)
+	paths, err = grok.AddDirectory(filepath.Join(dir, "docs"), AddOpts{FollowSymlinks: true})
+	Tassert(t, err == nil, "error adding directory: %v", err)
+	Tassert(t, len(paths) == 2, "expected 2 files, got %v", paths)
+}
+
+func TestAddDirectoryStream(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	files := map[string]string{
+		"docs/a.txt":   "alpha\n\nalpha again",
+		"docs/b.bin":   "\x00\x01\x02",
+		"docs/c/d.txt": "delta",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		Tassert(t, err == nil, "error creating directory: %v", err)
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+	}
+
+	var results []AddResult
+	for res := range grok.AddDirectoryStream(context.Background(), filepath.Join(dir, "docs"), AddOpts{}) {
+		results = append(results, res)
+	}
+	Tassert(t, len(results) == 3, "expected 3 results, got %v", results)
+	Tassert(t, strings.HasSuffix(results[0].Path, "a.txt") && results[0].Err == nil && results[0].Chunks == 2, "unexpected result %v", results[0])
+	Tassert(t, errors.Is(results[1].Err, ErrBinaryDocument), "expected binary error, got %v", results[1])
+	Tassert(t, strings.HasSuffix(results[2].Path, "d.txt") && results[2].Chunks == 1, "unexpected result %v", results[2])
+	Tassert(t, len(grok.Documents) == 2, "expected 2 documents, got %d", len(grok.Documents))
+
+	// the lock is released once the channel is closed
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	for res := range grok.AddDirectoryStream(context.Background(), filepath.Join(dir, "docs"), AddOpts{}) {
+		Tassert(t, res.Chunks == 0, "expected no new chunks, got %v", res)
+	}
+
+	// a caller that stops reading cancels the walk, which unlocks the
+	// Grokker without adding the rest
+	err = ioutil.WriteFile(filepath.Join(dir, "docs", "e.txt"), []byte("epsilon"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	for res := range grok.AddDirectoryStream(ctx, filepath.Join(dir, "docs"), AddOpts{}) {
+		Tassert(t, strings.HasSuffix(res.Path, "a.txt"), "unexpected result %v", res)
+		break
+	}
+	cancel()
+	done := make(chan error)
+	go func() {
+		done <- grok.Save()
+	}()
+	select {
+	case err = <-done:
+		Tassert(t, err == nil, "error saving: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceling the stream didn't unlock the Grokker")
+	}
+	Tassert(t, len(grok.Documents) == 2, "expected 2 documents, got %d", len(grok.Documents))
+}
+
+func TestDocumentWeight(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	files := map[string]string{
+		"spec.txt":  "the widget port number is 8080",
+		"forum.txt": "the widget port number is 8080 or so",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		err = grok.AddDocument(filepath.Join(dir, name))
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	query := "what is the widget port number or so"
+	results, err := grok.Search(query, 2)
+	Tassert(t, err == nil, "error searching: %v", err)
+	Tassert(t, results[0].Path == "forum.txt", "expected forum.txt first, got %v", results[0].Path)
+
+	weight, err := grok.DocumentWeight("spec.txt")
+	Tassert(t, err == nil, "error getting weight: %v", err)
+	Tassert(t, weight == 1, "expected default weight 1, got %v", weight)
+	err = grok.SetDocumentWeight("spec.txt", 0)
+	Tassert(t, err != nil, "expected error for zero weight")
+	err = grok.SetDocumentWeight("nosuch.txt", 2)
+	Tassert(t, errors.Is(err, ErrDocumentNotFound), "expected ErrDocumentNotFound, got %v", err)
+
+	// boosting the spec puts it first, and the weight survives a
+	// save and load
+	err = grok.SetDocumentWeight("spec.txt", 1.5)
+	Tassert(t, err == nil, "error setting weight: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	weight, err = g.DocumentWeight("spec.txt")
+	Tassert(t, err == nil, "error getting weight: %v", err)
+	Tassert(t, weight == 1.5, "expected weight 1.5, got %v", weight)
+	results, err = g.Search(query, 2)
+	Tassert(t, err == nil, "error searching: %v", err)
+	Tassert(t, results[0].Path == "spec.txt", "expected spec.txt first, got %v", results[0].Path)
+}
+
+// test that chunk token counts are stored when chunks are added,
+// persisted, and backfilled when an older db is migrated
+func TestChunkTokens(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	want := make(map[string]int)
+	for _, chunk := range grok.Chunks {
+		text, err := grok.chunkText(chunk, false, false)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		tokens, err := grok.tokens(text)
+		Tassert(t, err == nil, "error counting tokens: %v", err)
+		Tassert(t, chunk.Tokens == len(tokens), "expected %d tokens, got %d", len(tokens), chunk.Tokens)
+		want[chunk.Hash] = chunk.Tokens
+	}
+
+	// the counts survive a save and load
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	for _, chunk := range g.Chunks {
+		Tassert(t, chunk.Tokens == want[chunk.Hash], "expected %d tokens after load, got %d", want[chunk.Hash], chunk.Tokens)
+	}
+
+	// write the db the way 3.1.X did, without counts
+	for _, chunk := range grok.Chunks {
+		chunk.Tokens = 0
+		chunk.Vec = ""
+	}
+	grok.Version = "3.1.9"
+	buf, err := json.Marshal(grok)
+	Tassert(t, err == nil, "error marshaling: %v", err)
+	err = ioutil.WriteFile(grok.grokpath, buf, 0644)
+	Tassert(t, err == nil, "error writing db: %v", err)
+	os.Remove(grok.journalPath())
+	g, migrated, _, _, lock, err := LoadFrom(grok.grokpath, "", false)
+	Tassert(t, err == nil, "error loading: %v", err)
+	defer lock.Unlock()
+	Tassert(t, migrated, "expected migration")
+	for _, chunk := range g.Chunks {
+		Tassert(t, chunk.Tokens == want[chunk.Hash], "expected %d tokens after migration, got %d", want[chunk.Hash], chunk.Tokens)
+	}
+}
+
+// test that creation and migrations are recorded in the db
+func TestVersionHistory(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	history := grok.VersionHistory()
+	Tassert(t, len(history) == 1 && history[0].From == "" && history[0].To == Version, "unexpected history %v", history)
+	Tassert(t, strings.Contains(history[0].String(), "created at version "+Version), "unexpected entry %q", history[0])
+
+	// write the db the way 3.1.X did, without a history
+	grok.Version = "3.1.9"
+	grok.Migrations = nil
+	buf, err := json.Marshal(grok)
+	Tassert(t, err == nil, "error marshaling: %v", err)
+	err = ioutil.WriteFile(grok.grokpath, buf, 0644)
+	Tassert(t, err == nil, "error writing db: %v", err)
+	os.Remove(grok.journalPath())
+	g, migrated, _, _, lock, err := LoadFrom(grok.grokpath, "", false)
+	Tassert(t, err == nil, "error loading: %v", err)
+	Tassert(t, migrated, "expected migration")
+	history = g.VersionHistory()
+	Tassert(t, len(history) == 1 && history[0].From == "3.1.9" && history[0].To == "3.2.0", "unexpected history %v", history)
+	Tassert(t, time.Since(time.Unix(history[0].Time, 0)) < time.Minute, "unexpected time %d", history[0].Time)
+	err = g.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	lock.Unlock()
+
+	// the history survives a save and load
+	g, _, _, _, lock, err = LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	defer lock.Unlock()
+	Tassert(t, len(g.VersionHistory()) == 1, "expected 1 entry after reload, got %v", g.VersionHistory())
+}
+
+func TestListDocumentInfo(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	start := time.Now().Add(-time.Second)
+	for _, path := range []string{"testdata/te-abstract.txt", "testdata/te-full.txt"} {
+		err = grok.AddDocument(path)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+
+	docs := g.ListDocumentInfo()
+	Tassert(t, len(docs) == 2, "expected 2 documents, got %v", docs)
+	Tassert(t, strings.HasSuffix(docs[0].Path, "te-abstract.txt"), "expected te-abstract.txt first, got %v", docs[0].Path)
+	chunks, tokens := 0, 0
+	for _, doc := range docs {
+		Tassert(t, doc.Chunks > 0, "expected chunks for %s", doc.Path)
+		Tassert(t, doc.Tokens > 0, "expected tokens for %s", doc.Path)
+		Tassert(t, !doc.Embedded.Before(start) && !doc.Embedded.After(time.Now()), "unexpected embedded time %v for %s", doc.Embedded, doc.Path)
+		chunks += doc.Chunks
+		tokens += doc.Tokens
+	}
+	Tassert(t, docs[0].Chunks < docs[1].Chunks, "expected the abstract to have fewer chunks than the full text, got %v", docs)
+	Tassert(t, chunks == len(g.Chunks), "expected %d chunks in all, got %d", len(g.Chunks), chunks)
+	want := 0
+	for _, chunk := range g.Chunks {
+		want += chunk.Tokens
+	}
+	Tassert(t, tokens == want, "expected %d tokens in all, got %d", want, tokens)
+}
+
+// test that migrating a db from before version 1.0.0 converts each
+// document's Path to RelPath
+func TestMigrateDocumentPath(t *testing.T) {
+	dir := TmpTestDir()
+	buf, err := ioutil.ReadFile("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error reading doc: %v", err)
+	path := filepath.Join(dir, "te-abstract.txt")
+	err = ioutil.WriteFile(path, buf, 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	old := map[string]interface{}{
+		"Version":   "0.1.0",
+		"Model":     "gpt-4",
+		"Documents": []interface{}{map[string]interface{}{"Path": path}},
+	}
+	buf, err = json.Marshal(old)
+	Tassert(t, err == nil, "error marshaling: %v", err)
+	grokpath := filepath.Join(dir, ".grok")
+	err = ioutil.WriteFile(grokpath, buf, 0644)
+	Tassert(t, err == nil, "error writing db: %v", err)
+
+	g, migrated, _, _, lock, err := LoadFrom(grokpath, "", false)
+	Tassert(t, err == nil, "error loading: %v", err)
+	Tassert(t, migrated, "expected migration")
+	docs := g.ListDocuments()
+	Tassert(t, len(docs) == 1 && docs[0] == "te-abstract.txt", "expected te-abstract.txt, got %v", docs)
+	Tassert(t, len(g.Chunks) > 0, "expected chunks after migration")
+
+	// the old field is gone from the saved db
+	err = g.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	lock.Unlock()
+	g, _, _, _, lock, err = LoadFrom(grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, g.Documents[0].oldPath == "", "expected no Path in the saved db, got %q", g.Documents[0].oldPath)
+}
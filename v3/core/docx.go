@@ -0,0 +1,107 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// isDocx returns true if the document is a Word document, which
+// needs its text extracted before chunking.
+func isDocx(doc *Document) bool {
+	return !doc.Synthetic && strings.HasSuffix(strings.ToLower(doc.RelPath), ".docx")
+}
+
+// docxText extracts the text of a .docx file.  Paragraphs are
+// separated by blank lines so that the paragraph splitter sees them.
+// Tables are rendered one row per line with cells separated by tabs.
+// Chunk offsets refer to this text rather than to the file, so the
+// extraction must stay deterministic.
+func docxText(buf []byte) (text string, err error) {
+	defer Return(&err)
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	Ck(err, "reading docx")
+	var body io.ReadCloser
+	for _, f := range zr.File {
+		if f.Name == "word/document.xml" {
+			body, err = f.Open()
+			Ck(err)
+			break
+		}
+	}
+	if body == nil {
+		err = fmt.Errorf("docx has no word/document.xml")
+		return
+	}
+	defer body.Close()
+
+	var out bytes.Buffer
+	// tables nest, and paragraphs inside cells must not be split
+	// into separate chunks
+	tableDepth := 0
+	inText := false
+	dec := xml.NewDecoder(body)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		Ck(err, "parsing docx")
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				out.WriteString("\t")
+			case "br", "cr":
+				out.WriteString("\n")
+			case "tbl":
+				tableDepth++
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				if tableDepth > 0 {
+					out.WriteString(" ")
+				} else {
+					out.WriteString("\n\n")
+				}
+			case "tc":
+				trimSpace(&out)
+				out.WriteString("\t")
+			case "tr":
+				trimSpace(&out)
+				out.WriteString("\n")
+			case "tbl":
+				tableDepth--
+				if tableDepth == 0 {
+					out.WriteString("\n")
+				}
+			}
+		case xml.CharData:
+			if inText {
+				out.Write(t)
+			}
+		}
+	}
+	text = out.String()
+	return
+}
+
+// trimSpace removes trailing spaces and tabs from buf.
+func trimSpace(buf *bytes.Buffer) {
+	b := buf.Bytes()
+	n := len(b)
+	for n > 0 && (b[n-1] == ' ' || b[n-1] == '\t') {
+		n--
+	}
+	buf.Truncate(n)
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+const testDocxBody = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:body>
+<w:p><w:r><w:t>The quarterly report</w:t></w:r><w:r><w:t xml:space="preserve"> covers sales.</w:t></w:r></w:p>
+<w:p><w:r><w:t>Second paragraph.</w:t></w:r></w:p>
+<w:tbl>
+<w:tr><w:tc><w:p><w:r><w:t>Region</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>Total</w:t></w:r></w:p></w:tc></w:tr>
+<w:tr><w:tc><w:p><w:r><w:t>North</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>42</w:t></w:r></w:p></w:tc></w:tr>
+</w:tbl>
+</w:body>
+</w:document>`
+
+func TestDocx(t *testing.T) {
+	dir := TmpTestDir()
+	fn := filepath.Join(dir, "report.docx")
+	fh, err := os.Create(fn)
+	Tassert(t, err == nil, "error creating docx: %v", err)
+	zw := zip.NewWriter(fh)
+	w, err := zw.Create("word/document.xml")
+	Tassert(t, err == nil, "error creating docx: %v", err)
+	_, err = w.Write([]byte(testDocxBody))
+	Tassert(t, err == nil, "error writing docx: %v", err)
+	err = zw.Close()
+	Tassert(t, err == nil, "error closing docx: %v", err)
+	err = fh.Close()
+	Tassert(t, err == nil, "error closing docx: %v", err)
+
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chunks, err := grok.DocumentChunks("report.docx")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	Tassert(t, len(chunks) == 3, "expected 3 chunks, got %d", len(chunks))
+	var texts []string
+	for _, chunk := range chunks {
+		text, err := grok.ChunkText(chunk)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		texts = append(texts, strings.TrimSpace(text))
+	}
+	Tassert(t, texts[0] == "The quarterly report covers sales.", "unexpected first chunk %q", texts[0])
+	Tassert(t, texts[2] == "Region\tTotal\nNorth\t42", "unexpected table chunk %q", texts[2])
+
+	// files that aren't really docx are reported, not embedded
+	err = ioutil.WriteFile(filepath.Join(dir, "bad.docx"), []byte("not a zip"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(filepath.Join(dir, "bad.docx"))
+	Tassert(t, err != nil, "expected error for bad docx")
+}
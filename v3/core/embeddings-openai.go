@@ -2,59 +2,318 @@ package core
 
 import (
 	"context"
-	"os"
+	"errors"
+	"fmt"
 	"time"
 
-	embedLib "github.com/fabiustech/openai"
-	embedModelLib "github.com/fabiustech/openai/models"
+	gptLib "github.com/stevegt/go-openai"
 	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+	"github.com/stevegt/grokker/v3/openai"
 )
 
 // XXX using only OpenAI for embedding -- need to support more providers
 
-// initEmbeddingClient initializes the OpenAI embedding client.
+// DefaultEmbeddingModel is the embedding model used when
+// Grokker.EmbeddingModel is empty.
+const DefaultEmbeddingModel = "text-embedding-ada-002"
+
+// embeddingModelSpec describes an embedding model.
+type embeddingModelSpec struct {
+	// shortens is true if the model accepts a requested number of
+	// dimensions.
+	shortens bool
+	// tokenLimit is the most tokens the model accepts in one input.
+	tokenLimit int
+}
+
+// embeddingModels lists the embedding models grokker knows.
+var embeddingModels = map[string]embeddingModelSpec{
+	"text-embedding-ada-002": {shortens: false, tokenLimit: 8191},
+	"text-embedding-3-small": {shortens: true, tokenLimit: 8191},
+	"text-embedding-3-large": {shortens: true, tokenLimit: 8191},
+}
+
+// legacyEmbeddingTokenLimit is the EmbeddingTokenLimit stored by dbs
+// made before the limit was taken from the embedding model, whatever
+// the model was.
+const legacyEmbeddingTokenLimit = 8192
+
+// openaiEmbedder implements the client.Embedder interface using the
+// OpenAI embeddings API.
+type openaiEmbedder struct {
+	client *gptLib.Client
+	// model is the embedding model name
+	model string
+	// dims is the number of dimensions requested, or zero for the
+	// model's default
+	dims int
+	// keyErr is the problem with OPENAI_API_KEY found when the
+	// embedder was made, if any
+	keyErr error
+}
+
+// CreateEmbeddings returns the embeddings for texts from the OpenAI
+// embeddings API.
+func (e *openaiEmbedder) CreateEmbeddings(texts []string) (embeddings [][]float64, err error) {
+	defer Return(&err)
+	if e.keyErr != nil {
+		return nil, e.keyErr
+	}
+	req := gptLib.EmbeddingRequestStrings{
+		Input:      texts,
+		Model:      gptLib.EmbeddingModel(e.model),
+		Dimensions: e.dims,
+	}
+	res, err := e.client.CreateEmbeddings(context.Background(), req)
+	if err != nil {
+		return
+	}
+	for _, em := range res.Data {
+		embedding := make([]float64, len(em.Embedding))
+		for i, v := range em.Embedding {
+			embedding[i] = float64(v)
+		}
+		embeddings = append(embeddings, embedding)
+	}
+	return
+}
+
+// embeddingModel returns the name of the embedding model.
+func (g *Grokker) embeddingModel() string {
+	if g.EmbeddingModel == "" {
+		return DefaultEmbeddingModel
+	}
+	return g.EmbeddingModel
+}
+
+// initEmbeddingTokenLimit records the embedding model's input limit in
+// a new db, or in one that stored legacyEmbeddingTokenLimit.
+func (g *Grokker) initEmbeddingTokenLimit() {
+	if g.EmbeddingTokenLimit == 0 || g.EmbeddingTokenLimit == legacyEmbeddingTokenLimit {
+		g.EmbeddingTokenLimit = embeddingModels[g.embeddingModel()].tokenLimit
+	}
+}
+
+// initEmbeddingClient initializes the OpenAI embedding client, unless
+// another embedder has been set with SetEmbedder.  If OPENAI_BASE_URL
+// is set, requests go there instead of to the OpenAI API.
 func (g *Grokker) initEmbeddingClient() {
-	authtoken := os.Getenv("OPENAI_API_KEY")
-	g.embeddingClient = embedLib.NewClient(authtoken)
+	if g.embedder != nil {
+		return
+	}
+	g.embedder = &openaiEmbedder{
+		client: openai.NewClientWithHTTP(g.ChatOptions.HTTPClient),
+		model:  g.embeddingModel(),
+		dims:   g.EmbeddingDimensions,
+		keyErr: openai.CheckAPIKey(),
+	}
 }
 
-// createEmbeddings returns the embeddings for a slice of text chunks.
-func (g *Grokker) createEmbeddings(texts []string) (embeddings [][]float64, err error) {
+// SetEmbeddingModel sets the embedding model and the number of
+// dimensions to request from it, re-embedding every chunk if either
+// changes.  dims of zero uses the model's default; only the
+// text-embedding-3 models accept other values.  EmbeddingTokenLimit
+// is set to the model's input limit.  Any projection set
+// with SetEmbeddingDims is removed, since it was made for the old
+// model's embeddings.  Embedders set with SetEmbedder are not
+// affected.
+func (g *Grokker) SetEmbeddingModel(model string, dims int) (err error) {
 	defer Return(&err)
-	// use github.com/fabiustech/openai library
-	c := g.embeddingClient
-	// simply call c.CreateEmbeddings() once for each text chunk.
-	for i := 0; i < len(texts); i++ {
-		text := texts[i]
-		// set empty chunk embedding to nil
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if model == "" {
+		model = DefaultEmbeddingModel
+	}
+	spec, ok := embeddingModels[model]
+	if !ok {
+		err = fmt.Errorf("%q: %w", model, ErrModelNotFound)
+		return
+	}
+	if dims < 0 || (dims > 0 && !spec.shortens) {
+		err = fmt.Errorf("%s does not support %d dimensions", model, dims)
+		return
+	}
+	if model == g.embeddingModel() && dims == g.EmbeddingDimensions {
+		return
+	}
+	g.EmbeddingTokenLimit = spec.tokenLimit
+	g.EmbeddingModel = model
+	if model == DefaultEmbeddingModel {
+		g.EmbeddingModel = ""
+	}
+	g.EmbeddingDimensions = dims
+	if e, ok := g.embedder.(*openaiEmbedder); ok {
+		e.model = model
+		e.dims = dims
+	}
+	if g.isAltEmbeddingModel(model) {
+		g.removeAltEmbeddingModel(model)
+	}
+	g.Projection = nil
+	for _, chunk := range g.Chunks {
+		chunk.Embedding = nil
+	}
+	_, _, err = g.rebuild()
+	Ck(err)
+	return
+}
+
+// SetEmbeddingTokenLimit sets EmbeddingTokenLimit, the most tokens
+// sent to the embedding model in one input, for a model that accepts
+// fewer or more tokens than grokker expects, e.g. one served at
+// OPENAI_BASE_URL or by an embedder set with SetEmbedder.  Zero
+// restores the embedding model's limit.  As with SetChunkTokens,
+// documents already in the db keep their chunks until they change or
+// the db is rebuilt.
+func (g *Grokker) SetEmbeddingTokenLimit(limit int) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if limit < 0 {
+		return fmt.Errorf("embedding token limit must not be negative, got %d", limit)
+	}
+	if limit == 0 {
+		limit = embeddingModels[g.embeddingModel()].tokenLimit
+	}
+	g.EmbeddingTokenLimit = limit
+	return
+}
+
+// SetEmbedder replaces the client used to create embeddings, e.g. with
+// a fake for testing or a wrapper that adds logging or metrics.
+func (g *Grokker) SetEmbedder(e client.Embedder) {
+	g.embedder = e
+}
+
+// DefaultEmbeddingBatchTokens is the default value of
+// Grokker.EmbeddingBatchTokens.
+const DefaultEmbeddingBatchTokens = 100000
+
+// DefaultEmbeddingBatchSize is the default value of
+// Grokker.EmbeddingBatchSize, the most inputs the OpenAI embeddings
+// API accepts in one request.
+const DefaultEmbeddingBatchSize = 2048
+
+// embeddingBatchLimits returns the most tokens and texts to send in
+// a single embeddings request.
+func (g *Grokker) embeddingBatchLimits() (maxTokens, maxTexts int) {
+	maxTokens = g.EmbeddingBatchTokens
+	if maxTokens <= 0 {
+		maxTokens = DefaultEmbeddingBatchTokens
+	}
+	maxTexts = g.EmbeddingBatchSize
+	if maxTexts <= 0 {
+		maxTexts = DefaultEmbeddingBatchSize
+	}
+	// a batch must fit in a minute's allowance
+	if g.EmbeddingTokensPerMinute > 0 {
+		maxTokens = min(maxTokens, g.EmbeddingTokensPerMinute)
+	}
+	return
+}
+
+// embeddingBatches groups the texts with the given token counts into
+// batches of indexes, in order, so that no batch has more than
+// maxTexts texts or, unless it holds a single text, more than
+// maxTokens tokens.  Texts with zero tokens are left out.
+func embeddingBatches(tokenCounts []int, maxTokens, maxTexts int) (batches [][]int) {
+	var batch []int
+	var batchTokens int
+	for i, tc := range tokenCounts {
+		if tc == 0 {
+			continue
+		}
+		if len(batch) > 0 && (batchTokens+tc > maxTokens || len(batch) >= maxTexts) {
+			batches = append(batches, batch)
+			batch = nil
+			batchTokens = 0
+		}
+		batch = append(batch, i)
+		batchTokens += tc
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return
+}
+
+// createEmbeddings returns the embeddings for a slice of text chunks,
+// with nil embeddings for empty texts.  Texts are sent in batches
+// limited by g.embeddingBatchLimits.  If progress is not nil, it is
+// called after each batch.
+func (g *Grokker) createEmbeddings(texts []string, progress func(done, total int)) (embeddings [][]float64, err error) {
+	return g.createEmbeddingsWith(g.embedder, texts, progress)
+}
+
+// createEmbeddingsWith is like createEmbeddings, but uses c rather
+// than the embedding model's client.
+func (g *Grokker) createEmbeddingsWith(c client.Embedder, texts []string, progress func(done, total int)) (embeddings [][]float64, err error) {
+	defer Return(&err)
+	tokenCounts := make([]int, len(texts))
+	for i, text := range texts {
 		if len(text) == 0 {
-			embeddings = append(embeddings, nil)
 			continue
 		}
-		inputs := []string{text}
-		req := &embedLib.EmbeddingRequest{
-			Input: inputs,
-			Model: embedModelLib.AdaEmbeddingV2,
+		tokenCounts[i], err = g.TokenCount(text)
+		Ck(err)
+		if tokenCounts[i] == 0 {
+			// count every non-empty text so that it gets an
+			// embedding
+			tokenCounts[i] = 1
 		}
-		Debug("creating embedding for chunk %d of %d ...", i+1, len(texts))
-		// Debug("text: %q", text)
+	}
+	if g.embeddingOverflow() == OverflowTruncate && g.EmbeddingTokenLimit > 0 {
+		texts, err = g.truncateInputs(texts, tokenCounts)
+		Ck(err)
+	}
+	maxTokens, maxTexts := g.embeddingBatchLimits()
+	batches := embeddingBatches(tokenCounts, maxTokens, maxTexts)
+	embeddings = make([][]float64, len(texts))
+	limiter := g.embeddingLimiter()
+	var done int
+	for n, batch := range batches {
+		inputs := make([]string, len(batch))
+		var batchTokens int
+		for j, i := range batch {
+			inputs[j] = texts[i]
+			batchTokens += tokenCounts[i]
+		}
+		Debug("creating embeddings for batch %d of %d (%d texts) ...", n+1, len(batches), len(batch))
 		// loop with backoff until we get a response
-		var res *embedLib.EmbeddingResponse
+		var res [][]float64
 		for backoff := 1; backoff < 10; backoff++ {
-			res, err = c.CreateEmbeddings(context.Background(), req)
+			if limiter != nil {
+				limiter.wait(batchTokens)
+			}
+			res, err = c.CreateEmbeddings(inputs)
 			if err == nil {
 				break
 			}
+			if errors.Is(err, openai.ErrAPIKey) {
+				// retrying won't help
+				break
+			}
 			Pf("openai API error, retrying: %#v", err)
 			// wait and try again
 			time.Sleep(time.Second * time.Duration(backoff))
 		}
-		Ck(err, "%T: %#v", err, err)
-		for _, em := range res.Data {
-			embeddings = append(embeddings, em.Embedding)
+		Ck(embeddingError(err), "%T: %#v", err, err)
+		if len(res) != len(batch) {
+			err = embeddingError(fmt.Errorf("got %d embeddings for %d texts", len(res), len(batch)))
+			return
+		}
+		for j, i := range batch {
+			embeddings[i] = res[j]
 		}
+		done = batch[len(batch)-1] + 1
+		if progress != nil {
+			progress(done, len(texts))
+		}
+	}
+	if progress != nil && done < len(texts) {
+		// the remaining texts are empty
+		progress(len(texts), len(texts))
 	}
 	Debug("created %d embeddings", len(embeddings))
-	Assert(len(embeddings) <= len(texts))
 	return
 }
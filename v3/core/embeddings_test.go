@@ -0,0 +1,253 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestEmbeddingBatches(t *testing.T) {
+	cases := []struct {
+		counts    []int
+		maxTokens int
+		maxTexts  int
+		want      string
+	}{
+		// one input exactly fills the budget
+		{[]int{10, 1}, 10, 100, "[[0] [1]]"},
+		{[]int{4, 6, 1}, 10, 100, "[[0 1] [2]]"},
+		// one token over the budget
+		{[]int{4, 7}, 10, 100, "[[0] [1]]"},
+		// an input bigger than the budget gets a batch of its own
+		{[]int{1, 20, 1}, 10, 100, "[[0] [1] [2]]"},
+		// the text limit
+		{[]int{1, 1, 1, 1, 1}, 100, 2, "[[0 1] [2 3] [4]]"},
+		// empty texts are left out
+		{[]int{0, 3, 0, 3, 0}, 100, 100, "[[1 3]]"},
+		{[]int{0, 0}, 100, 100, "[]"},
+	}
+	for _, c := range cases {
+		got := fmt.Sprint(embeddingBatches(c.counts, c.maxTokens, c.maxTexts))
+		Tassert(t, got == c.want, "embeddingBatches(%v, %d, %d) = %s, want %s", c.counts, c.maxTokens, c.maxTexts, got, c.want)
+	}
+}
+
+// batchCountingEmbedder is a client.Embedder that records the size
+// of each request and the texts it was given.
+type batchCountingEmbedder struct {
+	sizes []int
+	texts []string
+}
+
+func (e *batchCountingEmbedder) CreateEmbeddings(texts []string) (embeddings [][]float64, err error) {
+	e.sizes = append(e.sizes, len(texts))
+	e.texts = append(e.texts, texts...)
+	for i := range texts {
+		embeddings = append(embeddings, []float64{1, float64(i), 0})
+	}
+	return
+}
+
+func TestCreateEmbeddingsBatches(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &batchCountingEmbedder{}
+	grok.SetEmbedder(embedder)
+	// "hello world" is two tokens
+	grok.EmbeddingBatchTokens = 4
+	grok.EmbeddingBatchSize = 3
+	texts := []string{"hello world", "", "hello world", "hello world", "a", "b", "c", ""}
+	var lastDone int
+	embeddings, err := grok.createEmbeddings(texts, func(done, total int) { lastDone = done })
+	Tassert(t, err == nil, "error creating embeddings: %v", err)
+	Tassert(t, fmt.Sprint(embedder.sizes) == "[2 3 1]", "unexpected batch sizes %v", embedder.sizes)
+	Tassert(t, len(embeddings) == len(texts), "expected %d embeddings, got %d", len(texts), len(embeddings))
+	Tassert(t, embeddings[1] == nil && embeddings[7] == nil, "expected nil embeddings for empty texts")
+	Tassert(t, embeddings[2][1] == 1, "expected second embedding of its batch, got %v", embeddings[2])
+	Tassert(t, lastDone == len(texts), "expected final progress %d, got %d", len(texts), lastDone)
+}
+
+func TestEmbeddingOverflow(t *testing.T) {
+	dir := TmpTestDir()
+	fn := filepath.Join(dir, "long.txt")
+	err := ioutil.WriteFile(fn, []byte(strings.Repeat("lorem ipsum dolor sit amet ", 20)), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+
+	add := func(policy string) (grok *Grokker, embedder *batchCountingEmbedder, err error) {
+		grok, err = Init(TmpTestDir(), "gpt-4")
+		Tassert(t, err == nil, "error creating grokker: %v", err)
+		embedder = &batchCountingEmbedder{}
+		grok.SetEmbedder(embedder)
+		grok.EmbeddingTokenLimit = 20
+		err = grok.SetEmbeddingOverflow(policy)
+		Tassert(t, err == nil, "error setting overflow policy: %v", err)
+		err = grok.AddDocument(fn)
+		return
+	}
+
+	// split makes several chunks
+	grok, embedder, err := add(OverflowSplit)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Chunks) > 1, "expected several chunks, got %d", len(grok.Chunks))
+	Tassert(t, len(embedder.texts) == len(grok.Chunks), "expected %d inputs, got %d", len(grok.Chunks), len(embedder.texts))
+
+	// truncate makes one chunk and embeds only its start
+	grok, embedder, err = add(OverflowTruncate)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Chunks) == 1, "expected one chunk, got %d", len(grok.Chunks))
+	Tassert(t, len(embedder.texts) == 1, "expected one input, got %d", len(embedder.texts))
+	tc, err := grok.TokenCount(embedder.texts[0])
+	Tassert(t, err == nil, "error counting tokens: %v", err)
+	Tassert(t, tc <= 20, "expected at most 20 tokens, got %d", tc)
+	Tassert(t, strings.Contains(embedder.texts[0], "lorem ipsum"), "unexpected input %q", embedder.texts[0])
+	text, err := grok.ChunkText(grok.Chunks[0])
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, len(text) > len(embedder.texts[0]), "expected the whole chunk to be kept")
+
+	// error refuses the document
+	_, _, err = add(OverflowError)
+	Tassert(t, err != nil, "expected error for long chunk")
+
+	grok, err = Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.SetEmbeddingOverflow("squash")
+	Tassert(t, err != nil, "expected error for unknown policy")
+}
+
+func TestSetEmbeddingModel(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, grok.embeddingDims() == 1536, "expected 1536 dimensions, got %d", grok.embeddingDims())
+	err = grok.SetEmbeddingModel("text-embedding-ada-002", 256)
+	Tassert(t, err != nil, "expected error shortening ada-002")
+	err = grok.SetEmbeddingModel("no-such-model", 0)
+	Tassert(t, errors.Is(err, ErrModelNotFound), "expected ErrModelNotFound, got %v", err)
+	err = grok.SetEmbeddingModel("text-embedding-3-small", 256)
+	Tassert(t, err == nil, "error setting embedding model: %v", err)
+	Tassert(t, grok.EmbeddingModel == "text-embedding-3-small", "unexpected model %q", grok.EmbeddingModel)
+	Tassert(t, grok.embeddingDims() == 256, "expected 256 dimensions, got %d", grok.embeddingDims())
+	_, err = grok.Search("software", 1)
+	Tassert(t, err == nil, "error searching: %v", err)
+	// a query embedded with other dimensions is rejected
+	grok.embedder.(*openaiEmbedder).dims = 512
+	_, err = grok.Search("software", 1)
+	Tassert(t, err != nil, "expected error for mismatched query dimensions")
+}
+
+func TestEmbeddingTokenLimit(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.SetEmbedder(&countingEmbedder{})
+	Tassert(t, grok.EmbeddingTokenLimit == 8191, "expected limit 8191, got %d", grok.EmbeddingTokenLimit)
+	// dbs from older versions stored 8192 whatever the model
+	grok.EmbeddingTokenLimit = 8192
+	err = grok.Setup("")
+	Tassert(t, err == nil, "error setting up: %v", err)
+	Tassert(t, grok.EmbeddingTokenLimit == 8191, "expected limit 8191, got %d", grok.EmbeddingTokenLimit)
+
+	err = grok.SetEmbeddingTokenLimit(-1)
+	Tassert(t, err != nil, "expected error for negative limit")
+	err = grok.SetEmbeddingTokenLimit(500)
+	Tassert(t, err == nil, "error setting limit: %v", err)
+	Tassert(t, grok.chunkTokens() == 500, "expected 500 chunk tokens, got %d", grok.chunkTokens())
+	// the limit survives a reload
+	err = grok.Setup("")
+	Tassert(t, err == nil, "error setting up: %v", err)
+	Tassert(t, grok.EmbeddingTokenLimit == 500, "expected limit 500, got %d", grok.EmbeddingTokenLimit)
+	err = grok.SetEmbeddingTokenLimit(0)
+	Tassert(t, err == nil, "error setting limit: %v", err)
+	Tassert(t, grok.EmbeddingTokenLimit == 8191, "expected limit 8191, got %d", grok.EmbeddingTokenLimit)
+}
+
+func TestChunkEmbeddings(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	for _, fn := range []string{"testdata/te-abstract.txt", "testdata/te-full.txt"} {
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	records, err := grok.ChunkEmbeddings()
+	Tassert(t, err == nil, "error getting embeddings: %v", err)
+	Tassert(t, len(records) == len(grok.Chunks), "expected %d records, got %d", len(grok.Chunks), len(records))
+	Tassert(t, records[0].Path == grok.Documents[0].RelPath, "expected the first document first, got %s", records[0].Path)
+	for i := 1; i < len(records); i++ {
+		prev, rec := records[i-1], records[i]
+		Tassert(t, prev.Path != rec.Path || prev.Offset < rec.Offset, "records out of order at %d: %v, %v", i, prev.Offset, rec.Offset)
+	}
+
+	// the stored embeddings match those of the embedded text
+	rec := records[len(records)-1]
+	Tassert(t, rec.Text != "", "expected chunk text")
+	embeddings, err := grok.EmbedText([]string{Spf("from %s:\n%s\n", rec.Path, rec.Text), ""})
+	Tassert(t, err == nil, "error embedding text: %v", err)
+	Tassert(t, len(embeddings) == 2 && embeddings[1] == nil, "expected a nil embedding for empty text, got %v", embeddings)
+	sim := grok.similarity(embeddings[0], rec.Embedding)
+	Tassert(t, sim > 0.999, "expected the same embedding, got similarity %v", sim)
+
+	// the records are copies
+	rec.Embedding[0] += 1
+	again, err := grok.ChunkEmbeddings()
+	Tassert(t, err == nil, "error getting embeddings: %v", err)
+	Tassert(t, again[len(again)-1].Embedding[0] != rec.Embedding[0], "expected a copy of the embedding")
+}
+
+func TestShareEmbeddings(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &countingEmbedder{}
+	grok.SetEmbedder(embedder)
+	boilerplate := "Copyright the authors.  Licensed under the Apache License, Version 2.0."
+	add := func(name, body string) {
+		fn := filepath.Join(dir, name)
+		err := ioutil.WriteFile(fn, []byte(boilerplate+"\n\n"+body+"\n"), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		embedder.count = 0
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	// without sharing, the boilerplate is embedded for each document
+	add("a.txt", "The server listens on port 8080.")
+	Tassert(t, embedder.count == 2, "expected 2 embeddings, got %d", embedder.count)
+	add("b.txt", "The client retries three times.")
+	Tassert(t, embedder.count == 2, "expected 2 embeddings, got %d", embedder.count)
+
+	// with sharing, only the new text is
+	grok.ShareEmbeddings = true
+	add("c.txt", "The cache holds one hour of data.")
+	Tassert(t, embedder.count == 1, "expected 1 embedding, got %d", embedder.count)
+	a, err := grok.DocumentChunks("a.txt")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	c, err := grok.DocumentChunks("c.txt")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	Tassert(t, c[0].TextHash == a[0].TextHash && c[0].Hash != a[0].Hash, "expected the same text in different documents")
+	Tassert(t, c[0].Embedding != nil && &c[0].Embedding[0] != &a[0].Embedding[0], "expected a copy of the shared embedding")
+
+	// text hashes are saved, and chunks made by older versions get
+	// them when refreshed
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, g.ShareEmbeddings, "expected ShareEmbeddings to be saved")
+	for _, chunk := range g.Chunks {
+		Tassert(t, chunk.TextHash != "", "expected text hash to be loaded for %s", chunk.Document.RelPath)
+		chunk.TextHash = ""
+	}
+	embedder = &countingEmbedder{}
+	g.SetEmbedder(embedder)
+	err = g.RefreshEmbeddings()
+	Tassert(t, err == nil, "error refreshing: %v", err)
+	Tassert(t, embedder.count == 0, "expected no embeddings, got %d", embedder.count)
+	for _, chunk := range g.Chunks {
+		Tassert(t, chunk.TextHash != "", "expected text hash to be set for %s", chunk.Document.RelPath)
+	}
+}
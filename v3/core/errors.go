@@ -0,0 +1,195 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors returned by the Grokker API wrap one of these, so that
+// callers can tell failures apart with errors.Is.  Internally errors
+// are still propagated with Ck and Return, which preserve wrapping.
+var (
+	// ErrDocumentNotFound means a document is not in the database.
+	ErrDocumentNotFound = errors.New("document not in the database")
+	// ErrDBNotFound means there is no Grokker database where one
+	// was looked for.
+	ErrDBNotFound = errors.New("no .grok file found")
+	// ErrModelNotFound means a model name is not known to grokker.
+	ErrModelNotFound = errors.New("model not found")
+	// ErrTokenLimitExceeded means a request doesn't fit in the
+	// model's token limit even after trimming the context.
+	ErrTokenLimitExceeded = errors.New("token limit exceeded")
+	// ErrBinaryDocument means a document looks like a binary file,
+	// whose embeddings would be meaningless.
+	ErrBinaryDocument = errors.New("looks binary")
+	// ErrDocumentTooLarge means a document is larger than
+	// Grokker.MaxFileSize, so it wasn't read.
+	ErrDocumentTooLarge = errors.New("document too large")
+	// ErrEmptyDocument means a document is empty or only whitespace,
+	// so it has no chunks to embed.  It is only returned when
+	// Grokker.RejectEmptyDocuments is set.
+	ErrEmptyDocument = errors.New("document has no text to embed")
+	// ErrAPI means a chat or embedding provider's API call failed,
+	// e.g. because of a network error or a rejected request.
+	ErrAPI = errors.New("API error")
+	// ErrChatAPI means a chat provider's API call failed.  It wraps
+	// ErrAPI.  Answer still returns the retrieved context when the
+	// chat API fails; see Result.Degraded.
+	ErrChatAPI = fmt.Errorf("chat %w", ErrAPI)
+	// ErrEmbeddingAPI means an embedding provider's API call failed.
+	// It wraps ErrAPI.
+	ErrEmbeddingAPI = fmt.Errorf("embedding %w", ErrAPI)
+	// ErrEmptyDiff means a commit message was requested for an
+	// empty diff.
+	ErrEmptyDiff = errors.New("empty diff")
+	// ErrNotDiff means a commit message was requested for text that
+	// isn't a diff.
+	ErrNotDiff = errors.New("not a diff")
+	// ErrNoVision means images were given to a model that doesn't
+	// accept them.
+	ErrNoVision = errors.New("model does not accept images")
+	// ErrNoRelevantContext means no chunk of the knowledge base is
+	// relevant enough to a question to answer it from; see
+	// Grokker.MinRelevance.
+	ErrNoRelevantContext = errors.New("no relevant context found")
+	// ErrInvalidJSON means the model didn't return a valid JSON
+	// object in JSON mode, even after being asked to correct it; see
+	// Grokker.JSONRetries.
+	ErrInvalidJSON = errors.New("reply is not a valid JSON object")
+	// ErrInvalidRequest means a request to the Server is missing
+	// something it needs, e.g. a question.
+	ErrInvalidRequest = errors.New("invalid request")
+)
+
+// chatError wraps err, if not nil, with ErrChatAPI.
+func chatError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrChatAPI, err)
+}
+
+// embeddingError wraps err, if not nil, with ErrEmbeddingAPI.
+func embeddingError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrEmbeddingAPI, err)
+}
+
+// apiOnly returns err if it wraps ErrAPI, and nil otherwise.
+func apiOnly(err error) error {
+	if errors.Is(err, ErrAPI) {
+		return err
+	}
+	return nil
+}
+
+// httpStatus returns the HTTP status code for an error returned by
+// the Grokker API.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidRequest), errors.Is(err, ErrNoVision), errors.Is(err, ErrEmptyDiff), errors.Is(err, ErrNotDiff):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrDocumentNotFound), errors.Is(err, ErrModelNotFound), errors.Is(err, ErrNoRelevantContext):
+		return http.StatusNotFound
+	case errors.Is(err, ErrBinaryDocument), errors.Is(err, ErrEmptyDocument):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrTokenLimitExceeded), errors.Is(err, ErrDocumentTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrAPI), errors.Is(err, ErrInvalidJSON):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// DocumentError is an error with one document.
+type DocumentError struct {
+	// RelPath is the path of the document, as in Document.RelPath.
+	RelPath string
+	// Err is what went wrong.
+	Err error
+}
+
+func (e DocumentError) Error() string {
+	return fmt.Sprintf("%s: %v", e.RelPath, e.Err)
+}
+
+func (e DocumentError) Unwrap() error {
+	return e.Err
+}
+
+// RefreshError is returned by UpdateEmbeddings and RefreshEmbeddings
+// when some documents could not be updated, e.g. because they can't
+// be read.  The other documents are updated anyway, and those that
+// failed keep their old chunks and embeddings, so the database is
+// still worth saving.
+type RefreshError struct {
+	// Failed lists the documents that could not be updated, in the
+	// order they were tried.
+	Failed []DocumentError
+}
+
+func (e *RefreshError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("failed to update %d document(s): %s", len(e.Failed), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of the failed documents, so that
+// errors.Is can find e.g. an os.ErrPermission among them.
+func (e *RefreshError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f
+	}
+	return errs
+}
+
+// QuestionError is an error with one question of a batch.
+type QuestionError struct {
+	// Index is the position of the question in the batch.
+	Index int
+	// Question is the question that failed.
+	Question string
+	// Err is what went wrong.
+	Err error
+}
+
+func (e QuestionError) Error() string {
+	return fmt.Sprintf("question %d (%.40q): %v", e.Index+1, e.Question, e.Err)
+}
+
+func (e QuestionError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by AnswerBatch when some questions could not
+// be answered.  The other questions are answered anyway.
+type BatchError struct {
+	// Failed lists the questions that could not be answered, in
+	// batch order.
+	Failed []QuestionError
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = f.Error()
+	}
+	return fmt.Sprintf("failed to answer %d question(s): %s", len(e.Failed), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of the failed questions, so that
+// errors.Is can find e.g. ErrChatAPI among them.
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f
+	}
+	return errs
+}
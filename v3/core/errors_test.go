@@ -0,0 +1,87 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+	"github.com/stevegt/grokker/v3/openai"
+)
+
+// failingChat is a client.ChatClient whose requests always fail.
+type failingChat struct{}
+
+func (failingChat) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	err = errors.New("connection refused")
+	return
+}
+
+func TestSentinelErrors(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	_, err = grok.Answer("no-such-model", "What?", false, false, false)
+	Tassert(t, errors.Is(err, ErrModelNotFound), "expected ErrModelNotFound, got %v", err)
+	_, err = grok.DocumentChunks("no-such-doc.txt")
+	Tassert(t, errors.Is(err, ErrDocumentNotFound), "expected ErrDocumentNotFound, got %v", err)
+	err = grok.RefreshDocument("no-such-doc.txt")
+	Tassert(t, errors.Is(err, ErrDocumentNotFound), "expected ErrDocumentNotFound, got %v", err)
+	_, err = grok.Msg("gpt-4", "You are a test.", strings.Repeat("word ", 10000))
+	Tassert(t, errors.Is(err, ErrTokenLimitExceeded), "expected ErrTokenLimitExceeded, got %v", err)
+	grok.SetChatClient("openai", failingChat{})
+	_, err = grok.Msg("gpt-4", "You are a test.", "hello")
+	Tassert(t, errors.Is(err, ErrAPI), "expected ErrAPI, got %v", err)
+	Tassert(t, errors.Is(err, ErrChatAPI) && !errors.Is(err, ErrEmbeddingAPI), "expected ErrChatAPI, got %v", err)
+	Tassert(t, !errors.Is(err, ErrModelNotFound), "unexpected ErrModelNotFound in %v", err)
+}
+
+// failingEmbedder is a client.Embedder whose requests always fail.
+// It fails as if the API key were bad, so that the request isn't
+// retried.
+type failingEmbedder struct{}
+
+func (failingEmbedder) CreateEmbeddings(texts []string) (embeddings [][]float64, err error) {
+	err = fmt.Errorf("%w: connection refused", openai.ErrAPIKey)
+	return
+}
+
+func TestDegradedAnswer(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	question := "What is this about?"
+
+	// without the chat API, queries return the retrieved passages,
+	// even when reranking
+	grok.SetChatClient("openai", failingChat{})
+	grok.Rerank = true
+	res, err := grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, res.Degraded && strings.Contains(res.Notice, "chat API error"), "expected a notice, got %#v", res)
+	Tassert(t, strings.HasPrefix(res.Answer, res.Notice), "expected the notice first, got %q", res.Answer)
+	Tassert(t, strings.Contains(res.Answer, "te-abstract.txt:\nThis paper"), "expected the passages, got %q", res.Answer)
+	Tassert(t, len(res.Sources) == 1, "expected sources, got %v", res.Sources)
+	results, err := grok.Search(question, 1)
+	Tassert(t, err == nil && len(results) == 1, "expected search to work, got %v, %v", results, err)
+
+	// without the embedding API, queries fail unless global
+	// knowledge is allowed
+	grok.SetChatClient("openai", countingChat{})
+	grok.SetEmbedder(failingEmbedder{})
+	_, err = grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, errors.Is(err, ErrEmbeddingAPI) && !errors.Is(err, ErrChatAPI), "expected ErrEmbeddingAPI, got %v", err)
+	_, err = grok.Search(question, 1)
+	Tassert(t, errors.Is(err, ErrEmbeddingAPI), "expected ErrEmbeddingAPI, got %v", err)
+	res, err = grok.AnswerResult("gpt-4", question, false, false, true)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, res.Degraded && strings.Contains(res.Notice, "embedding API error"), "expected a notice, got %#v", res)
+	Tassert(t, strings.HasSuffix(res.Answer, "messages"), "expected an answer, got %q", res.Answer)
+
+	// with neither, there's nothing to return
+	grok.SetChatClient("openai", failingChat{})
+	_, err = grok.AnswerResult("gpt-4", question, false, false, true)
+	Tassert(t, errors.Is(err, ErrChatAPI), "expected ErrChatAPI, got %v", err)
+}
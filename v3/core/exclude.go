@@ -0,0 +1,53 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// checkExclude returns an error if any of g.Exclude is a malformed
+// glob pattern.
+func (g *Grokker) checkExclude() (err error) {
+	for _, pattern := range g.Exclude {
+		_, err = filepath.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("exclude pattern %q: %v", pattern, err)
+		}
+	}
+	return
+}
+
+// excluder returns a function that reports whether the document at
+// relpath is left out of queries by g.Exclude, or nil if g.Exclude is
+// empty.  Answers are remembered, since a document has many chunks.
+// Malformed patterns match nothing; see checkExclude.
+func (g *Grokker) excluder() func(relpath string) bool {
+	if len(g.Exclude) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	return func(relpath string) bool {
+		excluded, ok := seen[relpath]
+		if !ok {
+			excluded = excludes(g.Exclude, relpath)
+			seen[relpath] = excluded
+		}
+		return excluded
+	}
+}
+
+// excludes returns true if relpath is one of patterns, is under a
+// directory that is, or matches one as a glob.
+func excludes(patterns []string, relpath string) bool {
+	for _, pattern := range patterns {
+		pattern = filepath.Clean(pattern)
+		if relpath == pattern || strings.HasPrefix(relpath, pattern+string(filepath.Separator)) {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, relpath); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestExclude(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = os.MkdirAll(filepath.Join(dir, "drafts"), 0755)
+	Tassert(t, err == nil, "error making dir: %v", err)
+	docs := map[string]string{
+		"server.md":        "The server listens on port 8080.",
+		"drafts/server.md": "The server listens on port 80.",
+	}
+	for name, content := range docs {
+		fn := filepath.Join(dir, name)
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	question := "Which port does the server listen on?"
+
+	res, err := grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, len(res.Sources) == 2, "expected both docs as sources, got %v", res.Sources)
+
+	for _, exclude := range []string{"drafts", "drafts/", "drafts/*.md", "drafts/server.md"} {
+		grok.Exclude = []string{exclude}
+		res, err = grok.AnswerResult("gpt-4", question, false, false, false)
+		Tassert(t, err == nil, "error answering: %v", err)
+		Tassert(t, len(res.Sources) == 1 && res.Sources[0] == "server.md", "expected only server.md excluding %q, got %v", exclude, res.Sources)
+		results, err := grok.Search(question, 5)
+		Tassert(t, err == nil, "error searching: %v", err)
+		Tassert(t, len(results) == 1 && results[0].Path == "server.md", "expected only server.md excluding %q, got %v", exclude, results)
+	}
+
+	grok.Exclude = []string{"drafts/["}
+	_, err = grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err != nil, "expected error for a bad pattern")
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// SysMsgExpand is the system message for expanding a query into
+// variants; the number of variants wanted is substituted for %d.
+var SysMsgExpand = "You help a search engine find passages in a collection of documents.  I will give you a question.  Rewrite it as %d different paragraphs, each a fuller restatement of what the question asks that spells out its likely terms, synonyms, and related concepts.  Don't answer the question.  Respond with only a JSON array of strings, one per paragraph."
+
+// expandQuery asks the chat model for g.QueryVariants rephrasings of
+// query.  If the chat API fails or the model's reply can't be used, it
+// warns and returns no variants, since the query alone still works.
+func (g *Grokker) expandQuery(ctx context.Context, query string) (variants []string, err error) {
+	defer Return(&err)
+	if g.QueryVariants <= 0 {
+		return
+	}
+	messages := initMessages(g, g.Model, Spf(SysMsgExpand, g.QueryVariants), g.textOptions())
+	messages = append(messages, client.ChatMsg{
+		Role:    RoleUser,
+		Content: query,
+	})
+	results, err := g.gateway(ctx, g.Model, messages, g.textOptions())
+	if errors.Is(err, ErrChatAPI) && ctx.Err() == nil {
+		// retrieval shouldn't depend on the chat API
+		Fpf(os.Stderr, "warning: not expanding query: %v\n", err)
+		return nil, nil
+	}
+	Ck(err)
+	variants, err = parseQueryVariants(results.Body, g.QueryVariants)
+	if err != nil {
+		Fpf(os.Stderr, "warning: not expanding query: %v\n", err)
+		return nil, nil
+	}
+	Debug("query variants: %q", variants)
+	return
+}
+
+// parseQueryVariants extracts the JSON array of variants from a query
+// expansion reply, tolerating text around the array.  Empty variants
+// are dropped, and at most n are returned.
+func parseQueryVariants(reply string, n int) (variants []string, err error) {
+	start := strings.Index(reply, "[")
+	end := strings.LastIndex(reply, "]")
+	if start < 0 || end < start {
+		err = fmt.Errorf("no JSON array in reply %.60q", reply)
+		return
+	}
+	var all []string
+	err = json.Unmarshal([]byte(reply[start:end+1]), &all)
+	if err != nil {
+		err = fmt.Errorf("can't parse reply %.60q: %v", reply, err)
+		return
+	}
+	for _, v := range all {
+		v = strings.TrimSpace(v)
+		if v != "" && len(variants) < n {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) == 0 {
+		err = fmt.Errorf("no variants in reply %.60q", reply)
+	}
+	return
+}
+
+// expandedScorer returns a function that scores chunks for query as
+// queryScorer does, but merged with the scores for each of variants:
+// a chunk gets the best of its scores, so that it ranks well if it
+// matches the query or any variant.  Variants with no embedding are
+// skipped.
+func (g *Grokker) expandedScorer(query string, embedding []float64, variants []string) (score func(*Chunk) float64, err error) {
+	defer Return(&err)
+	score, err = g.queryScorer(query, embedding)
+	Ck(err)
+	if len(variants) == 0 {
+		return
+	}
+	scorers := []func(*Chunk) float64{score}
+	for _, variant := range variants {
+		embedding, err := g.queryEmbedding(variant)
+		Ck(err)
+		if embedding == nil {
+			continue
+		}
+		scorer, err := g.queryScorer(variant, embedding)
+		Ck(err)
+		scorers = append(scorers, scorer)
+	}
+	// topChunks, relevantChunks, and explainChunks all score the
+	// same chunks, so remember the merged scores
+	merged := make(map[*Chunk]float64)
+	score = func(chunk *Chunk) float64 {
+		if s, ok := merged[chunk]; ok {
+			return s
+		}
+		best := math.Inf(-1)
+		for _, scorer := range scorers {
+			best = math.Max(best, scorer(chunk))
+		}
+		merged[chunk] = best
+		return best
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// queryExpander is a client.ChatClient that replies to every request,
+// such as a query expansion request, with reply.
+type queryExpander struct {
+	reply string
+	calls int
+}
+
+func (e *queryExpander) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	e.calls++
+	results.Body = e.reply
+	return
+}
+
+func TestQueryExpansion(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.SetEmbedder(&keywordEmbedder{words: []string{"battery", "flour"}})
+	err = grok.AddReader("pancakes.txt", strings.NewReader("Pancakes need flour, eggs, and milk."))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.AddReader("car.txt", strings.NewReader("If the engine won't turn over, check whether the battery is flat."))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	expander := &queryExpander{reply: `Here: ["Why won't my car's engine turn over?  Is the battery dead?"]`}
+	grok.SetChatClient("openai", expander)
+	query := "car won't start"
+
+	// the query shares no words with either document
+	_, explained, err := grok.retrieve(context.Background(), query, 100000, nil, false, false, true)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, len(explained) == 2, "expected 2 candidates, got %v", explained)
+	Tassert(t, explained[0].Score == explained[1].Score, "expected a tie, got %v", explained)
+	Tassert(t, expander.calls == 0, "expected no expansion request, got %d", expander.calls)
+
+	grok.QueryVariants = 3
+	_, explained, err = grok.retrieve(context.Background(), query, 100000, nil, false, false, true)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, explained[0].Path == "car.txt", "expected car.txt first, got %v", explained)
+	Tassert(t, explained[0].Score > explained[1].Score, "expected car.txt to score higher, got %v", explained)
+	Tassert(t, expander.calls == 1, "expected one expansion request, got %d", expander.calls)
+
+	// a useless reply leaves the query as it was
+	expander.reply = "I can't help with that."
+	_, explained, err = grok.retrieve(context.Background(), query, 100000, nil, false, false, true)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, explained[0].Score == explained[1].Score, "expected a tie, got %v", explained)
+}
+
+func TestParseQueryVariants(t *testing.T) {
+	variants, err := parseQueryVariants(`Sure: ["one", " ", "two", "three"]`, 2)
+	Tassert(t, err == nil, "error parsing: %v", err)
+	Tassert(t, len(variants) == 2 && variants[0] == "one" && variants[1] == "two", "unexpected variants %q", variants)
+	_, err = parseQueryVariants(`[]`, 2)
+	Tassert(t, err != nil, "expected error for no variants")
+	_, err = parseQueryVariants(`no array here`, 2)
+	Tassert(t, err != nil, "expected error for no array")
+	_, err = parseQueryVariants(`[1, 2]`, 2)
+	Tassert(t, err != nil, "expected error for non-strings")
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// SysMsgExtract is the system message for extracting structured data
+// from the knowledge base.
+var SysMsgExtract = "You are a data extraction assistant.  I will provide you with context, then you will respond with an acknowledgement, then I will ask you to extract information from the context along with a JSON schema.  You will respond with only a JSON value matching the schema, using null for anything the context doesn't say."
+
+// Extract asks the model to extract the information described by
+// question from the knowledge base as JSON matching schema, a JSON
+// schema document, and unmarshals the reply into out, which may be a
+// pointer to a typed struct or to a json.RawMessage.  Models that
+// support structured output are asked for it directly; for the rest
+// the schema is included in the prompt and the JSON is found in the
+// reply.
+func (g *Grokker) Extract(modelName, question string, schema json.RawMessage, out interface{}) (err error) {
+	defer Return(&err)
+	if !json.Valid(schema) {
+		err = fmt.Errorf("schema is not valid JSON")
+		return
+	}
+	prompt := Spf("%s\n\nRespond with only JSON matching this schema:\n%s", question, schema)
+	ptokens, err := g.tokens(prompt)
+	Ck(err)
+	modelName, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	maxTokens := g.contextBudget(m.TokenLimit) - len(ptokens)
+	ctxt, err := g.getContext(question, maxTokens, false, false, nil)
+	Ck(err)
+	// ask for structured output for this request only
+	opts := g.textOptions()
+	opts.JSONSchema = schema
+	results, _, _, err := g.answerWithRAG(context.Background(), modelName, SysMsgExtract, prompt, ctxt, nil, false, opts)
+	Ck(err)
+	reply := jsonValue(results.Body)
+	err = json.Unmarshal([]byte(reply), out)
+	if err != nil {
+		err = fmt.Errorf("can't parse reply %.60q: %v", results.Body, err)
+		return
+	}
+	return
+}
+
+// jsonValue returns the JSON object or array in reply, tolerating
+// markdown code fences and text around it.
+func jsonValue(reply string) string {
+	start := strings.IndexAny(reply, "{[")
+	if start < 0 {
+		return reply
+	}
+	closer := "}"
+	if reply[start] == '[' {
+		closer = "]"
+	}
+	end := strings.LastIndex(reply, closer)
+	if end < start {
+		return reply
+	}
+	return reply[start : end+1]
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	oai "github.com/stevegt/go-openai"
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+	"github.com/stevegt/grokker/v3/mock"
+)
+
+var invoiceSchema = json.RawMessage(`{"type": "object", "properties": {"name": {"type": "string"}, "amount": {"type": "number"}}}`)
+
+func TestExtract(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chat := mock.NewClient()
+	chat.SetResponse(oai.GPT4, "Here it is:\n```json\n{\"name\": \"Ann\", \"amount\": 12.5}\n```")
+	grok.SetChatClient("openai", chat)
+	var invoice struct {
+		Name   string
+		Amount float64
+	}
+	err = grok.Extract("gpt-4", "Who sent the invoice and for how much?", invoiceSchema, &invoice)
+	Tassert(t, err == nil, "error extracting: %v", err)
+	Tassert(t, invoice.Name == "Ann" && invoice.Amount == 12.5, "unexpected result %+v", invoice)
+
+	err = grok.Extract("gpt-4", "Who?", json.RawMessage(`{"type": `), &invoice)
+	Tassert(t, err != nil, "expected error for invalid schema")
+}
+
+// test that the schema is sent as the response format
+func TestExtractResponseFormat(t *testing.T) {
+	if os.Getenv("GROKKER_TEST_LIVE") != "" {
+		t.Skip("requires the fake OpenAI server")
+	}
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	var out json.RawMessage
+	err = grok.Extract("gpt-4", "Who sent the invoice?", invoiceSchema, &out)
+	// the fake server doesn't return JSON
+	Tassert(t, err != nil, "expected error parsing fake response")
+	Tassert(t, grok.ChatOptions.JSONSchema == nil, "expected ChatOptions to be left alone")
+	lastChatRequest.Lock()
+	defer lastChatRequest.Unlock()
+	format, ok := lastChatRequest.body["response_format"].(map[string]interface{})
+	Tassert(t, ok && format["type"] == "json_schema", "expected json_schema response format, got %v", lastChatRequest.body["response_format"])
+}
+
+// schemaChat is a client.ChatProvider that replies with an invoice
+// and counts requests that got a JSON schema they shouldn't have, or
+// didn't get one they should have.
+type schemaChat struct {
+	mu    sync.Mutex
+	wrong int
+}
+
+func (c *schemaChat) CompleteChat(model string, messages []client.ChatMsg) (client.Results, error) {
+	return c.Chat(context.Background(), model, messages, client.Options{})
+}
+
+func (c *schemaChat) Chat(ctx context.Context, model string, messages []client.ChatMsg, opts client.Options) (client.Results, error) {
+	extract := strings.HasPrefix(messages[0].Content, SysMsgExtract)
+	c.mu.Lock()
+	if extract != (len(opts.JSONSchema) > 0) {
+		c.wrong++
+	}
+	c.mu.Unlock()
+	return client.Results{Body: `{"name": "Ann", "amount": 12.5}`}, nil
+}
+
+// test that the schema goes only with extraction requests when
+// questions are answered at the same time
+func TestExtractConcurrent(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chat := &schemaChat{}
+	grok.SetChatClient("openai", chat)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			var out json.RawMessage
+			errs <- grok.Extract("gpt-4", "Who sent the invoice?", invoiceSchema, &out)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := grok.AnswerResult("gpt-4", "What is this about?", false, false, false)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		Tassert(t, err == nil, "error: %v", err)
+	}
+	Tassert(t, chat.wrong == 0, "%d requests had the wrong schema", chat.wrong)
+}
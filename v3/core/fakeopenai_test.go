@@ -0,0 +1,300 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// The tests in this package run against a fake OpenAI API server
+// unless GROKKER_TEST_LIVE is set, in which case they use the real
+// API and OPENAI_API_KEY.
+//
+// The fake server returns deterministic bag-of-words embeddings, so
+// that texts sharing words are similar, and replays recorded chat
+// responses from testdata/replay.  A recorded response is stored in a
+// file named after the sha256 hash of the last message's content;
+// requests without a recording get a generic response.
+
+// fakeEmbeddingDims is the length of the fake embedding vectors,
+// matching text-embedding-ada-002.
+const fakeEmbeddingDims = 1536
+
+// lastChatRequest is the most recent chat request received by the
+// fake server.
+var lastChatRequest struct {
+	sync.Mutex
+	body map[string]interface{}
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("GROKKER_TEST_LIVE") == "" {
+		srv := httptest.NewServer(http.HandlerFunc(fakeOpenAI))
+		os.Setenv("OPENAI_BASE_URL", srv.URL+"/v1")
+		if os.Getenv("OPENAI_API_KEY") == "" {
+			os.Setenv("OPENAI_API_KEY", "fake")
+		}
+		rc := m.Run()
+		srv.Close()
+		os.Exit(rc)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeOpenAI handles requests to the fake OpenAI API server.
+func fakeOpenAI(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	if r.Method == "POST" {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var res interface{}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/models"):
+		res = map[string]interface{}{
+			"object": "list",
+			"data": []interface{}{
+				map[string]interface{}{"id": "gpt-4", "object": "model"},
+				map[string]interface{}{"id": "fakellama", "object": "model", "max_model_len": 32768},
+			},
+		}
+	case strings.HasSuffix(r.URL.Path, "/embeddings"):
+		var data []interface{}
+		dims := fakeEmbeddingDims
+		if d, ok := req["dimensions"].(float64); ok {
+			dims = int(d)
+		}
+		inputs, _ := req["input"].([]interface{})
+		for i, input := range inputs {
+			text, _ := input.(string)
+			data = append(data, map[string]interface{}{
+				"object":    "embedding",
+				"embedding": fakeEmbedding(text, dims),
+				"index":     i,
+			})
+		}
+		res = map[string]interface{}{
+			"object": "list",
+			"data":   data,
+			"model":  req["model"],
+		}
+	case strings.HasSuffix(r.URL.Path, "/chat/completions"):
+		lastChatRequest.Lock()
+		lastChatRequest.body = req
+		lastChatRequest.Unlock()
+		var last string
+		msgs, _ := req["messages"].([]interface{})
+		if len(msgs) > 0 {
+			msg, _ := msgs[len(msgs)-1].(map[string]interface{})
+			last, _ = msg["content"].(string)
+		}
+		res = map[string]interface{}{
+			"id":     "fake",
+			"object": "chat.completion",
+			"model":  req["model"],
+			"choices": []interface{}{
+				map[string]interface{}{
+					"index": 0,
+					"message": map[string]interface{}{
+						"role":    "assistant",
+						"content": replayResponse(last),
+					},
+					"finish_reason": "stop",
+				},
+			},
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(res)
+	Ck(err)
+}
+
+// fakeEmbedding returns a normalized bag-of-words vector for text
+// with the given number of dimensions.
+func fakeEmbedding(text string, dims int) (vec []float64) {
+	vec = make([]float64, dims)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		h := fnv.New32a()
+		h.Write([]byte(strings.Trim(word, ".,:;!?\"'()")))
+		vec[h.Sum32()%uint32(dims)]++
+	}
+	var mag float64
+	for _, v := range vec {
+		mag += v * v
+	}
+	if mag == 0 {
+		vec[0] = 1
+		return
+	}
+	mag = math.Sqrt(mag)
+	for i := range vec {
+		vec[i] /= mag
+	}
+	return
+}
+
+// replayResponse returns the recorded response for a prompt, or a
+// generic response if there is no recording.
+func replayResponse(prompt string) string {
+	hash := sha256.Sum256([]byte(prompt))
+	fn := filepath.Join("testdata", "replay", hex.EncodeToString(hash[:]))
+	buf, err := ioutil.ReadFile(fn)
+	if err == nil {
+		return string(buf)
+	}
+	return "fake response"
+}
+
+// test that the seed and temperature are sent with chat requests
+func TestChatOptions(t *testing.T) {
+	if os.Getenv("GROKKER_TEST_LIVE") != "" {
+		t.Skip("requires the fake OpenAI server")
+	}
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	seed := 42
+	temperature := float32(0)
+	grok.ChatOptions.Seed = &seed
+	grok.ChatOptions.Temperature = &temperature
+	_, err = grok.Msg("gpt-4", "You are a test.", "hello")
+	Tassert(t, err == nil, "error sending message: %v", err)
+	lastChatRequest.Lock()
+	defer lastChatRequest.Unlock()
+	Tassert(t, lastChatRequest.body["seed"] == float64(42), "expected seed 42, got %v", lastChatRequest.body["seed"])
+	temp, ok := lastChatRequest.body["temperature"].(float64)
+	Tassert(t, ok && temp < 1e-6, "expected temperature near 0, got %v", lastChatRequest.body["temperature"])
+}
+
+// test that JSON mode is sent as the response format
+func TestJSONModeResponseFormat(t *testing.T) {
+	if os.Getenv("GROKKER_TEST_LIVE") != "" {
+		t.Skip("requires the fake OpenAI server")
+	}
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.ChatOptions.ResponseFormat = client.ResponseFormatJSON
+	_, err = grok.Msg("gpt-4", "You are a test.", "hello")
+	// the fake server doesn't return JSON
+	Tassert(t, errors.Is(err, ErrInvalidJSON), "expected ErrInvalidJSON, got %v", err)
+	lastChatRequest.Lock()
+	defer lastChatRequest.Unlock()
+	format, ok := lastChatRequest.body["response_format"].(map[string]interface{})
+	Tassert(t, ok && format["type"] == "json_object", "expected json_object response format, got %v", lastChatRequest.body["response_format"])
+}
+
+// test answering with a model other than the db's without changing it
+func TestAnswerModelOverride(t *testing.T) {
+	if os.Getenv("GROKKER_TEST_LIVE") != "" {
+		t.Skip("requires the fake OpenAI server")
+	}
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	name, _, err := grok.FindModel("gpt-4o")
+	Tassert(t, err == nil && name == "gpt-4o", "error finding model: %v", err)
+	res, err := grok.AnswerResult("gpt-4o", "What is this about?", false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, res.Model == "gpt-4o", "expected gpt-4o, got %q", res.Model)
+	lastChatRequest.Lock()
+	model := lastChatRequest.body["model"]
+	lastChatRequest.Unlock()
+	Tassert(t, model == "gpt-4o", "expected a request to gpt-4o, got %v", model)
+	Tassert(t, grok.Model == "gpt-4", "expected the db's model to stay gpt-4, got %q", grok.Model)
+	name, _, err = grok.FindModel("")
+	Tassert(t, err == nil && name == "gpt-4", "expected the db's model, got %q: %v", name, err)
+
+	// unknown models are rejected before anything is sent
+	_, _, err = grok.FindModel("no-such-model")
+	Tassert(t, errors.Is(err, ErrModelNotFound), "expected ErrModelNotFound, got %v", err)
+	_, err = grok.AnswerResult("no-such-model", "What is this about?", false, false, false)
+	Tassert(t, errors.Is(err, ErrModelNotFound), "expected ErrModelNotFound, got %v", err)
+
+	// the override isn't saved
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, g.Model == "gpt-4", "expected gpt-4 to be saved, got %q", g.Model)
+}
+
+// recordingTransport is an http.RoundTripper that records the paths
+// of the requests it sends.
+type recordingTransport struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.paths = append(rt.paths, req.URL.Path)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// test that embedding and chat requests go through the HTTP client
+// set with SetHTTPClient
+func TestSetHTTPClient(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	rt := &recordingTransport{}
+	grok.SetHTTPClient(&http.Client{Transport: rt})
+	err = grok.AddReader("notes.txt", strings.NewReader("The build runs nightly."))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	_, err = grok.Answer("gpt-4", "When does the build run?", false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	var embeddings, chats int
+	for _, path := range rt.paths {
+		switch {
+		case strings.HasSuffix(path, "/embeddings"):
+			embeddings++
+		case strings.HasSuffix(path, "/chat/completions"):
+			chats++
+		}
+	}
+	Tassert(t, embeddings == 2, "expected 2 embedding requests, got %v", rt.paths)
+	Tassert(t, chats == 1, "expected 1 chat request, got %v", rt.paths)
+}
+
+// test that the HTTP client passed to Init and Load with
+// WithHTTPClient sends their own requests too
+func TestWithHTTPClient(t *testing.T) {
+	rt := &recordingTransport{}
+	grok, err := Init(TmpTestDir(), "gpt-4", WithHTTPClient(&http.Client{Transport: rt}))
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	Tassert(t, len(rt.paths) == 1 && strings.HasSuffix(rt.paths[0], "/models"), "expected the model lookup to use the client, got %v", rt.paths)
+	err = grok.AddReader("notes.txt", strings.NewReader("The build runs nightly."))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+
+	rt = &recordingTransport{}
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true, WithHTTPClient(&http.Client{Transport: rt}))
+	Tassert(t, err == nil, "error loading: %v", err)
+	defer lock.Unlock()
+	_, err = g.Answer("gpt-4", "When does the build run?", false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, len(rt.paths) == 2, "expected embedding and chat requests, got %v", rt.paths)
+}
@@ -1,10 +1,16 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"strings"
 
 	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/anthropic"
 	"github.com/stevegt/grokker/v3/client"
 	"github.com/stevegt/grokker/v3/openai"
 	"github.com/stevegt/grokker/v3/perplexity"
@@ -17,6 +23,19 @@ Context:
 
 var SysMsgChat = "You are an expert knowledgable in the provided context.  I will provide you with context, then you will respond with an acknowledgement, then I will ask you a question about the context, then you will provide me with an answer."
 
+// LanguagePrompt is added to a system message to ask for responses in
+// a given natural language, which replaces %s.  See Grokker.Language.
+var LanguagePrompt = "  Always respond in %s, whatever language the context and question are in."
+
+// languagePrompt returns LanguagePrompt for lang, or an empty string
+// if lang is empty.
+func languagePrompt(lang string) string {
+	if lang == "" {
+		return ""
+	}
+	return Spf(LanguagePrompt, lang)
+}
+
 var SysMsgRevise = "You are an expert knowledgable in the provided context.  I will provide you with context, then you will respond with an acknowledgement, then I will provide you with a block of text.  You will revise the block of text based on the information in the context, maintaining the same style, vocabulary, and reading level."
 
 var SysMsgContinue = "You are an expert knowledgable in the provided context.  I will provide you with context, then you will respond with an acknowledgement, then I will provide you with a block of text.  You will continue the block of text based on the information in the context, maintaining the same style, vocabulary, and reading level."
@@ -25,13 +44,19 @@ var SysMsgContinue = "You are an expert knowledgable in the provided context.  I
 // role in the ChatMsg slice to the appropriate openai.ChatMessageRole
 // value.
 func (g *Grokker) CompleteChat(modelName, sysmsg string, msgs []client.ChatMsg) (response string, references []string, err error) {
+	return g.completeChat(context.Background(), modelName, sysmsg, msgs, g.ChatOptions)
+}
+
+// completeChat implements CompleteChat, sending opts with the
+// requests.
+func (g *Grokker) completeChat(ctx context.Context, modelName, sysmsg string, msgs []client.ChatMsg, opts client.Options) (response string, references []string, err error) {
 	defer Return(&err)
 
 	Debug("msgs: %s", Spprint(msgs))
 
 	// initialize the messages slice with the system message as the
 	// first message
-	omsgs := initMessages(g, sysmsg)
+	omsgs := initMessages(g, modelName, sysmsg, opts)
 	// add the rest of the messages
 	for _, msg := range msgs {
 		// skip empty messages
@@ -46,7 +71,11 @@ func (g *Grokker) CompleteChat(modelName, sysmsg string, msgs []client.ChatMsg)
 
 	Debug("sending to LLM: %s", Spprint(omsgs))
 
-	results, err := g.gateway(modelName, omsgs)
+	results, err := g.gateway(ctx, modelName, omsgs, opts)
+	Ck(err)
+	results, err = g.continueResults(ctx, modelName, omsgs, results, opts, nil)
+	Ck(err)
+	results, err = g.checkJSON(ctx, modelName, omsgs, results, opts)
 	Ck(err)
 
 	Debug("response from LLM: %#v", results)
@@ -67,27 +96,59 @@ func (g *Grokker) CompleteChat(modelName, sysmsg string, msgs []client.ChatMsg)
 // AnswerWithRAG returns the answer to a question.
 func (g *Grokker) AnswerWithRAG(modelName, sysmsg, question, ctxt string, global bool) (out string, err error) {
 	defer Return(&err)
+	results, _, _, err := g.answerWithRAG(context.Background(), modelName, sysmsg, question, ctxt, nil, global, g.ChatOptions)
+	Ck(err)
+	out = results.Body
+	return
+}
+
+// generate is like AnswerWithRAG, but for replies that grokker reads
+// itself, such as summaries and suggested questions, so it never asks
+// for JSON; see textOptions.
+func (g *Grokker) generate(modelName, sysmsg, question, ctxt string) (out string, err error) {
+	defer Return(&err)
+	results, _, _, err := g.answerWithRAG(context.Background(), modelName, sysmsg, question, ctxt, nil, false, g.textOptions())
+	Ck(err)
+	out = results.Body
+	return
+}
+
+// answerWithRAG returns the provider's results for a question with
+// the given context, along with the messages that were sent for the
+// final answer and how their tokens were split.  The images, if any,
+// are URLs sent with the question.  opts are sent with the request
+// for the answer; the question to the model's global knowledge, if
+// any, is sent without a response format.
+func (g *Grokker) answerWithRAG(ctx context.Context, modelName, sysmsg, question, ctxt string, images []string, global bool, opts client.Options) (results client.Results, messages []client.ChatMsg, tokens *TokenBreakdown, err error) {
+	defer Return(&err)
 
-	messages := initMessages(g, sysmsg)
+	err = g.checkVision(modelName, images)
+	Ck(err)
+
+	messages = initMessages(g, modelName, sysmsg, opts)
+	sysLen := len(messages)
 
 	// first get global knowledge
 	if global {
 		messages = append(messages, client.ChatMsg{
 			Role:    RoleUser,
 			Content: question,
+			Images:  images,
 		})
-		var results client.Results
-		results, err = g.gateway(modelName, messages)
+		var globalResults client.Results
+		globalResults, err = g.gateway(ctx, modelName, messages, textOptions(opts))
 		Ck(err)
 		// add the response to the messages.
 		messages = append(messages, client.ChatMsg{
 			Role:    RoleAI,
-			Content: results.Body,
+			Content: globalResults.Body,
 		})
 	}
 
 	// add context from local sources
+	ctxtIdx := -1
 	if len(ctxt) > 0 {
+		ctxtIdx = len(messages)
 		messages = append(messages, []client.ChatMsg{
 			{
 				Role:    RoleUser,
@@ -104,43 +165,299 @@ func (g *Grokker) AnswerWithRAG(modelName, sysmsg, question, ctxt string, global
 	messages = append(messages, client.ChatMsg{
 		Role:    RoleUser,
 		Content: question,
+		Images:  images,
 	})
 
-	// don't exceed max tokens
+	// don't exceed max tokens.  The context budget is computed from
+	// token estimates, so as a last resort trim the tail of the
+	// context, which holds the least relevant chunks, rather than
+	// fail.
 	// XXX might want to summarize the context
-	totalTc := 0
-	for _, msg := range messages {
-		tc, err := g.TokenCount(msg.Content)
+	_, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	totalTc, err := g.messagesTokenCount(messages)
+	Ck(err)
+	if totalTc > m.TokenLimit && ctxtIdx >= 0 {
+		ctxtTc, err := g.TokenCount(ctxt)
+		Ck(err)
+		keep := ctxtTc - (totalTc - m.TokenLimit)
+		if keep > 0 {
+			ctxt, _, err = g.truncateTokens(ctxt, keep)
+			Ck(err)
+			messages[ctxtIdx].Content = Spf("Context:\n\n%s", ctxt)
+			Fpf(os.Stderr, "warning: dropped %d of %d context tokens to fit the %d token limit of %s\n", ctxtTc-keep, ctxtTc, m.TokenLimit, modelName)
+		} else {
+			// drop the context and its acknowledgement
+			messages = append(messages[:ctxtIdx], messages[ctxtIdx+2:]...)
+			ctxtIdx = -1
+			Fpf(os.Stderr, "warning: dropped all %d context tokens to fit the %d token limit of %s\n", ctxtTc, m.TokenLimit, modelName)
+		}
+		totalTc, err = g.messagesTokenCount(messages)
 		Ck(err)
-		totalTc += tc
 	}
-	if totalTc > g.ModelObj.TokenLimit {
-		err = fmt.Errorf("token count %d exceeds token limit %d -- try reducing context", totalTc, g.ModelObj.TokenLimit)
+	tokens, err = g.tokenBreakdown(messages, sysLen, ctxtIdx, m.TokenLimit)
+	Ck(err)
+	if totalTc > m.TokenLimit {
+		err = fmt.Errorf("%w: token count %d exceeds token limit %d (%s) -- try reducing context", ErrTokenLimitExceeded, totalTc, m.TokenLimit, tokens)
 		return
 	}
 
 	// get the answer
-	var results client.Results
-	results, err = g.gateway(modelName, messages)
-	out = results.Body
-	Ck(err, "context length: %d type: %T: %#v", len(ctxt), ctxt, ctxt)
+	results, err = g.gateway(ctx, modelName, messages, opts)
+	Ck(err)
+	results, err = g.continueResults(ctx, modelName, messages, results, opts, nil)
+	Ck(err)
+	results, err = g.checkJSON(ctx, modelName, messages, results, opts)
+	Ck(err)
+
+	return
+}
+
+// FinishReasonLength is the finish reason of a response that was cut
+// off by the model's output token limit.
+const FinishReasonLength = "length"
+
+// ContinuePrompt asks the model to continue a response that was cut
+// off by its output token limit.
+var ContinuePrompt = "Your response was cut off.  Continue exactly where you left off, without repeating anything or adding any preamble."
+
+// continueResults asks the model to continue results, its response
+// to msgs, for as long as the response was cut off by the model's
+// output token limit, up to g.AutoContinue times.  It returns the
+// pieces stitched together, with their usage summed and the finish
+// reason of the last piece.  It stops early if the conversation would
+// no longer fit in the model's token limit.  opts are sent with each
+// request.  If w is not nil, the continuations are streamed to it.
+func (g *Grokker) continueResults(ctx context.Context, modelName string, msgs []client.ChatMsg, results client.Results, opts client.Options, w io.Writer) (out client.Results, err error) {
+	defer Return(&err)
+	out = results
+	_, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	for i := 0; i < g.AutoContinue && out.FinishReason == FinishReasonLength; i++ {
+		next := append(append([]client.ChatMsg{}, msgs...),
+			client.ChatMsg{Role: RoleAI, Content: out.Body},
+			client.ChatMsg{Role: RoleUser, Content: ContinuePrompt},
+		)
+		tc, err := g.messagesTokenCount(next)
+		Ck(err)
+		if tc > m.TokenLimit {
+			Debug("not continuing: token count %d exceeds token limit %d", tc, m.TokenLimit)
+			break
+		}
+		var more client.Results
+		if w == nil {
+			more, err = g.gateway(ctx, modelName, next, opts)
+		} else {
+			more, err = g.gatewayStream(ctx, modelName, next, opts, w)
+		}
+		Ck(err)
+		out.Body += more.Body
+		out.Citations = append(out.Citations, more.Citations...)
+		out.Usage.PromptTokens += more.Usage.PromptTokens
+		out.Usage.CompletionTokens += more.Usage.CompletionTokens
+		out.Usage.TotalTokens += more.Usage.TotalTokens
+		out.FinishReason = more.FinishReason
+		out.Raw = more.Raw
+	}
+	return
+}
+
+// DefaultJSONRetries is the default of Grokker.JSONRetries.
+const DefaultJSONRetries = 2
+
+// JSONPrompt is added to the system message in JSON mode.  OpenAI
+// rejects JSON mode requests that don't mention JSON in a message.
+var JSONPrompt = "  Respond with only a valid JSON object, without markdown code fences or any other text."
+
+// JSONRetryPrompt asks the model to correct a reply that isn't a
+// valid JSON object.  The parse error replaces %v.
+var JSONRetryPrompt = "Your response was not a valid JSON object: %v.  Respond again with only the JSON object, without markdown code fences or any other text."
+
+// jsonMode returns true if opts ask for JSON replies.
+func jsonMode(opts client.Options) bool {
+	return opts.ResponseFormat == client.ResponseFormatJSON
+}
+
+// textOptions returns opts without a response format or JSON schema,
+// for requests whose replies have a format of their own, such as the
+// internal requests for reranking or query expansion.  The response
+// format set by the caller is only for answers.
+func textOptions(opts client.Options) client.Options {
+	opts.ResponseFormat = ""
+	opts.JSONSchema = nil
+	return opts
+}
+
+// textOptions returns g.ChatOptions without a response format; see
+// the textOptions function.
+func (g *Grokker) textOptions() client.Options {
+	return textOptions(g.ChatOptions)
+}
+
+// jsonRetries returns g.JSONRetries or its default.
+func (g *Grokker) jsonRetries() int {
+	if g.JSONRetries == 0 {
+		return DefaultJSONRetries
+	}
+	return max(g.JSONRetries, 0)
+}
+
+// checkJSON returns results unchanged unless opts ask for JSON, in
+// which case it makes sure results, the model's response to msgs,
+// holds a JSON object.  A reply with the object wrapped in markdown
+// code fences or prose is trimmed to the object; otherwise the model
+// is told what was wrong and asked again, up to g.JSONRetries times.
+// Usage is summed over the attempts.  The error wraps ErrInvalidJSON
+// if no attempt succeeds.
+func (g *Grokker) checkJSON(ctx context.Context, modelName string, msgs []client.ChatMsg, results client.Results, opts client.Options) (out client.Results, err error) {
+	defer Return(&err)
+	out = results
+	if !jsonMode(opts) {
+		return
+	}
+	for i := 0; ; i++ {
+		obj, perr := jsonObject(out.Body)
+		if perr == nil {
+			out.Body = obj
+			return
+		}
+		if i >= g.jsonRetries() {
+			err = fmt.Errorf("%w: %v", ErrInvalidJSON, perr)
+			return
+		}
+		Debug("retrying invalid JSON reply: %v", perr)
+		next := append(append([]client.ChatMsg{}, msgs...),
+			client.ChatMsg{Role: RoleAI, Content: out.Body},
+			client.ChatMsg{Role: RoleUser, Content: Spf(JSONRetryPrompt, perr)},
+		)
+		var more client.Results
+		more, err = g.gateway(ctx, modelName, next, opts)
+		Ck(err)
+		usage := out.Usage
+		out = more
+		out.Usage.PromptTokens += usage.PromptTokens
+		out.Usage.CompletionTokens += usage.CompletionTokens
+		out.Usage.TotalTokens += usage.TotalTokens
+	}
+}
+
+// jsonObject returns the JSON object in reply, tolerating markdown
+// code fences and text around it, or an error saying why there isn't
+// one.
+func jsonObject(reply string) (obj string, err error) {
+	obj = strings.TrimSpace(reply)
+	if !json.Valid([]byte(obj)) {
+		obj = jsonValue(obj)
+	}
+	var v interface{}
+	err = json.Unmarshal([]byte(obj), &v)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := v.(map[string]interface{}); !ok {
+		return "", fmt.Errorf("want an object, got %.20s", obj)
+	}
+	return
+}
+
+// tokensPerMessage is the number of tokens the chat format adds to
+// each message for the role and delimiters.
+const tokensPerMessage = 4
+
+// messagesTokenCount returns the approximate number of tokens msgs
+// will use in a chat request.
+func (g *Grokker) messagesTokenCount(msgs []client.ChatMsg) (count int, err error) {
+	defer Return(&err)
+	for _, msg := range msgs {
+		tc, err := g.TokenCount(msg.Content)
+		Ck(err)
+		count += tc + tokensPerMessage + len(msg.Images)*ImageTokens
+	}
+	return
+}
+
+// TokenBreakdown shows how the tokens of a request to a chat model
+// are split between its parts, as counted with the tokenizer before
+// the request is sent, so that e.g. a request that exceeds the
+// model's token limit shows where the tokens went.  Each part
+// includes the overhead of its messages, so the parts add up to
+// Total.
+type TokenBreakdown struct {
+	// System is the system message, including the language and JSON
+	// instructions, and its acknowledgement for models that don't
+	// accept system messages.
+	System int `json:"system"`
+	// Global is the question and answer from the model's global
+	// knowledge, if it was asked for.
+	Global int `json:"global,omitempty"`
+	// Context is the retrieved context and its acknowledgement.
+	Context int `json:"context"`
+	// Question is the question, including any images sent with it.
+	Question int `json:"question"`
+	// Total is the sum of the parts above.
+	Total int `json:"total"`
+	// Limit is the model's token limit.
+	Limit int `json:"limit"`
+	// Completion is the part of Limit left for the model's reply,
+	// or a negative number if the request doesn't fit.
+	Completion int `json:"completion"`
+}
+
+// String returns a one-line summary of b, e.g. for error messages.
+func (b *TokenBreakdown) String() string {
+	s := Spf("system %d, ", b.System)
+	if b.Global > 0 {
+		s += Spf("global %d, ", b.Global)
+	}
+	return s + Spf("context %d, question %d, total %d of %d, %d left for the reply", b.Context, b.Question, b.Total, b.Limit, b.Completion)
+}
 
+// tokenBreakdown returns how the tokens of messages, as built by
+// answerWithRAG, are split between the sysLen messages from
+// initMessages, the global knowledge turn if any, the context
+// message at ctxtIdx and its acknowledgement if ctxtIdx isn't -1,
+// and the question, which is the last message.
+func (g *Grokker) tokenBreakdown(messages []client.ChatMsg, sysLen, ctxtIdx, limit int) (b *TokenBreakdown, err error) {
+	defer Return(&err)
+	b = &TokenBreakdown{Limit: limit}
+	count := func(msgs []client.ChatMsg) int {
+		tc, err := g.messagesTokenCount(msgs)
+		Ck(err)
+		return tc
+	}
+	last := len(messages) - 1
+	b.System = count(messages[:sysLen])
+	b.Question = count(messages[last:])
+	end := last
+	if ctxtIdx >= 0 {
+		b.Context = count(messages[ctxtIdx : ctxtIdx+2])
+		end = ctxtIdx
+	}
+	b.Global = count(messages[sysLen:end])
+	b.Total = b.System + b.Global + b.Context + b.Question
+	b.Completion = limit - b.Total
 	return
 }
 
-// initMessages creates and returns the initial messages slice.  It includes
-// the system message if the model supports it, otherwise it includes the
-// system message in the first user message.
-func initMessages(g *Grokker, sysmsg string) []client.ChatMsg {
+// initMessages creates and returns the initial messages slice for a
+// request to the named model.  It includes the system message if the
+// model supports it, otherwise it includes the system message in the
+// first user message.  If opts ask for JSON, the system message says
+// so.
+func initMessages(g *Grokker, modelName, sysmsg string, opts client.Options) []client.ChatMsg {
 	// noSysMsg that do not support system messages
 	noSysMsg := []string{
 		"o1-preview",
 		"o1-mini",
 		"o3-mini",
 	}
+	name, _, err := g.models.FindModel(modelName)
+	if err == nil {
+		modelName = name
+	}
 	sysmsgOk := true
 	for _, model := range noSysMsg {
-		if g.Model == model {
+		if modelName == model {
 			sysmsgOk = false
 			break
 		}
@@ -149,6 +466,9 @@ func initMessages(g *Grokker, sysmsg string) []client.ChatMsg {
 	if !sysmsgOk {
 		sysmsgRole = RoleUser
 	}
+	if jsonMode(opts) {
+		sysmsg += JSONPrompt
+	}
 	messages := []client.ChatMsg{
 		{
 			Role:    sysmsgRole,
@@ -166,28 +486,133 @@ func initMessages(g *Grokker, sysmsg string) []client.ChatMsg {
 	return messages
 }
 
+// SetChatClient replaces the client used for chat completions with
+// models from the given provider, e.g. "openai", "perplexity",
+// "anthropic", or "local".  This allows injecting fakes for testing or
+// wrappers that add logging or metrics.  Clients that also implement
+// client.ChatProvider are called through Chat, with the request's
+// context and g.ChatOptions; the rest don't receive either.
+func (g *Grokker) SetChatClient(provider string, c client.ChatClient) {
+	if g.chatClients == nil {
+		g.chatClients = make(map[string]client.ChatClient)
+	}
+	g.chatClients[provider] = c
+}
+
+// SetHTTPClient makes every request grokker sends to a provider's
+// API, for chat completions, embeddings, and model information, go
+// through hc, e.g. one whose transport uses a corporate proxy and
+// trusts its CA, or records metrics.  Clients set with SetChatClient
+// or SetEmbedder are not affected.  It sets g.ChatOptions.HTTPClient.
+// Init and Load send requests of their own, e.g. to look up the
+// model's token limit, so pass WithHTTPClient to them instead if
+// those must go through hc too.
+func (g *Grokker) SetHTTPClient(hc *http.Client) {
+	g.ChatOptions.HTTPClient = hc
+	if e, ok := g.embedder.(*openaiEmbedder); ok {
+		e.client = openai.NewClientWithHTTP(hc)
+	}
+}
+
+// WithHTTPClient is an Option that sets the client used for every
+// request, as SetHTTPClient does, from the first request on.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(g *Grokker) {
+		g.ChatOptions.HTTPClient = hc
+	}
+}
+
 // gateway acts as a router to the appropriate completion function
-// based on provider. A mock provider and model can be injected for
+// based on provider, sending opts with the request and giving up when
+// ctx is done.  A mock provider and model can be injected for
 // testing by adding it to models.Available before calling this
 // function.  See model.go:AddMockModel().
-func (g *Grokker) gateway(modelName string, inmsgs []client.ChatMsg) (results client.Results, err error) {
+func (g *Grokker) gateway(ctx context.Context, modelName string, inmsgs []client.ChatMsg, opts client.Options) (results client.Results, err error) {
 	defer Return(&err)
 
 	_, modelObj, err := g.models.FindModel(modelName)
 	Ck(err)
 
-	upstreamName := modelObj.upstreamName
+	p, err := g.chatProvider(modelObj, opts)
+	if err == nil {
+		results, err = p.Chat(ctx, modelObj.upstreamName, inmsgs, opts)
+	}
+	err = chatError(err)
+	return
+}
 
-	switch modelObj.providerName {
+// chatProvider returns the client for chat completions with m, using
+// an injected client if there is one for m's provider.
+func (g *Grokker) chatProvider(m *Model, opts client.Options) (p client.ChatProvider, err error) {
+	c, ok := g.chatClients[m.providerName]
+	if ok {
+		return chatProvider(c), nil
+	}
+	switch m.providerName {
 	case "openai":
-		return openai.CompleteChat(upstreamName, inmsgs)
+		err = openai.CheckAPIKey()
+		p = openai.NewChatClient(opts.HTTPClient)
 	case "perplexity":
 		pp := perplexity.NewClient()
-		return pp.CompleteChat(upstreamName, inmsgs)
+		pp.HTTPClient = opts.HTTPClient
+		p = pp
+	case "anthropic":
+		ac := anthropic.NewClient()
+		ac.HTTPClient = opts.HTTPClient
+		p = ac
+	case "local":
+		p = openai.NewLocalChatClient(opts)
 	case "mock":
-		return modelObj.provider.CompleteChat(upstreamName, inmsgs)
+		p = chatProvider(m.provider)
 	default:
-		Assert(false, "unknown provider: %s", modelObj.providerName)
+		Assert(false, "unknown provider: %s", m.providerName)
+	}
+	return
+}
+
+// chatProvider returns c as a client.ChatProvider.  If c doesn't
+// implement it, Chat calls CompleteChat, without the options, unless
+// ctx is already done.
+func chatProvider(c client.ChatClient) client.ChatProvider {
+	if p, ok := c.(client.ChatProvider); ok {
+		return p
 	}
+	return plainChat{c}
+}
+
+// plainChat adapts a client.ChatClient to client.ChatProvider.
+type plainChat struct {
+	client.ChatClient
+}
+
+func (c plainChat) Chat(ctx context.Context, model string, messages []client.ChatMsg, opts client.Options) (results client.Results, err error) {
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+	return c.CompleteChat(model, messages)
+}
+
+// gatewayStream is like gateway, but writes the response to w as it
+// arrives if the provider supports streaming, or all at once when it
+// arrives otherwise.
+func (g *Grokker) gatewayStream(ctx context.Context, modelName string, msgs []client.ChatMsg, opts client.Options, w io.Writer) (results client.Results, err error) {
+	defer Return(&err)
+	_, modelObj, err := g.models.FindModel(modelName)
+	Ck(err)
+	_, injected := g.chatClients[modelObj.providerName]
+	if modelObj.providerName == "openai" && !injected {
+		err = openai.CheckAPIKey()
+		if err == nil {
+			c := openai.NewChatClient(opts.HTTPClient)
+			results, err = c.ChatStream(ctx, modelObj.upstreamName, msgs, opts, w)
+		}
+		err = chatError(err)
+		return
+	}
+	results, err = g.gateway(ctx, modelName, msgs, opts)
+	Ck(err)
+	_, err = io.WriteString(w, results.Body)
+	Ck(err)
 	return
 }
@@ -1,20 +1,15 @@
 package core
 
 import (
+	"fmt"
+	"os"
 	"strings"
 
 	. "github.com/stevegt/goadapt"
 )
 
-/*
-var GitSummaryPrompt = `
-Summarize the context into a single line of 60 characters or less.  Add nothing else.  Use present tense.  Do not quote.
-`
-var GitCommitPrompt = `
-Summarize the bullet points found in the context into a single line of 60 characters or less.  Add nothing else.  Use present tense. Do not quote.
-`
-*/
-
+// GitSummaryPrompt is the default prompt for summarizing a file's
+// diff in one line; see GitCommitOpts.SummaryPrompt.
 var GitSummaryPrompt = `
 In a single line of 60 characters or less, describe the changes
 described in the context.
@@ -22,6 +17,8 @@ Use present tense, active, imperative statements as if giving directions.
 Add nothing else.  Never add quote marks.
 `
 
+// GitDiffPrompt is the default prompt for describing a piece of a
+// diff in bullet points; see GitCommitOpts.DiffPrompt.
 var GitDiffPrompt = `
 In bullet points, describe the changes found in the 'git diff'
 fragments in the context.  The bullet points will be used in the body
@@ -30,11 +27,175 @@ Use present tense, active, imperative statements as if giving directions.
 Add nothing else.  Never add quote marks.
 `
 
-// summarizeDiff recursively summarizes a diff until the summary is
-// short enough to be used as a prompt.
-func (g *Grokker) summarizeDiff(modelName, diff string) (sumlines string, diffSummary string, err error) {
+// GitCommitPrompt is the default instructions for writing a commit
+// message; see GitCommitOpts.CommitPrompt.
+var GitCommitPrompt = "Write a git commit message for the given diff. Use present tense, active, imperative statements as if giving directions.  Do not use extra adjectives or marketing hype."
+
+// GitCommitOpts controls the style of the commit messages generated
+// by GitCommitMessage.  The zero value produces the default style:  a
+// plain subject of 60 characters or less followed by bullet-pointed
+// details.
+type GitCommitOpts struct {
+	// SubjectLen is the maximum length of the subject line.  Zero
+	// means DefaultGitSubjectLen.
+	SubjectLen int
+	// NoBody omits the bullet-pointed body, so the message is only
+	// the subject line.
+	NoBody bool
+	// Conventional makes the subject line follow the conventional
+	// commits format, e.g. "fix(parser): handle empty input".
+	Conventional bool
+	// MaxSummaryCalls caps the chat calls made to summarize a diff
+	// piece by piece, which is done when the diff is too large to
+	// send to the model whole.  Zero means
+	// DefaultGitMaxSummaryCalls.  Once the cap is reached, the rest
+	// of the diff is truncated rather than summarized.
+	MaxSummaryCalls int
+	// MaxSummaryTokens caps the total tokens sent in those calls.
+	// Zero means no cap.
+	MaxSummaryTokens int
+	// CommitPrompt, if not empty, replaces GitCommitPrompt, e.g. to
+	// change the tone of the message.  Instructions for the subject
+	// line and body are still added according to the options above.
+	CommitPrompt string
+	// Language is the natural language of the message, e.g.
+	// "Japanese".  If empty, Grokker.Language is used, and if that is
+	// empty too, the model's default, usually English.
+	Language string
+	// DiffPrompt and SummaryPrompt, if not empty, replace
+	// GitDiffPrompt and GitSummaryPrompt when a diff too large to
+	// send whole is summarized piece by piece.
+	DiffPrompt    string
+	SummaryPrompt string
+}
+
+// prompts returns the commit, diff, and summary prompts given by
+// opts, or the defaults.
+func (opts GitCommitOpts) prompts() (commit, diff, summary string) {
+	commit, diff, summary = GitCommitPrompt, GitDiffPrompt, GitSummaryPrompt
+	if opts.CommitPrompt != "" {
+		commit = opts.CommitPrompt
+	}
+	if opts.DiffPrompt != "" {
+		diff = opts.DiffPrompt
+	}
+	if opts.SummaryPrompt != "" {
+		summary = opts.SummaryPrompt
+	}
+	return
+}
+
+// checkDiff returns an error wrapping ErrEmptyDiff if diff is empty,
+// or ErrNotDiff if it doesn't look like unified diff output.
+func checkDiff(diff string) error {
+	if strings.TrimSpace(diff) == "" {
+		return fmt.Errorf("%w: nothing to describe -- stage some changes first", ErrEmptyDiff)
+	}
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") || strings.HasPrefix(line, "@@ ") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: expected output of 'git diff'", ErrNotDiff)
+}
+
+// DefaultGitSubjectLen is the default maximum length of a generated
+// commit message subject line.
+const DefaultGitSubjectLen = 60
+
+// DefaultGitMaxSummaryCalls is the default value of
+// GitCommitOpts.MaxSummaryCalls.
+const DefaultGitMaxSummaryCalls = 20
+
+// gitDiffTokens returns the most tokens of diff sent to m at once;
+// larger diffs are summarized piece by piece first.
+func gitDiffTokens(m *Model) int {
+	return int(float64(m.TokenLimit) * .7)
+}
+
+// gitTruncatedTokens is how much of a file's diff is kept in place
+// of its summary once the summary budget is spent.
+const gitTruncatedTokens = 200
+
+// diffBudget tracks the chat calls and tokens spent summarizing a
+// diff.
+type diffBudget struct {
+	calls, maxCalls   int
+	tokens, maxTokens int
+}
+
+// newDiffBudget returns the budget given by opts.
+func newDiffBudget(opts GitCommitOpts) *diffBudget {
+	maxCalls := opts.MaxSummaryCalls
+	if maxCalls <= 0 {
+		maxCalls = DefaultGitMaxSummaryCalls
+	}
+	return &diffBudget{maxCalls: maxCalls, maxTokens: opts.MaxSummaryTokens}
+}
+
+// spend records a call sending tokens tokens and returns true, or
+// returns false without recording anything if the call would exceed
+// the budget.
+func (b *diffBudget) spend(tokens int) bool {
+	if b.calls >= b.maxCalls {
+		return false
+	}
+	if b.maxTokens > 0 && b.tokens+tokens > b.maxTokens {
+		return false
+	}
+	b.calls++
+	b.tokens += tokens
+	return true
+}
+
+// gitCommitSysmsg returns the system message used to generate a
+// commit message in the style given by opts.
+func gitCommitSysmsg(opts GitCommitOpts) (sysmsg string) {
+	subjectLen := opts.SubjectLen
+	if subjectLen <= 0 {
+		subjectLen = DefaultGitSubjectLen
+	}
+	sysmsg, _, _ = opts.prompts()
+	sysmsg = strings.TrimSpace(sysmsg)
+	if opts.Conventional {
+		sysmsg += Spf("  The first line of the commit message must be a conventional commits subject of %d characters or less, in the format 'type(scope): summary', where type is one of feat, fix, docs, style, refactor, perf, test, build, ci, or chore, and scope is the main area of the code that changed.", subjectLen)
+	} else {
+		sysmsg += Spf("  The first line of the commit message must be a summary of %d characters or less.", subjectLen)
+	}
+	if opts.NoBody {
+		sysmsg += "  Return only the first line.  Add nothing else."
+	} else {
+		sysmsg += "  The first line must be followed by a blank line, followed by bullet-pointed details.  Make a separate bullet list for each changed file."
+	}
+	sysmsg += languagePrompt(opts.Language)
+	return
+}
+
+// summarizeDiff summarizes a diff file by file, making at most the
+// chat calls allowed by opts.  Once that budget is spent, the rest of
+// each file's diff is truncated instead of summarized, and a summary
+// that is still too long to use as a prompt is truncated too.
+func (g *Grokker) summarizeDiff(modelName, diff string, opts GitCommitOpts) (sumlines string, diffSummary string, err error) {
 	defer Return(&err)
-	maxTokens := int(float64(g.ModelObj.TokenLimit) * .7)
+	_, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	maxTokens := gitDiffTokens(m)
+	budget := newDiffBudget(opts)
+	_, diffPrompt, summaryPrompt := opts.prompts()
+	// ask returns the answer to prompt given context, or false if
+	// the budget is spent.
+	ask := func(prompt, context string) (resp string, ok bool, err error) {
+		defer Return(&err)
+		tc, err := g.TokenCount(prompt + context)
+		Ck(err)
+		if !budget.spend(tc) {
+			return
+		}
+		resp, err = g.generate(modelName, SysMsgChat+languagePrompt(opts.Language), prompt, context)
+		Ck(err)
+		ok = true
+		return
+	}
 	// split the diff on filenames
 	fileChunks := strings.Split(diff, "diff --git")
 	// split each file chunk into smaller chunks
@@ -58,33 +219,50 @@ func (g *Grokker) summarizeDiff(modelName, diff string) (sumlines string, diffSu
 		}
 		var chunks []*Chunk
 		chunks, err = g.chunksFromString(nil, fileChunk, maxTokens)
+		Ck(err)
 		// summarize each chunk
-		for _, chunk := range chunks {
+		for i, chunk := range chunks {
 			// format the chunk
 			context := Spf("diff --git %s\n%s", fns, chunk.text)
-			resp, err := g.AnswerWithRAG(modelName, SysMsgChat, GitDiffPrompt, context, false)
+			resp, ok, err := ask(diffPrompt, context)
 			Ck(err)
+			if !ok {
+				// out of budget; keep the start of the rest of
+				// this file's diff instead
+				var rest string
+				for _, c := range chunks[i:] {
+					rest += c.text
+				}
+				resp, _, err = g.truncateTokens(rest, gitTruncatedTokens)
+				Ck(err)
+				resp = Spf("(summary budget spent; diff truncated)\n%s", resp)
+				fileSummary = Spf("%s\n%s", fileSummary, resp)
+				break
+			}
 			fileSummary = Spf("%s\n%s", fileSummary, resp)
 		}
 		// XXX recurse here to glue the summaries together for a given
 		// file?
 
 		// get a summary line of the changes for this file
-		sumLine, err := g.AnswerWithRAG(modelName, SysMsgChat, GitSummaryPrompt, fileSummary, false)
+		sumLine, ok, err := ask(summaryPrompt, fileSummary)
 		Ck(err)
+		if !ok {
+			sumLine = Spf("Change %s", strings.TrimSpace(fns))
+		}
 		// append the summary line to the list of summary lines
 		sumlines = Spf("%s\n%s", sumlines, sumLine)
 		// append sumLine and the diff for this file to the summary
 		// of the changes for all files
 		diffSummary = Spf("%s\n\n%s\n\n%s", diffSummary, sumLine, fileSummary)
 	}
-	/*
-		// if the summary is too long, recurse
-		if len(diffSummary) > int(maxLen) {
-			// recurse
-			Fpf(os.Stderr, "diff summary too long (%d bytes), recursing\n", len(diffSummary))
-			diffSummary, err = g.summarizeDiff(diffSummary)
-		}
-	*/
+	// rather than recursing on a summary that is still too long,
+	// which could make any number of calls, truncate it
+	var truncated bool
+	diffSummary, truncated, err = g.truncateTokens(diffSummary, maxTokens)
+	Ck(err)
+	if truncated {
+		Fpf(os.Stderr, "warning: diff summary truncated to %d tokens\n", maxTokens)
+	}
 	return
 }
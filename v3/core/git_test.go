@@ -0,0 +1,149 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+func TestGitCommitSysmsg(t *testing.T) {
+	// the zero value gives the default style
+	sysmsg := gitCommitSysmsg(GitCommitOpts{})
+	Tassert(t, strings.Contains(sysmsg, "60 characters or less"), "expected default subject length in sysmsg: %s", sysmsg)
+	Tassert(t, strings.Contains(sysmsg, "bullet-pointed details"), "expected body instructions in sysmsg: %s", sysmsg)
+	Tassert(t, !strings.Contains(sysmsg, "type(scope)"), "unexpected conventional commits instructions in sysmsg: %s", sysmsg)
+
+	// custom subject length, no body, conventional commits
+	sysmsg = gitCommitSysmsg(GitCommitOpts{SubjectLen: 72, NoBody: true, Conventional: true})
+	Tassert(t, strings.Contains(sysmsg, "72 characters or less"), "expected custom subject length in sysmsg: %s", sysmsg)
+	Tassert(t, !strings.Contains(sysmsg, "bullet-pointed details"), "unexpected body instructions in sysmsg: %s", sysmsg)
+	Tassert(t, strings.Contains(sysmsg, "type(scope): summary"), "expected conventional commits instructions in sysmsg: %s", sysmsg)
+
+	// custom instructions replace the default ones
+	sysmsg = gitCommitSysmsg(GitCommitOpts{CommitPrompt: "Write a terse commit message in French.\n"})
+	Tassert(t, strings.HasPrefix(sysmsg, "Write a terse commit message in French.  The first line"), "expected custom instructions in sysmsg: %s", sysmsg)
+	Tassert(t, !strings.Contains(sysmsg, "marketing hype"), "unexpected default instructions in sysmsg: %s", sysmsg)
+}
+
+// callCountingChat is a client.ChatClient that counts its calls.
+type callCountingChat struct {
+	calls int
+}
+
+func (c *callCountingChat) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	c.calls++
+	results.Body = "- change things"
+	return
+}
+
+// promptRecordingChat is a client.ChatClient that counts the last
+// messages it was sent.
+type promptRecordingChat struct {
+	seen map[string]int
+}
+
+func (c *promptRecordingChat) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	if c.seen == nil {
+		c.seen = make(map[string]int)
+	}
+	c.seen[messages[len(messages)-1].Content]++
+	results.Body = "- change things"
+	return
+}
+
+func TestSummarizeDiffBudget(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	chat := &callCountingChat{}
+	grok.SetChatClient("openai", chat)
+	var diff string
+	for _, fn := range []string{"a.go", "b.go", "c.go", "d.go"} {
+		diff += Spf("diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n@@ -1 +1 @@\n-old\n+new\n", fn, fn, fn, fn)
+	}
+
+	// two calls per file fit in the default budget
+	_, _, err = grok.summarizeDiff("gpt-4", diff, GitCommitOpts{})
+	Tassert(t, err == nil, "error summarizing diff: %v", err)
+	Tassert(t, chat.calls == 8, "expected 8 calls, got %d", chat.calls)
+
+	// a smaller budget stops the calls and truncates the rest
+	chat.calls = 0
+	sumlines, summary, err := grok.summarizeDiff("gpt-4", diff, GitCommitOpts{MaxSummaryCalls: 3})
+	Tassert(t, err == nil, "error summarizing diff: %v", err)
+	Tassert(t, chat.calls == 3, "expected 3 calls, got %d", chat.calls)
+	Tassert(t, strings.Contains(summary, "diff truncated") && strings.Contains(summary, "+new"), "expected truncated diff in summary: %s", summary)
+	Tassert(t, strings.Contains(sumlines, "Change a/d.go b/d.go"), "expected fallback summary line: %s", sumlines)
+
+	// custom prompts are used for the pieces
+	prompts := &promptRecordingChat{}
+	grok.SetChatClient("openai", prompts)
+	_, _, err = grok.summarizeDiff("gpt-4", diff, GitCommitOpts{DiffPrompt: "Describe the diff.", SummaryPrompt: "Name the change."})
+	Tassert(t, err == nil, "error summarizing diff: %v", err)
+	Tassert(t, prompts.seen["Describe the diff."] == 4 && prompts.seen["Name the change."] == 4, "unexpected prompts %v", prompts.seen)
+	grok.SetChatClient("openai", chat)
+
+	// a token budget stops the calls too
+	chat.calls = 0
+	_, _, err = grok.summarizeDiff("gpt-4", diff, GitCommitOpts{MaxSummaryTokens: 1})
+	Tassert(t, err == nil, "error summarizing diff: %v", err)
+	Tassert(t, chat.calls == 0, "expected no calls, got %d", chat.calls)
+}
+
+func TestGitCommitMessageFromDiff(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	chat := &callCountingChat{}
+	grok.SetChatClient("openai", chat)
+
+	// bad input is rejected without calling the model
+	_, err = grok.GitCommitMessageFromDiff("gpt-4", " \n", GitCommitOpts{})
+	Tassert(t, errors.Is(err, ErrEmptyDiff), "expected ErrEmptyDiff, got %v", err)
+	_, err = grok.GitCommitMessageFromDiff("gpt-4", "fix the parser\n", GitCommitOpts{})
+	Tassert(t, errors.Is(err, ErrNotDiff), "expected ErrNotDiff, got %v", err)
+	Tassert(t, chat.calls == 0, "expected no calls, got %d", chat.calls)
+
+	diff := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1 +1 @@\n-old\n+new\n"
+	msg, err := grok.GitCommitMessageFromDiff("gpt-4", diff, GitCommitOpts{})
+	Tassert(t, err == nil, "error generating message: %v", err)
+	Tassert(t, msg == "- change things", "unexpected message %q", msg)
+	Tassert(t, chat.calls == 1, "expected 1 call, got %d", chat.calls)
+}
+
+// test that a diff too large for the model is summarized within the
+// budget before the message is written
+func TestGitCommitMessageLargeDiff(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	chat := &callCountingChat{}
+	grok.SetChatClient("openai", chat)
+	var diff string
+	for _, fn := range []string{"a.go", "b.go", "c.go", "d.go"} {
+		diff += Spf("diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n@@ -1,20 +1,20 @@\n", fn, fn, fn, fn)
+		for i := 0; i < 20; i++ {
+			diff += Spf("-old line %d\n+new line %d\n", i, i)
+		}
+	}
+	_, m, err := grok.models.FindModel("gpt-4")
+	Tassert(t, err == nil, "error finding model: %v", err)
+	m.TokenLimit = 400
+
+	// two calls per file, then one for the message
+	_, err = grok.GitCommitMessageFromDiff("gpt-4", diff, GitCommitOpts{})
+	Tassert(t, err == nil, "error generating message: %v", err)
+	Tassert(t, chat.calls == 9, "expected 9 calls, got %d", chat.calls)
+
+	chat.calls = 0
+	_, err = grok.GitCommitMessageFromDiff("gpt-4", diff, GitCommitOpts{MaxSummaryCalls: 2})
+	Tassert(t, err == nil, "error generating message: %v", err)
+	Tassert(t, chat.calls == 3, "expected 3 calls, got %d", chat.calls)
+
+	// the summary prompts are used on this path too
+	prompts := &promptRecordingChat{}
+	grok.SetChatClient("openai", prompts)
+	_, err = grok.GitCommitMessageFromDiff("gpt-4", diff, GitCommitOpts{DiffPrompt: "Describe the diff.", SummaryPrompt: "Name the change."})
+	Tassert(t, err == nil, "error generating message: %v", err)
+	Tassert(t, prompts.seen["Describe the diff."] == 4 && prompts.seen["Name the change."] == 4, "unexpected prompts %v", prompts.seen)
+}
@@ -3,10 +3,12 @@ package core
 import (
 	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 
-	"github.com/fabiustech/openai"
+	"github.com/gofrs/flock"
 	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
 	"github.com/stevegt/grokker/v3/util"
 	"github.com/tiktoken-go/tokenizer"
 )
@@ -50,13 +52,50 @@ import (
 const (
 	// See the "Semantic Versioning" section of the README for
 	// information on API and db stability and versioning.
-	Version = "3.0.44"
+	Version = "3.2.0"
 )
 
+// A Grokker is safe for concurrent use once it has been set up:
+// queries such as Answer and Search share a read lock on the document
+// and chunk lists, and changes such as AddDocument, UpdateEmbeddings,
+// and Save take a write lock, so queries wait while the knowledge base
+// changes.  Configuration methods such as SetChatClient and
+// SetEmbedder, and the exported fields, should not be changed while
+// other goroutines are using the Grokker.  A Conversation is not safe
+// for concurrent use.
 type Grokker struct {
-	embeddingClient *openai.Client
+	// mu protects Documents and Chunks; see above
+	mu sync.RWMutex
+	// cacheMu protects keywordCache, rateLimit, and the
+	// token counts cached in chunks, which queries update while
+	// holding mu for reading
+	cacheMu sync.Mutex
+	// embedder creates embeddings; see SetEmbedder
+	embedder client.Embedder
+	// altEmbedders overrides the client used for each of
+	// AltEmbeddingModels; see SetModelEmbedder
+	altEmbedders map[string]client.Embedder
+	// chatClients overrides the chat client used for each provider
+	// name; see SetChatClient
+	chatClients map[string]client.ChatClient
+	// tokenLimitMisses holds the models whose token limit couldn't
+	// be looked up in this run, so they aren't asked again until the
+	// next one
+	tokenLimitMisses map[string]bool
+	// overrides are the db fields set from .grokconfig for this run
+	// only; see ApplyConfig
+	overrides []override
 	// The grokker version number this db was last updated with.
 	Version string
+	// Generation counts the times the db has been rewritten in full,
+	// so that journal records from before a rewrite can be told
+	// apart; see journal.go.
+	Generation int64 `json:",omitempty"`
+	// Migrations records when the db was created and each time it
+	// was migrated to a newer version, oldest first.  Dbs created
+	// before it was added start with their first migration.  See
+	// VersionHistory.
+	Migrations []Migration `json:",omitempty"`
 	// The absolute path of the root directory of the document
 	// repository.  This is passed in from cli based on where we
 	// found the db.
@@ -68,26 +107,347 @@ type Grokker struct {
 	// model specs
 	models *Models
 	// XXX make Model be the most recently used model name
-	Model               string
-	ModelObj            *Model `json:"-"`
+	Model    string
+	ModelObj *Model `json:"-"`
+	// EmbeddingTokenLimit is the most tokens sent to the embedding
+	// model in one input, recorded from the embedding model when the
+	// db is made or the model changes.  See SetEmbeddingTokenLimit.
 	EmbeddingTokenLimit int
+	// TokenLimits caches the context windows of models as reported
+	// by their providers, keyed by model name, so that they are only
+	// looked up once, when the db is made or the model changes.  Zero
+	// means the provider was asked but doesn't say, so the built-in
+	// limit is used.  See Model.TokenLimit.
+	TokenLimits map[string]int `json:",omitempty"`
+	// EmbeddingModel is the name of the embedding model.  Empty
+	// means DefaultEmbeddingModel.  See SetEmbeddingModel.
+	EmbeddingModel string `json:",omitempty"`
+	// AltEmbeddingModels are embedding models whose embeddings are
+	// kept for every chunk alongside those of EmbeddingModel, so that
+	// retrieval with each can be compared; see AddEmbeddingModel and
+	// RetrievalModel.
+	AltEmbeddingModels []string `json:",omitempty"`
+	// EmbeddingDimensions is the number of dimensions requested
+	// from the embedding model.  Zero means the model's default.
+	EmbeddingDimensions int `json:",omitempty"`
+	// EmbeddingBatchTokens is the most tokens sent in a single
+	// embeddings request.  Zero means DefaultEmbeddingBatchTokens.
+	EmbeddingBatchTokens int `json:",omitempty"`
+	// EmbeddingBatchSize is the most texts sent in a single
+	// embeddings request.  Zero means DefaultEmbeddingBatchSize.
+	EmbeddingBatchSize int `json:",omitempty"`
+	// EmbeddingTokensPerMinute and EmbeddingRequestsPerMinute, if
+	// not zero, keep embedding requests under an account's rate
+	// limits, e.g. while adding many documents, by making requests
+	// wait their turn rather than failing with HTTP 429 and being
+	// retried.  The limits are shared by every goroutine embedding
+	// with the Grokker, and batches are made small enough to fit in a
+	// minute's allowance.
+	EmbeddingTokensPerMinute   int `json:",omitempty"`
+	EmbeddingRequestsPerMinute int `json:",omitempty"`
+	// Chunking names the chunker used for documents that have no
+	// chunker registered for their language; see SetChunking.
+	// Empty means "paragraph".
+	Chunking string `json:",omitempty"`
+	// ChunkTokens is the most tokens in a chunk of a document.  Zero
+	// means EmbeddingTokenLimit.  Documents already in the db keep
+	// their chunks until they change or the db is rebuilt.
+	ChunkTokens int `json:",omitempty"`
+	// MinChunkTokens is the fewest tokens in a chunk of a document.
+	// Shorter chunks, such as a short final paragraph, are merged
+	// into a neighboring chunk if the result fits in ChunkTokens.
+	// Zero means no minimum.  Like ChunkTokens, it applies to
+	// documents as they are added or changed.
+	MinChunkTokens int `json:",omitempty"`
+	// EmbedHeadings adds the headings that a chunk of a markdown
+	// document falls under, e.g. "Setup > Config", to the text
+	// embedded for the chunk after the document's path, so that
+	// queries naming a section can find it.  It costs a few tokens
+	// per chunk and applies to chunks embedded after it is set; run
+	// rebuild to re-embed the others.
+	EmbedHeadings bool `json:",omitempty"`
+	// ShareEmbeddings reuses the embedding of a chunk already in the
+	// db for a new chunk with the same text in another document,
+	// rather than embedding the text again, which saves embedding
+	// requests for corpora with a lot of shared boilerplate.  The
+	// reused embedding was made with the other document's path, so
+	// queries naming a path match such chunks less well.  Chunks of
+	// markdown documents aren't shared while EmbedHeadings is set.
+	ShareEmbeddings bool `json:",omitempty"`
+	// RejectEmptyDocuments makes adding or updating a document that
+	// is empty or only whitespace fail with an error wrapping
+	// ErrEmptyDocument.  Otherwise such a document is kept with a
+	// warning, though it has no chunks and can never be retrieved.
+	RejectEmptyDocuments bool `json:",omitempty"`
+	// SystemPrompt, if not empty, replaces SysMsgChat as the system
+	// message for questions.  It is not stored in the db; see
+	// Config.
+	SystemPrompt string `json:"-"`
+	// Language, if not empty, is the natural language that answers
+	// and commit messages are written in, e.g. "Japanese".  It is not
+	// stored in the db; see Config.
+	Language string `json:"-"`
+	// ContextBudgetFraction is the fraction of the model's token
+	// limit that Answer and Revise spend on context retrieved from
+	// the knowledge base.  Zero means DefaultContextBudgetFraction.
+	ContextBudgetFraction float64 `json:",omitempty"`
+	// ContextChunks is the most chunks considered for the context of
+	// a query before trimming them to the token budget, so that only
+	// the top candidates are sorted and measured.  Zero means
+	// DefaultContextChunks.
+	ContextChunks int `json:",omitempty"`
+	// KeywordWeight blends keyword (BM25) scores into retrieval so
+	// that exact terms such as error codes and identifiers are
+	// found even when embeddings miss them.  0 ranks chunks by
+	// embedding similarity alone and 1 by keywords alone.
+	KeywordWeight float64 `json:",omitempty"`
+	// Rerank asks the chat model to rate the relevance of the top
+	// RerankCandidates chunks for a query and reorders them before
+	// they are used as context.  This costs one extra chat request
+	// per query.
+	Rerank bool `json:",omitempty"`
+	// FitContext makes queries use as many of the highest ranked
+	// chunks as fit in the context budget, counting the tokens of
+	// each chunk as it appears in the prompt, instead of considering
+	// only the top ContextChunks and cutting the last one short.
+	// With Rerank, the reranked chunks are fitted the same way.
+	FitContext bool `json:",omitempty"`
+	// RerankCandidates is the number of chunks reranked when Rerank
+	// is set.  Zero means DefaultRerankCandidates.
+	RerankCandidates int `json:",omitempty"`
+	// QueryVariants is the number of rephrasings of a query the chat
+	// model is asked for before retrieval.  Each is embedded, and a
+	// chunk ranks by its best score for the query or any variant, so
+	// that terse or keyword-only questions find passages that use
+	// other words.  This costs one extra chat request per query.
+	// Zero turns expansion off.
+	QueryVariants int `json:",omitempty"`
+	// HyDE asks the chat model to draft a hypothetical answer to a
+	// query before retrieval and ranks chunks by their similarity to
+	// the average of the query's embedding and the answer's, which
+	// often finds passages that the bare question misses.  This
+	// costs one extra chat request per query.
+	HyDE bool `json:",omitempty"`
+	// DedupThreshold drops a chunk from the context of a query if
+	// the cosine similarity of its embedding to a higher-ranked chunk
+	// already chosen is above the threshold, e.g. 0.95, so that
+	// near-identical passages such as repeated license headers don't
+	// use up the budget.  Zero turns deduplication off.
+	DedupThreshold float64 `json:",omitempty"`
+	// MaxChunksPerDoc is the most chunks from any one document used
+	// as the context of a query, so that questions comparing several
+	// documents see all of them rather than only the one with the
+	// closest matches.  Zero means no limit.
+	MaxChunksPerDoc int `json:",omitempty"`
+	// MinRelevance is the lowest score a chunk may have to be used as
+	// the context of a query, e.g. 0.3 for cosine similarity.  If no
+	// chunk scores that high, Answer answers from the model's global
+	// knowledge if asked to, and otherwise returns an error wrapping
+	// ErrNoRelevantContext rather than let the model make up an
+	// answer from unrelated passages.  Zero means no floor.
+	MinRelevance float64 `json:",omitempty"`
+	// AutoGlobal turns on the model's global knowledge, as if Answer
+	// had been asked for it, for a question whose best retrieved
+	// chunk scores below it, e.g. 0.3 for cosine similarity, so that
+	// questions the knowledge base doesn't cover are still answered,
+	// with a notice saying so.  Scores are compared as for
+	// MinRelevance.  Zero means global knowledge is only used when
+	// asked for.
+	AutoGlobal float64 `json:",omitempty"`
+	// Metric is how embeddings are compared when ranking chunks; see
+	// the Metric* constants.  Empty means MetricCosine.
+	Metric string `json:",omitempty"`
+	// AutoContinue is the most times Answer, Msg, CompleteChat, and
+	// Conversation.Ask ask the model to continue a response that was
+	// cut off by its output token limit.  Zero returns truncated
+	// responses as they are; see Result.FinishReason.
+	AutoContinue int `json:",omitempty"`
+	// JSONRetries is the most times Answer asks the model to correct
+	// a reply that isn't a valid JSON object when
+	// ChatOptions.ResponseFormat is client.ResponseFormatJSON.  Zero
+	// means DefaultJSONRetries, and a negative value means none.
+	JSONRetries int `json:",omitempty"`
+	// MaxFileSize is the largest document, in bytes, that is read,
+	// so that adding e.g. a huge log file can't exhaust memory.
+	// Larger documents are skipped with an error wrapping
+	// ErrDocumentTooLarge, though a Span of one that fits can still
+	// be added.  Zero means DefaultMaxFileSize, and a negative value
+	// means no limit.
+	MaxFileSize int64 `json:",omitempty"`
+	// RefreshWorkers is the most documents RefreshEmbeddings embeds
+	// at once, so that re-embedding a large knowledge base, e.g.
+	// after a model upgrade, isn't limited by the latency of one
+	// request at a time.  The embedder must be safe for concurrent
+	// use.  Zero means DefaultRefreshWorkers; 1 refreshes one
+	// document at a time.
+	RefreshWorkers int `json:",omitempty"`
+	// EmbeddingOverflow is what happens to chunks longer than
+	// EmbeddingTokenLimit; see the Overflow* constants.  Empty means
+	// OverflowSplit.
+	EmbeddingOverflow string `json:",omitempty"`
+	// EmbeddingFormat is the format embeddings are stored in; see
+	// the Embedding* constants.  Empty means EmbeddingFloat64.
+	EmbeddingFormat string `json:",omitempty"`
+	// Compress gzip-compresses the db when it is saved.  Compressed
+	// dbs are detected when loading regardless of this setting.
+	Compress bool `json:",omitempty"`
+	// Projection, if not nil, reduces embeddings to fewer dimensions
+	// before they are stored.  See SetEmbeddingDims.
+	Projection *Projection `json:",omitempty"`
+	// Progress, if not nil, is called to report progress during
+	// long operations.  See ProgressFunc.
+	Progress ProgressFunc `json:"-"`
+	// ChatOptions are optional generation parameters, such as the
+	// seed and temperature, sent with each chat request.  The
+	// response format and JSON schema are only sent with requests
+	// for answers, not with those whose replies grokker reads
+	// itself, e.g. for reranking, HyDE, or summaries.  These are not
+	// stored in the db.
+	ChatOptions client.Options `json:"-"`
+	// ExplainRetrieval makes AnswerResult fill in Result.Retrieval,
+	// showing how the context was chosen.  It is not stored in the
+	// db.
+	ExplainRetrieval bool `json:"-"`
+	// Exclude leaves documents out of the context of queries and
+	// out of search results, e.g. outdated drafts kept for history.
+	// Each entry is a document path relative to Root, a directory
+	// whose documents are all left out, or a glob pattern matched
+	// against the path as by filepath.Match, e.g. "drafts/*.md".
+	// Excluded chunks are skipped before they are scored.  It is not
+	// stored in the db.
+	Exclude []string `json:"-"`
+	// RetrievalModel is the embedding model whose embeddings queries
+	// and searches are ranked by: EmbeddingModel, or one of
+	// AltEmbeddingModels to compare its results.  Empty means
+	// EmbeddingModel.  It is not stored in the db.
+	RetrievalModel string `json:"-"`
 	// pathname of the grokker database file
 	grokpath string
-	// lock                *flock.Flock
+	// dirty holds the RelPaths of documents changed since the db
+	// was last saved; see journal.go
+	dirty map[string]bool
+	// keywordCache holds the term frequencies of each chunk; see
+	// keywordIndex
+	keywordCache map[*Chunk]*chunkTerms
+	// rateLimit enforces the embedding rate limits; see
+	// embeddingLimiter
+	rateLimit *rateLimiter
+	// savedHeader is the header of the db as last saved or loaded,
+	// or nil if the db must be rewritten on the next save
+	savedHeader []byte
+	// lock is the db lock taken by LoadFrom, if any; see Close
+	lock *flock.Flock
+	// readonly is true if the db was loaded read-only
+	readonly bool
+	// closed is true once Close has been called
+	closed bool
+}
+
+// DefaultContextBudgetFraction is the default value of
+// Grokker.ContextBudgetFraction.
+const DefaultContextBudgetFraction = 0.5
+
+// DefaultContextChunks is the default value of Grokker.ContextChunks.
+const DefaultContextChunks = 100
+
+// ProgressFunc reports progress during long operations.
+// UpdateEmbeddings, RefreshEmbeddings, and Rebuild call it with the
+// number of documents done so far and the total, naming the document
+// being worked on next; the final call has done == total and an empty
+// currentDoc.  AddDocument and AddReader call it with the number of
+// the document's new chunks embedded so far and the total.
+type ProgressFunc func(done, total int, currentDoc string)
+
+// progress calls g.Progress if it is set.
+func (g *Grokker) progress(done, total int, currentDoc string) {
+	if g.Progress != nil {
+		g.Progress(done, total, currentDoc)
+	}
+}
+
+// embeddingProgress returns a function for updateDocument that
+// reports embedding progress for doc, or nil if g.Progress is not
+// set.
+func (g *Grokker) embeddingProgress(doc *Document) func(done, total int) {
+	if g.Progress == nil {
+		return nil
+	}
+	return func(done, total int) {
+		g.Progress(done, total, doc.RelPath)
+	}
 }
 
 // XXX get rid of this global
 var Tokenizer tokenizer.Codec
 
-// mtime returns the last modified time of the Grokker database.
+// mtime returns the last modified time of the Grokker database,
+// including its journal.
 func (g *Grokker) mtime() (timestamp time.Time, err error) {
 	defer Return(&err)
 	fi, err := os.Stat(g.grokpath)
 	Ck(err)
 	timestamp = fi.ModTime()
+	fi, err = os.Stat(g.journalPath())
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	Ck(err)
+	if fi.ModTime().After(timestamp) {
+		timestamp = fi.ModTime()
+	}
 	return
 }
 
+// contextBudget returns the number of tokens available for context
+// given a model's token limit.
+func (g *Grokker) contextBudget(tokenLimit int) int {
+	fraction := g.ContextBudgetFraction
+	if fraction <= 0 || fraction >= 1 {
+		fraction = DefaultContextBudgetFraction
+	}
+	return int(float64(tokenLimit) * fraction)
+}
+
+// contextChunks returns the most chunks to consider for context.
+func (g *Grokker) contextChunks() int {
+	if g.ContextChunks <= 0 {
+		return DefaultContextChunks
+	}
+	return g.ContextChunks
+}
+
+// chunkTokens returns the most tokens in a chunk of a document.
+func (g *Grokker) chunkTokens() int {
+	if g.ChunkTokens <= 0 || g.ChunkTokens > g.EmbeddingTokenLimit {
+		return g.EmbeddingTokenLimit
+	}
+	return g.ChunkTokens
+}
+
+// minChunkTokens returns the fewest tokens in a chunk of a document.
+func (g *Grokker) minChunkTokens() int {
+	if g.MinChunkTokens > g.chunkTokens() {
+		return g.chunkTokens()
+	}
+	return g.MinChunkTokens
+}
+
+// sysMsgChat returns the system message for questions.
+func (g *Grokker) sysMsgChat() string {
+	return g.sysMsgChatIn(g.Language)
+}
+
+// sysMsgChatIn returns the system message for questions answered in
+// lang.
+func (g *Grokker) sysMsgChatIn(lang string) string {
+	sysmsg := SysMsgChat
+	if g.SystemPrompt != "" {
+		sysmsg = g.SystemPrompt
+	}
+	return sysmsg + languagePrompt(lang)
+}
+
 // tokens returns the tokens for a text segment.
 func (g *Grokker) tokens(text string) (tokens []string, err error) {
 	defer Return(&err)
@@ -96,6 +456,25 @@ func (g *Grokker) tokens(text string) (tokens []string, err error) {
 	return
 }
 
+// truncateTokens returns the first maxTokens tokens of text, and
+// whether the text was truncated.
+func (g *Grokker) truncateTokens(text string, maxTokens int) (out string, truncated bool, err error) {
+	defer Return(&err)
+	ids, _, err := Tokenizer.Encode(text)
+	Ck(err)
+	if len(ids) <= maxTokens {
+		out = text
+		return
+	}
+	if maxTokens < 0 {
+		maxTokens = 0
+	}
+	out, err = Tokenizer.Decode(ids[:maxTokens])
+	Ck(err)
+	truncated = true
+	return
+}
+
 // meanVectorFromLongString returns the mean vector of a long string.
 func (g *Grokker) meanVectorFromLongString(text string) (vector []float64, err error) {
 	defer Return(&err)
@@ -103,7 +482,7 @@ func (g *Grokker) meanVectorFromLongString(text string) (vector []float64, err e
 	texts, err := g.stringsFromString(text, g.ModelObj.TokenLimit)
 	Ck(err)
 	// get the embeddings for each string
-	embeddings, err := g.createEmbeddings(texts)
+	embeddings, err := g.createEmbeddings(texts, nil)
 	Ck(err)
 	// get the mean vector of the embeddings
 	vector = util.MeanVector(embeddings)
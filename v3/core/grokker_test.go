@@ -1,12 +1,22 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gofrs/flock"
+	oai "github.com/stevegt/go-openai"
 	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+	"github.com/stevegt/grokker/v3/mock"
 	"github.com/stevegt/grokker/v3/util"
 )
 
@@ -63,13 +73,54 @@ func TestSplitChunk(t *testing.T) {
 		Tassert(t, tc <= grok.ModelObj.TokenLimit, "expected chunk %d to have %d tokens or less, got %d tokens", i, grok.ModelObj.TokenLimit, tc)
 	}
 }
+
+func TestSplitPoint(t *testing.T) {
+	cases := []struct {
+		text       string
+		start, end int
+		want       int
+	}{
+		// back off to the end of the sentence
+		{"One two. Three four five", 0, 16, 9},
+		// back off to whitespace
+		{"one two three four", 0, 11, 8},
+		// don't give up more than half the segment
+		{"one twothreefourfive", 0, 12, 12},
+		// a single long token is cut at a rune boundary
+		{"ααααα", 0, 5, 4},
+	}
+	for _, c := range cases {
+		got := splitPoint(c.text, c.start, c.end)
+		Tassert(t, got == c.want, "splitPoint(%q, %d, %d) = %d, want %d", c.text, c.start, c.end, got, c.want)
+	}
+
+	// a long paragraph splits between words
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	text := strings.Repeat("lorem ipsum dolor sit amet ", 200)
+	chunk := newChunk(nil, 0, len(text), text)
+	newChunks, err := chunk.splitChunk(grok, 100)
+	Tassert(t, err == nil, "error splitting chunk: %v", err)
+	Tassert(t, len(newChunks) > 1, "expected chunk to be split")
+	for i, c := range newChunks[:len(newChunks)-1] {
+		Tassert(t, strings.HasSuffix(c.text, " "), "chunk %d ends mid-word: %q", i, c.text[len(c.text)-10:])
+	}
+
+	// a single token longer than the limit still splits
+	text = strings.Repeat("x", 2000)
+	chunk = newChunk(nil, 0, len(text), text)
+	newChunks, err = chunk.splitChunk(grok, 10)
+	Tassert(t, err == nil, "error splitting chunk: %v", err)
+	Tassert(t, len(newChunks) > 1, "expected long token to be split")
+}
+
 func TestEmbeddings(t *testing.T) {
 	//
 	// create a new Grokker database
 	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
 	Tassert(t, err == nil, "error creating grokker: %v", err)
 	// add some embeddings
-	embs, err := grok.createEmbeddings([]string{"hello", "world"})
+	embs, err := grok.createEmbeddings([]string{"hello", "world"}, nil)
 	Tassert(t, err == nil, "error creating embeddings: %v", err)
 	Tassert(t, len(embs) == 2, "expected 2 embeddings, got %d", len(embs))
 	Tassert(t, len(embs[0]) == 1536, "expected 1536 embeddings, got %d", len(embs[0]))
@@ -142,6 +193,594 @@ func TestFindSimilar(t *testing.T) {
 	}
 }
 
+// test limiting the number of context chunks considered
+func TestContextChunks(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	query := "Why is order of operations important when administering a UNIX machine?"
+	all, err := grok.findChunks(query, 100000, nil)
+	Tassert(t, err == nil, "error finding similar chunks: %v", err)
+	Tassert(t, len(all) > 2, "expected more than 2 chunks, got %d", len(all))
+	grok.ContextChunks = 2
+	top, err := grok.findChunks(query, 100000, nil)
+	Tassert(t, err == nil, "error finding similar chunks: %v", err)
+	Tassert(t, len(top) == 2, "expected 2 chunks, got %d", len(top))
+	for i := range top {
+		Tassert(t, top[i] == all[i], "chunk %d differs from the unlimited ranking", i)
+	}
+}
+
+// test searching for chunks without generating an answer
+func TestSearch(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	// add the document
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Chunks) > 3, "expected more than 3 chunks, got %d", len(grok.Chunks))
+	results, err := grok.Search("Why is order of operations important when administering a UNIX machine?", 3)
+	Tassert(t, err == nil, "error searching: %v", err)
+	Tassert(t, len(results) == 3, "expected 3 results, got %d", len(results))
+	for i, res := range results {
+		Tassert(t, len(res.Text) == res.Length, "result %d: expected %d bytes of text, got %d", i, res.Length, len(res.Text))
+		if i > 0 {
+			Tassert(t, res.Score <= results[i-1].Score, "results not sorted by score")
+		}
+	}
+	// K must be positive
+	_, err = grok.Search("order", 0)
+	Tassert(t, err != nil, "expected error for K=0")
+}
+
+func TestChunkLines(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	fn := filepath.Join(dir, "notes.txt")
+	err = ioutil.WriteFile(fn, []byte("alpha one\nalpha two\n\nbeta one\n\ngamma one\ngamma two\ngamma three\n"), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	check := func(grok *Grokker) {
+		results, err := grok.Search("gamma", 1)
+		Tassert(t, err == nil, "error searching: %v", err)
+		Tassert(t, results[0].Line == 6 && results[0].EndLine == 8, "expected lines 6-8, got %d-%d", results[0].Line, results[0].EndLine)
+		results, err = grok.Search("beta", 1)
+		Tassert(t, err == nil, "error searching: %v", err)
+		Tassert(t, results[0].Line == 4 && results[0].EndLine == 4, "expected line 4, got %d-%d", results[0].Line, results[0].EndLine)
+	}
+	check(grok)
+
+	// lines are saved with the chunks
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	grok, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	for _, chunk := range grok.Chunks {
+		Tassert(t, chunk.Line > 0, "expected lines to be loaded for chunk at offset %d", chunk.Offset)
+	}
+	check(grok)
+
+	// and counted for chunks made by older versions
+	for _, chunk := range grok.Chunks {
+		chunk.Line, chunk.EndLine = 0, 0
+	}
+	check(grok)
+
+	// lines of a line span count from the start of the file
+	err = grok.AddDocumentWithOpts(fn, AddOpts{Span: &Span{Lines: true, Start: 4, End: 8}})
+	Tassert(t, err == nil, "error adding span: %v", err)
+	check(grok)
+}
+
+func TestRelatedDocuments(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	docs := map[string]string{
+		"install.md":  "Install the server with make.\n\nThe server listens on port 8080.",
+		"setup.md":    "Build and install the server with make install.\n\nThe server listens on port 8080 by default.",
+		"recipes.md":  "Whisk the eggs and sugar.\n\nBake the cake for forty minutes.",
+		"release.txt": "Tag the release and push the tag.",
+	}
+	for name, content := range docs {
+		fn := filepath.Join(dir, name)
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	results, err := grok.RelatedDocuments("install.md", 2)
+	Tassert(t, err == nil, "error finding related documents: %v", err)
+	Tassert(t, len(results) == 2, "expected 2 results, got %v", results)
+	Tassert(t, results[0].Path == "setup.md", "expected setup.md first, got %v", results)
+	Tassert(t, results[0].Score > results[1].Score, "results not sorted by score: %v", results)
+	results, err = grok.RelatedDocuments("install.md", 10)
+	Tassert(t, err == nil, "error finding related documents: %v", err)
+	Tassert(t, len(results) == 3, "expected every other document, got %v", results)
+
+	_, err = grok.RelatedDocuments("nosuch.md", 2)
+	Tassert(t, errors.Is(err, ErrDocumentNotFound), "expected ErrDocumentNotFound, got %v", err)
+	_, err = grok.RelatedDocuments("install.md", 0)
+	Tassert(t, err != nil, "expected error for K=0")
+}
+
+func TestFindDuplicates(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	install := "Install the server with make install.  The server listens on port 8080 and logs to syslog."
+	cake := "Whisk the eggs and sugar, fold in the flour, and bake the cake for forty minutes."
+	docs := []struct{ name, content string }{
+		{"install.md", install},
+		{"cake.md", cake},
+		{"install-copy.md", install + "  Edited."},
+		{"release.md", "Tag the release and push the tag to the remote."},
+		{"cake-copy.md", "Note: " + cake},
+	}
+	for _, doc := range docs {
+		fn := filepath.Join(dir, doc.name)
+		err = ioutil.WriteFile(fn, []byte(doc.content), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	groups, err := grok.FindDuplicates(0.9)
+	Tassert(t, err == nil, "error finding duplicates: %v", err)
+	var got []string
+	for _, group := range groups {
+		var paths []string
+		for _, doc := range group {
+			paths = append(paths, doc.Path)
+		}
+		got = append(got, strings.Join(paths, " "))
+	}
+	Tassert(t, strings.Join(got, "; ") == "install.md install-copy.md; cake.md cake-copy.md", "unexpected groups %q", got)
+	Tassert(t, groups[0][0].Score == 1, "expected the first member to score 1, got %f", groups[0][0].Score)
+	// the scores are the ones used for grouping, whatever the metric
+	grok.Metric = MetricEuclidean
+	groups, err = grok.FindDuplicates(0.9)
+	Tassert(t, err == nil, "error finding duplicates: %v", err)
+	sim, err := grok.DocumentSimilarity("install.md", "install-copy.md")
+	Tassert(t, err == nil, "error getting similarity: %v", err)
+	Tassert(t, sim > 0.9, "expected copies to be similar, got %f", sim)
+	Tassert(t, groups[0][1].Score == sim, "expected score %f, got %f", sim, groups[0][1].Score)
+	_, err = grok.DocumentSimilarity("install.md", "nosuch.md")
+	Tassert(t, errors.Is(err, ErrDocumentNotFound), "expected ErrDocumentNotFound, got %v", err)
+
+	// a threshold above every similarity finds nothing
+	groups, err = grok.FindDuplicates(1)
+	Tassert(t, err == nil, "error finding duplicates: %v", err)
+	Tassert(t, len(groups) == 0, "expected no groups, got %d", len(groups))
+}
+
+// test that corrupt embeddings are ranked last and rejected on update
+func TestCorruptEmbeddings(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, len(grok.Chunks) > 2, "expected more than 2 chunks, got %d", len(grok.Chunks))
+	// corrupt two chunks' embeddings
+	dims := len(grok.Chunks[0].Embedding)
+	grok.Chunks[0].Embedding = make([]float64, dims)
+	grok.Chunks[1].Embedding[0] = math.NaN()
+	embedding, err := grok.queryEmbedding("order of operations")
+	Tassert(t, err == nil, "error embedding query: %v", err)
+	chunks, err := grok.similarChunks(embedding, 1000000, nil)
+	Tassert(t, err == nil, "error finding similar chunks: %v", err)
+	n := len(chunks)
+	for _, chunk := range chunks[:n-2] {
+		Tassert(t, chunk != grok.Chunks[0] && chunk != grok.Chunks[1], "corrupt chunk ranked above good chunks")
+	}
+	// corrupt embeddings are rejected when a document is updated
+	err = validateEmbedding(make([]float64, dims), dims)
+	Tassert(t, err != nil, "expected error for all-zero embedding")
+	err = validateEmbedding([]float64{1, 2}, dims)
+	Tassert(t, err != nil, "expected error for wrong dimensionality")
+}
+
+// test progress reporting
+func TestProgress(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	// a nil Progress is fine
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	var calls, lastDone, lastTotal int
+	grok.Progress = func(done, total int, currentDoc string) {
+		calls++
+		lastDone, lastTotal = done, total
+	}
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, calls > 0, "expected progress calls")
+	Tassert(t, lastDone == lastTotal, "expected final done == total, got %d/%d", lastDone, lastTotal)
+	calls = 0
+	err = grok.RefreshEmbeddings()
+	Tassert(t, err == nil, "error refreshing: %v", err)
+	Tassert(t, calls == 3, "expected 3 progress calls, got %d", calls)
+	Tassert(t, lastDone == 2 && lastTotal == 2, "expected 2/2, got %d/%d", lastDone, lastTotal)
+}
+
+// test finding the db from a subdirectory
+func TestFindGrokDB(t *testing.T) {
+	dir := TmpTestDir()
+	_, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	sub := filepath.Join(dir, "a", "b")
+	err = os.MkdirAll(sub, 0755)
+	Tassert(t, err == nil, "error creating subdirectory: %v", err)
+	want := filepath.Join(dir, ".grok")
+	for _, start := range []string{dir, sub} {
+		path, err := FindGrokDB(start)
+		Tassert(t, err == nil, "error finding db from %s: %v", start, err)
+		Tassert(t, path == want, "expected %s, got %s", want, path)
+	}
+	_, err = FindGrokDB(TmpTestDir())
+	Tassert(t, errors.Is(err, ErrDBNotFound), "expected ErrDBNotFound, got %v", err)
+}
+
+// closingEmbedder is a client.Embedder that records being closed.
+type closingEmbedder struct {
+	batchCountingEmbedder
+	closed int
+}
+
+func (e *closingEmbedder) Close() error {
+	e.closed++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	g, _, _, _, _, err := LoadFrom(grok.grokpath, "", false)
+	Tassert(t, err == nil, "error loading: %v", err)
+	embedder := &closingEmbedder{}
+	g.SetEmbedder(embedder)
+	err = g.AddReader("a.txt", strings.NewReader("apples"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+
+	// Close saves, closes the embedder, and releases the lock
+	err = g.Close()
+	Tassert(t, err == nil, "error closing: %v", err)
+	Tassert(t, embedder.closed == 1, "expected embedder closed once, got %d", embedder.closed)
+	other := flock.New(grok.grokpath + ".lock")
+	locked, err := other.TryLock()
+	Tassert(t, err == nil && locked, "expected lock to be released: %v", err)
+	other.Unlock()
+	err = g.Close()
+	Tassert(t, err == nil, "error closing again: %v", err)
+	Tassert(t, embedder.closed == 1, "expected embedder closed once, got %d", embedder.closed)
+
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, len(g.Documents) == 1, "expected the document to be saved, got %v", g.ListDocuments())
+}
+
+// test saving and loading a compressed db
+func TestCompress(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	grok.Compress = true
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	buf, err := ioutil.ReadFile(grok.grokpath)
+	Tassert(t, err == nil, "error reading db: %v", err)
+	Tassert(t, len(buf) > 2 && buf[0] == 0x1f && buf[1] == 0x8b, "expected gzip magic number")
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, g.Compress, "expected Compress to be set")
+	Tassert(t, len(g.Chunks) == len(grok.Chunks), "expected %d chunks, got %d", len(grok.Chunks), len(g.Chunks))
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	grok.KeywordWeight = 0.5
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_, err := grok.AnswerResult("gpt-4", "What is this about?", false, false, false)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := grok.Search("transaction engine", 3)
+			errs <- err
+		}()
+		go func(i int) {
+			defer wg.Done()
+			errs <- grok.AddReader(Spf("note%d.txt", i), strings.NewReader(Spf("note number %d", i)))
+			grok.ListDocuments()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		Tassert(t, err == nil, "error during concurrent use: %v", err)
+	}
+	Tassert(t, len(grok.Documents) == 11, "expected 11 documents, got %d", len(grok.Documents))
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+}
+
+// test re-embedding a single document
+func TestRefreshDocument(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &countingEmbedder{}
+	grok.SetEmbedder(embedder)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chunks, err := grok.DocumentChunks("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	total := len(grok.Chunks)
+	// unchanged documents are normally not re-embedded
+	embedder.count = 0
+	err = grok.RefreshEmbeddings()
+	Tassert(t, err == nil, "error refreshing: %v", err)
+	Tassert(t, embedder.count == 0, "expected no embeddings, got %d", embedder.count)
+	err = grok.RefreshDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error refreshing doc: %v", err)
+	Tassert(t, embedder.count == len(chunks), "expected %d embeddings, got %d", len(chunks), embedder.count)
+	Tassert(t, len(grok.Chunks) == total, "expected %d chunks, got %d", total, len(grok.Chunks))
+	err = grok.RefreshDocument("testdata/nonexistent.txt")
+	Tassert(t, err != nil, "expected error for unknown document")
+}
+
+func TestRefreshSkipsFailures(t *testing.T) {
+	dir := TmpTestDir()
+	good := filepath.Join(dir, "good.txt")
+	bad := filepath.Join(dir, "bad.txt")
+	for _, fn := range []string{good, bad} {
+		err := ioutil.WriteFile(fn, []byte("original text of "+filepath.Base(fn)+"\n"), 0644)
+		Tassert(t, err == nil, "error writing doc: %v", err)
+	}
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	for _, fn := range []string{good, bad} {
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+
+	// change both documents, making one unreadable; permissions
+	// don't stop root, so replace it with a directory
+	err = ioutil.WriteFile(good, []byte("new text of good.txt\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	err = os.Remove(bad)
+	Tassert(t, err == nil, "error removing doc: %v", err)
+	err = os.Mkdir(bad, 0755)
+	Tassert(t, err == nil, "error making directory: %v", err)
+	later := time.Now().Add(time.Hour)
+	for _, fn := range []string{good, bad} {
+		err = os.Chtimes(fn, later, later)
+		Tassert(t, err == nil, "error setting mtime: %v", err)
+	}
+
+	check := func(err error) {
+		var refreshErr *RefreshError
+		Tassert(t, errors.As(err, &refreshErr), "expected RefreshError, got %v", err)
+		Tassert(t, len(refreshErr.Failed) == 1 && refreshErr.Failed[0].RelPath == "bad.txt", "unexpected failures %v", refreshErr.Failed)
+		// the good document was updated and the bad one kept its chunk
+		chunks, err := grok.DocumentChunks("good.txt")
+		Tassert(t, err == nil && len(chunks) == 1, "unexpected chunks for good.txt: %v, %v", chunks, err)
+		text, err := grok.ChunkText(chunks[0])
+		Tassert(t, err == nil && strings.Contains(text, "new text"), "expected good.txt to be updated, got %q", text)
+		chunks, err = grok.DocumentChunks("bad.txt")
+		Tassert(t, err == nil && len(chunks) == 1, "expected bad.txt to keep its chunk: %v, %v", chunks, err)
+		Tassert(t, chunks[0].Embedding != nil, "expected bad.txt to keep its embedding")
+	}
+	updated, err := grok.UpdateEmbeddings()
+	Tassert(t, updated, "expected good.txt to be updated")
+	check(err)
+	err = grok.RefreshEmbeddings()
+	check(err)
+}
+
+// test that refreshes check for blank documents the way adds do
+func TestRefreshEmptyDocument(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		dir := TmpTestDir()
+		fn := filepath.Join(dir, "notes.txt")
+		err := ioutil.WriteFile(fn, []byte("some notes\n"), 0644)
+		Tassert(t, err == nil, "error writing doc: %v", err)
+		grok, err := Init(dir, "gpt-4")
+		Tassert(t, err == nil, "error creating grokker: %v", err)
+		grok.RefreshWorkers = workers
+		grok.RejectEmptyDocuments = true
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+
+		err = ioutil.WriteFile(fn, []byte(" \n"), 0644)
+		Tassert(t, err == nil, "error writing doc: %v", err)
+		err = grok.RefreshEmbeddings()
+		var refreshErr *RefreshError
+		Tassert(t, errors.As(err, &refreshErr), "expected RefreshError, got %v", err)
+		Tassert(t, len(refreshErr.Failed) == 1 && errors.Is(refreshErr.Failed[0].Err, ErrEmptyDocument), "unexpected failures %v", refreshErr.Failed)
+		chunks, err := grok.DocumentChunks("notes.txt")
+		Tassert(t, err == nil && len(chunks) == 1, "expected notes.txt to keep its chunk: %v, %v", chunks, err)
+	}
+}
+
+// slowEmbedder is a client.Embedder that is safe for concurrent use.
+// It records the most calls in flight at once, and takes longer to
+// embed longer texts.
+type slowEmbedder struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (e *slowEmbedder) CreateEmbeddings(texts []string) (embeddings [][]float64, err error) {
+	e.mu.Lock()
+	e.inFlight++
+	e.maxInFlight = max(e.maxInFlight, e.inFlight)
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.inFlight--
+		e.mu.Unlock()
+	}()
+	var size int
+	for _, text := range texts {
+		size += len(text)
+		embeddings = append(embeddings, []float64{1, float64(len(text)), 0})
+	}
+	time.Sleep(time.Duration(size/20) * time.Millisecond)
+	return
+}
+
+func TestRefreshWorkers(t *testing.T) {
+	// refresh the same changed documents one at a time and
+	// concurrently
+	refresh := func(workers int) (grok *Grokker, embedder *slowEmbedder) {
+		dir := TmpTestDir()
+		grok, err := Init(dir, "gpt-4")
+		Tassert(t, err == nil, "error creating grokker: %v", err)
+		embedder = &slowEmbedder{}
+		grok.SetEmbedder(embedder)
+		grok.RefreshWorkers = workers
+		write := func(i int, text string) string {
+			// earlier documents are longer, so they finish last
+			fn := filepath.Join(dir, Spf("doc%d.txt", i))
+			para := strings.Repeat(Spf("document %d ", i), 8-i)
+			err := ioutil.WriteFile(fn, []byte(para+"\n\n"+text+"\n\n"+para+"\n"), 0644)
+			Tassert(t, err == nil, "error writing doc: %v", err)
+			return fn
+		}
+		for i := 0; i < 6; i++ {
+			err = grok.AddDocument(write(i, "old"))
+			Tassert(t, err == nil, "error adding doc: %v", err)
+		}
+		for i := 0; i < 6; i++ {
+			write(i, "new")
+		}
+		err = grok.RefreshEmbeddings()
+		Tassert(t, err == nil, "error refreshing: %v", err)
+		return
+	}
+	serial, embedder := refresh(1)
+	Tassert(t, embedder.maxInFlight == 1, "expected one request at a time, got %d", embedder.maxInFlight)
+	concurrent, embedder := refresh(4)
+	Tassert(t, embedder.maxInFlight > 1, "expected concurrent requests, got %d", embedder.maxInFlight)
+	Tassert(t, embedder.maxInFlight <= 4, "expected at most 4 concurrent requests, got %d", embedder.maxInFlight)
+
+	// the chunk list doesn't depend on the order documents finished
+	Tassert(t, len(serial.Chunks) == len(concurrent.Chunks), "expected %d chunks, got %d", len(serial.Chunks), len(concurrent.Chunks))
+	for i, chunk := range concurrent.Chunks {
+		want := serial.Chunks[i]
+		Tassert(t, chunk.Document.RelPath == want.Document.RelPath && chunk.Offset == want.Offset && chunk.Hash == want.Hash,
+			"chunk %d: expected %s at %d, got %s at %d", i, want.Document.RelPath, want.Offset, chunk.Document.RelPath, chunk.Offset)
+		Tassert(t, chunk.Embedding != nil, "expected chunk %d to be embedded", i)
+		text, err := concurrent.ChunkText(chunk)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		Tassert(t, !strings.Contains(text, "old"), "expected old chunks to be collected, got %q", text)
+	}
+}
+
+func TestUpdateEmbeddingsChecked(t *testing.T) {
+	dir := TmpTestDir()
+	fn := filepath.Join(dir, "doc.txt")
+	err := ioutil.WriteFile(fn, []byte("original text\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, grok.Documents[0].Checked != 0, "expected the check time to be recorded")
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	text := func() string {
+		chunks, err := grok.DocumentChunks("doc.txt")
+		Tassert(t, err == nil && len(chunks) == 1, "unexpected chunks: %v, %v", chunks, err)
+		text, err := grok.ChunkText(chunks[0])
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		return text
+	}
+
+	// a change is found even if the db file is newer, e.g. because
+	// it was copied or restored
+	err = ioutil.WriteFile(fn, []byte("changed text\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(fn, later, later)
+	Tassert(t, err == nil, "error setting mtime: %v", err)
+	err = os.Chtimes(grok.grokpath, later.Add(time.Hour), later.Add(time.Hour))
+	Tassert(t, err == nil, "error setting mtime: %v", err)
+	updated, err := grok.UpdateEmbeddings()
+	Tassert(t, err == nil, "error updating: %v", err)
+	Tassert(t, updated, "expected the changed doc to be updated")
+	Tassert(t, strings.Contains(text(), "changed"), "unexpected text %q", text())
+
+	// a change that looks older than the last check is missed unless
+	// the caller asks for every document to be checked
+	err = ioutil.WriteFile(fn, []byte("restored text\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	earlier := time.Now().Add(-time.Hour)
+	err = os.Chtimes(fn, earlier, earlier)
+	Tassert(t, err == nil, "error setting mtime: %v", err)
+	updated, err = grok.UpdateEmbeddings()
+	Tassert(t, err == nil, "error updating: %v", err)
+	Tassert(t, !updated, "expected the old-looking change to be skipped")
+	updated, err = grok.UpdateEmbeddingsSince(time.Time{})
+	Tassert(t, err == nil, "error updating: %v", err)
+	Tassert(t, updated, "expected every doc to be checked")
+	Tassert(t, strings.Contains(text(), "restored"), "unexpected text %q", text())
+}
+
+// test that a document whose embedding failed is retried by the next
+// update, even after a save
+func TestUpdateEmbeddingsRetriesFailures(t *testing.T) {
+	dir := TmpTestDir()
+	fn := filepath.Join(dir, "doc.txt")
+	err := ioutil.WriteFile(fn, []byte("some text\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	earlier := time.Now().Add(-time.Hour)
+	err = os.Chtimes(fn, earlier, earlier)
+	Tassert(t, err == nil, "error setting mtime: %v", err)
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.SetEmbedder(failingEmbedder{})
+	err = grok.AddDocument(fn)
+	Tassert(t, errors.Is(err, ErrEmbeddingAPI), "expected ErrEmbeddingAPI, got %v", err)
+	Tassert(t, len(grok.Chunks) == 0, "expected no unembedded chunks, got %d", len(grok.Chunks))
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", false)
+	Tassert(t, err == nil, "error loading: %v", err)
+	defer lock.Unlock()
+	g.SetEmbedder(&countingEmbedder{})
+	updated, err := g.UpdateEmbeddings()
+	Tassert(t, err == nil, "error updating: %v", err)
+	Tassert(t, updated, "expected the failed doc to be retried")
+	chunks, err := g.DocumentChunks("doc.txt")
+	Tassert(t, err == nil && len(chunks) == 1 && chunks[0].Embedding != nil, "expected an embedded chunk, got %v, %v", chunks, err)
+	Tassert(t, g.Documents[0].Checked > 0, "expected the check time to be recorded, got %d", g.Documents[0].Checked)
+}
+
 // test a chat query
 func TestChatQuery(t *testing.T) {
 	// create a new Grokker database
@@ -162,6 +801,454 @@ func TestChatQuery(t *testing.T) {
 
 }
 
+// test that AnswerResult returns the messages sent to the model
+func TestAnswerResultMessages(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	question := "What is this about?"
+	res, err := grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	msgs := res.Messages
+	Tassert(t, len(msgs) == 4, "expected 4 messages, got %d", len(msgs))
+	Tassert(t, msgs[0].Role == RoleSystem && msgs[0].Content == SysMsgChat, "expected system message first, got %#v", msgs[0])
+	Tassert(t, strings.HasPrefix(msgs[1].Content, "Context:"), "expected context second, got %q", msgs[1].Content)
+	Tassert(t, msgs[3].Content == question, "expected question last, got %q", msgs[3].Content)
+}
+
+// messagesChat is a client.ChatClient that records the messages of
+// its last request.
+type messagesChat struct {
+	messages []client.ChatMsg
+}
+
+func (c *messagesChat) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	c.messages = messages
+	results.Body = "ok"
+	return
+}
+
+// test that models without system messages get them as user messages,
+// even when they aren't the default model
+func TestNoSystemMessage(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	chat := &messagesChat{}
+	grok.SetChatClient("openai", chat)
+	err = grok.AddReader("notes.txt", strings.NewReader("The build runs nightly."))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+
+	res, err := grok.AnswerResult("o1-mini", "When does the build run?", false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, res.Messages[0].Role == RoleUser && res.Messages[1].Role == RoleAI, "expected the system message as a user message, got %#v", res.Messages[:2])
+	_, _, err = grok.CompleteChat("o3-mini", SysMsgChat, []client.ChatMsg{{Role: RoleUser, Content: "Hello"}})
+	Tassert(t, err == nil, "error completing chat: %v", err)
+	Tassert(t, chat.messages[0].Role == RoleUser, "expected the system message as a user message, got %#v", chat.messages[0])
+	_, _, err = grok.CompleteChat("gpt-4", SysMsgChat, []client.ChatMsg{{Role: RoleUser, Content: "Hello"}})
+	Tassert(t, err == nil, "error completing chat: %v", err)
+	Tassert(t, chat.messages[0].Role == RoleSystem, "expected a system message, got %#v", chat.messages[0])
+}
+
+func TestAnswerTokens(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	question := "What is this about?"
+	res, err := grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	tokens := res.Tokens
+	Tassert(t, tokens != nil, "expected a token breakdown")
+	sysTc, err := grok.TokenCount(SysMsgChat)
+	Tassert(t, err == nil, "error counting tokens: %v", err)
+	qTc, err := grok.TokenCount(question)
+	Tassert(t, err == nil, "error counting tokens: %v", err)
+	Tassert(t, tokens.System == sysTc+tokensPerMessage, "expected %d system tokens, got %d", sysTc+tokensPerMessage, tokens.System)
+	Tassert(t, tokens.Question == qTc+tokensPerMessage, "expected %d question tokens, got %d", qTc+tokensPerMessage, tokens.Question)
+	Tassert(t, tokens.Context > 0 && tokens.Global == 0, "unexpected breakdown %s", tokens)
+	total, err := grok.messagesTokenCount(res.Messages)
+	Tassert(t, err == nil, "error counting tokens: %v", err)
+	Tassert(t, tokens.Total == total, "expected %d tokens in all, got %d", total, tokens.Total)
+	Tassert(t, tokens.Limit == 8192 && tokens.Completion == tokens.Limit-tokens.Total, "unexpected breakdown %s", tokens)
+
+	// a request that doesn't fit says where the tokens went
+	long := strings.Repeat("word ", 9000)
+	_, _, tokens, err = grok.answerWithRAG(context.Background(), "gpt-4", SysMsgChat, long, "", nil, false, grok.ChatOptions)
+	Tassert(t, errors.Is(err, ErrTokenLimitExceeded), "expected ErrTokenLimitExceeded, got %v", err)
+	Tassert(t, tokens.Question > tokens.Limit && tokens.Completion < 0, "unexpected breakdown %s", tokens)
+	Tassert(t, strings.Contains(err.Error(), tokens.String()), "expected the breakdown in %q", err)
+}
+
+func TestContextBudget(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	// fractions outside (0, 1) fall back to the default
+	for _, tc := range []struct {
+		fraction float64
+		want     int
+	}{
+		{0, 4096},
+		{0.25, 2048},
+		{0.8, 6553},
+		{1, 4096},
+		{-0.5, 4096},
+	} {
+		grok.ContextBudgetFraction = tc.fraction
+		got := grok.contextBudget(8192)
+		Tassert(t, got == tc.want, "fraction %v: expected %d tokens, got %d", tc.fraction, tc.want, got)
+	}
+
+	// a larger fraction lets more context into the answer
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	question := "Why is order of operations important when administering a UNIX machine?"
+	var contexts []int
+	for _, fraction := range []float64{0.25, 0.75} {
+		grok.ContextBudgetFraction = fraction
+		res, err := grok.AnswerResult("gpt-4", question, false, false, false)
+		Tassert(t, err == nil, "error answering query: %v", err)
+		Tassert(t, res.Tokens.Context <= grok.contextBudget(8192), "fraction %v: %d context tokens is over budget", fraction, res.Tokens.Context)
+		contexts = append(contexts, res.Tokens.Context)
+	}
+	Tassert(t, contexts[1] > contexts[0], "expected more context with a larger fraction, got %v", contexts)
+}
+
+func TestExplainRetrieval(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	grok.ContextChunks = 5
+	query := "Why is order of operations important when administering a UNIX machine?"
+
+	// a small budget drops some candidates
+	_, chunks, explained, err := grok.explainContext(context.Background(), query, 1000, false, false, nil, true)
+	Tassert(t, err == nil, "error getting context: %v", err)
+	Tassert(t, len(explained) == 5, "expected 5 candidates, got %d", len(explained))
+	var used, dropped int
+	for i, ex := range explained {
+		Tassert(t, strings.HasSuffix(ex.Path, "te-full.txt"), "unexpected path %q", ex.Path)
+		Tassert(t, ex.Tokens > 0, "expected token count for candidate %d", i)
+		if ex.Selected {
+			used++
+			Tassert(t, dropped == 0, "candidate %d used after one was dropped", i)
+		} else {
+			dropped++
+		}
+	}
+	Tassert(t, used > 0 && dropped > 0, "expected some used and some dropped, got %d and %d", used, dropped)
+	Tassert(t, len(chunks) >= used, "expected at least %d context chunks, got %d", used, len(chunks))
+
+	// answers only explain retrieval when asked
+	res, err := grok.AnswerResult("gpt-4", query, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, res.Retrieval == nil, "unexpected retrieval %v", res.Retrieval)
+	grok.ExplainRetrieval = true
+	res, err = grok.AnswerResult("gpt-4", query, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, len(res.Retrieval) > 0, "expected retrieval to be explained")
+}
+
+func TestDedupThreshold(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	license := "Copyright the authors.  Licensed under the Apache License, Version 2.0; you may not use this file except in compliance with the License."
+	for i, body := range []string{"The server listens on port 8080.", "The client retries three times.", "The cache holds one hour of data."} {
+		fn := filepath.Join(dir, Spf("file%d.go", i))
+		err = ioutil.WriteFile(fn, []byte(license+"\n\n"+body+"\n"), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	query := "Under what license may I use this file?"
+	countLicenses := func(chunks []*Chunk) (n int) {
+		for _, chunk := range chunks {
+			text, err := grok.chunkText(chunk, false, false)
+			Tassert(t, err == nil, "error getting chunk text: %v", err)
+			if strings.Contains(text, "Apache License") {
+				n++
+			}
+		}
+		return
+	}
+
+	chunks, _, err := grok.retrieve(context.Background(), query, 1000, nil, false, false, false)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, countLicenses(chunks) == 3, "expected 3 license chunks without dedup, got %d", countLicenses(chunks))
+
+	grok.DedupThreshold = 0.9
+	chunks, explained, err := grok.retrieve(context.Background(), query, 1000, nil, false, false, true)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, countLicenses(chunks) == 1, "expected 1 license chunk with dedup, got %d", countLicenses(chunks))
+	Tassert(t, len(chunks) == 4, "expected the other chunks to be kept, got %d", len(chunks))
+	var dropped int
+	for _, ex := range explained {
+		if !ex.Selected {
+			dropped++
+		}
+	}
+	Tassert(t, dropped == 2, "expected 2 duplicates dropped, got %d", dropped)
+}
+
+func TestMaxChunksPerDoc(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	var paras []string
+	for i := 0; i < 6; i++ {
+		paras = append(paras, Spf("Retries: the client retries failed requests %d times with backoff.", i+2))
+	}
+	docs := map[string]string{
+		"client.md": strings.Join(paras, "\n\n"),
+		"server.md": "Retries: the server never retries failed requests.",
+	}
+	for name, content := range docs {
+		fn := filepath.Join(dir, name)
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	query := "How many times does the client retry failed requests with backoff?"
+	countDocs := func(chunks []*Chunk) map[string]int {
+		counts := make(map[string]int)
+		for _, chunk := range chunks {
+			counts[chunk.Document.RelPath]++
+		}
+		return counts
+	}
+
+	grok.ContextChunks = 3
+	chunks, _, err := grok.retrieve(context.Background(), query, 1000, nil, false, false, false)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, countDocs(chunks)["server.md"] == 0, "expected the client doc to crowd out the server doc, got %v", countDocs(chunks))
+
+	grok.MaxChunksPerDoc = 2
+	chunks, _, err = grok.retrieve(context.Background(), query, 1000, nil, false, false, false)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	counts := countDocs(chunks)
+	Tassert(t, counts["client.md"] == 2 && counts["server.md"] == 1, "expected 2 client chunks and 1 server chunk, got %v", counts)
+}
+
+func TestFitContext(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	var paras []string
+	for i := 0; i < 6; i++ {
+		paras = append(paras, Spf("Retries: the client retries failed requests %d times with backoff.", i+2))
+	}
+	fn := filepath.Join(dir, "client.md")
+	err = ioutil.WriteFile(fn, []byte(strings.Join(paras, "\n\n")), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	query := "How many times does the client retry failed requests with backoff?"
+
+	// without FitContext, K limits the chunks even if more would fit
+	grok.ContextChunks = 2
+	chunks, _, err := grok.retrieve(context.Background(), query, 10000, nil, true, false, false)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, len(chunks) == 2, "expected 2 chunks, got %d", len(chunks))
+
+	// with it, every chunk that fits is used
+	grok.FitContext = true
+	chunks, _, err = grok.retrieve(context.Background(), query, 10000, nil, true, false, false)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, len(chunks) == 6, "expected 6 chunks, got %d", len(chunks))
+
+	// chunks are counted as they appear in the prompt, with their
+	// headers, and the first that doesn't fit ends the context
+	// rather than being cut short
+	var limit int
+	for _, chunk := range chunks[:3] {
+		text, err := grok.chunkText(chunk, true, false)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		tokens, err := grok.tokens(text)
+		Tassert(t, err == nil, "error counting tokens: %v", err)
+		limit += len(tokens)
+	}
+	fitted, explained, err := grok.retrieve(context.Background(), query, limit+1, nil, true, false, true)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, len(fitted) == 3, "expected 3 chunks, got %d", len(fitted))
+	for i, chunk := range fitted {
+		Tassert(t, chunk == chunks[i], "expected whole chunk %d, got %v", i, chunk)
+	}
+	Tassert(t, len(explained) == 4 && !explained[3].Selected, "expected the 4th chunk to be considered and dropped, got %v", explained)
+
+	// a first chunk larger than the budget is cut to fit
+	fitted, _, err = grok.retrieve(context.Background(), query, 5, nil, true, false, false)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, len(fitted) > 0 && fitted[0].Length < chunks[0].Length, "expected part of the first chunk, got %v", fitted)
+}
+
+func TestMinRelevance(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	fn := filepath.Join(dir, "server.md")
+	err = ioutil.WriteFile(fn, []byte("The server listens on port 8080."), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	question := "What is the capital of France?"
+
+	// without a floor, unrelated chunks are still used
+	res, err := grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, len(res.Sources) == 1, "expected the unrelated doc as a source, got %v", res.Sources)
+
+	grok.MinRelevance = 0.5
+	_, err = grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, errors.Is(err, ErrNoRelevantContext), "expected ErrNoRelevantContext, got %v", err)
+
+	// with global knowledge, the question is answered without context
+	res, err = grok.AnswerResult("gpt-4", question, false, false, true)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, len(res.Sources) == 0, "expected no sources, got %v", res.Sources)
+
+	// relevant chunks pass the floor
+	res, err = grok.AnswerResult("gpt-4", "Which port does the server listen on?", false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, len(res.Sources) == 1, "expected the doc as a source, got %v", res.Sources)
+}
+
+func TestAutoGlobal(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	fn := filepath.Join(dir, "server.md")
+	err = ioutil.WriteFile(fn, []byte("The server listens on port 8080."), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	grok.AutoGlobal = 0.5
+
+	// a question the knowledge base doesn't cover turns on global
+	// knowledge, and the answer says so
+	res, err := grok.AnswerResult("gpt-4", "What is the capital of France?", false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, res.Global && !res.Degraded, "expected global knowledge, got %+v", res)
+	Tassert(t, strings.Contains(res.Notice, "below 0.50"), "unexpected notice %q", res.Notice)
+	Tassert(t, strings.HasPrefix(res.Answer, res.Notice), "expected the notice in the answer, got %q", res.Answer)
+	Tassert(t, res.Retrieval == nil, "expected no retrieval details, got %v", res.Retrieval)
+
+	// one it covers doesn't
+	res, err = grok.AnswerResult("gpt-4", "Which port does the server listen on?", false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, !res.Global && res.Notice == "", "expected no global knowledge, got %+v", res)
+	Tassert(t, len(res.Sources) == 1, "expected the doc as a source, got %v", res.Sources)
+}
+
+func TestLanguage(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	res, err := grok.AnswerResult("gpt-4", "What is this about?", false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, res.Messages[0].Content == SysMsgChat, "unexpected system message %q", res.Messages[0].Content)
+	grok.Language = "Japanese"
+	res, err = grok.AnswerResult("gpt-4", "What is this about?", false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, strings.HasSuffix(res.Messages[0].Content, "Always respond in Japanese, whatever language the context and question are in."), "expected language in system message, got %q", res.Messages[0].Content)
+	sysmsg := gitCommitSysmsg(GitCommitOpts{Language: "Japanese"})
+	Tassert(t, strings.Contains(sysmsg, "respond in Japanese"), "expected language in commit sysmsg: %s", sysmsg)
+}
+
+// truncatingChat is a client.ChatClient that returns its pieces one
+// at a time, each but the last cut off by the output token limit.
+type truncatingChat struct {
+	pieces []string
+	calls  [][]client.ChatMsg
+}
+
+func (c *truncatingChat) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	i := len(c.calls)
+	c.calls = append(c.calls, messages)
+	results.Body = c.pieces[i]
+	results.Usage.TotalTokens = 10
+	results.FinishReason = "stop"
+	if i < len(c.pieces)-1 {
+		results.FinishReason = FinishReasonLength
+	}
+	return
+}
+
+func TestAutoContinue(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	question := "Tell me everything."
+
+	// truncated answers are reported, not continued, by default
+	chat := &truncatingChat{pieces: []string{"one, ", "two, ", "three."}}
+	grok.SetChatClient("openai", chat)
+	res, err := grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, res.Answer == "one, ", "unexpected answer %q", res.Answer)
+	Tassert(t, res.FinishReason == FinishReasonLength, "expected finish reason length, got %q", res.FinishReason)
+
+	// continuations are stitched together
+	grok.AutoContinue = 5
+	chat = &truncatingChat{pieces: []string{"one, ", "two, ", "three."}}
+	grok.SetChatClient("openai", chat)
+	res, err = grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, res.Answer == "one, two, three.", "unexpected answer %q", res.Answer)
+	Tassert(t, res.FinishReason == "stop", "expected finish reason stop, got %q", res.FinishReason)
+	Tassert(t, res.Usage.TotalTokens == 30, "expected usage summed, got %d", res.Usage.TotalTokens)
+	Tassert(t, len(chat.calls) == 3, "expected 3 calls, got %d", len(chat.calls))
+	last := chat.calls[2]
+	Tassert(t, last[len(last)-2].Content == "one, two, ", "expected answer so far, got %q", last[len(last)-2].Content)
+	Tassert(t, last[len(last)-1].Content == ContinuePrompt, "expected continue prompt, got %q", last[len(last)-1].Content)
+
+	// the number of continuations is limited
+	grok.AutoContinue = 1
+	chat = &truncatingChat{pieces: []string{"one, ", "two, ", "three."}}
+	grok.SetChatClient("openai", chat)
+	res, err = grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, res.Answer == "one, two, ", "unexpected answer %q", res.Answer)
+	Tassert(t, res.FinishReason == FinishReasonLength, "expected finish reason length, got %q", res.FinishReason)
+}
+
+func TestJSONMode(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.ChatOptions.ResponseFormat = client.ResponseFormatJSON
+	question := "List the colors as JSON."
+
+	// fences and prose around the object are trimmed
+	chat := &truncatingChat{pieces: []string{"Here:\n```json\n{\"colors\": [\"red\"]}\n```\n"}}
+	grok.SetChatClient("openai", chat)
+	res, err := grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, res.Answer == `{"colors": ["red"]}`, "unexpected answer %q", res.Answer)
+	Tassert(t, strings.HasSuffix(chat.calls[0][0].Content, JSONPrompt), "expected JSON prompt in system message, got %q", chat.calls[0][0].Content)
+
+	// invalid replies are retried with the parse error
+	chat = &truncatingChat{pieces: []string{"red and blue", "[\"red\"]", "{\"colors\": [\"red\", \"blue\"]}"}}
+	grok.SetChatClient("openai", chat)
+	res, err = grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, res.Answer == `{"colors": ["red", "blue"]}`, "unexpected answer %q", res.Answer)
+	Tassert(t, len(chat.calls) == 3, "expected 3 calls, got %d", len(chat.calls))
+	Tassert(t, res.Usage.TotalTokens == 30, "expected usage summed, got %d", res.Usage.TotalTokens)
+	last := chat.calls[2]
+	Tassert(t, last[len(last)-2].Content == `["red"]`, "expected the bad reply, got %q", last[len(last)-2].Content)
+	Tassert(t, strings.Contains(last[len(last)-1].Content, "want an object"), "expected the parse error, got %q", last[len(last)-1].Content)
+
+	// the number of retries is limited
+	grok.JSONRetries = 1
+	chat = &truncatingChat{pieces: []string{"red", "blue", "{}"}}
+	grok.SetChatClient("openai", chat)
+	_, err = grok.AnswerResult("gpt-4", question, false, false, false)
+	Tassert(t, errors.Is(err, ErrInvalidJSON), "expected ErrInvalidJSON, got %v", err)
+	Tassert(t, len(chat.calls) == 2, "expected 2 calls, got %d", len(chat.calls))
+}
+
 // test splitting chunks when chunk size is greater than token limit
 func TestSplitChunks(t *testing.T) {
 	// create a new Grokker database
@@ -221,3 +1308,130 @@ func XXXTestRevise(t *testing.T) {
 
 	// grok msg "You are an expert in the following topic.  Say 'rating=N', where N is an integer from 0 to 100, where 0 means the provided text disregards the halting problem in systems administration, and 100 considers it paramount."  < testdata/revise.txt
 }
+
+// test answering from supplied context that is too big for the model
+func TestAnswerWithContext(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.models.AddMockModel("mock", 4096)
+	// te-full.txt is longer than the mock model's token limit
+	buf, err := ioutil.ReadFile("testdata/te-full.txt")
+	Tassert(t, err == nil, "error reading testdata/te-full.txt: %v", err)
+	ctxt := string(buf)
+	truncated, ok, err := grok.truncateTokens(ctxt, 100)
+	Tassert(t, err == nil, "error truncating: %v", err)
+	Tassert(t, ok, "expected context to be truncated")
+	tc, err := grok.TokenCount(truncated)
+	Tassert(t, err == nil, "error counting tokens: %v", err)
+	Tassert(t, tc <= 100, "expected 100 tokens or less, got %d", tc)
+	// the context is trimmed to fit rather than failing
+	resp, err := grok.AnswerWithContext("What is this about?", ctxt, AnswerOpts{ModelName: "mock"})
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, resp == "default mock response", "unexpected response: %q", resp)
+}
+
+// test that AnswerWithRAG trims context that doesn't fit the model
+func TestAnswerWithRAGTrimsContext(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.models.AddMockModel("mock", 1000)
+	buf, err := ioutil.ReadFile("testdata/te-full.txt")
+	Tassert(t, err == nil, "error reading testdata/te-full.txt: %v", err)
+	// the context is trimmed rather than failing
+	resp, err := grok.AnswerWithRAG("mock", SysMsgChat, "What is this about?", string(buf), false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, resp == "default mock response", "unexpected response: %q", resp)
+	// a question that doesn't fit by itself is still an error
+	question := strings.Repeat("why ", 2000)
+	_, err = grok.AnswerWithRAG("mock", SysMsgChat, question, string(buf), false)
+	Tassert(t, err != nil, "expected error for oversized question")
+}
+
+// countingEmbedder is a client.Embedder that returns fixed
+// embeddings and counts the texts it was asked to embed.
+type countingEmbedder struct {
+	count int
+}
+
+func (e *countingEmbedder) CreateEmbeddings(texts []string) (embeddings [][]float64, err error) {
+	for range texts {
+		e.count++
+		embeddings = append(embeddings, []float64{1, 0, 0})
+	}
+	return
+}
+
+// test injecting embedding and chat clients
+func TestInjectedClients(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &countingEmbedder{}
+	grok.SetEmbedder(embedder)
+	chat := mock.NewClient()
+	chat.SetResponse(oai.GPT4, "injected response")
+	grok.SetChatClient("openai", chat)
+	// Setup must not replace the injected embedder
+	err = grok.Setup("gpt-4")
+	Tassert(t, err == nil, "error setting up grokker: %v", err)
+	// add the document
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	Tassert(t, embedder.count > 0, "expected injected embedder to be used")
+	// answer a query
+	resp, err := grok.Answer("gpt-4", "What is this about?", false, false, false)
+	Tassert(t, err == nil, "error answering query: %v", err)
+	Tassert(t, resp == "injected response", "unexpected response: %q", resp)
+}
+
+func TestRebuild(t *testing.T) {
+	dir := TmpTestDir()
+	notes := filepath.Join(dir, "notes.txt")
+	gone := filepath.Join(dir, "gone.txt")
+	err := ioutil.WriteFile(notes, []byte("the first version of the notes\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	err = ioutil.WriteFile(gone, []byte("a file that will be removed\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.SetEmbedder(&countingEmbedder{})
+	err = grok.AddDocument(notes)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.AddDocument(gone)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	goneChunks, err := grok.DocumentChunks("gone.txt")
+	Tassert(t, err == nil && len(goneChunks) == 1, "expected 1 chunk: %v, %v", goneChunks, err)
+
+	// damage the db: the notes change behind its back, a chunk is
+	// orphaned, and the embeddings are lost
+	err = ioutil.WriteFile(notes, []byte("the second version of the notes\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	err = os.Remove(gone)
+	Tassert(t, err == nil, "error removing doc: %v", err)
+	grok.Chunks = append(grok.Chunks, &Chunk{Document: &Document{RelPath: "orphan.txt"}, Hash: "stale"})
+	for _, chunk := range grok.Chunks {
+		chunk.Embedding = nil
+	}
+
+	// the old notes chunk and the orphan are replaced by the new notes
+	// chunk, and the missing document keeps its chunk
+	added, removed, err := grok.Rebuild()
+	Tassert(t, err == nil, "error rebuilding: %v", err)
+	Tassert(t, added == 1 && removed == 2, "expected 1 added and 2 removed, got %d and %d", added, removed)
+	Tassert(t, len(grok.Chunks) == 2, "expected 2 chunks, got %d", len(grok.Chunks))
+	chunks, err := grok.DocumentChunks("notes.txt")
+	Tassert(t, err == nil && len(chunks) == 1, "expected 1 chunk: %v, %v", chunks, err)
+	text, err := grok.chunkText(chunks[0], false, false)
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, strings.Contains(text, "second version"), "expected new text, got %q", text)
+	Tassert(t, len(chunks[0].Embedding) > 0, "expected the new chunk to be embedded")
+	kept, err := grok.DocumentChunks("gone.txt")
+	Tassert(t, err == nil && len(kept) == 1 && kept[0] == goneChunks[0], "expected gone.txt to keep its chunk: %v, %v", kept, err)
+
+	// rebuilding again changes nothing
+	added, removed, err = grok.Rebuild()
+	Tassert(t, err == nil, "error rebuilding: %v", err)
+	Tassert(t, added == 0 && removed == 0, "expected no changes, got %d added and %d removed", added, removed)
+}
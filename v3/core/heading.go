@@ -0,0 +1,58 @@
+package core
+
+import (
+	"strings"
+
+	"github.com/stevegt/grokker/v3/util"
+)
+
+// isMarkdown returns true if doc is a markdown document.
+func isMarkdown(doc *Document) bool {
+	if doc == nil {
+		return false
+	}
+	lang, _, err := util.Ext2Lang(doc.RelPath)
+	return err == nil && lang == "markdown"
+}
+
+// headingTrail returns the titles of the markdown headings that are
+// open at the end of txt, outermost first, e.g. ["Setup", "Config"]
+// for text under "## Config" in the "# Setup" section.  Lines in
+// fenced code blocks are not headings.
+func headingTrail(txt string) (trail []string) {
+	var levels []int
+	fenced := false
+	for _, line := range strings.Split(txt, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fenced = !fenced
+			continue
+		}
+		if fenced {
+			continue
+		}
+		level := 0
+		for level < len(line) && line[level] == '#' {
+			level++
+		}
+		if level == 0 || level > 6 {
+			continue
+		}
+		if level < len(line) && line[level] != ' ' && line[level] != '\t' {
+			// e.g. "#hashtag"
+			continue
+		}
+		title := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(line[level:]), "#"))
+		if title == "" {
+			continue
+		}
+		// a heading closes any open heading at its level or deeper
+		for len(levels) > 0 && levels[len(levels)-1] >= level {
+			levels = levels[:len(levels)-1]
+			trail = trail[:len(trail)-1]
+		}
+		levels = append(levels, level)
+		trail = append(trail, title)
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestHeadingTrail(t *testing.T) {
+	txt := "# Setup\n\nintro\n\n## Install\n\n```\n# not a heading\n```\n\n## Config ##\n\n#hashtag\n\n### Files\n\n## Server\n"
+	trail := headingTrail(txt)
+	Tassert(t, fmt.Sprint(trail) == "[Setup Server]", "unexpected trail %q", trail)
+	trail = headingTrail(txt[:strings.Index(txt, "## Server")])
+	Tassert(t, fmt.Sprint(trail) == "[Setup Config Files]", "unexpected trail %q", trail)
+	Tassert(t, headingTrail("no headings\n") == nil, "expected no trail")
+}
+
+func TestEmbedHeadings(t *testing.T) {
+	para := strings.Repeat("The server listens on port 8080. ", 5)
+	txt := "# Server\n\n" + para + "\n\n## Config\n\n" + para + "\n"
+
+	embed := func(embedHeadings bool) []string {
+		dir := TmpTestDir()
+		fn := filepath.Join(dir, "server.md")
+		err := ioutil.WriteFile(fn, []byte(txt), 0644)
+		Tassert(t, err == nil, "error writing doc: %v", err)
+		grok, err := Init(dir, "gpt-3.5-turbo")
+		Tassert(t, err == nil, "error creating grokker: %v", err)
+		embedder := &batchCountingEmbedder{}
+		grok.SetEmbedder(embedder)
+		grok.EmbedHeadings = embedHeadings
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+		return embedder.texts
+	}
+
+	texts := embed(false)
+	Tassert(t, len(texts) == 4, "expected 4 chunks, got %d", len(texts))
+	for _, text := range texts {
+		Tassert(t, strings.HasPrefix(text, "from server.md:\n"), "expected only the path, got %q", text)
+	}
+
+	texts = embed(true)
+	Tassert(t, len(texts) == 4, "expected 4 chunks, got %d", len(texts))
+	Tassert(t, strings.HasPrefix(texts[0], "from server.md:\n"), "expected no headings before the first, got %q", texts[0])
+	Tassert(t, strings.HasPrefix(texts[1], "from server.md (Server):\n"), "unexpected text %q", texts[1])
+	Tassert(t, strings.HasPrefix(texts[3], "from server.md (Server > Config):\n"), "unexpected text %q", texts[3])
+}
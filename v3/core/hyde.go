@@ -0,0 +1,48 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+	"github.com/stevegt/grokker/v3/util"
+)
+
+// SysMsgHyDE is the system message for drafting a hypothetical answer
+// to a query for retrieval.
+var SysMsgHyDE = "You help a search engine find passages in a collection of documents.  I will give you a question.  Write one paragraph that answers it the way a passage in a manual, article, or note would, using the terms such a passage would use.  If you don't know the answer, write a plausible one anyway; it is only used to search for the real one."
+
+// hydeEmbedding returns the average of embedding, the embedding of
+// query, and the embedding of a hypothetical answer to query drafted
+// by the chat model, so that chunks are compared with something
+// shaped like the passages being looked for rather than with a bare
+// question.  If the chat API fails or the model's reply is empty, it
+// warns and returns embedding unchanged.
+func (g *Grokker) hydeEmbedding(ctx context.Context, query string, embedding []float64) (out []float64, err error) {
+	defer Return(&err)
+	messages := initMessages(g, g.Model, SysMsgHyDE, g.textOptions())
+	messages = append(messages, client.ChatMsg{
+		Role:    RoleUser,
+		Content: query,
+	})
+	results, err := g.gateway(ctx, g.Model, messages, g.textOptions())
+	if errors.Is(err, ErrChatAPI) && ctx.Err() == nil {
+		// retrieval shouldn't depend on the chat API
+		Fpf(os.Stderr, "warning: not using a hypothetical answer: %v\n", err)
+		return embedding, nil
+	}
+	Ck(err)
+	answer := strings.TrimSpace(results.Body)
+	if answer == "" {
+		Fpf(os.Stderr, "warning: not using a hypothetical answer: empty reply\n")
+		return embedding, nil
+	}
+	Debug("hypothetical answer: %q", answer)
+	answerEmbedding, err := g.queryEmbedding(answer)
+	Ck(err)
+	out = util.MeanVector([][]float64{embedding, answerEmbedding})
+	return
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestHyDE(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.SetEmbedder(&keywordEmbedder{words: []string{"battery", "flour"}})
+	err = grok.AddReader("pancakes.txt", strings.NewReader("Pancakes need flour, eggs, and milk."))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.AddReader("car.txt", strings.NewReader("If the engine won't turn over, check whether the battery is flat."))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	drafter := &queryExpander{reply: "A car that won't start usually has a dead battery."}
+	grok.SetChatClient("openai", drafter)
+	query := "car won't start"
+
+	_, explained, err := grok.retrieve(context.Background(), query, 100000, nil, false, false, true)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, len(explained) == 2, "expected 2 candidates, got %v", explained)
+	Tassert(t, explained[0].Score == explained[1].Score, "expected a tie, got %v", explained)
+	Tassert(t, drafter.calls == 0, "expected no chat request, got %d", drafter.calls)
+
+	grok.HyDE = true
+	_, explained, err = grok.retrieve(context.Background(), query, 100000, nil, false, false, true)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, explained[0].Path == "car.txt", "expected car.txt first, got %v", explained)
+	Tassert(t, explained[0].Score > explained[1].Score, "expected car.txt to score higher, got %v", explained)
+	Tassert(t, drafter.calls == 1, "expected one chat request, got %d", drafter.calls)
+
+	// an empty reply leaves the query as it was
+	drafter.reply = " "
+	_, explained, err = grok.retrieve(context.Background(), query, 100000, nil, false, false, true)
+	Tassert(t, err == nil, "error retrieving: %v", err)
+	Tassert(t, explained[0].Score == explained[1].Score, "expected a tie, got %v", explained)
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// ImageTokens is roughly how many tokens an image uses in a chat
+// request, e.g. a 1024x1024 image at high detail on gpt-4o.  It is
+// used to budget context when images are sent with a question.
+const ImageTokens = 765
+
+// imageURLs returns the URLs to send for images given as file paths
+// or URLs.  http(s) and data: URLs are returned as they are, and
+// files are read and returned as data: URLs.
+func imageURLs(images []string) (urls []string, err error) {
+	defer Return(&err)
+	for _, image := range images {
+		if strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "https://") || strings.HasPrefix(image, "data:") {
+			urls = append(urls, image)
+			continue
+		}
+		buf, err := ioutil.ReadFile(image)
+		Ck(err)
+		mimeType := http.DetectContentType(buf)
+		if !strings.HasPrefix(mimeType, "image/") {
+			err = fmt.Errorf("%s: not an image, looks like %s", image, mimeType)
+			return nil, err
+		}
+		urls = append(urls, Spf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(buf)))
+	}
+	return
+}
+
+// checkVision returns an error wrapping ErrNoVision if images are
+// given for a model that doesn't accept them.
+func (g *Grokker) checkVision(modelName string, images []string) (err error) {
+	defer Return(&err)
+	if len(images) == 0 {
+		return
+	}
+	_, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	if !m.vision {
+		err = fmt.Errorf("%s: %w", m.Name, ErrNoVision)
+	}
+	return
+}
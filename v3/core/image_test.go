@@ -0,0 +1,60 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestAnswerImages(t *testing.T) {
+	if os.Getenv("GROKKER_TEST_LIVE") != "" {
+		t.Skip("requires the fake OpenAI server")
+	}
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4o")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	png := filepath.Join(dir, "diagram.png")
+	err = ioutil.WriteFile(png, []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), 0644)
+	Tassert(t, err == nil, "error writing image: %v", err)
+
+	question := "What does this diagram show?"
+	res, err := grok.AnswerImages("gpt-4o", question, []string{png, "https://example.com/arch.png"}, false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, len(res.Sources) > 0, "expected text context to still be retrieved")
+
+	lastChatRequest.Lock()
+	msgs, _ := lastChatRequest.body["messages"].([]interface{})
+	lastChatRequest.Unlock()
+	last, _ := msgs[len(msgs)-1].(map[string]interface{})
+	parts, ok := last["content"].([]interface{})
+	Tassert(t, ok && len(parts) == 3, "expected text and 2 image parts, got %v", last["content"])
+	text, _ := parts[0].(map[string]interface{})
+	Tassert(t, text["type"] == "text" && text["text"] == question, "unexpected text part %v", text)
+	var urls []string
+	for _, part := range parts[1:] {
+		p, _ := part.(map[string]interface{})
+		Tassert(t, p["type"] == "image_url", "unexpected part %v", p)
+		img, _ := p["image_url"].(map[string]interface{})
+		url, _ := img["url"].(string)
+		urls = append(urls, url)
+	}
+	Tassert(t, strings.HasPrefix(urls[0], "data:image/png;base64,"), "expected a data URL for the file, got %.40q", urls[0])
+	Tassert(t, urls[1] == "https://example.com/arch.png", "expected the URL as given, got %q", urls[1])
+	context, _ := msgs[len(msgs)-3].(map[string]interface{})
+	content, _ := context["content"].(string)
+	Tassert(t, strings.HasPrefix(content, "Context:"), "expected context before the question, got %.40q", content)
+
+	// models that don't accept images fail before any request
+	_, err = grok.AnswerImages("gpt-4", question, []string{png}, false, false, false)
+	Tassert(t, errors.Is(err, ErrNoVision), "expected ErrNoVision, got %v", err)
+	// files must be images
+	_, err = grok.AnswerImages("gpt-4o", question, []string{"testdata/te-abstract.txt"}, false, false, false)
+	Tassert(t, err != nil && strings.Contains(err.Error(), "not an image"), "expected not an image error, got %v", err)
+}
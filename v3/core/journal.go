@@ -0,0 +1,220 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// The journal is an append-only log of document changes kept next to
+// the db, so that saving after adding or forgetting a few documents
+// appends a few records instead of rewriting the whole db.  Each
+// record holds the complete current state of one document -- its
+// Document entry and all of its chunks -- so replaying a record more
+// than once gives the same result.  Each record is also tagged with
+// the db's Generation, which goes up each time the db is rewritten,
+// so that after a crash between rewriting the db and removing the
+// journal, the stale records are skipped rather than rolling the
+// documents back.
+//
+// Changes to anything other than documents and chunks, such as a
+// migration or a new embedding format, are saved by rewriting the db,
+// which also empties the journal.  The db is also rewritten once the
+// journal grows larger than the db itself.
+
+// journalRecord is one line of the journal.
+type journalRecord struct {
+	// Generation is the Generation of the db the record applies to.
+	Generation int64 `json:",omitempty"`
+	// RelPath names the document the record replaces.
+	RelPath string
+	// Document is nil if the document was forgotten.
+	Document *Document `json:",omitempty"`
+	// Chunks are the document's chunks, with embeddings encoded in
+	// the db's EmbeddingFormat.
+	Chunks []*Chunk `json:",omitempty"`
+}
+
+// journalPath returns the pathname of the journal.
+func (g *Grokker) journalPath() string {
+	return g.grokpath + ".journal"
+}
+
+// touch records that the named document changed since the last save.
+func (g *Grokker) touch(relpath string) {
+	if g.dirty == nil {
+		g.dirty = make(map[string]bool)
+	}
+	g.dirty[relpath] = true
+}
+
+// header returns the db marshaled without its documents and chunks.
+// If it hasn't changed since the last save, the changes since then
+// can be saved to the journal.  The caller must hold g.mu for writing.
+func (g *Grokker) header() (buf []byte, err error) {
+	docs, chunks := g.Documents, g.Chunks
+	g.Documents, g.Chunks = nil, nil
+	restore := g.persistOverrides()
+	defer func() {
+		restore()
+		g.Documents, g.Chunks = docs, chunks
+	}()
+	return json.Marshal(g)
+}
+
+// markSaved records the current state of the db as saved.
+func (g *Grokker) markSaved() (err error) {
+	defer Return(&err)
+	g.savedHeader, err = g.header()
+	Ck(err)
+	g.dirty = nil
+	return
+}
+
+// saveJournal appends the changed documents to the journal and
+// returns true, or returns false without writing anything if the db
+// needs to be rewritten instead.
+func (g *Grokker) saveJournal() (saved bool, err error) {
+	defer Return(&err)
+	if g.savedHeader == nil {
+		return
+	}
+	hdr, err := g.header()
+	Ck(err)
+	if !bytes.Equal(hdr, g.savedHeader) {
+		return
+	}
+	// compact once the journal outgrows the db
+	dbInfo, err := os.Stat(g.grokpath)
+	Ck(err)
+	journalInfo, err := os.Stat(g.journalPath())
+	if err == nil && journalInfo.Size() > dbInfo.Size() {
+		return
+	}
+	err = nil
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	format := g.embeddingFormat()
+	for _, doc := range g.Documents {
+		if !g.dirty[doc.RelPath] {
+			continue
+		}
+		rec := journalRecord{Generation: g.Generation, RelPath: doc.RelPath, Document: doc}
+		for _, chunk := range g.Chunks {
+			if chunk.stale || chunk.Document.RelPath != doc.RelPath {
+				continue
+			}
+			c := *chunk
+			if format != EmbeddingFloat64 {
+				c.Vec, err = encodeEmbedding(c.Embedding, format)
+				Ck(err)
+				c.Embedding = nil
+				c.Vecs, err = encodeEmbeddingMap(c.Embeddings, format)
+				Ck(err)
+				c.Embeddings = nil
+			}
+			rec.Chunks = append(rec.Chunks, &c)
+		}
+		err = enc.Encode(rec)
+		Ck(err)
+		delete(g.dirty, doc.RelPath)
+	}
+	// whatever is left was forgotten
+	for relpath := range g.dirty {
+		err = enc.Encode(journalRecord{Generation: g.Generation, RelPath: relpath})
+		Ck(err)
+	}
+	fh, err := os.OpenFile(g.journalPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	Ck(err)
+	_, err = fh.Write(buf.Bytes())
+	Ck(err)
+	err = fh.Close()
+	Ck(err)
+	g.dirty = nil
+	saved = true
+	return
+}
+
+// replayJournal applies the journal, if any, to a freshly unmarshaled
+// db.  It must run before decodeEmbeddings.  Records from an older
+// generation of the db are skipped.  It returns true if the journal
+// ends in a corrupt record or holds stale records, in which case the
+// db needs to be rewritten before anything more is appended.
+func (g *Grokker) replayJournal() (rewrite bool, err error) {
+	defer Return(&err)
+	fh, err := os.Open(g.journalPath())
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	Ck(err)
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	// records for large documents are large
+	scanner.Buffer(nil, 1<<30)
+	for n := 1; scanner.Scan(); n++ {
+		var rec journalRecord
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			// a torn write from a crash can only be at the end
+			Fpf(os.Stderr, "WARNING: ignoring corrupt record %d in %s: %v\n", n, g.journalPath(), err)
+			err = nil
+			rewrite = true
+			break
+		}
+		if rec.Generation != g.Generation {
+			// left behind by a crash after the db was rewritten
+			Debug("skipping record %d of generation %d in %s", n, rec.Generation, g.journalPath())
+			rewrite = true
+			continue
+		}
+		// replace the document in place so that the order of
+		// g.Documents matches what a full save would have kept
+		var docs []*Document
+		found := false
+		for _, doc := range g.Documents {
+			if doc.RelPath != rec.RelPath {
+				docs = append(docs, doc)
+				continue
+			}
+			found = true
+			if rec.Document != nil {
+				docs = append(docs, rec.Document)
+			}
+		}
+		if !found && rec.Document != nil {
+			docs = append(docs, rec.Document)
+		}
+		var chunks []*Chunk
+		for _, chunk := range g.Chunks {
+			if chunk.Document.RelPath != rec.RelPath {
+				chunks = append(chunks, chunk)
+			}
+		}
+		for _, chunk := range rec.Chunks {
+			chunk.Document = rec.Document
+			chunks = append(chunks, chunk)
+		}
+		g.Documents = docs
+		g.Chunks = chunks
+	}
+	err = scanner.Err()
+	Ck(err, "reading %s", g.journalPath())
+	return
+}
+
+// removeJournal removes the journal after the db has been rewritten.
+func (g *Grokker) removeJournal() (err error) {
+	err = os.Remove(g.journalPath())
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("removing journal: %v", err)
+	}
+	return
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestJournal(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	// start with a db larger than the journal will be
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	grok.savedHeader = nil
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	_, err = os.Stat(grok.journalPath())
+	Tassert(t, os.IsNotExist(err), "expected no journal: %v", err)
+	fi, err := os.Stat(grok.grokpath)
+	Tassert(t, err == nil, "error stating db: %v", err)
+	size := fi.Size()
+
+	// adding a document appends to the journal
+	err = grok.AddReader("a.txt", strings.NewReader("apples and oranges"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.AddReader("b.txt", strings.NewReader("bananas and pears"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	fi, err = os.Stat(grok.grokpath)
+	Tassert(t, err == nil, "error stating db: %v", err)
+	Tassert(t, fi.Size() == size, "expected db to be left alone")
+	_, err = os.Stat(grok.journalPath())
+	Tassert(t, err == nil, "expected a journal: %v", err)
+
+	// forgetting and replacing documents replays correctly
+	err = grok.ForgetDocument("a.txt")
+	Tassert(t, err == nil, "error forgetting doc: %v", err)
+	err = grok.gc()
+	Tassert(t, err == nil, "error collecting garbage: %v", err)
+	err = grok.AddReader("b.txt", strings.NewReader("bananas and plums"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.gc()
+	Tassert(t, err == nil, "error collecting garbage: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	_, err = os.Stat(grok.journalPath())
+	Tassert(t, err == nil, "expected a journal: %v", err)
+	Tassert(t, len(g.Documents) == 2 && g.Documents[1].RelPath == "b.txt", "expected te-abstract.txt and b.txt, got %v", g.ListDocuments())
+	Tassert(t, len(g.Chunks) == len(grok.Chunks), "expected %d chunks, got %d", len(grok.Chunks), len(g.Chunks))
+	for _, chunk := range g.Chunks {
+		Tassert(t, chunk.Embedding != nil, "expected embedding for chunk %v", chunk)
+	}
+	chunks, err := g.DocumentChunks("b.txt")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	text, err := g.ChunkText(chunks[0])
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, strings.Contains(text, "plums"), "expected the replaced content, got %q", text)
+
+	// changing anything else rewrites the db and removes the journal
+	g.Compress = true
+	err = g.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	_, err = os.Stat(g.journalPath())
+	Tassert(t, os.IsNotExist(err), "expected journal to be removed: %v", err)
+	g, _, _, _, lock, err = LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, len(g.Documents) == 2, "expected 2 documents, got %v", g.ListDocuments())
+}
+
+// test that a journal left behind by a crash after the db was
+// rewritten doesn't roll documents back
+func TestStaleJournal(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	err = grok.AddReader("a.txt", strings.NewReader("apples and oranges"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	journal, err := os.ReadFile(grok.journalPath())
+	Tassert(t, err == nil, "error reading journal: %v", err)
+
+	// change the document, rewrite the db, and put the old journal
+	// back as if removing it had failed
+	err = grok.AddReader("a.txt", strings.NewReader("apricots and olives"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	grok.savedHeader = nil
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	_, err = os.Stat(grok.journalPath())
+	Tassert(t, os.IsNotExist(err), "expected journal to be removed: %v", err)
+	err = os.WriteFile(grok.journalPath(), journal, 0644)
+	Tassert(t, err == nil, "error writing journal: %v", err)
+
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", false)
+	Tassert(t, err == nil, "error loading: %v", err)
+	defer lock.Unlock()
+	chunks, err := g.DocumentChunks("a.txt")
+	Tassert(t, err == nil && len(chunks) == 1, "expected 1 chunk: %v, %v", chunks, err)
+	text, err := g.ChunkText(chunks[0])
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, strings.Contains(text, "apricots"), "expected the rewritten content, got %q", text)
+
+	// the next save rewrites the db and drops the stale journal
+	err = g.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	_, err = os.Stat(g.journalPath())
+	Tassert(t, os.IsNotExist(err), "expected journal to be removed: %v", err)
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"math"
+	"os"
+	"strings"
+	"unicode"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Keyword scoring complements embedding similarity for queries that
+// hinge on exact tokens -- error codes, identifiers, rare words --
+// which embedding models tend to blur.  Chunks are scored with BM25
+// and the scores are normalized to [0, 1] before being blended with
+// cosine similarity; see Grokker.KeywordWeight.
+
+// BM25 parameters; these are the usual defaults.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// chunkTerms holds the term frequencies of a chunk.
+type chunkTerms struct {
+	freqs map[string]int
+	// length is the number of terms in the chunk
+	length int
+}
+
+// keywordTerms splits text into lowercase terms.  Underscores are
+// kept so that identifiers survive intact.
+func keywordTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// keywordIndex returns the term frequencies of every chunk in the
+// database.  They are cached for the life of the Grokker, since a
+// chunk's text can't change without its hash and thus the chunk
+// changing.  Each document is read at most once.
+func (g *Grokker) keywordIndex() (index map[*Chunk]*chunkTerms, err error) {
+	defer Return(&err)
+	g.cacheMu.Lock()
+	cache := g.keywordCache
+	g.cacheMu.Unlock()
+	index = make(map[*Chunk]*chunkTerms, len(g.Chunks))
+	bufs := make(map[string][]byte)
+	for _, chunk := range g.Chunks {
+		if terms, ok := cache[chunk]; ok {
+			index[chunk] = terms
+			continue
+		}
+		relpath := chunk.Document.RelPath
+		buf, ok := bufs[relpath]
+		if !ok {
+			buf, err = g.readDocument(chunk.Document)
+			if os.IsNotExist(err) {
+				// the document might be on another branch
+				err = nil
+			}
+			Ck(err)
+			bufs[relpath] = buf
+		}
+		start := chunk.Offset
+		stop := chunk.Offset + chunk.Length
+		if start > len(buf) {
+			start = len(buf)
+		}
+		if stop > len(buf) {
+			stop = len(buf)
+		}
+		terms := &chunkTerms{freqs: make(map[string]int)}
+		for _, term := range keywordTerms(string(buf[start:stop])) {
+			terms.freqs[term]++
+			terms.length++
+		}
+		index[chunk] = terms
+	}
+	// drop chunks that are no longer in the database
+	g.cacheMu.Lock()
+	g.keywordCache = index
+	g.cacheMu.Unlock()
+	return
+}
+
+// keywordScores returns the BM25 score of each chunk for query,
+// divided by the highest score so that the best match scores 1.
+// Chunks that match no query terms are left out.
+func (g *Grokker) keywordScores(query string) (scores map[*Chunk]float64, err error) {
+	defer Return(&err)
+	index, err := g.keywordIndex()
+	Ck(err)
+	scores = make(map[*Chunk]float64)
+	if len(index) == 0 {
+		return
+	}
+	var totalLength int
+	for _, terms := range index {
+		totalLength += terms.length
+	}
+	avgLength := float64(totalLength) / float64(len(index))
+	if avgLength == 0 {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, term := range keywordTerms(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		// count the chunks containing the term
+		var n int
+		for _, terms := range index {
+			if terms.freqs[term] > 0 {
+				n++
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		idf := math.Log(1 + (float64(len(index)-n)+0.5)/(float64(n)+0.5))
+		for chunk, terms := range index {
+			tf := float64(terms.freqs[term])
+			if tf == 0 {
+				continue
+			}
+			norm := 1 - bm25B + bm25B*float64(terms.length)/avgLength
+			scores[chunk] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+	var max float64
+	for _, score := range scores {
+		max = math.Max(max, score)
+	}
+	for chunk := range scores {
+		scores[chunk] /= max
+	}
+	return
+}
+
+// keywordWeight returns g.KeywordWeight clamped to [0, 1].
+func (g *Grokker) keywordWeight() float64 {
+	return math.Min(math.Max(g.KeywordWeight, 0), 1)
+}
+
+// queryScorer returns a function that scores chunks for a query.
+// With a zero KeywordWeight it is plain cosine similarity with
+// embedding; otherwise cosine similarity and the normalized keyword
+// score are blended by the weight.  Either way, the score is then
+// multiplied by the weight of the chunk's document.  Chunks with
+// unusable embeddings score -Inf.
+func (g *Grokker) queryScorer(query string, embedding []float64) (score func(*Chunk) float64, err error) {
+	defer Return(&err)
+	weights := g.docWeights()
+	weight := g.keywordWeight()
+	if weight == 0 {
+		score = func(chunk *Chunk) float64 {
+			return weights.apply(chunk, g.chunkScore(embedding, chunk))
+		}
+		return
+	}
+	keyword, err := g.keywordScores(query)
+	Ck(err)
+	score = func(chunk *Chunk) float64 {
+		sim := g.chunkScore(embedding, chunk)
+		if math.IsInf(sim, -1) {
+			return sim
+		}
+		return weights.apply(chunk, (1-weight)*sim+weight*keyword[chunk])
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestKeywordWeight(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	var paras []string
+	for i := 0; i < 5; i++ {
+		paras = append(paras, fmt.Sprintf("What does this error mean?  Every error means something; see section %d.", i))
+	}
+	paras = append(paras, "E4017: disk quota exceeded.")
+	err = grok.AddReader("errors.txt", strings.NewReader(strings.Join(paras, "\n\n")))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	query := "What does error E4017 mean?"
+
+	results, err := grok.Search(query, 1)
+	Tassert(t, err == nil, "error searching: %v", err)
+	Tassert(t, !strings.Contains(results[0].Text, "E4017"), "expected embeddings alone to miss E4017, got %q", results[0].Text)
+
+	grok.KeywordWeight = 0.5
+	results, err = grok.Search(query, 1)
+	Tassert(t, err == nil, "error searching: %v", err)
+	Tassert(t, strings.Contains(results[0].Text, "E4017"), "expected keyword match first, got %q", results[0].Text)
+	chunks, err := grok.findChunks(query, 100000, nil)
+	Tassert(t, err == nil, "error finding chunks: %v", err)
+	text, err := grok.ChunkText(chunks[0])
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, strings.Contains(text, "E4017"), "expected keyword match first, got %q", text)
+}
+
+func TestKeywordTerms(t *testing.T) {
+	terms := keywordTerms("Call foo_bar() -- returns E4017!")
+	Tassert(t, strings.Join(terms, " ") == "call foo_bar returns e4017", "unexpected terms %q", terms)
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/stevegt/grokker/v3/util"
+)
+
+// Similarity metrics for comparing embeddings.  See Grokker.Metric.
+const (
+	// MetricCosine compares the directions of embeddings, ignoring
+	// their lengths.  It suits OpenAI's embedding models, whose
+	// embeddings are normalized.
+	MetricCosine = "cosine"
+	// MetricDot uses the dot product of embeddings, for models
+	// tuned for it whose embeddings are not normalized, scored as
+	// its logistic function so that scores stay between 0 and 1.
+	MetricDot = "dot"
+	// MetricEuclidean ranks embeddings by Euclidean (L2) distance,
+	// scored as 1/(1+distance) so that closer is higher.
+	MetricEuclidean = "euclidean"
+)
+
+// metric returns the similarity metric for embeddings.
+func (g *Grokker) metric() string {
+	if g.Metric == "" {
+		return MetricCosine
+	}
+	return g.Metric
+}
+
+// SetMetric sets the similarity metric used to compare embeddings;
+// see the Metric* constants.  It takes effect with the next query and
+// doesn't require re-embedding.
+func (g *Grokker) SetMetric(metric string) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch metric {
+	case MetricCosine, MetricDot, MetricEuclidean:
+	default:
+		return fmt.Errorf("unknown metric %q, want cosine, dot, or euclidean", metric)
+	}
+	g.Metric = metric
+	return
+}
+
+// similarity returns the similarity of two embeddings using g's
+// metric.  Higher is more similar.  Every metric scores between 0 and
+// 1 for related texts, as cosine does, so that MinRelevance,
+// AutoGlobal, and the keyword blend mean the same whichever is used.
+// Checks for duplicate text use cosine similarity instead; see
+// duplicate.
+func (g *Grokker) similarity(a, b []float64) float64 {
+	switch g.metric() {
+	case MetricDot:
+		return 1 / (1 + math.Exp(-util.Dot(a, b)))
+	case MetricEuclidean:
+		return 1 / (1 + util.Distance(a, b))
+	default:
+		return util.Similarity(a, b)
+	}
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestMetric(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	// long is far away but points roughly the same way as the
+	// query; short is close by and points almost exactly the same
+	// way
+	query := []float64{1, 0}
+	long := []float64{10, 10}
+	short := []float64{1, 0.1}
+	want := map[string]bool{
+		MetricCosine:    false,
+		MetricDot:       true,
+		MetricEuclidean: false,
+	}
+	for metric, longWins := range want {
+		err = grok.SetMetric(metric)
+		Tassert(t, err == nil, "error setting metric: %v", err)
+		got := grok.similarity(query, long) > grok.similarity(query, short)
+		Tassert(t, got == longWins, "%s: expected long to win: %v, got %v", metric, longWins, got)
+	}
+	// every metric scores between 0 and 1, so thresholds such as
+	// MinRelevance mean the same for each
+	for metric := range want {
+		err = grok.SetMetric(metric)
+		Tassert(t, err == nil, "error setting metric: %v", err)
+		for _, vec := range [][]float64{long, short} {
+			sim := grok.similarity(query, vec)
+			Tassert(t, sim >= 0 && sim <= 1, "%s: expected a score from 0 to 1, got %v", metric, sim)
+		}
+	}
+
+	// duplicates are found by direction whatever the metric:  long
+	// and its double are the same text, short isn't
+	double := []float64{20, 20}
+	chunks := []*Chunk{{Embedding: long}, {Embedding: double}, {Embedding: short}}
+	for metric := range want {
+		err = grok.SetMetric(metric)
+		Tassert(t, err == nil, "error setting metric: %v", err)
+		kept := grok.dedupChunks(chunks, 0.95)
+		Tassert(t, len(kept) == 2 && kept[1] == chunks[2], "%s: expected the double to be dropped, got %d chunks", metric, len(kept))
+	}
+
+	err = grok.SetMetric("manhattan")
+	Tassert(t, err != nil, "expected error for unknown metric")
+
+	// the metric is stored in the db
+	err = grok.SetMetric(MetricDot)
+	Tassert(t, err == nil, "error setting metric: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, g.metric() == MetricDot, "expected dot after reload, got %q", g.metric())
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/stevegt/goadapt"
 	"github.com/stevegt/semver"
@@ -17,6 +18,9 @@ func (g *Grokker) canon(path string) (rel string) {
 	if err != nil {
 		Fpf(os.Stderr, "error: %s\n", err)
 	}
+	if filepath.IsAbs(path) {
+		rel = g.docPath(path)
+	}
 	// check if the document exists at the canonical path
 	_, err = os.Stat(g.absPath(&Document{RelPath: rel}))
 	if err != nil {
@@ -25,6 +29,34 @@ func (g *Grokker) canon(path string) (rel string) {
 	return
 }
 
+// Migration is an entry in a db's version history.
+type Migration struct {
+	// Time is when the db was created or migrated, in Unix seconds.
+	Time int64 `json:"time"`
+	// From is the db version before the migration, or empty when the
+	// db was created.
+	From string `json:"from,omitempty"`
+	// To is the db version after the migration, or when the db was
+	// created.
+	To string `json:"to"`
+}
+
+func (m Migration) String() string {
+	t := time.Unix(m.Time, 0).UTC().Format(time.RFC3339)
+	if m.From == "" {
+		return Spf("%s  created at version %s", t, m.To)
+	}
+	return Spf("%s  migrated from %s to %s", t, m.From, m.To)
+}
+
+// VersionHistory returns when the db was created and migrated, oldest
+// first, so that problems can be traced to an upgrade.
+func (g *Grokker) VersionHistory() (history []Migration) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return append(history, g.Migrations...)
+}
+
 // migrate migrates the current Grokker database from an older version
 // to the current version.
 func (g *Grokker) migrate() (migrated bool, was, now string, err error) {
@@ -74,8 +106,14 @@ func (g *Grokker) migrate() (migrated bool, was, now string, err error) {
 		Fpf(os.Stderr, "migrating from %s to %s\n", g.Version, Version)
 
 		// perform the migration
+		from := g.Version
 		err = g.migrateOneVersion()
 		Ck(err)
+		g.Migrations = append(g.Migrations, Migration{
+			Time: time.Now().Unix(),
+			From: from,
+			To:   g.Version,
+		})
 
 		migrated = true
 	}
@@ -98,16 +136,14 @@ func (g *Grokker) migrateOneVersion() (err error) {
 	switch vstr {
 
 	case "0.1.X":
-		// copy Document.Path to Document.RelPath, leave old content
-		// for now
+		// convert the old Document.Path to Document.RelPath
 		for _, doc := range g.Documents {
-			doc.RelPath = g.canon(doc.Path)
+			doc.RelPath = g.canon(doc.oldPath)
 		}
-		// copy Chunk.Document.Path to Chunk.Document.RelPath, leave
-		// old content for now
+		// likewise for Chunk.Document
 		for _, chunk := range g.Chunks {
 			// copy and canonicalize the path
-			chunk.Document.RelPath = g.canon(chunk.Document.Path)
+			chunk.Document.RelPath = g.canon(chunk.Document.oldPath)
 		}
 		// refresh embeddings now because we are about to save the grok file
 		// and that will make its timestamp newer than any possibly-modified
@@ -145,7 +181,27 @@ func (g *Grokker) migrateOneVersion() (err error) {
 		// API change, so this is a no-op as far as the db is concerned
 		g.Version = "3.0.0"
 
-	// XXX remove doc.Path in a future version
+	case "3.0.X":
+		// store embeddings as packed float32 instead of JSON
+		// float64 arrays; the embeddings were decoded when the
+		// db was loaded, so they will be re-encoded on save
+		g.EmbeddingFormat = EmbeddingFloat32
+		g.Version = "3.1.0"
+
+	case "3.1.X":
+		// store each chunk's token count; chunks of documents
+		// that are missing are left at zero and counted when
+		// they are next used
+		err = InitTokenizer()
+		Ck(err)
+		for _, chunk := range g.Chunks {
+			_, err = chunk.tokenCount(g)
+			if err != nil {
+				Fpf(os.Stderr, "warning: counting tokens in %s: %v\n", chunk.Document.RelPath, err)
+				err = nil
+			}
+		}
+		g.Version = "3.2.0"
 
 	default:
 		Assert(false, "migration missing: from version: %s", g.Version)
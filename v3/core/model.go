@@ -3,11 +3,12 @@ package core
 import (
 	"fmt"
 	"sort"
+	"strings"
 
-	oai "github.com/stevegt/go-openai"
 	. "github.com/stevegt/goadapt"
 	"github.com/stevegt/grokker/v3/client"
 	"github.com/stevegt/grokker/v3/mock"
+	"github.com/stevegt/grokker/v3/openai"
 )
 
 var DefaultModel = "o3-mini"
@@ -19,7 +20,15 @@ type Model struct {
 	providerName string
 	upstreamName string
 	active       bool
-	provider     client.ChatClient
+	// deprecated models have been or are being retired by the
+	// provider
+	deprecated bool
+	// unavailable is set if the provider's client can't call this
+	// model, e.g. because the client library no longer supports it
+	unavailable error
+	// vision models accept images with their messages
+	vision   bool
+	provider client.ChatClient
 }
 
 func (m *Model) String() string {
@@ -27,7 +36,14 @@ func (m *Model) String() string {
 	if m.active {
 		status = "*"
 	}
-	return fmt.Sprintf("%1s %-20s %-20s tokens: %d)", status, m.Name, m.providerName, m.TokenLimit)
+	deprecated := ""
+	if m.deprecated {
+		deprecated = " (deprecated)"
+	}
+	if m.unavailable != nil {
+		deprecated = " (unavailable)"
+	}
+	return fmt.Sprintf("%1s %-20s %-20s tokens: %d)%s", status, m.Name, m.providerName, m.TokenLimit, deprecated)
 }
 
 // GetModel returns the current model name and model_t from the db
@@ -38,10 +54,37 @@ func (g *Grokker) GetModel() (model string, m *Model, err error) {
 	return
 }
 
+// FindModel returns the named model without making it the db's
+// model, e.g. to check a model given for a single call of Answer
+// before using it.  An empty name means g.Model.  It returns an error
+// wrapping ErrModelNotFound if there is no such model.
+func (g *Grokker) FindModel(model string) (name string, m *Model, err error) {
+	if model == "" {
+		model = g.Model
+	}
+	return g.models.FindModel(model)
+}
+
 // Models is a type that manages the set of available models.
 type Models struct {
 	// The list of available models.
 	Available map[string]*Model
+	// tokenLimits overrides the token limits of models, including
+	// local models, which aren't listed in Available; see
+	// setTokenLimit.
+	tokenLimits map[string]int
+}
+
+// setTokenLimit sets the token limit of the named model, replacing
+// the built-in one.
+func (models *Models) setTokenLimit(name string, tokenLimit int) {
+	if models.tokenLimits == nil {
+		models.tokenLimits = make(map[string]int)
+	}
+	models.tokenLimits[name] = tokenLimit
+	if m, ok := models.Available[name]; ok {
+		m.TokenLimit = tokenLimit
+	}
 }
 
 // NewModels creates a new Models object.
@@ -58,16 +101,41 @@ func NewModels() (models *Models) {
 		models.Available[name] = m
 	}
 
-	add("gpt-3.5-turbo", 4096, "openai", oai.GPT3Dot5Turbo)
-	add("gpt-4", 8192, "openai", oai.GPT4)
-	add("gpt-4-32k", 32768, "openai", oai.GPT432K)
-	add("gpt-4-turbo-preview", 128000, "openai", oai.GPT4TurboPreview)
-	add("gpt-4o", 128000, "openai", oai.GPT4o)
-	add("o1-preview", 128000, "openai", oai.O1Preview)
-	add("o1-mini", 128000, "openai", oai.O1Mini)
-	add("o1", 128000, "openai", oai.O1Preview)
-	// add("o3", 200000, "openai", oai.O3)
-	add("o3-mini", 200000, "openai", oai.O3Mini)
+	// addOpenAI resolves the upstream name through the openai
+	// package so that models the client library has dropped are
+	// listed but fail with a clear error when used
+	addOpenAI := func(name string, tokenLimit int) {
+		upstreamName, err := openai.UpstreamName(name)
+		add(name, tokenLimit, "openai", upstreamName)
+		models.Available[name].unavailable = err
+	}
+
+	deprecate := func(name string) {
+		models.Available[name].deprecated = true
+	}
+
+	vision := func(name string) {
+		models.Available[name].vision = true
+	}
+
+	addOpenAI("gpt-3.5-turbo", 4096)
+	addOpenAI("gpt-4", 8192)
+	addOpenAI("gpt-4-32k", 32768)
+	deprecate("gpt-4-32k")
+	addOpenAI("gpt-4-turbo-preview", 128000)
+	addOpenAI("gpt-4o", 128000)
+	vision("gpt-4o")
+	addOpenAI("gpt-4o-mini", 128000)
+	vision("gpt-4o-mini")
+	addOpenAI("o1-preview", 128000)
+	deprecate("o1-preview")
+	addOpenAI("o1-mini", 128000)
+	deprecate("o1-mini")
+	addOpenAI("o1", 200000)
+	vision("o1")
+	addOpenAI("o3", 200000)
+	vision("o3")
+	addOpenAI("o3-mini", 200000)
 
 	// XXX perplexity input token limits are not published?
 	add("sonar-deep-research", 128000, "perplexity", "sonar-deep-research")
@@ -77,9 +145,23 @@ func NewModels() (models *Models) {
 	add("sonar-reasoning-pro", 128000, "perplexity", "sonar-reasoning-pro")
 	add("r1-1776", 128000, "perplexity", "r1-1776")
 
+	add("claude-opus-4", 200000, "anthropic", "claude-opus-4-0")
+	add("claude-sonnet-4", 200000, "anthropic", "claude-sonnet-4-0")
+	add("claude-3-7-sonnet", 200000, "anthropic", "claude-3-7-sonnet-latest")
+	add("claude-3-5-haiku", 200000, "anthropic", "claude-3-5-haiku-latest")
+
 	return
 }
 
+// LocalModelPrefix marks a model name as the name of a model served by
+// a local OpenAI-compatible API, e.g. "local:llama3.1" for Ollama's
+// llama3.1.  See openai.NewLocalChatClient.
+const LocalModelPrefix = "local:"
+
+// LocalTokenLimit is the token limit assumed for local models, whose
+// context sizes depend on how the server was configured.
+var LocalTokenLimit = 8192
+
 // AddMockModel adds a mock model for testing purposes.
 func (models *Models) AddMockModel(name string, tokenLimit int) {
 	m := &Model{
@@ -93,14 +175,34 @@ func (models *Models) AddMockModel(name string, tokenLimit int) {
 }
 
 // FindModel returns the model name and object given a model name.
-// if the given model name is empty, then use DefaultModel.
+// if the given model name is empty, then use DefaultModel.  Names
+// starting with LocalModelPrefix are found without being listed.
 func (models *Models) FindModel(model string) (name string, m *Model, err error) {
 	if model == "" {
 		model = DefaultModel
 	}
 	m, ok := models.Available[model]
+	if !ok && strings.HasPrefix(model, LocalModelPrefix) && len(model) > len(LocalModelPrefix) {
+		m = &Model{
+			Name:         model,
+			TokenLimit:   LocalTokenLimit,
+			providerName: "local",
+			upstreamName: strings.TrimPrefix(model, LocalModelPrefix),
+			// we can't tell whether a local model accepts
+			// images, so let its server decide
+			vision: true,
+		}
+		if tokenLimit, found := models.tokenLimits[model]; found {
+			m.TokenLimit = tokenLimit
+		}
+		ok = true
+	}
 	if !ok {
-		err = fmt.Errorf("model %q not found", model)
+		err = fmt.Errorf("%q: %w", model, ErrModelNotFound)
+		return
+	}
+	if m.unavailable != nil {
+		err = m.unavailable
 		return
 	}
 	name = model
@@ -129,6 +231,7 @@ func (models *Models) ListModels() (list []*Model) {
 func (g *Grokker) Setup(model string) (err error) {
 	defer Return(&err)
 	g.initEmbeddingClient()
+	g.initEmbeddingTokenLimit()
 	err = g.initModel(model)
 	Ck(err)
 	err = InitTokenizer()
@@ -147,13 +250,59 @@ func (g *Grokker) initModel(model string) (err error) {
 	defer Return(&err)
 	Assert(g.Root != "", "root directory not set")
 	g.models = NewModels()
+	for name, tokenLimit := range g.TokenLimits {
+		if tokenLimit > 0 {
+			g.models.setTokenLimit(name, tokenLimit)
+		}
+	}
 	model, m, err := g.models.FindModel(model)
 	Ck(err)
 	m.active = true
 	// XXX make Model be the most recently used model name
 	g.Model = model
 	g.ModelObj = m
-	// XXX EmbeddingTokenLimit hardcoded for the text-embedding-ada-002 model
-	g.EmbeddingTokenLimit = 8192
 	return
 }
+
+// lookupTokenLimit asks m's provider for m's context window, if the
+// provider lists it and hasn't been asked before, and caches the
+// answer in g.TokenLimits.  It's only called when the db is made or
+// the model changes, so that loading a db never waits on the
+// network.  If the provider can't be reached, e.g. offline, m keeps
+// its built-in limit and the provider isn't asked again until the
+// next run.
+func (g *Grokker) lookupTokenLimit(m *Model) {
+	if _, ok := g.TokenLimits[m.Name]; ok {
+		return
+	}
+	if g.tokenLimitMisses[m.Name] {
+		return
+	}
+	var tokenLimit int
+	var err error
+	switch m.providerName {
+	case "openai":
+		tokenLimit, err = openai.ContextWindow(m.upstreamName, g.ChatOptions.HTTPClient)
+	case "local":
+		tokenLimit, err = openai.LocalContextWindow(m.upstreamName, g.ChatOptions.HTTPClient)
+	default:
+		// the provider doesn't list context windows
+		return
+	}
+	if err != nil {
+		Debug("can't look up the token limit of %s: %v", m.Name, err)
+		if g.tokenLimitMisses == nil {
+			g.tokenLimitMisses = make(map[string]bool)
+		}
+		g.tokenLimitMisses[m.Name] = true
+		return
+	}
+	if g.TokenLimits == nil {
+		g.TokenLimits = make(map[string]int)
+	}
+	g.TokenLimits[m.Name] = tokenLimit
+	if tokenLimit > 0 {
+		g.models.setTokenLimit(m.Name, tokenLimit)
+		m.TokenLimit = tokenLimit
+	}
+}
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/anthropic"
+	"github.com/stevegt/grokker/v3/client"
+	"github.com/stevegt/grokker/v3/openai"
+)
+
+// test that models the client can't call fail with a clear error
+func TestUnavailableModel(t *testing.T) {
+	models := NewModels()
+	_, m, err := models.FindModel("gpt-4o")
+	Tassert(t, err == nil, "error finding gpt-4o: %v", err)
+	Tassert(t, m.upstreamName == "gpt-4o", "unexpected upstream name: %q", m.upstreamName)
+	// simulate a model dropped from the client library
+	m.unavailable = openai.ErrModelUnavailable
+	_, _, err = models.FindModel("gpt-4o")
+	Tassert(t, errors.Is(err, openai.ErrModelUnavailable), "expected ErrModelUnavailable, got %v", err)
+	_, err = openai.UpstreamName("gpt-2")
+	Tassert(t, errors.Is(err, openai.ErrModelUnavailable), "expected ErrModelUnavailable, got %v", err)
+}
+
+// test the OpenAI models' token limits, upstream names, and
+// deprecation
+func TestOpenAIModels(t *testing.T) {
+	models := NewModels()
+	for _, tc := range []struct {
+		name       string
+		tokenLimit int
+		deprecated bool
+	}{
+		{"gpt-4", 8192, false},
+		{"gpt-4-32k", 32768, true},
+		{"gpt-4o", 128000, false},
+		{"gpt-4o-mini", 128000, false},
+		{"o1-preview", 128000, true},
+		{"o1-mini", 128000, true},
+		{"o1", 200000, false},
+		{"o3", 200000, false},
+		{"o3-mini", 200000, false},
+	} {
+		_, m, err := models.FindModel(tc.name)
+		Tassert(t, err == nil, "error finding %s: %v", tc.name, err)
+		Tassert(t, m.TokenLimit == tc.tokenLimit, "%s: expected %d tokens, got %d", tc.name, tc.tokenLimit, m.TokenLimit)
+		Tassert(t, m.upstreamName == tc.name, "%s: unexpected upstream name %q", tc.name, m.upstreamName)
+		Tassert(t, m.deprecated == tc.deprecated, "%s: expected deprecated %v", tc.name, tc.deprecated)
+		Tassert(t, strings.Contains(m.String(), "(deprecated)") == tc.deprecated, "%s: unexpected listing %q", tc.name, m.String())
+	}
+}
+
+// test that model selection routes chat to the model's provider
+// while embeddings stay on OpenAI
+func TestChatProviders(t *testing.T) {
+	if os.Getenv("GROKKER_TEST_LIVE") != "" {
+		t.Skip("uses fake provider servers")
+	}
+	var gotReq map[string]interface{}
+	var gotKey, gotVersion string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("X-Api-Key")
+		gotVersion = r.Header.Get("Anthropic-Version")
+		json.NewDecoder(r.Body).Decode(&gotReq)
+		Tassert(t, r.URL.Path == "/v1/messages", "unexpected path %q", r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"content":     []interface{}{map[string]interface{}{"type": "text", "text": "hello from claude"}},
+			"stop_reason": "max_tokens",
+			"usage":       map[string]interface{}{"input_tokens": 10, "output_tokens": 5},
+		})
+	}))
+	defer srv.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", srv.URL)
+	t.Setenv("ANTHROPIC_API_KEY", "fake-anthropic")
+	t.Setenv("GROKKER_LOCAL_URL", os.Getenv("OPENAI_BASE_URL"))
+
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+
+	// anthropic, with the options
+	temp := float32(0.5)
+	grok.ChatOptions.Temperature = &temp
+	results, err := grok.gateway(context.Background(), "claude-sonnet-4", []client.ChatMsg{
+		{Role: "SYSTEM", Content: "You are a test."},
+		{Role: "USER", Content: "Hello"},
+	}, grok.ChatOptions)
+	Tassert(t, err == nil, "anthropic chat failed: %v", err)
+	Tassert(t, results.Body == "hello from claude", "unexpected body %q", results.Body)
+	Tassert(t, results.FinishReason == FinishReasonLength, "expected length finish reason, got %q", results.FinishReason)
+	Tassert(t, results.Usage.TotalTokens == 15, "unexpected usage %+v", results.Usage)
+	Tassert(t, gotKey == "fake-anthropic", "unexpected key %q", gotKey)
+	Tassert(t, gotVersion == anthropic.Version, "unexpected version %q", gotVersion)
+	Tassert(t, gotReq["model"] == "claude-sonnet-4-0", "unexpected model %v", gotReq["model"])
+	Tassert(t, gotReq["system"] == "You are a test.", "expected system prompt in its own field, got %v", gotReq["system"])
+	msgs, _ := gotReq["messages"].([]interface{})
+	Tassert(t, len(msgs) == 1, "expected only the user message, got %v", msgs)
+	Tassert(t, gotReq["temperature"] == 0.5, "expected temperature 0.5, got %v", gotReq["temperature"])
+
+	// a JSON object is asked for by starting the reply
+	opts := client.Options{ResponseFormat: client.ResponseFormatJSON}
+	results, err = grok.gateway(context.Background(), "claude-sonnet-4", []client.ChatMsg{{Role: "USER", Content: "Hello"}}, opts)
+	Tassert(t, err == nil, "anthropic chat failed: %v", err)
+	Tassert(t, results.Body == "{hello from claude", "expected the prefill in the body, got %q", results.Body)
+	msgs, _ = gotReq["messages"].([]interface{})
+	Tassert(t, len(msgs) == 2, "expected a prefilled reply, got %v", msgs)
+
+	// a done context abandons the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = grok.gateway(ctx, "claude-sonnet-4", []client.ChatMsg{{Role: "USER", Content: "Hello"}}, opts)
+	Tassert(t, errors.Is(err, context.Canceled), "expected context.Canceled, got %v", err)
+
+	// local models are found by prefix and use the OpenAI-compatible API
+	_, m, err := grok.models.FindModel("local:llama3.1")
+	Tassert(t, err == nil, "error finding local model: %v", err)
+	Tassert(t, m.providerName == "local" && m.upstreamName == "llama3.1", "unexpected local model %+v", m)
+	_, _, err = grok.models.FindModel(LocalModelPrefix)
+	Tassert(t, errors.Is(err, ErrModelNotFound), "expected ErrModelNotFound for bare prefix, got %v", err)
+	_, err = grok.Msg("local:llama3.1", "You are a test.", "Hello")
+	Tassert(t, err == nil, "local chat failed: %v", err)
+	lastChatRequest.Lock()
+	model := lastChatRequest.body["model"]
+	lastChatRequest.Unlock()
+	Tassert(t, model == "llama3.1", "expected upstream name llama3.1, got %v", model)
+}
+
+// optionsChat is a client.ChatProvider that records the options and
+// context of the last request.
+type optionsChat struct {
+	opts client.Options
+	ctx  context.Context
+}
+
+func (c *optionsChat) CompleteChat(model string, messages []client.ChatMsg) (client.Results, error) {
+	return c.Chat(context.Background(), model, messages, client.Options{})
+}
+
+func (c *optionsChat) Chat(ctx context.Context, model string, messages []client.ChatMsg, opts client.Options) (client.Results, error) {
+	c.ctx, c.opts = ctx, opts
+	return client.Results{Body: "ok"}, nil
+}
+
+// test that injected clients that implement client.ChatProvider get
+// the options, and that plain ones still work
+func TestInjectedChatProvider(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	seed := 7
+	grok.ChatOptions.Seed = &seed
+	chat := &optionsChat{}
+	grok.SetChatClient("openai", chat)
+	_, err = grok.Msg("gpt-4", "You are a test.", "Hello")
+	Tassert(t, err == nil, "error chatting: %v", err)
+	Tassert(t, chat.opts.Seed != nil && *chat.opts.Seed == 7, "expected the seed, got %+v", chat.opts)
+	Tassert(t, chat.ctx != nil, "expected a context")
+
+	grok.SetChatClient("openai", &echoChat{})
+	out, err := grok.Msg("gpt-4", "You are a test.", "Hello")
+	Tassert(t, err == nil && out == "Hello", "unexpected reply %q, %v", out, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = grok.gateway(ctx, "gpt-4", []client.ChatMsg{{Role: "USER", Content: "Hello"}}, grok.ChatOptions)
+	Tassert(t, errors.Is(err, context.Canceled), "expected context.Canceled, got %v", err)
+}
+
+func TestLookupTokenLimit(t *testing.T) {
+	if os.Getenv("GROKKER_TEST_LIVE") != "" {
+		t.Skip("uses the fake OpenAI server")
+	}
+	// the fake server lists fakellama's context window
+	t.Setenv("GROKKER_LOCAL_URL", os.Getenv("OPENAI_BASE_URL"))
+	grok, err := Init(TmpTestDir(), "local:fakellama")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	Tassert(t, grok.ModelObj.TokenLimit == 32768, "expected the listed limit, got %d", grok.ModelObj.TokenLimit)
+	Tassert(t, grok.TokenLimits["local:fakellama"] == 32768, "expected the limit to be cached, got %v", grok.TokenLimits)
+
+	// models the server lists without a context window keep the
+	// built-in limit, and aren't looked up again
+	_, err = grok.SetModel("gpt-4")
+	Tassert(t, err == nil, "error setting model: %v", err)
+	Tassert(t, grok.ModelObj.TokenLimit == 8192, "expected the built-in limit, got %d", grok.ModelObj.TokenLimit)
+	limit, ok := grok.TokenLimits["gpt-4"]
+	Tassert(t, ok && limit == 0, "expected gpt-4 to be cached as unknown, got %v", grok.TokenLimits)
+
+	// the cached limit is used on reload, without asking the server
+	_, err = grok.SetModel("local:fakellama")
+	Tassert(t, err == nil, "error setting model: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	t.Setenv("GROKKER_LOCAL_URL", "http://127.0.0.1:1/v1")
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, g.ModelObj.TokenLimit == 32768, "expected the cached limit, got %d", g.ModelObj.TokenLimit)
+
+	// unreachable servers fall back to the built-in limit, and are
+	// asked again in the next run
+	_, err = g.SetModel("local:other")
+	Tassert(t, err == nil, "error setting model: %v", err)
+	Tassert(t, g.ModelObj.TokenLimit == LocalTokenLimit, "expected the built-in limit, got %d", g.ModelObj.TokenLimit)
+	_, ok = g.TokenLimits["local:other"]
+	Tassert(t, !ok, "expected an unreachable server's answer not to be cached")
+	Tassert(t, g.tokenLimitMisses["local:other"], "expected the miss to be remembered for this run")
+
+	// loading a db doesn't look anything up
+	t.Setenv("GROKKER_LOCAL_URL", os.Getenv("OPENAI_BASE_URL"))
+	delete(grok.TokenLimits, "local:fakellama")
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err = LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, g.ModelObj.TokenLimit == LocalTokenLimit, "expected the built-in limit, got %d", g.ModelObj.TokenLimit)
+
+	// OpenAI doesn't list context windows, so it isn't asked
+	t.Setenv("OPENAI_BASE_URL", "")
+	tokens, err := openai.ContextWindow("gpt-4", nil)
+	Tassert(t, err == nil && tokens == 0, "expected no lookup, got %d, %v", tokens, err)
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"fmt"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Overflow policies for chunks that are longer than the embedding
+// model's input limit.  See Grokker.EmbeddingOverflow.
+const (
+	// OverflowSplit splits long chunks into pieces that each get
+	// their own embedding.
+	OverflowSplit = "split"
+	// OverflowTruncate keeps each chunk whole, embedding only its
+	// first EmbeddingTokenLimit tokens.  Answers still see the whole
+	// chunk.
+	OverflowTruncate = "truncate"
+	// OverflowError refuses to add a document with a chunk that is
+	// too long to embed.
+	OverflowError = "error"
+)
+
+// embeddingOverflow returns the overflow policy for long chunks.
+func (g *Grokker) embeddingOverflow() string {
+	if g.EmbeddingOverflow == "" {
+		return OverflowSplit
+	}
+	return g.EmbeddingOverflow
+}
+
+// SetEmbeddingOverflow sets what happens to chunks that are longer
+// than the embedding model's input limit; see the Overflow*
+// constants.  Documents already in the db keep their chunks until
+// they change or the db is rebuilt.
+func (g *Grokker) SetEmbeddingOverflow(policy string) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch policy {
+	case OverflowSplit, OverflowTruncate, OverflowError:
+	default:
+		return fmt.Errorf("unknown overflow policy %q, want split, truncate, or error", policy)
+	}
+	g.EmbeddingOverflow = policy
+	return
+}
+
+// checkOverflow returns an error if any of a document's chunks is
+// longer than the embedding token limit.
+func (g *Grokker) checkOverflow(doc *Document, chunks []*Chunk) (err error) {
+	defer Return(&err)
+	for _, chunk := range chunks {
+		tc, err := chunk.tokenCount(g)
+		Ck(err)
+		if tc > g.EmbeddingTokenLimit {
+			return fmt.Errorf("%s: chunk at offset %d has %d tokens, more than the embedding limit of %d", doc.RelPath, chunk.Offset, tc, g.EmbeddingTokenLimit)
+		}
+	}
+	return
+}
+
+// truncateInputs returns texts with any text longer than the
+// embedding token limit cut down to fit, updating tokenCounts to
+// match.  texts itself is not modified.
+func (g *Grokker) truncateInputs(texts []string, tokenCounts []int) (out []string, err error) {
+	defer Return(&err)
+	out = texts
+	var copied bool
+	for i, tc := range tokenCounts {
+		if tc <= g.EmbeddingTokenLimit {
+			continue
+		}
+		if !copied {
+			out = append([]string(nil), texts...)
+			copied = true
+		}
+		out[i], _, err = g.truncateTokens(texts[i], g.EmbeddingTokenLimit)
+		Ck(err)
+		tokenCounts[i] = g.EmbeddingTokenLimit
+		Debug("truncated embedding input %d from %d to %d tokens", i, tc, g.EmbeddingTokenLimit)
+	}
+	return
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Projection is a random projection that reduces embeddings to fewer
+// dimensions before they are stored, shrinking the database.  Random
+// projections approximately preserve the angles between vectors, so
+// cosine similarity rankings stay close to those of the full
+// embeddings.
+//
+// The projection matrix is not stored; it is regenerated from Seed,
+// which math/rand guarantees to produce the same sequence across Go
+// releases.  Storing the matrix itself would cost more space than the
+// reduction saves for all but the largest databases.
+type Projection struct {
+	// InputDims is the number of dimensions of the embeddings
+	// returned by the embedding model.
+	InputDims int
+	// Dims is the number of dimensions of the stored embeddings.
+	Dims int
+	// Seed seeds the generator for the projection matrix.
+	Seed int64
+	// matrix is the Dims x InputDims projection matrix, built once
+	// by matrixOnce, since queries holding only a read lock on the
+	// Grokker project their embeddings concurrently
+	matrix     [][]float64
+	matrixOnce sync.Once
+}
+
+// projectionSeed returns the seed for a new projection.  Tests replace
+// it to get repeatable projections.
+var projectionSeed = func() int64 {
+	return time.Now().UnixNano()
+}
+
+// newProjection returns a projection from inputDims to dims
+// dimensions with a new random seed.
+func newProjection(inputDims, dims int) (p *Projection, err error) {
+	if dims < 1 || dims >= inputDims {
+		err = fmt.Errorf("projected dimensions must be between 1 and %d, got %d", inputDims-1, dims)
+		return
+	}
+	p = &Projection{
+		InputDims: inputDims,
+		Dims:      dims,
+		Seed:      projectionSeed(),
+	}
+	return
+}
+
+// project returns the projection of embedding.  Nil embeddings stay
+// nil.
+func (p *Projection) project(embedding []float64) (out []float64, err error) {
+	if embedding == nil {
+		return
+	}
+	if len(embedding) != p.InputDims {
+		err = fmt.Errorf("embedding has %d dimensions, projection expects %d", len(embedding), p.InputDims)
+		return
+	}
+	p.matrixOnce.Do(func() {
+		// Gaussian entries scaled by 1/sqrt(Dims), per
+		// Johnson-Lindenstrauss
+		rng := rand.New(rand.NewSource(p.Seed))
+		scale := 1 / math.Sqrt(float64(p.Dims))
+		p.matrix = make([][]float64, p.Dims)
+		for i := range p.matrix {
+			row := make([]float64, p.InputDims)
+			for j := range row {
+				row[j] = rng.NormFloat64() * scale
+			}
+			p.matrix[i] = row
+		}
+	})
+	out = make([]float64, p.Dims)
+	for i, row := range p.matrix {
+		var sum float64
+		for j, v := range embedding {
+			sum += row[j] * v
+		}
+		out[i] = sum
+	}
+	return
+}
+
+// projectEmbedding projects embedding if the database uses a
+// projection, and otherwise returns it unchanged.
+func (g *Grokker) projectEmbedding(embedding []float64) (out []float64, err error) {
+	if g.Projection == nil {
+		return embedding, nil
+	}
+	return g.Projection.project(embedding)
+}
+
+// SetEmbeddingDims sets the number of dimensions stored for each
+// embedding, using a random projection to reduce the embeddings
+// returned by the embedding model.  Zero stores full embeddings.
+// Full embeddings already in the database are projected in place;
+// otherwise the database is rebuilt, re-embedding every chunk.
+func (g *Grokker) SetEmbeddingDims(dims int) (err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if dims < 0 {
+		err = fmt.Errorf("dimensions must not be negative, got %d", dims)
+		return
+	}
+	if g.Projection == nil && dims == 0 {
+		return
+	}
+	if g.Projection != nil && g.Projection.Dims == dims {
+		return
+	}
+	if g.Projection == nil {
+		// the stored embeddings are full embeddings, so we can
+		// project them without calling the embedding API
+		inputDims := g.embeddingDims()
+		if inputDims == 0 {
+			// the database is empty; get the model's
+			// dimensions from a sample embedding
+			var sample [][]float64
+			sample, err = g.createEmbeddings([]string{"dimensions"}, nil)
+			Ck(err)
+			inputDims = len(sample[0])
+		}
+		var p *Projection
+		p, err = newProjection(inputDims, dims)
+		Ck(err)
+		for _, chunk := range g.Chunks {
+			chunk.Embedding, err = p.project(chunk.Embedding)
+			Ck(err)
+		}
+		g.Projection = p
+		return
+	}
+	// the full embeddings are gone, so start over
+	if dims == 0 {
+		g.Projection = nil
+	} else {
+		g.Projection, err = newProjection(g.Projection.InputDims, dims)
+		Ck(err)
+	}
+	for _, chunk := range g.Chunks {
+		chunk.Embedding = nil
+	}
+	_, _, err = g.rebuild()
+	Ck(err)
+	return
+}
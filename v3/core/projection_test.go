@@ -0,0 +1,91 @@
+package core
+
+import (
+	"sync"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestSetEmbeddingDims(t *testing.T) {
+	// use a repeatable projection
+	defer func(f func() int64) { projectionSeed = f }(projectionSeed)
+	projectionSeed = func() int64 { return 1 }
+
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	query := "Why is order of operations important when administering a UNIX machine?"
+	full, err := grok.Search(query, 1)
+	Tassert(t, err == nil, "error searching: %v", err)
+
+	// project the existing embeddings in place
+	err = grok.SetEmbeddingDims(256)
+	Tassert(t, err == nil, "error setting dimensions: %v", err)
+	Tassert(t, grok.embeddingDims() == 256, "expected 256 dimensions, got %d", grok.embeddingDims())
+	reduced, err := grok.Search(query, 1)
+	Tassert(t, err == nil, "error searching: %v", err)
+	Tassert(t, reduced[0].Offset == full[0].Offset, "expected the same top chunk, got offset %d instead of %d", reduced[0].Offset, full[0].Offset)
+
+	// the matrix is regenerated from the seed
+	p := &Projection{InputDims: grok.Projection.InputDims, Dims: 256, Seed: grok.Projection.Seed}
+	vec := make([]float64, p.InputDims)
+	vec[0] = 1
+	a, err := p.project(vec)
+	Tassert(t, err == nil, "error projecting: %v", err)
+	b, err := grok.Projection.project(vec)
+	Tassert(t, err == nil, "error projecting: %v", err)
+	for i := range a {
+		Tassert(t, a[i] == b[i], "projections differ at %d", i)
+	}
+
+	// changing the dimensions again rebuilds from scratch
+	err = grok.SetEmbeddingDims(128)
+	Tassert(t, err == nil, "error setting dimensions: %v", err)
+	Tassert(t, grok.embeddingDims() == 128, "expected 128 dimensions, got %d", grok.embeddingDims())
+	err = grok.SetEmbeddingDims(0)
+	Tassert(t, err == nil, "error setting dimensions: %v", err)
+	Tassert(t, grok.Projection == nil, "expected no projection")
+	Tassert(t, grok.embeddingDims() == p.InputDims, "expected %d dimensions, got %d", p.InputDims, grok.embeddingDims())
+
+	// too many dimensions
+	err = grok.SetEmbeddingDims(100000)
+	Tassert(t, err != nil, "expected error for too many dimensions")
+}
+
+// test concurrent queries on a freshly loaded projected db, which
+// build the projection matrix on first use; run with -race
+func TestProjectionConcurrentSearch(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &keywordEmbedder{words: []string{"unix", "order", "machine"}}
+	grok.SetEmbedder(embedder)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.SetEmbeddingDims(2)
+	Tassert(t, err == nil, "error setting dimensions: %v", err)
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	defer lock.Unlock()
+	g.SetEmbedder(embedder)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := g.Search("What is this about?", 1)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		Tassert(t, err == nil, "error searching: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Embedding storage formats.  See Grokker.EmbeddingFormat.
+const (
+	// EmbeddingFloat64 stores embeddings as JSON arrays of numbers,
+	// as databases before 3.1 did.
+	EmbeddingFloat64 = "float64"
+	// EmbeddingFloat32 stores embeddings as base64-encoded
+	// little-endian float32 values.  Rankings are unaffected.
+	EmbeddingFloat32 = "float32"
+	// EmbeddingInt8 stores embeddings as a base64-encoded float32
+	// scale followed by one signed byte per dimension.  Rankings
+	// change very slightly.
+	EmbeddingInt8 = "int8"
+)
+
+// DefaultEmbeddingFormat is the storage format for new databases.
+const DefaultEmbeddingFormat = EmbeddingFloat32
+
+// embeddingFormat returns the storage format for embeddings.
+func (g *Grokker) embeddingFormat() string {
+	if g.EmbeddingFormat == "" {
+		return EmbeddingFloat64
+	}
+	return g.EmbeddingFormat
+}
+
+// SetEmbeddingFormat sets the format embeddings are stored in; see
+// the Embedding* constants.  Embeddings in memory are rounded to the
+// new format right away so that rankings match what a later load of
+// the database will see.
+func (g *Grokker) SetEmbeddingFormat(format string) (err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch format {
+	case EmbeddingFloat64, EmbeddingFloat32, EmbeddingInt8:
+	default:
+		err = fmt.Errorf("unknown embedding format %q", format)
+		return
+	}
+	g.EmbeddingFormat = format
+	if format == EmbeddingFloat64 {
+		return
+	}
+	for _, chunk := range g.Chunks {
+		vecs, err := encodeEmbeddingMap(chunk.Embeddings, format)
+		Ck(err)
+		if vecs != nil {
+			chunk.Embeddings, err = decodeEmbeddingMap(vecs, format)
+			Ck(err)
+		}
+		if chunk.Embedding == nil {
+			continue
+		}
+		vec, err := encodeEmbedding(chunk.Embedding, format)
+		Ck(err)
+		if vec == "" {
+			continue
+		}
+		chunk.Embedding, err = decodeEmbedding(vec, format)
+		Ck(err)
+	}
+	return
+}
+
+// encodeEmbeddings moves each chunk's embedding into its Vec field,
+// encoded in the database's storage format, before the database is
+// marshaled.  It returns a function that restores the embeddings.
+func (g *Grokker) encodeEmbeddings() (restore func(), err error) {
+	defer Return(&err)
+	restore = func() {}
+	format := g.embeddingFormat()
+	if format == EmbeddingFloat64 {
+		return
+	}
+	saved := make([][]float64, len(g.Chunks))
+	savedAlt := make([]map[string][]float64, len(g.Chunks))
+	for i, chunk := range g.Chunks {
+		saved[i] = chunk.Embedding
+		chunk.Vec, err = encodeEmbedding(chunk.Embedding, format)
+		Ck(err)
+		chunk.Embedding = nil
+		savedAlt[i] = chunk.Embeddings
+		chunk.Vecs, err = encodeEmbeddingMap(chunk.Embeddings, format)
+		Ck(err)
+		chunk.Embeddings = nil
+	}
+	restore = func() {
+		for i, chunk := range g.Chunks {
+			chunk.Embedding = saved[i]
+			chunk.Vec = ""
+			chunk.Embeddings = savedAlt[i]
+			chunk.Vecs = nil
+		}
+	}
+	return
+}
+
+// decodeEmbeddings decodes each chunk's Vec field into its Embedding
+// after the database is unmarshaled.
+func (g *Grokker) decodeEmbeddings() (err error) {
+	defer Return(&err)
+	format := g.embeddingFormat()
+	for _, chunk := range g.Chunks {
+		if chunk.Vecs != nil {
+			chunk.Embeddings, err = decodeEmbeddingMap(chunk.Vecs, format)
+			Ck(err)
+			chunk.Vecs = nil
+		}
+		if chunk.Vec == "" {
+			continue
+		}
+		chunk.Embedding, err = decodeEmbedding(chunk.Vec, format)
+		Ck(err)
+		chunk.Vec = ""
+	}
+	return
+}
+
+// encodeEmbeddingMap encodes each of embeddings in the given format.
+func encodeEmbeddingMap(embeddings map[string][]float64, format string) (vecs map[string]string, err error) {
+	if embeddings == nil {
+		return
+	}
+	vecs = make(map[string]string, len(embeddings))
+	for model, embedding := range embeddings {
+		vecs[model], err = encodeEmbedding(embedding, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// decodeEmbeddingMap decodes each of vecs from the given format.
+func decodeEmbeddingMap(vecs map[string]string, format string) (embeddings map[string][]float64, err error) {
+	embeddings = make(map[string][]float64, len(vecs))
+	for model, vec := range vecs {
+		embeddings[model], err = decodeEmbedding(vec, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// encodeEmbedding encodes embedding in the given format.  Nil
+// embeddings encode to the empty string.
+func encodeEmbedding(embedding []float64, format string) (vec string, err error) {
+	if embedding == nil {
+		return
+	}
+	var buf []byte
+	switch format {
+	case EmbeddingFloat32:
+		buf = make([]byte, 4*len(embedding))
+		for i, v := range embedding {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(v)))
+		}
+	case EmbeddingInt8:
+		var max float64
+		for _, v := range embedding {
+			max = math.Max(max, math.Abs(v))
+		}
+		scale := float32(max / 127)
+		buf = make([]byte, 4+len(embedding))
+		binary.LittleEndian.PutUint32(buf, math.Float32bits(scale))
+		for i, v := range embedding {
+			var q float64
+			if scale != 0 {
+				q = math.Round(v / float64(scale))
+			}
+			buf[4+i] = byte(int8(q))
+		}
+	default:
+		err = fmt.Errorf("can't encode embeddings as %q", format)
+		return
+	}
+	vec = base64.StdEncoding.EncodeToString(buf)
+	return
+}
+
+// decodeEmbedding decodes an embedding encoded by encodeEmbedding.
+func decodeEmbedding(vec, format string) (embedding []float64, err error) {
+	buf, err := base64.StdEncoding.DecodeString(vec)
+	if err != nil {
+		return
+	}
+	switch format {
+	case EmbeddingFloat32:
+		if len(buf)%4 != 0 {
+			err = fmt.Errorf("float32 embedding has %d bytes, not a multiple of 4", len(buf))
+			return
+		}
+		embedding = make([]float64, len(buf)/4)
+		for i := range embedding {
+			embedding[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:])))
+		}
+	case EmbeddingInt8:
+		if len(buf) < 4 {
+			err = fmt.Errorf("int8 embedding has only %d bytes", len(buf))
+			return
+		}
+		scale := float64(math.Float32frombits(binary.LittleEndian.Uint32(buf)))
+		embedding = make([]float64, len(buf)-4)
+		for i := range embedding {
+			embedding[i] = float64(int8(buf[4+i])) * scale
+		}
+	default:
+		err = fmt.Errorf("can't decode embeddings stored as %q", format)
+	}
+	return
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestEncodeEmbedding(t *testing.T) {
+	embedding := []float64{0.5, -0.25, 0.125, 0, -1}
+	for _, format := range []string{EmbeddingFloat32, EmbeddingInt8} {
+		vec, err := encodeEmbedding(embedding, format)
+		Tassert(t, err == nil, "%s: error encoding: %v", format, err)
+		out, err := decodeEmbedding(vec, format)
+		Tassert(t, err == nil, "%s: error decoding: %v", format, err)
+		Tassert(t, len(out) == len(embedding), "%s: expected %d dimensions, got %d", format, len(embedding), len(out))
+		for i := range out {
+			Tassert(t, math.Abs(out[i]-embedding[i]) < 0.01, "%s: dimension %d: expected %f, got %f", format, i, embedding[i], out[i])
+		}
+	}
+	vec, err := encodeEmbedding(nil, EmbeddingInt8)
+	Tassert(t, err == nil && vec == "", "expected nil embedding to encode to empty string, got %q, %v", vec, err)
+}
+
+// test that quantized embeddings shrink the db without changing the
+// rankings
+func TestEmbeddingFormats(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	Tassert(t, grok.EmbeddingFormat == DefaultEmbeddingFormat, "unexpected default format %q", grok.EmbeddingFormat)
+	err = grok.AddDocument("testdata/te-full.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	query := "Why is order of operations important when administering a UNIX machine?"
+	want, err := grok.Search(query, 3)
+	Tassert(t, err == nil, "error searching: %v", err)
+
+	sizes := make(map[string]int64)
+	for _, format := range []string{EmbeddingFloat64, EmbeddingFloat32, EmbeddingInt8} {
+		err = grok.SetEmbeddingFormat(format)
+		Tassert(t, err == nil, "error setting format: %v", err)
+		err = grok.Save()
+		Tassert(t, err == nil, "error saving: %v", err)
+		fi, err := os.Stat(grok.grokpath)
+		Tassert(t, err == nil, "error stating db: %v", err)
+		sizes[format] = fi.Size()
+		// reload and compare rankings
+		g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+		Tassert(t, err == nil, "%s: error loading: %v", format, err)
+		lock.Unlock()
+		got, err := g.Search(query, 3)
+		Tassert(t, err == nil, "%s: error searching: %v", format, err)
+		for i := range want {
+			Tassert(t, got[i].Offset == want[i].Offset, "%s: result %d: expected offset %d, got %d", format, i, want[i].Offset, got[i].Offset)
+			Tassert(t, math.Abs(got[i].Score-want[i].Score) < 0.01, "%s: result %d: expected score %f, got %f", format, i, want[i].Score, got[i].Score)
+		}
+	}
+	// the fake embeddings are mostly zeros, which are short in
+	// JSON, so float32 saves less here than with real embeddings
+	Tassert(t, sizes[EmbeddingFloat32] < sizes[EmbeddingFloat64], "float32 db not smaller: %v", sizes)
+	Tassert(t, sizes[EmbeddingInt8] < sizes[EmbeddingFloat32]/2, "int8 db not much smaller: %v", sizes)
+
+	err = grok.SetEmbeddingFormat("float16")
+	Tassert(t, err != nil, "expected error for unknown format")
+}
+
+// test migrating a db with float64 embeddings
+func TestMigrateEmbeddingFormat(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	want := grok.Chunks[0].Embedding
+	// write the db the way 3.0.X did
+	grok.Version = "3.0.44"
+	grok.EmbeddingFormat = ""
+	buf, err := json.Marshal(grok)
+	Tassert(t, err == nil, "error marshaling: %v", err)
+	grokpath := filepath.Join(dir, ".grok")
+	err = ioutil.WriteFile(grokpath, buf, 0644)
+	Tassert(t, err == nil, "error writing db: %v", err)
+	g, migrated, _, _, lock, err := LoadFrom(grokpath, "", false)
+	Tassert(t, err == nil, "error loading: %v", err)
+	defer lock.Unlock()
+	Tassert(t, migrated, "expected migration")
+	Tassert(t, g.Version == Version, "unexpected version %q", g.Version)
+	Tassert(t, g.EmbeddingFormat == EmbeddingFloat32, "unexpected format %q", g.EmbeddingFormat)
+	got := g.Chunks[0].Embedding
+	Tassert(t, len(got) == len(want), "expected %d dimensions, got %d", len(want), len(got))
+	Tassert(t, got[0] == want[0], "embedding changed")
+}
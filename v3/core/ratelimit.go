@@ -0,0 +1,96 @@
+package core
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// rateLimiter keeps embedding requests under a tokens-per-minute and
+// a requests-per-minute limit using two token buckets, each holding a
+// minute's allowance and refilled continuously.  It is shared by
+// every goroutine that embeds with a Grokker, e.g. RefreshEmbeddings'
+// workers.  Callers that arrive while a bucket is empty are queued in
+// arrival order by letting the bucket go negative: each waits until
+// the bucket would have refilled to cover its request.
+type rateLimiter struct {
+	mu sync.Mutex
+	// tpm and rpm are the limits; zero is no limit
+	tpm, rpm int
+	// tokens and requests are what the buckets hold as of last
+	tokens, requests float64
+	last             time.Time
+	// now and sleep are time.Now and time.Sleep, except in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newRateLimiter returns a rateLimiter for the given limits, starting
+// with full buckets.
+func newRateLimiter(tpm, rpm int) *rateLimiter {
+	return &rateLimiter{
+		tpm:      tpm,
+		rpm:      rpm,
+		tokens:   float64(tpm),
+		requests: float64(rpm),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// wait blocks until a request of the given number of tokens can be
+// sent without exceeding the limits, and takes it from the buckets.
+// A request larger than a minute's allowance waits for a full bucket
+// rather than forever.
+func (l *rateLimiter) wait(tokens int) {
+	l.mu.Lock()
+	now := l.now()
+	var delay time.Duration
+	if !l.last.IsZero() {
+		minutes := now.Sub(l.last).Minutes()
+		l.tokens = math.Min(l.tokens+minutes*float64(l.tpm), float64(l.tpm))
+		l.requests = math.Min(l.requests+minutes*float64(l.rpm), float64(l.rpm))
+	}
+	l.last = now
+	if l.tpm > 0 {
+		l.tokens -= math.Min(float64(tokens), float64(l.tpm))
+		delay = max(delay, refillDelay(l.tokens, l.tpm))
+	}
+	if l.rpm > 0 {
+		l.requests--
+		delay = max(delay, refillDelay(l.requests, l.rpm))
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		Debug("rate limit: waiting %v", delay)
+		l.sleep(delay)
+	}
+}
+
+// refillDelay returns how long a bucket holding level, refilled at
+// perMinute, takes to get back to zero.
+func refillDelay(level float64, perMinute int) time.Duration {
+	if level >= 0 {
+		return 0
+	}
+	return time.Duration(-level / float64(perMinute) * float64(time.Minute))
+}
+
+// embeddingLimiter returns the rateLimiter for g's embedding rate
+// limits, or nil if there are none.  The same limiter is returned
+// until the limits change.
+func (g *Grokker) embeddingLimiter() *rateLimiter {
+	tpm := max(g.EmbeddingTokensPerMinute, 0)
+	rpm := max(g.EmbeddingRequestsPerMinute, 0)
+	if tpm == 0 && rpm == 0 {
+		return nil
+	}
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	if g.rateLimit == nil || g.rateLimit.tpm != tpm || g.rateLimit.rpm != rpm {
+		g.rateLimit = newRateLimiter(tpm, rpm)
+	}
+	return g.rateLimit
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// fakeClock returns a rateLimiter for the given limits whose sleeps
+// advance a fake clock instead of waiting, and records them.
+func fakeClock(tpm, rpm int) (l *rateLimiter, sleeps *[]time.Duration) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sleeps = &[]time.Duration{}
+	l = newRateLimiter(tpm, rpm)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		*sleeps = append(*sleeps, d)
+		now = now.Add(d)
+	}
+	return
+}
+
+func TestRateLimiter(t *testing.T) {
+	// 600 tokens per minute is 10 per second
+	l, sleeps := fakeClock(600, 0)
+	l.wait(600)
+	l.wait(300)
+	l.wait(60)
+	got := fmt.Sprint(*sleeps)
+	Tassert(t, got == "[30s 6s]", "unexpected sleeps %s", got)
+
+	l, sleeps = fakeClock(0, 2)
+	for i := 0; i < 4; i++ {
+		l.wait(1000000)
+	}
+	got = fmt.Sprint(*sleeps)
+	Tassert(t, got == "[30s 30s]", "unexpected sleeps %s", got)
+
+	// a request bigger than the allowance waits for a full bucket
+	l, sleeps = fakeClock(100, 0)
+	l.wait(1000)
+	l.wait(1000)
+	got = fmt.Sprint(*sleeps)
+	Tassert(t, got == "[1m0s]", "unexpected sleeps %s", got)
+}
+
+func TestEmbeddingRateLimit(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &batchCountingEmbedder{}
+	grok.SetEmbedder(embedder)
+	Tassert(t, grok.embeddingLimiter() == nil, "expected no limiter")
+	grok.EmbeddingRequestsPerMinute = 1
+	grok.EmbeddingTokensPerMinute = 1000
+	l := grok.embeddingLimiter()
+	Tassert(t, l != nil && grok.embeddingLimiter() == l, "expected the same limiter each time")
+	var sleeps *[]time.Duration
+	grok.rateLimit, sleeps = fakeClock(1000, 1)
+	for i := 0; i < 3; i++ {
+		err = grok.AddReader(fmt.Sprintf("doc%d.txt", i), strings.NewReader(fmt.Sprintf("document number %d", i)))
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	got := fmt.Sprint(*sleeps)
+	Tassert(t, got == "[1m0s 1m0s]", "unexpected sleeps %s", got)
+
+	// batches fit in a minute's tokens
+	maxTokens, _ := grok.embeddingBatchLimits()
+	Tassert(t, maxTokens == 1000, "expected batches of at most 1000 tokens, got %d", maxTokens)
+
+	// changing the limits replaces the limiter
+	grok.EmbeddingRequestsPerMinute = 0
+	l = grok.embeddingLimiter()
+	Tassert(t, l.tpm == 1000 && l.rpm == 0, "expected a new limiter, got %d tpm and %d rpm", l.tpm, l.rpm)
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// DefaultRefreshWorkers is the default of Grokker.RefreshWorkers.
+const DefaultRefreshWorkers = 4
+
+// refreshWorkers returns g.RefreshWorkers or its default.
+func (g *Grokker) refreshWorkers() int {
+	if g.RefreshWorkers <= 0 {
+		return DefaultRefreshWorkers
+	}
+	return g.RefreshWorkers
+}
+
+// refreshResult is what refreshChunks found for one document.
+type refreshResult struct {
+	// chunks are the document's chunks, with embeddings set on
+	// those whose hashes weren't already in the database.
+	chunks []*Chunk
+	// checked is when the document was read; see Document.Checked.
+	checked int64
+	err     error
+}
+
+// refreshChunks splits doc into chunks and embeds those whose hashes
+// aren't in known, the hashes of the document's chunks in the
+// database.  It changes neither the database nor doc, so that
+// refreshDocuments can run it for several documents at once, and a
+// document that fails keeps its old chunks; mergeChunks adds the
+// result to the database.
+func (g *Grokker) refreshChunks(doc *Document, known map[string]bool) (res *refreshResult) {
+	res = &refreshResult{checked: time.Now().Unix()}
+	chunks, err := g.docChunks(doc)
+	if err != nil {
+		res.err = err
+		return
+	}
+	// embed each new text once, as updateDocument does
+	var newChunks []*Chunk
+	for _, chunk := range chunks {
+		if !known[chunk.Hash] {
+			known[chunk.Hash] = true
+			newChunks = append(newChunks, chunk)
+		}
+	}
+	res.err = g.embedChunks(doc, newChunks, nil)
+	if res.err == nil {
+		res.chunks = chunks
+	}
+	return
+}
+
+// mergeChunks replaces doc's chunks in the database with those
+// refreshChunks returned, keeping existing chunks with the same
+// hashes, as updateDocument does.  Orphaned chunks are left for gc.
+func (g *Grokker) mergeChunks(doc *Document, res *refreshResult) {
+	for _, chunk := range g.Chunks {
+		if chunk.Document.RelPath == doc.RelPath {
+			chunk.stale = true
+		}
+	}
+	var updated bool
+	for _, chunk := range res.chunks {
+		if g.setChunk(chunk) != nil {
+			updated = true
+		}
+	}
+	g.touch(doc.RelPath)
+	if updated {
+		doc.Embedded = time.Now().Unix()
+	}
+	doc.Checked = res.checked
+}
+
+// refreshDocuments re-chunks docs and embeds their new chunks using
+// up to g.refreshWorkers() goroutines, then merges the results into
+// the database in the order of docs, so that the resulting chunk list
+// doesn't depend on which document finished first.  Documents that
+// fail are reported in failed and keep their old chunks.  An API
+// error stops the refresh: documents not yet started are skipped,
+// and the error is returned after merging the documents before the
+// one that failed.  The caller must hold g.mu for writing.
+func (g *Grokker) refreshDocuments(docs []*Document) (failed []DocumentError, err error) {
+	defer Return(&err)
+	// the hashes of each document's chunks, looked up before any
+	// worker starts so that the workers don't read g.Chunks while
+	// it's changing
+	known := make([]map[string]bool, len(docs))
+	index := make(map[string]int)
+	for i, doc := range docs {
+		known[i] = make(map[string]bool)
+		index[doc.RelPath] = i
+	}
+	for _, chunk := range g.Chunks {
+		i, ok := index[chunk.Document.RelPath]
+		if ok {
+			known[i][chunk.Hash] = true
+		}
+	}
+
+	results := make([]*refreshResult, len(docs))
+	var mu sync.Mutex
+	var started int
+	var stopped bool
+	// next returns the index of the next document to refresh, or
+	// -1 if there are none left or an API error stopped the refresh
+	next := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped || started == len(docs) {
+			return -1
+		}
+		i := started
+		started++
+		done := 0
+		for _, res := range results {
+			if res != nil {
+				done++
+			}
+		}
+		g.progress(done, len(docs), docs[i].RelPath)
+		if g.Progress == nil {
+			Fpf(os.Stderr, "refreshing embeddings for %s\n", docs[i].RelPath)
+		}
+		return i
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < min(g.refreshWorkers(), len(docs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := next(); i >= 0; i = next() {
+				res := g.refreshChunks(docs[i], known[i])
+				mu.Lock()
+				results[i] = res
+				if apiOnly(res.err) != nil {
+					stopped = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, res := range results {
+		if res == nil {
+			// skipped after an API error, which comes first
+			break
+		}
+		Ck(apiOnly(res.err))
+		if res.err != nil {
+			failed = append(failed, DocumentError{docs[i].RelPath, res.err})
+			continue
+		}
+		g.mergeChunks(docs[i], res)
+	}
+	return
+}
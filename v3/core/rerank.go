@@ -0,0 +1,100 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// SysMsgRerank is the system message for reranking retrieved chunks.
+var SysMsgRerank = "You are a search relevance judge.  I will give you a question and numbered passages.  Rate how useful each passage is for answering the question, from 0 (irrelevant) to 10 (answers it directly).  Judge what each passage says, not how many words it shares with the question.  Respond with only a JSON array of numbers, one per passage, in order."
+
+// DefaultRerankCandidates is the default value of
+// Grokker.RerankCandidates.
+const DefaultRerankCandidates = 20
+
+// rerankCandidates returns the number of chunks to rerank.
+func (g *Grokker) rerankCandidates() int {
+	if g.RerankCandidates <= 0 {
+		return DefaultRerankCandidates
+	}
+	return g.RerankCandidates
+}
+
+// rerank asks the chat model to rate the relevance of each candidate
+// to query and returns the candidates sorted by rating, keeping the
+// original order among equal ratings.  If the chat API fails or the
+// model's reply can't be used, it warns and returns the candidates
+// unchanged, since the original ranking is still a reasonable one.
+func (g *Grokker) rerank(ctx context.Context, query string, candidates []*Chunk) (ranked []*Chunk, err error) {
+	defer Return(&err)
+	if len(candidates) < 2 {
+		return candidates, nil
+	}
+	// leave half of the model's window for the reply and overhead
+	perChunk := g.ModelObj.TokenLimit / 2 / len(candidates)
+	var prompt strings.Builder
+	Fpf(&prompt, "Question: %s\n\n", query)
+	for i, chunk := range candidates {
+		text, err := g.chunkText(chunk, true, false)
+		Ck(err)
+		text, _, err = g.truncateTokens(text, perChunk)
+		Ck(err)
+		Fpf(&prompt, "Passage %d:\n%s\n\n", i+1, text)
+	}
+	messages := initMessages(g, g.Model, SysMsgRerank, g.textOptions())
+	messages = append(messages, client.ChatMsg{
+		Role:    RoleUser,
+		Content: prompt.String(),
+	})
+	results, err := g.gateway(ctx, g.Model, messages, g.textOptions())
+	if errors.Is(err, ErrChatAPI) && ctx.Err() == nil {
+		// retrieval shouldn't depend on the chat API
+		Fpf(os.Stderr, "warning: not reranking: %v\n", err)
+		return candidates, nil
+	}
+	Ck(err)
+	scores, err := parseRerankScores(results.Body, len(candidates))
+	if err != nil {
+		Fpf(os.Stderr, "warning: not reranking: %v\n", err)
+		return candidates, nil
+	}
+	idx := make([]int, len(candidates))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return scores[idx[i]] > scores[idx[j]]
+	})
+	for _, i := range idx {
+		ranked = append(ranked, candidates[i])
+	}
+	return
+}
+
+// parseRerankScores extracts the JSON array of n scores from a
+// reranking reply, tolerating text around the array.
+func parseRerankScores(reply string, n int) (scores []float64, err error) {
+	start := strings.Index(reply, "[")
+	end := strings.LastIndex(reply, "]")
+	if start < 0 || end < start {
+		err = fmt.Errorf("no JSON array in reply %.60q", reply)
+		return
+	}
+	err = json.Unmarshal([]byte(reply[start:end+1]), &scores)
+	if err != nil {
+		err = fmt.Errorf("can't parse reply %.60q: %v", reply, err)
+		return
+	}
+	if len(scores) != n {
+		err = fmt.Errorf("got %d scores for %d passages", len(scores), n)
+	}
+	return
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// passageJudge is a client.ChatClient that rates each passage in a
+// rerank prompt 10 if it contains want and 0 otherwise.
+type passageJudge struct {
+	want  string
+	calls int
+}
+
+func (j *passageJudge) CompleteChat(model string, messages []client.ChatMsg) (results client.Results, err error) {
+	j.calls++
+	prompt := messages[len(messages)-1].Content
+	passages := regexp.MustCompile(`(?m)^Passage \d+:\n`).Split(prompt, -1)[1:]
+	var scores []string
+	for _, p := range passages {
+		if strings.Contains(p, j.want) {
+			scores = append(scores, "10")
+		} else {
+			scores = append(scores, "0")
+		}
+	}
+	results.Body = fmt.Sprintf("Scores: [%s]", strings.Join(scores, ", "))
+	return
+}
+
+func TestRerank(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	var paras []string
+	for i := 0; i < 5; i++ {
+		paras = append(paras, fmt.Sprintf("How do I reset the router?  Reset the router as described in step %d.", i))
+	}
+	paras = append(paras, "Hold the button on the back for ten seconds.")
+	err = grok.AddReader("router.txt", strings.NewReader(strings.Join(paras, "\n\n")))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	judge := &passageJudge{want: "ten seconds"}
+	grok.SetChatClient("openai", judge)
+	query := "How do I reset the router?"
+
+	chunks, err := grok.findChunks(query, 100000, nil)
+	Tassert(t, err == nil, "error finding chunks: %v", err)
+	text, err := grok.ChunkText(chunks[0])
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, !strings.Contains(text, "ten seconds"), "expected embeddings alone to miss the answer, got %q", text)
+	Tassert(t, judge.calls == 0, "expected no rerank request, got %d", judge.calls)
+
+	grok.Rerank = true
+	chunks, err = grok.findChunks(query, 100000, nil)
+	Tassert(t, err == nil, "error finding chunks: %v", err)
+	text, err = grok.ChunkText(chunks[0])
+	Tassert(t, err == nil, "error getting chunk text: %v", err)
+	Tassert(t, strings.Contains(text, "ten seconds"), "expected reranked answer first, got %q", text)
+	Tassert(t, judge.calls == 1, "expected one rerank request, got %d", judge.calls)
+}
+
+func TestParseRerankScores(t *testing.T) {
+	scores, err := parseRerankScores("Here you go: [3, 7.5, 0]", 3)
+	Tassert(t, err == nil, "error parsing scores: %v", err)
+	Tassert(t, fmt.Sprint(scores) == "[3 7.5 0]", "unexpected scores %v", scores)
+	_, err = parseRerankScores("[3, 7]", 3)
+	Tassert(t, err != nil, "expected error for wrong number of scores")
+	_, err = parseRerankScores("no idea", 3)
+	Tassert(t, err != nil, "expected error for missing array")
+}
+
+// formatJudge is a client.ChatProvider that judges rerank prompts as
+// passageJudge does, drafts a paragraph for HyDE prompts, and answers
+// anything else with a JSON object, recording the options sent with
+// each kind of request.
+type formatJudge struct {
+	passageJudge
+	opts map[string]client.Options
+}
+
+func (j *formatJudge) CompleteChat(model string, messages []client.ChatMsg) (client.Results, error) {
+	return j.Chat(context.Background(), model, messages, client.Options{})
+}
+
+func (j *formatJudge) Chat(ctx context.Context, model string, messages []client.ChatMsg, opts client.Options) (results client.Results, err error) {
+	sysmsg := messages[0].Content
+	switch {
+	case strings.HasPrefix(sysmsg, SysMsgRerank):
+		j.opts["rerank"] = opts
+		return j.passageJudge.CompleteChat(model, messages)
+	case strings.HasPrefix(sysmsg, SysMsgHyDE):
+		j.opts["hyde"] = opts
+		results.Body = "Hold the button for ten seconds to reset it."
+	default:
+		j.opts["answer"] = opts
+		results.Body = `{"answer": "hold the button"}`
+	}
+	return
+}
+
+// test that JSON mode applies to the answer but not to the requests
+// for reranking and HyDE, whose replies have formats of their own
+func TestRerankJSONMode(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddReader("router.txt", strings.NewReader("Reset the router as described below.\n\nHold the button on the back for ten seconds.\n"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	judge := &formatJudge{passageJudge: passageJudge{want: "ten seconds"}, opts: map[string]client.Options{}}
+	grok.SetChatClient("openai", judge)
+	grok.ChatOptions.ResponseFormat = client.ResponseFormatJSON
+	grok.Rerank = true
+	grok.HyDE = true
+
+	res, err := grok.AnswerResult("gpt-4", "How do I reset the router?", false, false, false)
+	Tassert(t, err == nil, "error answering: %v", err)
+	Tassert(t, res.Answer == `{"answer": "hold the button"}`, "unexpected answer %q", res.Answer)
+	Tassert(t, judge.calls == 1, "expected one rerank request, got %d", judge.calls)
+	Tassert(t, judge.opts["rerank"].ResponseFormat == "", "expected no response format for reranking, got %+v", judge.opts["rerank"])
+	Tassert(t, judge.opts["hyde"].ResponseFormat == "", "expected no response format for HyDE, got %+v", judge.opts["hyde"])
+	Tassert(t, judge.opts["answer"].ResponseFormat == client.ResponseFormatJSON, "expected JSON for the answer, got %+v", judge.opts["answer"])
+	ctxt := res.Messages[len(res.Messages)-3].Content
+	Tassert(t, strings.Index(ctxt, "ten seconds") < strings.Index(ctxt, "Reset the router"), "expected reranked context, got %q", ctxt)
+}
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+	"github.com/stevegt/grokker/v3/openai"
+)
+
+// SelfTestCheck is the outcome of one of the checks made by SelfTest.
+type SelfTestCheck struct {
+	// Name says what was checked.
+	Name string `json:"name"`
+	// Detail describes what was found, e.g. the number of embedding
+	// dimensions.
+	Detail string `json:"detail,omitempty"`
+	// Err is why the check failed, or nil if it passed.
+	Err error `json:"-"`
+}
+
+func (c SelfTestCheck) String() string {
+	if c.Err != nil {
+		return Spf("FAIL %s: %v", c.Name, c.Err)
+	}
+	if c.Detail == "" {
+		return Spf("ok   %s", c.Name)
+	}
+	return Spf("ok   %s: %s", c.Name, c.Detail)
+}
+
+// SelfTest checks that grokker can do its job:  that an OpenAI API key
+// is set if one is needed, that the embedding API and the default chat
+// model answer a tiny request, and that the db survives a round trip
+// through its file format.  It returns every check it made, in order,
+// and an error if any of them failed.  Checks that call an API give up
+// when ctx is done.
+func (g *Grokker) SelfTest(ctx context.Context) (checks []SelfTestCheck, err error) {
+	_, m, modelErr := g.models.FindModel(g.Model)
+	_, openaiEmbeddings := g.embedder.(*openaiEmbedder)
+	if openaiEmbeddings || (modelErr == nil && m.providerName == "openai") {
+		checks = append(checks, g.checkAPIKey())
+	}
+	checks = append(checks, selfTestCheck(ctx, "embeddings", g.checkEmbeddings))
+	checks = append(checks, selfTestCheck(ctx, Spf("chat model %s", g.Model), func() (string, error) {
+		if modelErr != nil {
+			return "", modelErr
+		}
+		return g.checkChat(m)
+	}))
+	checks = append(checks, selfTestCheck(ctx, "database", g.checkRoundTrip))
+	var failed []string
+	for _, check := range checks {
+		if check.Err != nil {
+			failed = append(failed, check.Name)
+		}
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("self-test failed: %s", strings.Join(failed, ", "))
+	}
+	return
+}
+
+// selfTestCheck runs f as the check called name, giving up when ctx
+// is done.  f keeps running in the background if it doesn't return in
+// time.
+func selfTestCheck(ctx context.Context, name string, f func() (detail string, err error)) (check SelfTestCheck) {
+	check.Name = name
+	if ctx.Err() != nil {
+		check.Err = ctx.Err()
+		return
+	}
+	type result struct {
+		detail string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		// report panics as failures rather than crashing
+		defer func() {
+			if r := recover(); r != nil {
+				res.err = fmt.Errorf("%v", r)
+			}
+			done <- res
+		}()
+		res.detail, res.err = f()
+	}()
+	select {
+	case res := <-done:
+		check.Detail, check.Err = res.detail, res.err
+	case <-ctx.Done():
+		check.Err = ctx.Err()
+	}
+	return
+}
+
+// checkAPIKey checks that OPENAI_API_KEY is set.
+func (g *Grokker) checkAPIKey() (check SelfTestCheck) {
+	check.Name = "OPENAI_API_KEY"
+	check.Err = openai.CheckAPIKey()
+	if check.Err != nil {
+		return
+	}
+	key := os.Getenv("OPENAI_API_KEY")
+	if len(key) > 8 {
+		check.Detail = Spf("set, ending in %s", key[len(key)-4:])
+	} else {
+		check.Detail = "set"
+	}
+	return
+}
+
+// checkEmbeddings checks that the embedder returns an embedding that
+// matches those in the db.
+func (g *Grokker) checkEmbeddings() (detail string, err error) {
+	defer Return(&err)
+	embeddings, err := g.embedder.CreateEmbeddings([]string{"grokker self-test"})
+	Ck(embeddingError(err))
+	if len(embeddings) != 1 {
+		err = fmt.Errorf("got %d embeddings for 1 text", len(embeddings))
+		return
+	}
+	embedding, err := g.projectEmbedding(embeddings[0])
+	Ck(err)
+	g.mu.RLock()
+	dims := g.embeddingDims()
+	g.mu.RUnlock()
+	if dims != 0 {
+		err = validateEmbedding(embedding, dims)
+		Ck(err, "stored embeddings don't match -- try 'grok rebuild'")
+	}
+	detail = Spf("%s, %d dimensions", g.embeddingModel(), len(embedding))
+	return
+}
+
+// checkChat checks that the chat model m answers.
+func (g *Grokker) checkChat(m *Model) (detail string, err error) {
+	defer Return(&err)
+	if m.unavailable != nil {
+		err = m.unavailable
+		return
+	}
+	msgs := []client.ChatMsg{{Role: RoleUser, Content: "Reply with OK."}}
+	resp, _, err := g.completeChat(context.Background(), m.Name, "You are a connectivity test.", msgs, g.textOptions())
+	Ck(err)
+	if strings.TrimSpace(resp) == "" {
+		err = fmt.Errorf("empty response")
+		return
+	}
+	detail = Spf("%s via %s", m.upstreamName, m.providerName)
+	return
+}
+
+// checkRoundTrip checks that the db can be encoded the way Save
+// writes it and decoded the way Load reads it without losing
+// documents, chunks, or embeddings.
+func (g *Grokker) checkRoundTrip() (detail string, err error) {
+	defer Return(&err)
+	// encoding moves embeddings around, so readers must wait
+	g.mu.Lock()
+	restore, err := g.encodeEmbeddings()
+	if err != nil {
+		g.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(g)
+	restore()
+	var missing int
+	for _, doc := range g.Documents {
+		if doc.Synthetic {
+			continue
+		}
+		if _, statErr := os.Stat(g.absPath(doc)); statErr != nil {
+			missing++
+		}
+	}
+	docs, chunks := len(g.Documents), len(g.Chunks)
+	g.mu.Unlock()
+	Ck(err)
+	loaded := &Grokker{}
+	err = json.Unmarshal(data, loaded)
+	Ck(err)
+	err = loaded.decodeEmbeddings()
+	Ck(err)
+	if len(loaded.Documents) != docs || len(loaded.Chunks) != chunks {
+		err = fmt.Errorf("saved %d documents and %d chunks but loaded %d and %d", docs, chunks, len(loaded.Documents), len(loaded.Chunks))
+		return
+	}
+	dims := loaded.embeddingDims()
+	for _, chunk := range loaded.Chunks {
+		if chunk.Embedding == nil {
+			continue
+		}
+		err = validateEmbedding(chunk.Embedding, dims)
+		Ck(err, "chunk at offset %d of %s", chunk.Offset, chunk.Document.RelPath)
+	}
+	detail = Spf("%d documents, %d chunks, %d bytes", docs, chunks, len(data))
+	if missing > 0 {
+		detail += Spf(" (%d documents missing from disk)", missing)
+	}
+	return
+}
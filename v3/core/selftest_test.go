@@ -0,0 +1,82 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/openai"
+)
+
+func TestAPIKeyCheck(t *testing.T) {
+	key := os.Getenv("OPENAI_API_KEY")
+	defer os.Setenv("OPENAI_API_KEY", key)
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	defer os.Setenv("OPENAI_BASE_URL", baseURL)
+
+	// a compatible server, such as the fake one, might not need a
+	// key
+	if baseURL != "" {
+		os.Setenv("OPENAI_API_KEY", "")
+		grok, err := Init(TmpTestDir(), "gpt-4")
+		Tassert(t, err == nil, "error creating grokker: %v", err)
+		err = grok.AddDocument("testdata/te-abstract.txt")
+		Tassert(t, err == nil, "error adding doc without a key: %v", err)
+	}
+
+	// but OpenAI does
+	os.Setenv("OPENAI_BASE_URL", "")
+	for _, bad := range []string{"", "<your_api_key>", "sk-abc def", "'sk-abc'"} {
+		os.Setenv("OPENAI_API_KEY", bad)
+		grok, err := Init(TmpTestDir(), "gpt-4")
+		Tassert(t, err == nil, "error creating grokker: %v", err)
+		// fails right away rather than retrying
+		start := time.Now()
+		err = grok.AddDocument("testdata/te-abstract.txt")
+		Tassert(t, errors.Is(err, openai.ErrAPIKey), "expected ErrAPIKey for %q, got %v", bad, err)
+		Tassert(t, time.Since(start) < time.Second, "expected no retries")
+		_, err = grok.Msg("gpt-4", "You are a test.", "Hello")
+		Tassert(t, errors.Is(err, openai.ErrAPIKey), "expected ErrAPIKey for %q from chat, got %v", bad, err)
+	}
+
+	// malformed keys are caught for compatible servers too
+	os.Setenv("OPENAI_BASE_URL", baseURL)
+	os.Setenv("OPENAI_API_KEY", "<your_api_key>")
+	err := openai.CheckAPIKey()
+	Tassert(t, errors.Is(err, openai.ErrAPIKey), "expected ErrAPIKey, got %v", err)
+}
+
+func TestSelfTest(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+
+	checks, err := grok.SelfTest(context.Background())
+	Tassert(t, err == nil, "unexpected self-test failure: %v %v", err, checks)
+	Tassert(t, len(checks) == 4, "expected 4 checks, got %v", checks)
+	for _, check := range checks {
+		Tassert(t, check.Err == nil, "unexpected failure: %v", check)
+	}
+
+	// a broken chat client fails only its own check
+	grok.SetChatClient("openai", failingChat{})
+	checks, err = grok.SelfTest(context.Background())
+	Tassert(t, err != nil, "expected self-test failure")
+	var failed []string
+	for _, check := range checks {
+		if check.Err != nil {
+			failed = append(failed, check.Name)
+		}
+	}
+	Tassert(t, len(failed) == 1 && failed[0] == "chat model gpt-4", "unexpected failures %v", failed)
+
+	// network checks give up when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = grok.SelfTest(ctx)
+	Tassert(t, err != nil, "expected failure with a cancelled context")
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// SentenceChunker splits content into sentences and packs as many
+// whole sentences into each chunk as fit in tokenLimit tokens,
+// ignoring paragraph boundaries.  This gives more uniform chunks than
+// ParagraphChunker for prose with very long or very short paragraphs.
+// A sentence longer than tokenLimit becomes a chunk of its own and is
+// split further by the caller.
+var SentenceChunker Chunker = ChunkerFunc(func(doc *Document, content string, tokenLimit int) (chunks []string, err error) {
+	defer Return(&err)
+	start := 0
+	end := 0
+	tokens := 0
+	for _, sentence := range splitSentences(content) {
+		_, sentenceTokens, err := Tokenizer.Encode(sentence)
+		Ck(err)
+		if end > start && tokens+len(sentenceTokens) >= tokenLimit {
+			chunks = append(chunks, content[start:end])
+			start = end
+			tokens = 0
+		}
+		end += len(sentence)
+		tokens += len(sentenceTokens)
+	}
+	if end > start {
+		chunks = append(chunks, content[start:end])
+	}
+	return
+})
+
+// splitSentences splits txt into sentences that together cover all of
+// txt, each keeping the whitespace that follows it.  A sentence ends
+// with Unicode sentence-terminal punctuation, such as a full stop,
+// question mark, danda, or ideographic full stop, followed by any
+// closing quotes or brackets and then whitespace or the end of txt.
+// CJK terminals need no whitespace after them.  A full stop followed
+// by a lowercase letter or digit, as in "e.g. this", does not end a
+// sentence.
+func splitSentences(txt string) (sentences []string) {
+	start := 0
+	for i := 0; i < len(txt); {
+		r, size := utf8.DecodeRuneInString(txt[i:])
+		i += size
+		if !unicode.Is(unicode.Sentence_Terminal, r) {
+			continue
+		}
+		// take any further terminals and closing punctuation
+		j := i
+		for j < len(txt) {
+			next, size := utf8.DecodeRuneInString(txt[j:])
+			if !unicode.Is(unicode.Sentence_Terminal, next) && !isCloser(next) {
+				break
+			}
+			j += size
+		}
+		// take the whitespace after the sentence
+		k := j
+		for k < len(txt) {
+			next, size := utf8.DecodeRuneInString(txt[k:])
+			if !unicode.IsSpace(next) {
+				break
+			}
+			k += size
+		}
+		if k == j && j < len(txt) && !isCJK(r) {
+			// e.g. "3.14" or "grokker.go"
+			i = j
+			continue
+		}
+		if r == '.' && k < len(txt) {
+			next, _ := utf8.DecodeRuneInString(txt[k:])
+			if unicode.IsLower(next) || unicode.IsDigit(next) {
+				i = k
+				continue
+			}
+		}
+		sentences = append(sentences, txt[start:k])
+		start = k
+		i = k
+	}
+	if start < len(txt) {
+		sentences = append(sentences, txt[start:])
+	}
+	return
+}
+
+// isCloser reports whether r is a quote or bracket that may follow the
+// end of a sentence.
+func isCloser(r rune) bool {
+	return r == '"' || r == '\'' || unicode.In(r, unicode.Pe, unicode.Pf)
+}
+
+// isCJK reports whether r is from the CJK blocks, whose sentence
+// terminals such as '。' and '！' are not followed by spaces.
+func isCJK(r rune) bool {
+	return r >= 0x2e80 && r <= 0x9fff || r >= 0xff00 && r <= 0xffef
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestSplitSentences(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"One. Two! Three?", []string{"One. ", "Two! ", "Three?"}},
+		{"He said \"stop.\" Then he left.\n\nNext", []string{"He said \"stop.\" ", "Then he left.\n\n", "Next"}},
+		{"See e.g. the file grokker.go, version 3.14. Done.", []string{"See e.g. the file grokker.go, version 3.14. ", "Done."}},
+		{"Wait... What?! Yes.", []string{"Wait... ", "What?! ", "Yes."}},
+		{"第一句。第二句！第三句", []string{"第一句。", "第二句！", "第三句"}},
+		{"यह वाक्य है। दूसरा", []string{"यह वाक्य है। ", "दूसरा"}},
+	}
+	for _, c := range cases {
+		got := splitSentences(c.in)
+		Tassert(t, strings.Join(got, "") == c.in, "sentences of %q don't cover the text: %q", c.in, got)
+		Tassert(t, len(got) == len(c.want), "splitSentences(%q) = %q, want %q", c.in, got, c.want)
+		for i := range got {
+			Tassert(t, got[i] == c.want[i], "splitSentences(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestSentenceChunking(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.SetChunking("bogus")
+	Tassert(t, err != nil, "expected error for unknown chunking")
+	err = grok.SetChunking("sentence")
+	Tassert(t, err == nil, "error setting chunking: %v", err)
+	Tassert(t, grok.Chunking == "sentence", "expected sentence chunking, got %q", grok.Chunking)
+
+	// one enormous paragraph packs into several chunks of whole
+	// sentences, counted from the file
+	var txt string
+	for i := 0; i < 40; i++ {
+		txt += Spf("Clause %d says the party of the first part shall indemnify the party of the second part. ", i)
+	}
+	fn := filepath.Join(dir, "contract.txt")
+	err = ioutil.WriteFile(fn, []byte(txt), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	err = grok.SetChunkTokens(100, 0)
+	Tassert(t, err == nil, "error setting chunk tokens: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chunks, err := grok.DocumentChunks("contract.txt")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	Tassert(t, len(chunks) > 1, "expected several chunks, got %d", len(chunks))
+	for i, c := range chunks {
+		text, err := grok.ChunkText(c)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		Tassert(t, strings.HasSuffix(text, "part. "), "chunk %d doesn't end with a sentence: %q", i, text)
+		c.Tokens = 0
+		tc, err := c.tokenCount(grok)
+		Tassert(t, err == nil, "error counting tokens: %v", err)
+		Tassert(t, tc > 0 && tc <= 100, "chunk %d has %d tokens", i, tc)
+	}
+
+	// a chunker registered for the file type still wins
+	defer RegisterChunker("csv", tableChunker{delimiter: ','})
+	RegisterChunker("csv", ParagraphChunker)
+	chunks, err = grok.chunksFromString(&Document{RelPath: "x.csv"}, "a. b.\n\nc. d.", 100)
+	Tassert(t, err == nil, "error chunking: %v", err)
+	Tassert(t, len(chunks) == 2, "expected 2 paragraphs, got %d", len(chunks))
+
+	err = grok.SetChunking("paragraph")
+	Tassert(t, err == nil, "error setting chunking: %v", err)
+	Tassert(t, grok.Chunking == "", "expected default chunking, got %q", grok.Chunking)
+}
@@ -0,0 +1,325 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Server serves a Grokker knowledge base over HTTP, so that several
+// tools can share one knowledge base.  All endpoints accept and return
+// JSON:
+//
+//	POST /ask     {"question": "...", "model": "...", "global": false,
+//	               "refresh": false}
+//	              returns a Result
+//	POST /add     {"paths": ["..."]}
+//	POST /forget  {"paths": ["..."]}
+//	GET  /stats
+//
+// Errors are returned as {"error": "..."} with a non-200 status, 400
+// for requests that are missing something.  A request whose client
+// goes away stops at the next chat request or document.  Questions
+// are answered concurrently; requests that change the
+// knowledge base wait for the questions in progress and hold off new
+// ones until they are done.  The database is saved after each request
+// that changes it.  Documents changed on disk are re-embedded when
+// Serve starts and when a question asks for a refresh, not before
+// every question, which would hold off the others.
+type Server struct {
+	g   *Grokker
+	mux *http.ServeMux
+}
+
+type askRequest struct {
+	Question string `json:"question"`
+	Model    string `json:"model,omitempty"`
+	Global   bool   `json:"global,omitempty"`
+	// ShowPrompt includes the messages sent to the model and their
+	// token breakdown in the response.
+	ShowPrompt bool `json:"show_prompt,omitempty"`
+	// Refresh updates the embeddings of documents changed on disk
+	// before answering, holding off other questions meanwhile.
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+type pathsRequest struct {
+	Paths []string `json:"paths"`
+}
+
+type pathsResponse struct {
+	Paths []string `json:"paths"`
+}
+
+type statsResponse struct {
+	Version   string   `json:"version"`
+	DBVersion string   `json:"db_version"`
+	Model     string   `json:"model"`
+	Documents []string `json:"documents"`
+	Chunks    int      `json:"chunks"`
+	Tokens    int      `json:"tokens"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	// Paths are the paths an /add request added before it failed.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// addError is the error of an /add request that failed partway
+// through, along with the paths it added first.
+type addError struct {
+	added []string
+	err   error
+}
+
+func (e *addError) Error() string {
+	return e.err.Error()
+}
+
+func (e *addError) Unwrap() error {
+	return e.err
+}
+
+// NewServer returns a Server for g.
+func NewServer(g *Grokker) (s *Server) {
+	s = &Server{g: g, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/ask", s.handleAsk)
+	s.mux.HandleFunc("/add", s.handleAdd)
+	s.mux.HandleFunc("/forget", s.handleForget)
+	s.mux.HandleFunc("/stats", s.handleStats)
+	return
+}
+
+// Serve brings the embeddings of changed documents up to date, then
+// serves the knowledge base over HTTP on addr until an error occurs.
+// See Server for the endpoints.
+func (g *Grokker) Serve(addr string) (err error) {
+	defer Return(&err)
+	s := NewServer(g)
+	err = s.refresh()
+	Ck(err)
+	Fpf(os.Stderr, "serving %s on %s\n", g.Root, addr)
+	err = http.ListenAndServe(addr, s)
+	return
+}
+
+// refresh updates the embeddings of documents changed on disk and
+// saves the database if any were.  Documents that can't be read are
+// reported as warnings.
+func (s *Server) refresh() (err error) {
+	defer Return(&err)
+	updated, err := s.g.UpdateEmbeddings()
+	// documents that can't be read shouldn't stop questions
+	var refreshErr *RefreshError
+	if errors.As(err, &refreshErr) {
+		Fpf(os.Stderr, "warning: %v\n", err)
+		err = nil
+	}
+	Ck(err)
+	if updated {
+		err = s.g.Save()
+		Ck(err)
+	}
+	return
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// do runs fn and writes its result as JSON.  If the client goes away
+// before fn finishes, do returns without writing a response; fn still
+// runs to completion so the database is left consistent.
+func (s *Server) do(w http.ResponseWriter, r *http.Request, method string, fn func() (interface{}, error)) {
+	if r.Method != method {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: fmt.Sprintf("method %s not allowed", r.Method)})
+		return
+	}
+	type result struct {
+		res interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		res.res, res.err = fn()
+		done <- res
+	}()
+	select {
+	case <-r.Context().Done():
+		Debug("request canceled: %v", r.Context().Err())
+		return
+	case res := <-done:
+		if res.err != nil {
+			errRes := errorResponse{Error: res.err.Error()}
+			var addErr *addError
+			if errors.As(res.err, &addErr) {
+				errRes.Paths = addErr.added
+			}
+			writeJSON(w, httpStatus(res.err), errRes)
+			return
+		}
+		writeJSON(w, http.StatusOK, res.res)
+	}
+}
+
+// decode decodes the JSON request body into v, writing an error
+// response and returning false if it can't.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("%v: %v", ErrInvalidRequest, err)})
+		return false
+	}
+	return true
+}
+
+// checkPaths returns an error wrapping ErrInvalidRequest if paths is
+// empty or holds an empty path.
+func checkPaths(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("%w: paths are required", ErrInvalidRequest)
+	}
+	for _, path := range paths {
+		if path == "" {
+			return fmt.Errorf("%w: empty path", ErrInvalidRequest)
+		}
+	}
+	return nil
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		Debug("error writing response: %v", err)
+	}
+}
+
+func (s *Server) handleAsk(w http.ResponseWriter, r *http.Request) {
+	var req askRequest
+	if r.Method == http.MethodPost && !decode(w, r, &req) {
+		return
+	}
+	s.do(w, r, http.MethodPost, func() (res interface{}, err error) {
+		defer Return(&err)
+		if strings.TrimSpace(req.Question) == "" {
+			err = fmt.Errorf("%w: question is required", ErrInvalidRequest)
+			return
+		}
+		ctx := r.Context()
+		g := s.g
+		modelName := req.Model
+		if modelName == "" {
+			modelName = g.Model
+		}
+		if req.Refresh {
+			err = s.refresh()
+			Ck(err)
+		}
+		err = ctx.Err()
+		Ck(err)
+		result, err := g.answerImages(ctx, modelName, req.Question, nil, false, false, req.Global)
+		Ck(err)
+		if !req.ShowPrompt {
+			result.Messages, result.Tokens = nil, nil
+		}
+		res = result
+		return
+	})
+}
+
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	var req pathsRequest
+	if r.Method == http.MethodPost && !decode(w, r, &req) {
+		return
+	}
+	s.do(w, r, http.MethodPost, func() (res interface{}, err error) {
+		defer Return(&err)
+		err = checkPaths(req.Paths)
+		Ck(err)
+		// documents already added are kept and saved even if a
+		// later one fails or the client goes away before the rest
+		// are
+		var added []string
+		var failed error
+		for _, path := range req.Paths {
+			if r.Context().Err() != nil {
+				break
+			}
+			failed = s.g.AddDocument(path)
+			if failed != nil {
+				break
+			}
+			added = append(added, path)
+		}
+		err = s.g.Save()
+		Ck(err)
+		if failed != nil {
+			err = &addError{added: added, err: failed}
+			return
+		}
+		res = pathsResponse{Paths: added}
+		return
+	})
+}
+
+func (s *Server) handleForget(w http.ResponseWriter, r *http.Request) {
+	var req pathsRequest
+	if r.Method == http.MethodPost && !decode(w, r, &req) {
+		return
+	}
+	s.do(w, r, http.MethodPost, func() (res interface{}, err error) {
+		defer Return(&err)
+		err = checkPaths(req.Paths)
+		Ck(err)
+		for _, path := range req.Paths {
+			err = s.g.ForgetDocument(path)
+			Ck(err)
+		}
+		s.g.mu.Lock()
+		err = s.g.gc()
+		s.g.mu.Unlock()
+		Ck(err)
+		err = s.g.Save()
+		Ck(err)
+		res = pathsResponse{Paths: req.Paths}
+		return
+	})
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.do(w, r, http.MethodGet, func() (res interface{}, err error) {
+		g := s.g
+		g.mu.RLock()
+		model, chunks := g.Model, len(g.Chunks)
+		tokens := 0
+		g.cacheMu.Lock()
+		for _, chunk := range g.Chunks {
+			tokens += chunk.Tokens
+		}
+		g.cacheMu.Unlock()
+		g.mu.RUnlock()
+		res = statsResponse{
+			Version:   CodeVersion(),
+			DBVersion: g.DBVersion(),
+			Model:     model,
+			Documents: g.ListDocuments(),
+			Chunks:    chunks,
+			Tokens:    tokens,
+		}
+		return
+	})
+}
+
+// ensure Server implements http.Handler
+var _ http.Handler = (*Server)(nil)
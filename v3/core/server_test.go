@@ -0,0 +1,178 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/client"
+)
+
+// post sends a JSON request to the server and decodes the response.
+func post(t *testing.T, srv *httptest.Server, path string, req, res interface{}) *http.Response {
+	buf, err := json.Marshal(req)
+	Tassert(t, err == nil, "error encoding request: %v", err)
+	resp, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(buf))
+	Tassert(t, err == nil, "error posting to %s: %v", path, err)
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(res)
+	Tassert(t, err == nil, "error decoding response from %s: %v", path, err)
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	srv := httptest.NewServer(NewServer(grok))
+	defer srv.Close()
+
+	// add a document
+	var added pathsResponse
+	resp := post(t, srv, "/add", pathsRequest{Paths: []string{"testdata/te-abstract.txt"}}, &added)
+	Tassert(t, resp.StatusCode == http.StatusOK, "unexpected status adding document: %d", resp.StatusCode)
+
+	// check the stats
+	resp, err = http.Get(srv.URL + "/stats")
+	Tassert(t, err == nil, "error getting stats: %v", err)
+	var stats statsResponse
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	Tassert(t, err == nil, "error decoding stats: %v", err)
+	Tassert(t, len(stats.Documents) == 1, "expected 1 document, got %d", len(stats.Documents))
+	Tassert(t, stats.Chunks > 0, "expected chunks, got %d", stats.Chunks)
+	Tassert(t, stats.Tokens > 0, "expected tokens, got %d", stats.Tokens)
+
+	// ask a question
+	var ans Result
+	resp = post(t, srv, "/ask", askRequest{Question: "What is the document about?"}, &ans)
+	Tassert(t, resp.StatusCode == http.StatusOK, "unexpected status asking question: %d", resp.StatusCode)
+	Tassert(t, ans.Answer != "", "expected an answer")
+	Tassert(t, len(ans.Sources) == 1 && strings.HasSuffix(ans.Sources[0], "te-abstract.txt"), "unexpected sources: %v", ans.Sources)
+
+	// an empty question is a bad request
+	var errRes errorResponse
+	resp = post(t, srv, "/ask", askRequest{Question: " "}, &errRes)
+	Tassert(t, resp.StatusCode == http.StatusBadRequest, "unexpected status for empty question: %d", resp.StatusCode)
+	Tassert(t, errRes.Error != "", "expected an error message")
+	resp = post(t, srv, "/add", pathsRequest{}, &errRes)
+	Tassert(t, resp.StatusCode == http.StatusBadRequest, "unexpected status for no paths: %d", resp.StatusCode)
+
+	// an unknown model is not found
+	resp = post(t, srv, "/ask", askRequest{Question: "What?", Model: "no-such-model"}, &errRes)
+	Tassert(t, resp.StatusCode == http.StatusNotFound, "unexpected status for unknown model: %d", resp.StatusCode)
+
+	// forget the document
+	var forgotten pathsResponse
+	resp = post(t, srv, "/forget", pathsRequest{Paths: []string{"testdata/te-abstract.txt"}}, &forgotten)
+	Tassert(t, resp.StatusCode == http.StatusOK, "unexpected status forgetting document: %d", resp.StatusCode)
+	Tassert(t, len(grok.Documents) == 0, "expected no documents, got %d", len(grok.Documents))
+	Tassert(t, len(grok.Chunks) == 0, "expected no chunks, got %d", len(grok.Chunks))
+
+	// stats only accepts GET
+	resp = post(t, srv, "/stats", nil, &errRes)
+	Tassert(t, resp.StatusCode == http.StatusMethodNotAllowed, "unexpected status posting to stats: %d", resp.StatusCode)
+}
+
+// blockingChat is a client.ChatProvider that blocks until the
+// request's context is done.
+type blockingChat struct {
+	started, done chan struct{}
+}
+
+func (c *blockingChat) CompleteChat(model string, messages []client.ChatMsg) (client.Results, error) {
+	return c.Chat(context.Background(), model, messages, client.Options{})
+}
+
+func (c *blockingChat) Chat(ctx context.Context, model string, messages []client.ChatMsg, opts client.Options) (client.Results, error) {
+	close(c.started)
+	<-ctx.Done()
+	close(c.done)
+	return client.Results{}, ctx.Err()
+}
+
+// test that a client going away cancels its question
+func TestServerCancel(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	chat := &blockingChat{started: make(chan struct{}), done: make(chan struct{})}
+	grok.SetChatClient("openai", chat)
+	srv := httptest.NewServer(NewServer(grok))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-chat.started
+		cancel()
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/ask", strings.NewReader(`{"question": "Is anyone there?"}`))
+	Tassert(t, err == nil, "error creating request: %v", err)
+	_, err = http.DefaultClient.Do(req)
+	Tassert(t, err != nil, "expected the request to be canceled")
+	select {
+	case <-chat.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("chat request not canceled")
+	}
+}
+
+// test that questions only re-embed changed documents when asked to
+func TestServerRefresh(t *testing.T) {
+	dir := TmpTestDir()
+	fn := filepath.Join(dir, "notes.txt")
+	err := ioutil.WriteFile(fn, []byte("The build runs nightly.\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	srv := httptest.NewServer(NewServer(grok))
+	defer srv.Close()
+	hash := func() string {
+		chunks, err := grok.DocumentChunks("notes.txt")
+		Tassert(t, err == nil && len(chunks) == 1, "expected 1 chunk: %v, %v", chunks, err)
+		return chunks[0].Hash
+	}
+	old := hash()
+
+	// change the document after it was embedded
+	err = ioutil.WriteFile(fn, []byte("The build runs hourly.\n"), 0644)
+	Tassert(t, err == nil, "error writing doc: %v", err)
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(fn, later, later)
+	Tassert(t, err == nil, "error setting times: %v", err)
+	var ans Result
+	resp := post(t, srv, "/ask", askRequest{Question: "When does the build run?"}, &ans)
+	Tassert(t, resp.StatusCode == http.StatusOK, "unexpected status asking question: %d", resp.StatusCode)
+	Tassert(t, hash() == old, "expected the stale chunk to be left alone")
+	resp = post(t, srv, "/ask", askRequest{Question: "When does the build run?", Refresh: true}, &ans)
+	Tassert(t, resp.StatusCode == http.StatusOK, "unexpected status asking question: %d", resp.StatusCode)
+	Tassert(t, hash() != old, "expected the document to be re-embedded")
+}
+
+// test that an /add that fails partway saves and reports what it added
+func TestServerAddFailure(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	srv := httptest.NewServer(NewServer(grok))
+	defer srv.Close()
+
+	var errRes errorResponse
+	resp := post(t, srv, "/add", pathsRequest{Paths: []string{"testdata/te-abstract.txt", "testdata/nonexistent.txt", "testdata/te-full.txt"}}, &errRes)
+	Tassert(t, resp.StatusCode != http.StatusOK, "expected an error adding a missing document")
+	Tassert(t, errRes.Error != "", "expected an error message")
+	Tassert(t, len(errRes.Paths) == 1 && errRes.Paths[0] == "testdata/te-abstract.txt", "expected the added path, got %v", errRes.Paths)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	lock.Unlock()
+	Tassert(t, len(g.Documents) == 1, "expected the added document to be saved, got %v", g.ListDocuments())
+}
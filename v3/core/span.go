@@ -0,0 +1,100 @@
+package core
+
+import (
+	"fmt"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Span selects part of a document's file, so that only that part is
+// chunked and embedded, e.g. the API section of a large manual.  See
+// AddOpts.Span.
+type Span struct {
+	// Lines selects whole lines rather than bytes.
+	Lines bool `json:",omitempty"`
+	// Start and End are the first and last lines of the span,
+	// counting from 1, if Lines is set.  Otherwise they are the byte
+	// offsets of the start and end of the span, counting from 0,
+	// with End excluded.
+	Start, End int
+}
+
+// ParseSpan parses a span given as "START-END", e.g. "10-20", in
+// lines if lines is true and in bytes otherwise.
+func ParseSpan(s string, lines bool) (span *Span, err error) {
+	span = &Span{Lines: lines}
+	var extra string
+	n, _ := fmt.Sscanf(s, "%d-%d%s", &span.Start, &span.End, &extra)
+	if n != 2 {
+		return nil, fmt.Errorf("bad span %q, want START-END", s)
+	}
+	err = span.check()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// String returns a description of s, e.g. "lines 10-20".
+func (s *Span) String() string {
+	if s.Lines {
+		return Spf("lines %d-%d", s.Start, s.End)
+	}
+	return Spf("bytes %d-%d", s.Start, s.End)
+}
+
+// check returns an error if s can't select anything from any file.
+func (s *Span) check() error {
+	switch {
+	case s.Lines && s.Start < 1:
+		return fmt.Errorf("%s: lines count from 1", s)
+	case s.Start < 0:
+		return fmt.Errorf("%s: start must not be negative", s)
+	case s.Lines && s.End < s.Start, !s.Lines && s.End <= s.Start:
+		return fmt.Errorf("%s: end is before start", s)
+	}
+	return nil
+}
+
+// slice returns the part of buf selected by s, or an error if s
+// isn't within buf.
+func (s *Span) slice(buf []byte) (out []byte, err error) {
+	err = s.check()
+	if err != nil {
+		return
+	}
+	if !s.Lines {
+		if s.End > len(buf) {
+			return nil, fmt.Errorf("%s: out of bounds, the file has %d bytes", s, len(buf))
+		}
+		return buf[s.Start:s.End], nil
+	}
+	// find where each line starts
+	starts := []int{0}
+	for i, b := range buf {
+		if b == '\n' && i+1 < len(buf) {
+			starts = append(starts, i+1)
+		}
+	}
+	lines := len(starts)
+	if len(buf) == 0 {
+		lines = 0
+	}
+	if s.End > lines {
+		return nil, fmt.Errorf("%s: out of bounds, the file has %d lines", s, lines)
+	}
+	end := len(buf)
+	if s.End < lines {
+		end = starts[s.End]
+	}
+	return buf[starts[s.Start-1]:end], nil
+}
+
+// firstLine returns the line number of the first line of s, or 1 if
+// s is nil or selects bytes.
+func (s *Span) firstLine() int {
+	if s == nil || !s.Lines {
+		return 1
+	}
+	return s.Start
+}
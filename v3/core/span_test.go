@@ -0,0 +1,49 @@
+package core
+
+import (
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestSpanSlice(t *testing.T) {
+	buf := []byte("one\ntwo\nthree\nfour")
+	cases := []struct {
+		span string
+		want string
+	}{
+		{"1-1", "one\n"},
+		{"2-3", "two\nthree\n"},
+		{"3-4", "three\nfour"},
+		{"4-5", ""},
+		{"0-2", ""},
+		{"3-2", ""},
+	}
+	for _, c := range cases {
+		span, err := ParseSpan(c.span, true)
+		if c.want == "" && err != nil {
+			continue
+		}
+		Tassert(t, err == nil, "error parsing %q: %v", c.span, err)
+		got, err := span.slice(buf)
+		if c.want == "" {
+			Tassert(t, err != nil, "expected error for lines %s, got %q", c.span, got)
+			continue
+		}
+		Tassert(t, err == nil, "error slicing lines %s: %v", c.span, err)
+		Tassert(t, string(got) == c.want, "lines %s: got %q, want %q", c.span, got, c.want)
+	}
+
+	span, err := ParseSpan("4-7", false)
+	Tassert(t, err == nil, "error parsing span: %v", err)
+	got, err := span.slice(buf)
+	Tassert(t, err == nil && string(got) == "two", "unexpected slice %q, %v", got, err)
+	span, err = ParseSpan("4-100", false)
+	Tassert(t, err == nil, "error parsing span: %v", err)
+	_, err = span.slice(buf)
+	Tassert(t, err != nil, "expected error for out of bounds bytes")
+	for _, bad := range []string{"", "10", "a-b", "1-2x", "5-5"} {
+		_, err = ParseSpan(bad, false)
+		Tassert(t, err != nil, "expected error parsing %q", bad)
+	}
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// streamSize is the size in bytes above which plain text documents
+// are chunked as they are read rather than read whole; see
+// streamable.
+const streamSize = 1 << 20
+
+// embedGroupSize is the most new chunks of a document whose texts are
+// held in memory at once while they are embedded.
+const embedGroupSize = 1000
+
+// streamBytesPerToken bounds the bytes of a paragraph held in memory
+// while streaming, as a multiple of the chunk token limit.  Longer
+// paragraphs, such as log files with no blank lines, are cut at a line
+// end and split further as usual.
+const streamBytesPerToken = 8
+
+// streamable returns true if doc is a plain text file of at least
+// streamSize bytes that is split into paragraphs, with no settings
+// that need its whole text at once, so that streamChunks can chunk
+// it.
+func (g *Grokker) streamable(doc *Document) bool {
+	if doc.Synthetic || doc.Span != nil || isDocx(doc) {
+		return false
+	}
+	if _, ok := registeredChunker(doc); ok || g.Chunking != "" {
+		return false
+	}
+	if g.minChunkTokens() > 0 || (g.EmbedHeadings && isMarkdown(doc)) {
+		return false
+	}
+	fi, err := os.Stat(g.absPath(doc))
+	return err == nil && fi.Size() >= streamSize
+}
+
+// streamChunks returns the chunks of a streamable document, split as
+// chunksFromDoc would split them, but reads the file a paragraph at a
+// time so that memory use doesn't grow with its size.  The chunks'
+// texts are not kept; they are read from the file when needed.
+func (g *Grokker) streamChunks(doc *Document) (chunks []*Chunk, err error) {
+	defer Return(&err)
+	fh, err := os.Open(g.absPath(doc))
+	Ck(err)
+	defer fh.Close()
+	limit := streamBytesPerToken * g.chunkTokens()
+	r := bufio.NewReaderSize(fh, 64<<10)
+	var para []byte
+	offset := 0
+	line := 1
+	// emit adds the first n bytes of para as a chunk
+	emit := func(n int) {
+		chunk := newChunk(doc, offset, n, string(para[:n]))
+		chunk.setLines(line, chunk.text)
+		line += bytes.Count(para[:n], []byte("\n"))
+		pieces := []*Chunk{chunk}
+		if g.embeddingOverflow() == OverflowSplit {
+			pieces, err = chunk.splitChunk(g, g.chunkTokens())
+			Ck(err)
+		}
+		for _, piece := range pieces {
+			piece.text = ""
+			chunks = append(chunks, piece)
+		}
+		offset += n
+		para = append(para[:0], para[n:]...)
+	}
+	for {
+		next, rerr := r.ReadSlice('\n')
+		para = append(para, next...)
+		switch {
+		case bytes.HasSuffix(para, []byte("\n\n")) && (len(para) > 2 || offset == 0):
+			// end of a paragraph, as in splitIntoChunks
+			emit(len(para))
+		case len(para) >= limit:
+			emit(cutPoint(para))
+		}
+		if errors.Is(rerr, io.EOF) {
+			break
+		}
+		if errors.Is(rerr, bufio.ErrBufferFull) {
+			continue
+		}
+		Ck(rerr)
+	}
+	if len(para) > 0 {
+		emit(len(para))
+	}
+	return
+}
+
+// cutPoint returns where to cut a paragraph that has grown too long:
+// after its last newline, or failing that, after its last complete
+// UTF-8 character.
+func cutPoint(para []byte) int {
+	if i := bytes.LastIndexByte(para, '\n'); i >= 0 {
+		return i + 1
+	}
+	i := len(para) - 1
+	for i > 0 && !utf8.RuneStart(para[i]) {
+		i--
+	}
+	if i > 0 && !utf8.FullRune(para[i:]) {
+		return i
+	}
+	return len(para)
+}
+
+// readChunk reads only the bytes a chunk covers from its document's
+// file, rather than the whole file, so that chunks of large documents
+// are cheap to read.  ok is false if the document's content isn't
+// simply its file's bytes, e.g. for Word documents, in which case
+// the caller must use docSpan.  buf is nil if the file has been
+// removed, and short if the file has shrunk.
+func (g *Grokker) readChunk(c *Chunk) (buf []byte, ok bool, err error) {
+	doc := c.Document
+	if doc.Synthetic || isDocx(doc) || (doc.Span != nil && doc.Span.Lines) {
+		return
+	}
+	ok = true
+	fh, err := os.Open(g.absPath(doc))
+	if os.IsNotExist(err) {
+		return nil, ok, nil
+	}
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	offset := int64(c.Offset)
+	if doc.Span != nil {
+		offset += int64(doc.Span.Start)
+	}
+	buf = make([]byte, c.Length)
+	n, err := fh.ReadAt(buf, offset)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	buf = buf[:n]
+	return
+}
+
+// readHead returns up to the first n bytes of the file at path.
+func readHead(path string, n int) (buf []byte, err error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	buf = make([]byte, n)
+	n, err = io.ReadFull(fh, buf)
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		err = nil
+	}
+	buf = buf[:n]
+	return
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// bigText returns text of at least size bytes made of paragraphs of
+// varying length, some separated by runs of blank lines.
+func bigText(size int) string {
+	var sb strings.Builder
+	for i := 0; sb.Len() < size; i++ {
+		sb.WriteString(Spf("Paragraph %d says", i))
+		for j := 0; j < i%50; j++ {
+			sb.WriteString(Spf(" word%d", j))
+		}
+		sb.WriteString(".\n\n")
+		if i%7 == 0 {
+			sb.WriteString("\n\n")
+		}
+	}
+	return sb.String()
+}
+
+func TestStreamChunks(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.MaxFileSize = -1
+	txt := bigText(streamSize)
+	fn := filepath.Join(dir, "big.txt")
+	err = ioutil.WriteFile(fn, []byte(txt), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	doc := &Document{RelPath: "big.txt"}
+	Tassert(t, grok.streamable(doc), "expected a large text file to be streamable")
+
+	// streaming finds the same chunks as reading the whole file
+	streamed, err := grok.streamChunks(doc)
+	Tassert(t, err == nil, "error streaming chunks: %v", err)
+	whole, err := grok.chunksFromString(doc, txt, grok.chunkTokens())
+	Tassert(t, err == nil, "error chunking: %v", err)
+	Tassert(t, len(streamed) == len(whole), "expected %d chunks, got %d", len(whole), len(streamed))
+	for i := range whole {
+		a, b := whole[i], streamed[i]
+		Tassert(t, a.Offset == b.Offset && a.Length == b.Length && a.Hash == b.Hash, "chunk %d differs: %d+%d vs %d+%d", i, a.Offset, a.Length, b.Offset, b.Length)
+		Tassert(t, b.text == "", "expected streamed chunk text to be dropped")
+	}
+
+	// paragraphs too long to hold in memory are cut at line ends
+	var sb strings.Builder
+	for i := 0; sb.Len() < streamSize; i++ {
+		sb.WriteString(Spf("2026-10-15 12:00:00 request %d served\n", i))
+	}
+	log := sb.String()
+	fn = filepath.Join(dir, "big.log")
+	err = ioutil.WriteFile(fn, []byte(log), 0644)
+	Tassert(t, err == nil, "error writing file: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chunks, err := grok.DocumentChunks("big.log")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	Tassert(t, len(chunks) > 1, "expected the log to be split, got %d chunks", len(chunks))
+	var got strings.Builder
+	for _, chunk := range chunks {
+		Tassert(t, chunk.Embedding != nil, "expected an embedding at offset %d", chunk.Offset)
+		tc, err := chunk.tokenCount(grok)
+		Tassert(t, err == nil, "error counting tokens: %v", err)
+		Tassert(t, tc <= grok.chunkTokens(), "chunk at offset %d has %d tokens", chunk.Offset, tc)
+		text, err := grok.ChunkText(chunk)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		got.WriteString(text)
+	}
+	Tassert(t, got.String() == log, "expected the chunks to cover the log")
+}
+
+func TestCutPoint(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int
+	}{
+		{"one\ntwo", 4},
+		{"no newline", 10},
+		{"cut 日本", 10},
+		{"cut 日\xe6\x9c", 7},
+	}
+	for _, c := range cases {
+		got := cutPoint([]byte(c.in))
+		Tassert(t, got == c.want, "cutPoint(%q) = %d, want %d", c.in, got, c.want)
+	}
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Subset returns a new in-memory database holding copies of the
+// documents for which filter returns true, and their chunks and
+// embeddings, with the same settings as g.  Nothing is re-embedded.
+// The copies share nothing with g, so either database can be changed
+// without affecting the other.  filter must not modify the documents
+// it is given.
+//
+// The new database has no file; use SaveAs to write it.  Document
+// paths stay relative to the directory holding the database, so
+// copy the documents along with it if they are needed for refreshing
+// or answering questions.
+func (g *Grokker) Subset(filter func(*Document) bool) (sub *Grokker, err error) {
+	defer Return(&err)
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	// copy the settings by way of the db header, which also
+	// deep-copies the projection
+	hdr, err := g.header()
+	Ck(err)
+	sub = &Grokker{}
+	err = json.Unmarshal(hdr, sub)
+	Ck(err)
+	sub.Root = g.Root
+	sub.embedder = g.embedder
+	for model, e := range g.altEmbedders {
+		sub.SetModelEmbedder(model, e)
+	}
+	for name, c := range g.chatClients {
+		sub.SetChatClient(name, c)
+	}
+	sub.ChatOptions = g.ChatOptions
+	err = sub.Setup(g.Model)
+	Ck(err)
+	// copy the matching documents
+	docs := make(map[string]*Document)
+	for _, doc := range g.Documents {
+		if !filter(doc) {
+			continue
+		}
+		newDoc := *doc
+		if doc.Span != nil {
+			span := *doc.Span
+			newDoc.Span = &span
+		}
+		docs[doc.RelPath] = &newDoc
+		sub.Documents = append(sub.Documents, &newDoc)
+	}
+	// copy their chunks, pointing them at the copied documents
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+	for _, chunk := range g.Chunks {
+		doc, ok := docs[chunk.Document.RelPath]
+		if !ok {
+			continue
+		}
+		sub.Chunks = append(sub.Chunks, &Chunk{
+			Document:   doc,
+			Offset:     chunk.Offset,
+			Length:     chunk.Length,
+			Line:       chunk.Line,
+			EndLine:    chunk.EndLine,
+			Tokens:     chunk.Tokens,
+			Hash:       chunk.Hash,
+			TextHash:   chunk.TextHash,
+			Embedding:  append([]float64(nil), chunk.Embedding...),
+			Embeddings: copyEmbeddings(chunk.Embeddings),
+		})
+	}
+	return
+}
+
+// SaveAs saves the database to grokpath, which becomes the path used
+// by later calls to Save.  It is mainly for databases made by Subset,
+// which have no path yet.
+func (g *Grokker) SaveAs(grokpath string) (err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if grokpath == "" {
+		err = fmt.Errorf("empty db path")
+		return
+	}
+	g.grokpath = grokpath
+	// write the whole db rather than journaling changes to it
+	g.savedHeader = nil
+	err = g.save()
+	Ck(err)
+	return
+}
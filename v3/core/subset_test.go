@@ -0,0 +1,64 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestSubset(t *testing.T) {
+	dir := TmpTestDir()
+	for _, name := range []string{"public.txt", "private.txt"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte("notes about "+name+"\n"), 0644)
+		Tassert(t, err == nil, "error writing doc: %v", err)
+	}
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	// add only the first line of public.txt
+	err = grok.AddDocumentWithOpts(filepath.Join(dir, "public.txt"), AddOpts{Span: &Span{Lines: true, Start: 1, End: 1}})
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	err = grok.AddDocument(filepath.Join(dir, "private.txt"))
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	grok.ContextChunks = 7
+
+	sub, err := grok.Subset(func(doc *Document) bool {
+		return strings.HasPrefix(doc.RelPath, "public")
+	})
+	Tassert(t, err == nil, "error making subset: %v", err)
+	paths := sub.ListDocuments()
+	Tassert(t, len(paths) == 1 && paths[0] == "public.txt", "unexpected documents %v", paths)
+	Tassert(t, len(sub.Chunks) == 1, "expected 1 chunk, got %d", len(sub.Chunks))
+	Tassert(t, sub.Chunks[0].Document == sub.Documents[0], "expected chunk to point at the copied document")
+	Tassert(t, sub.ContextChunks == 7, "expected settings to be copied, got %d", sub.ContextChunks)
+
+	// the copies are independent
+	sub.Chunks[0].Embedding[0] += 1
+	err = sub.SetDocumentWeight("public.txt", 2)
+	Tassert(t, err == nil, "error setting weight: %v", err)
+	var orig *Chunk
+	for _, chunk := range grok.Chunks {
+		if chunk.Document.RelPath == "public.txt" {
+			orig = chunk
+		}
+	}
+	Tassert(t, orig.Embedding[0] != sub.Chunks[0].Embedding[0], "expected embeddings to be copied")
+	sub.Documents[0].Span.End = 2
+	Tassert(t, orig.Document.Span.End == 1, "expected the span to be copied, got %v", orig.Document.Span)
+	weight, err := grok.DocumentWeight("public.txt")
+	Tassert(t, err == nil && weight == 1, "expected original weight to be unchanged, got %v, %v", weight, err)
+
+	// the subset has no file until SaveAs
+	err = sub.Save()
+	Tassert(t, err != nil, "expected error saving subset without a path")
+	outdir := TmpTestDir()
+	err = sub.SaveAs(filepath.Join(outdir, ".grok"))
+	Tassert(t, err == nil, "error saving subset: %v", err)
+	loaded, _, _, _, _, err := LoadFrom(filepath.Join(outdir, ".grok"), "", true)
+	Tassert(t, err == nil, "error loading subset: %v", err)
+	defer loaded.Close()
+	Tassert(t, len(loaded.Documents) == 1 && len(loaded.Chunks) == 1, "unexpected saved subset: %d docs, %d chunks", len(loaded.Documents), len(loaded.Chunks))
+	Tassert(t, len(grok.Documents) == 2, "expected original to keep its documents")
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+var SuggestPrompt = `
+The context contains passages sampled from across a knowledge base.
+Suggest %d questions that a newcomer could usefully ask and that the
+knowledge base can answer.  Cover as many different topics as you
+can.  Respond with one question per line and nothing else.
+`
+
+// suggestSamples is the most chunks sampled by SuggestQuestions.
+const suggestSamples = 20
+
+// SuggestQuestions samples chunks from across the knowledge base and
+// asks the model to propose n questions the knowledge base can
+// answer, to help users explore an unfamiliar corpus.  Chunks are
+// sampled at even intervals so that every part of the knowledge base
+// is represented.
+func (g *Grokker) SuggestQuestions(n int) (questions []string, err error) {
+	defer Return(&err)
+	if n < 1 {
+		err = fmt.Errorf("n must be at least 1, got %d", n)
+		return
+	}
+	var chunks []*Chunk
+	g.mu.RLock()
+	for _, chunk := range g.Chunks {
+		if chunk.Document != nil {
+			chunks = append(chunks, chunk)
+		}
+	}
+	g.mu.RUnlock()
+	if len(chunks) == 0 {
+		err = fmt.Errorf("the knowledge base is empty")
+		return
+	}
+	samples := suggestSamples
+	if samples > len(chunks) {
+		samples = len(chunks)
+	}
+	perChunk := g.contextBudget(g.ModelObj.TokenLimit) / samples
+	var context []string
+	for i := 0; i < samples; i++ {
+		chunk := chunks[i*len(chunks)/samples]
+		text, err := g.chunkText(chunk, true, false)
+		Ck(err)
+		if text == "" {
+			// document has been removed
+			continue
+		}
+		text, _, err = g.truncateTokens(text, perChunk)
+		Ck(err)
+		context = append(context, text)
+	}
+	prompt := Spf(SuggestPrompt, n)
+	out, err := g.generate(g.Model, SysMsgChat, prompt, strings.Join(context, "\n"))
+	Ck(err)
+	questions = parseQuestions(out)
+	if len(questions) > n {
+		questions = questions[:n]
+	}
+	return
+}
+
+// listMarker matches the numbering or bullet at the start of a list
+// item.
+var listMarker = regexp.MustCompile(`^\s*(\d+[.)]|[-*•])\s*`)
+
+// parseQuestions returns the non-empty lines of a reply with any list
+// markers removed.
+func parseQuestions(reply string) (questions []string) {
+	for _, line := range strings.Split(reply, "\n") {
+		line = strings.TrimSpace(listMarker.ReplaceAllString(line, ""))
+		if line == "" {
+			continue
+		}
+		questions = append(questions, line)
+	}
+	return
+}
@@ -0,0 +1,25 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	oai "github.com/stevegt/go-openai"
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/mock"
+)
+
+func TestSuggestQuestions(t *testing.T) {
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	_, err = grok.SuggestQuestions(3)
+	Tassert(t, err != nil, "expected error for empty knowledge base")
+	err = grok.AddDocument("testdata/te-abstract.txt")
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chat := mock.NewClient()
+	chat.SetResponse(oai.GPT4, "1. What is congruence?\n2) Why does order matter?\n\n- How do I converge machines?\n")
+	grok.SetChatClient("openai", chat)
+	questions, err := grok.SuggestQuestions(2)
+	Tassert(t, err == nil, "error suggesting questions: %v", err)
+	Tassert(t, strings.Join(questions, "|") == "What is congruence?|Why does order matter?", "unexpected questions %q", questions)
+}
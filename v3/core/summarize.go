@@ -0,0 +1,176 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+var SummaryPartPrompt = `
+Summarize the text found in the context.  The summary will later be
+combined with summaries of the other parts of the same document, so
+keep every important fact, name, and number, and add nothing else.
+`
+
+var SummaryPrompt = `
+Write a coherent summary of the text found in the context in about %d
+words.  Use a single paragraph unless the text clearly needs more.
+Add nothing else.
+`
+
+var SummaryAllPrompt = `
+The context contains summaries of each of the documents in a
+repository.  Write a coherent overview of the whole repository in
+about %d words, describing what the documents are about as a whole and
+how they relate to each other.  Add nothing else.
+`
+
+// DefaultSummaryWords is the default target length of a summary.
+const DefaultSummaryWords = 150
+
+// SummarizeOpts contains options for Summarize and SummarizeAll.
+type SummarizeOpts struct {
+	// ModelName is the chat model used to generate the summary.  If
+	// empty, the current default model is used.
+	ModelName string
+	// Words is the target length of the summary in words.  Zero
+	// means DefaultSummaryWords.
+	Words int
+}
+
+// Summarize returns a summary of the document at path.  The document
+// does not need to be in the knowledge base.  Long documents are
+// summarized map-reduce style:  the text is split into chunks that
+// fit in the model's context, each chunk is summarized, and the
+// partial summaries are recursively summarized until they are short
+// enough to produce the final summary.
+func (g *Grokker) Summarize(path string, opts SummarizeOpts) (summary string, err error) {
+	defer Return(&err)
+	buf, err := g.readFile(path)
+	Ck(err)
+	summary, err = g.summarizeText(string(buf), opts)
+	Ck(err)
+	return
+}
+
+// DocSummary is the summary of a single document.
+type DocSummary struct {
+	// RelPath is the path of the document relative to g.Root.
+	RelPath string
+	// Summary is the summary of the document.
+	Summary string
+}
+
+// SummarizeAll returns a single summary spanning every document in the
+// knowledge base, along with the intermediate per-document summaries
+// it was built from.  Each document is summarized with Summarize,
+// then the per-document summaries are combined, recursively
+// summarizing them if they don't fit in the model's context.
+// Documents that are missing from disk or are empty are skipped.
+func (g *Grokker) SummarizeAll(opts SummarizeOpts) (summary string, docSummaries []DocSummary, err error) {
+	defer Return(&err)
+	modelName := opts.ModelName
+	if modelName == "" {
+		modelName = g.Model
+	}
+	words := opts.Words
+	if words <= 0 {
+		words = DefaultSummaryWords
+	}
+	g.mu.RLock()
+	docs := append([]*Document{}, g.Documents...)
+	g.mu.RUnlock()
+	var combined string
+	for _, doc := range docs {
+		buf, err := g.readDocument(doc)
+		if os.IsNotExist(err) {
+			Debug("SummarizeAll: document %q not found", doc.RelPath)
+			continue
+		}
+		Ck(err)
+		if strings.TrimSpace(string(buf)) == "" {
+			continue
+		}
+		Fpf(os.Stderr, "summarizing %s\n", doc.RelPath)
+		docSummary, err := g.summarizeText(string(buf), opts)
+		Ck(err)
+		docSummaries = append(docSummaries, DocSummary{RelPath: doc.RelPath, Summary: docSummary})
+		combined += Spf("from %s:\n%s\n\n", doc.RelPath, docSummary)
+	}
+	if len(docSummaries) == 0 {
+		err = fmt.Errorf("no documents to summarize")
+		return
+	}
+	combined, err = g.fitSummaryInput(modelName, combined)
+	Ck(err)
+	summary, err = g.generate(modelName, SysMsgChat, Spf(SummaryAllPrompt, words), combined)
+	Ck(err)
+	return
+}
+
+// summarizeText summarizes txt using the target length in opts.
+func (g *Grokker) summarizeText(txt string, opts SummarizeOpts) (summary string, err error) {
+	defer Return(&err)
+	modelName := opts.ModelName
+	if modelName == "" {
+		modelName = g.Model
+	}
+	words := opts.Words
+	if words <= 0 {
+		words = DefaultSummaryWords
+	}
+	if strings.TrimSpace(txt) == "" {
+		err = fmt.Errorf("nothing to summarize")
+		return
+	}
+	txt, err = g.fitSummaryInput(modelName, txt)
+	Ck(err)
+	summary, err = g.generate(modelName, SysMsgChat, Spf(SummaryPrompt, words), txt)
+	Ck(err)
+	return
+}
+
+// fitSummaryInput shrinks txt with shrinkText until it takes no more
+// than half the token limit of the named model, leaving the rest for
+// the prompt and the summary.
+func (g *Grokker) fitSummaryInput(modelName, txt string) (out string, err error) {
+	defer Return(&err)
+	_, m, err := g.models.FindModel(modelName)
+	Ck(err)
+	maxTokens := int(float64(m.TokenLimit) * .5)
+	return g.shrinkText(modelName, txt, maxTokens)
+}
+
+// shrinkText recursively summarizes txt until it is no longer than
+// maxTokens.  Text that is already short enough is returned as-is.
+func (g *Grokker) shrinkText(modelName, txt string, maxTokens int) (out string, err error) {
+	defer Return(&err)
+	tc, err := g.TokenCount(txt)
+	Ck(err)
+	if tc <= maxTokens {
+		out = txt
+		return
+	}
+	Debug("shrinkText: %d tokens, limit %d", tc, maxTokens)
+	chunks, err := g.chunksFromString(nil, txt, maxTokens)
+	Ck(err)
+	var parts []string
+	for i, chunk := range chunks {
+		Debug("shrinkText: summarizing chunk %d of %d", i+1, len(chunks))
+		resp, err := g.generate(modelName, SysMsgChat, SummaryPartPrompt, chunk.text)
+		Ck(err)
+		parts = append(parts, strings.TrimSpace(resp))
+	}
+	out = strings.Join(parts, "\n\n")
+	// make sure we're making progress, otherwise we'd recurse forever
+	outTc, err := g.TokenCount(out)
+	Ck(err)
+	if outTc >= tc {
+		err = fmt.Errorf("summary of %d tokens did not shrink, got %d tokens", tc, outTc)
+		return
+	}
+	// recurse
+	return g.shrinkText(modelName, out, maxTokens)
+}
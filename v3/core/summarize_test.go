@@ -0,0 +1,74 @@
+package core
+
+import (
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestSummarize(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.models.AddMockModel("mock", 4096)
+
+	// te-full.txt is longer than the model's token limit, so it
+	// must be summarized in parts first
+	opts := SummarizeOpts{ModelName: "mock", Words: 50}
+	summary, err := grok.Summarize("testdata/te-full.txt", opts)
+	Tassert(t, err == nil, "error summarizing: %v", err)
+	Tassert(t, summary == "default mock response", "unexpected summary: %q", summary)
+
+	// empty documents can't be summarized
+	_, err = grok.Summarize("/dev/null", opts)
+	Tassert(t, err != nil, "expected error summarizing empty document")
+}
+
+func TestSummarizeAll(t *testing.T) {
+	// create a new Grokker database
+	grok, err := Init(TmpTestDir(), "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.models.AddMockModel("mock", 4096)
+	opts := SummarizeOpts{ModelName: "mock"}
+
+	// an empty knowledge base can't be summarized
+	_, _, err = grok.SummarizeAll(opts)
+	Tassert(t, err != nil, "expected error summarizing empty knowledge base")
+
+	// add documents without embedding them; missing documents are
+	// skipped
+	grok.Root = "testdata"
+	grok.Documents = []*Document{
+		{RelPath: "te-abstract.txt"},
+		{RelPath: "te-full.txt"},
+		{RelPath: "missing.txt"},
+	}
+	summary, docSummaries, err := grok.SummarizeAll(opts)
+	Tassert(t, err == nil, "error summarizing: %v", err)
+	Tassert(t, summary == "default mock response", "unexpected summary: %q", summary)
+	Tassert(t, len(docSummaries) == 2, "expected 2 document summaries, got %d", len(docSummaries))
+	Tassert(t, docSummaries[1].RelPath == "te-full.txt", "unexpected document: %q", docSummaries[1].RelPath)
+}
+
+func TestSummarizeModelLimit(t *testing.T) {
+	// the default model has plenty of room, but the selected model
+	// doesn't, so the text must be shrunk to fit the selected one
+	grok, err := Init(TmpTestDir(), "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	grok.models.AddMockModel("small", 200)
+	chat := &callCountingChat{}
+	grok.SetChatClient("mock", chat)
+
+	opts := SummarizeOpts{ModelName: "small", Words: 50}
+	summary, err := grok.Summarize("testdata/te-abstract.txt", opts)
+	Tassert(t, err == nil, "error summarizing: %v", err)
+	Tassert(t, summary == "- change things", "unexpected summary: %q", summary)
+	Tassert(t, chat.calls > 1, "expected text to be shrunk first, got %d calls", chat.calls)
+
+	// the default model fits the text in one call
+	chat.calls = 0
+	grok.SetChatClient("openai", chat)
+	_, err = grok.Summarize("testdata/te-abstract.txt", SummarizeOpts{Words: 50})
+	Tassert(t, err == nil, "error summarizing: %v", err)
+	Tassert(t, chat.calls == 1, "expected 1 call, got %d", chat.calls)
+}
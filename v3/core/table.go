@@ -0,0 +1,103 @@
+package core
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// maxTableRows is the most data rows put in one chunk of a CSV or
+// TSV document.  Smaller windows retrieve more precisely; the token
+// limit may make them smaller still.
+const maxTableRows = 20
+
+// tableChunker chunks CSV and TSV documents; see Chunk.
+type tableChunker struct {
+	delimiter rune
+}
+
+// tableDelimiter returns the field delimiter of a document chunked by
+// a tableChunker, or 0 if doc is not tabular.
+func tableDelimiter(doc *Document) rune {
+	if doc == nil {
+		return 0
+	}
+	c, ok := chunkerFor(doc).(tableChunker)
+	if !ok {
+		return 0
+	}
+	return c.delimiter
+}
+
+// tableHeader returns the header row of a tabular document with the
+// given delimiter, including its trailing newline.
+func tableHeader(txt string, delimiter rune) string {
+	r := csv.NewReader(strings.NewReader(txt))
+	r.Comma = delimiter
+	r.LazyQuotes = true
+	_, err := r.Read()
+	if err != nil {
+		return ""
+	}
+	return txt[:r.InputOffset()]
+}
+
+// Chunk splits a CSV or TSV document into chunks of whole rows.
+// Each chunk after the first covers only data rows; chunkText repeats
+// the header row in front of them so that every chunk is embedded and
+// retrieved with its column names.  Rows are found with encoding/csv
+// so that quoted fields may contain newlines.  If the document can't
+// be parsed, it falls back to splitting on blank lines.
+func (c tableChunker) Chunk(doc *Document, txt string, tokenLimit int) (chunks []string, err error) {
+	defer Return(&err)
+	r := csv.NewReader(strings.NewReader(txt))
+	r.Comma = c.delimiter
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	// find the end offset of each row
+	var ends []int
+	for {
+		_, err = r.Read()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			Debug("can't parse table, splitting on blank lines: %v", err)
+			return ParagraphChunker.Chunk(doc, txt, tokenLimit)
+		}
+		ends = append(ends, int(r.InputOffset()))
+	}
+	if len(ends) < 2 {
+		return ParagraphChunker.Chunk(doc, txt, tokenLimit)
+	}
+	countTokens := func(text string) int {
+		_, tokens, err := Tokenizer.Encode(text)
+		Ck(err)
+		return len(tokens)
+	}
+	headerTokens := countTokens(txt[:ends[0]])
+	// the first chunk includes the header itself
+	start := 0
+	tokens := 0
+	rows := 0
+	for i := 1; i < len(ends); i++ {
+		rowStart := ends[i-1]
+		rowTokens := countTokens(txt[rowStart:ends[i]])
+		full := rows >= maxTableRows || headerTokens+tokens+rowTokens >= tokenLimit
+		if rows > 0 && full {
+			chunks = append(chunks, txt[start:rowStart])
+			start = rowStart
+			tokens = 0
+			rows = 0
+		}
+		tokens += rowTokens
+		rows++
+	}
+	if start < len(txt) {
+		chunks = append(chunks, txt[start:])
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestSplitTable(t *testing.T) {
+	dir := TmpTestDir()
+	header := "region,product,total\n"
+	var rows []string
+	for i := 0; i < 50; i++ {
+		rows = append(rows, fmt.Sprintf("north,widget %d,%d\n", i, i*10))
+	}
+	// quoted fields may span lines
+	rows[7] = "south,\"multi\nline\",70\n"
+	txt := header + strings.Join(rows, "")
+	fn := filepath.Join(dir, "sales.CSV")
+	err := ioutil.WriteFile(fn, []byte(txt), 0644)
+	Tassert(t, err == nil, "error writing csv: %v", err)
+
+	grok, err := Init(dir, "gpt-3.5-turbo")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	err = grok.AddDocument(fn)
+	Tassert(t, err == nil, "error adding doc: %v", err)
+	chunks, err := grok.DocumentChunks("sales.CSV")
+	Tassert(t, err == nil, "error getting chunks: %v", err)
+	Tassert(t, len(chunks) == 3, "expected 3 chunks of at most %d rows, got %d", maxTableRows, len(chunks))
+	var got string
+	for i, chunk := range chunks {
+		text, err := grok.ChunkText(chunk)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		Tassert(t, strings.HasPrefix(text, header), "chunk %d doesn't start with the header: %q", i, text)
+		if i > 0 {
+			text = strings.TrimPrefix(text, header)
+		}
+		got += text
+		// line numbers start with the header
+		text, err = grok.chunkText(chunk, false, true)
+		Tassert(t, err == nil, "error getting chunk text: %v", err)
+		Tassert(t, strings.HasPrefix(text, "1: region"), "chunk %d doesn't start with a numbered header: %q", i, text)
+	}
+	Tassert(t, got == txt, "chunks don't cover the table: %q", got)
+	Tassert(t, strings.Contains(got, "\"multi\nline\""), "quoted newline was split")
+}
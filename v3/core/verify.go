@@ -0,0 +1,253 @@
+package core
+
+import (
+	"math"
+	"os"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Kinds of Problem found by Verify.
+const (
+	// ProblemOrphanChunk is a chunk whose document isn't in the db.
+	// Repair removes it.
+	ProblemOrphanChunk = "orphan-chunk"
+	// ProblemDuplicateDocument is a document listed more than once.
+	// Repair keeps the first entry; the entries share their chunks.
+	ProblemDuplicateDocument = "duplicate-document"
+	// ProblemBadEmbedding is a chunk whose embedding has the wrong
+	// number of dimensions or contains NaN or infinite values.
+	// Repair embeds the chunk again.
+	ProblemBadEmbedding = "bad-embedding"
+	// ProblemSettings is a db setting that is inconsistent with this
+	// version of grokker or with the db's other settings, e.g. an
+	// unknown model.  Repair leaves these alone, since fixing them
+	// means choosing a new setting.
+	ProblemSettings = "settings"
+)
+
+// Problem is an inconsistency in the db found by Verify.
+type Problem struct {
+	// Kind is one of the Problem* constants.
+	Kind string `json:"kind"`
+	// Path is the document concerned, if any.
+	Path string `json:"path,omitempty"`
+	// Detail describes what was found.
+	Detail string `json:"detail"`
+	// Fixable is true if Repair can fix the problem without losing
+	// anything.
+	Fixable bool `json:"fixable"`
+	// Fixed is true if Repair fixed the problem.
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+func (p Problem) String() string {
+	s := p.Kind
+	if p.Path != "" {
+		s += " " + p.Path
+	}
+	s += ": " + p.Detail
+	if p.Fixed {
+		s += " (fixed)"
+	}
+	return s
+}
+
+// Verify checks that the db is consistent:  that every chunk belongs
+// to a document in the db, that no document is listed twice, that
+// every embedding has the same number of dimensions and holds only
+// finite values, and that the db's version and model settings make
+// sense.  It returns the problems found, in that order; an empty list
+// means the db is consistent.  Repair fixes those that can be fixed
+// safely.
+func (g *Grokker) Verify() (problems []Problem, err error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	problems = g.verify()
+	return
+}
+
+// verify implements Verify.  The caller must hold g.mu.
+func (g *Grokker) verify() (problems []Problem) {
+	docs := make(map[string]bool)
+	for _, doc := range g.Documents {
+		docs[doc.RelPath] = true
+	}
+	for _, chunk := range g.Chunks {
+		if !docs[chunk.Document.RelPath] {
+			problems = append(problems, Problem{
+				Kind:    ProblemOrphanChunk,
+				Path:    chunk.Document.RelPath,
+				Detail:  Spf("chunk at offset %d has no document", chunk.Offset),
+				Fixable: true,
+			})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, doc := range g.Documents {
+		if seen[doc.RelPath] {
+			problems = append(problems, Problem{
+				Kind:    ProblemDuplicateDocument,
+				Path:    doc.RelPath,
+				Detail:  "document is listed more than once",
+				Fixable: true,
+			})
+		}
+		seen[doc.RelPath] = true
+	}
+
+	dims := g.usualEmbeddingDims()
+	for _, chunk := range g.Chunks {
+		if chunk.Embedding == nil || !docs[chunk.Document.RelPath] {
+			continue
+		}
+		detail := badEmbedding(chunk.Embedding, dims)
+		if detail != "" {
+			problems = append(problems, Problem{
+				Kind:    ProblemBadEmbedding,
+				Path:    chunk.Document.RelPath,
+				Detail:  Spf("chunk at offset %d: %s", chunk.Offset, detail),
+				Fixable: true,
+			})
+		}
+	}
+
+	for _, detail := range g.badSettings() {
+		problems = append(problems, Problem{Kind: ProblemSettings, Detail: detail})
+	}
+	return
+}
+
+// usualEmbeddingDims returns the number of dimensions most embeddings
+// in the db have, so that one bad embedding isn't taken as the norm,
+// or 0 if there are none.
+func (g *Grokker) usualEmbeddingDims() (dims int) {
+	counts := make(map[int]int)
+	for _, chunk := range g.Chunks {
+		if chunk.Embedding != nil {
+			counts[len(chunk.Embedding)]++
+		}
+	}
+	for n, count := range counts {
+		if count > counts[dims] || (count == counts[dims] && n < dims) {
+			dims = n
+		}
+	}
+	return
+}
+
+// badEmbedding describes what is wrong with an embedding that should
+// have dims dimensions, or returns "" if nothing is.  Unlike
+// validateEmbedding, it accepts embeddings of all zeros, which some
+// embedders return for texts they can't embed.
+func badEmbedding(embedding []float64, dims int) string {
+	if len(embedding) != dims {
+		return Spf("embedding has %d dimensions, expected %d", len(embedding), dims)
+	}
+	for _, v := range embedding {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return Spf("embedding contains %v", v)
+		}
+	}
+	return ""
+}
+
+// badSettings describes the db settings that don't make sense.
+func (g *Grokker) badSettings() (details []string) {
+	if g.Version != Version {
+		details = append(details, Spf("db version is %q, expected %q", g.Version, Version))
+	}
+	if g.models != nil {
+		_, _, err := g.models.FindModel(g.Model)
+		if err != nil {
+			details = append(details, Spf("chat model: %v", err))
+		}
+	}
+	spec, ok := embeddingModels[g.embeddingModel()]
+	switch {
+	case !ok:
+		details = append(details, Spf("unknown embedding model %q", g.EmbeddingModel))
+	case g.EmbeddingDimensions != 0 && !spec.shortens:
+		details = append(details, Spf("embedding model %s does not support %d dimensions", g.embeddingModel(), g.EmbeddingDimensions))
+	}
+	if g.EmbeddingTokenLimit <= 0 {
+		details = append(details, Spf("embedding token limit is %d", g.EmbeddingTokenLimit))
+	}
+	return
+}
+
+// Repair verifies the db as Verify does and fixes the problems that
+// can be fixed safely:  it removes orphaned chunks and duplicate
+// document entries, and embeds chunks with bad embeddings again.  It
+// returns every problem found, with Fixed set on those it fixed.  A
+// chunk that can't be embedded again, e.g. because its document's
+// file is gone, keeps its bad embedding and its problem stays
+// unfixed; an embedding API error stops the repair and is returned.
+func (g *Grokker) Repair() (problems []Problem, err error) {
+	defer Return(&err)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	problems = g.verify()
+
+	// drop duplicate documents, then orphaned chunks
+	seen := make(map[string]bool)
+	var docs []*Document
+	for _, doc := range g.Documents {
+		if !seen[doc.RelPath] {
+			docs = append(docs, doc)
+		}
+		seen[doc.RelPath] = true
+	}
+	g.Documents = docs
+	err = g.gc()
+	Ck(err)
+	for i := range problems {
+		switch problems[i].Kind {
+		case ProblemOrphanChunk, ProblemDuplicateDocument:
+			problems[i].Fixed = true
+			// rewrite the whole db on the next save, since the
+			// journal only records documents that exist
+			g.savedHeader = nil
+		}
+	}
+
+	// re-embed bad embeddings, clearing them all first so that
+	// embedChunks checks the new ones against a good embedding
+	dims := g.usualEmbeddingDims()
+	bad := make(map[string][]*Chunk)
+	old := make(map[*Chunk][]float64)
+	for _, chunk := range g.Chunks {
+		if chunk.Embedding != nil && badEmbedding(chunk.Embedding, dims) != "" {
+			bad[chunk.Document.RelPath] = append(bad[chunk.Document.RelPath], chunk)
+			old[chunk] = chunk.Embedding
+			chunk.Embedding = nil
+		}
+	}
+	failed := make(map[string]bool)
+	for _, doc := range g.Documents {
+		chunks := bad[doc.RelPath]
+		if len(chunks) == 0 {
+			continue
+		}
+		embedErr := g.embedChunks(doc, chunks, nil)
+		if embedErr != nil {
+			// put back what was there, so that Verify still
+			// reports it
+			for _, chunk := range chunks {
+				chunk.Embedding = old[chunk]
+			}
+			Ck(apiOnly(embedErr))
+			Fpf(os.Stderr, "warning: %s: %v\n", doc.RelPath, embedErr)
+			failed[doc.RelPath] = true
+			continue
+		}
+		g.touch(doc.RelPath)
+	}
+	for i := range problems {
+		if problems[i].Kind == ProblemBadEmbedding && !failed[problems[i].Path] {
+			problems[i].Fixed = true
+		}
+	}
+	return
+}
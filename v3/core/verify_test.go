@@ -0,0 +1,65 @@
+package core
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestVerify(t *testing.T) {
+	dir := TmpTestDir()
+	grok, err := Init(dir, "gpt-4")
+	Tassert(t, err == nil, "error creating grokker: %v", err)
+	embedder := &countingEmbedder{}
+	grok.SetEmbedder(embedder)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		fn := filepath.Join(dir, name)
+		err = ioutil.WriteFile(fn, []byte("first paragraph of "+name+"\n\nsecond paragraph\n"), 0644)
+		Tassert(t, err == nil, "error writing file: %v", err)
+		err = grok.AddDocument(fn)
+		Tassert(t, err == nil, "error adding doc: %v", err)
+	}
+	problems, err := grok.Verify()
+	Tassert(t, err == nil, "error verifying: %v", err)
+	Tassert(t, len(problems) == 0, "expected no problems, got %v", problems)
+
+	// break each invariant
+	grok.Documents = append(grok.Documents, grok.Documents[0])
+	grok.Chunks = append(grok.Chunks, &Chunk{Document: &Document{RelPath: "gone.txt"}, Hash: "x", Length: 1, Embedding: []float64{1, 0, 0}})
+	grok.Chunks[0].Embedding = []float64{math.NaN(), 0, 0}
+	grok.Chunks[1].Embedding = []float64{1, 0}
+	grok.EmbeddingDimensions = 256
+	problems, err = grok.Verify()
+	Tassert(t, err == nil, "error verifying: %v", err)
+	kinds := make(map[string]int)
+	for _, p := range problems {
+		kinds[p.Kind]++
+	}
+	Tassert(t, len(problems) == 5, "expected 5 problems, got %v", problems)
+	Tassert(t, kinds[ProblemOrphanChunk] == 1, "expected an orphan chunk, got %v", problems)
+	Tassert(t, kinds[ProblemDuplicateDocument] == 1, "expected a duplicate document, got %v", problems)
+	Tassert(t, kinds[ProblemBadEmbedding] == 2, "expected 2 bad embeddings, got %v", problems)
+	Tassert(t, kinds[ProblemSettings] == 1, "expected a bad setting, got %v", problems)
+
+	// everything but the setting is fixed, and stays fixed
+	embedder.count = 0
+	problems, err = grok.Repair()
+	Tassert(t, err == nil, "error repairing: %v", err)
+	for _, p := range problems {
+		Tassert(t, p.Fixed == (p.Kind != ProblemSettings), "unexpected fix state: %v", p)
+	}
+	Tassert(t, embedder.count == 2, "expected 2 embeddings, got %d", embedder.count)
+	grok.EmbeddingDimensions = 0
+	err = grok.Save()
+	Tassert(t, err == nil, "error saving: %v", err)
+	g, _, _, _, lock, err := LoadFrom(grok.grokpath, "", true)
+	Tassert(t, err == nil, "error loading: %v", err)
+	defer lock.Unlock()
+	problems, err = g.Verify()
+	Tassert(t, err == nil, "error verifying: %v", err)
+	Tassert(t, len(problems) == 0, "expected no problems, got %v", problems)
+	Tassert(t, len(g.Documents) == 2, "expected 2 documents, got %d", len(g.Documents))
+}
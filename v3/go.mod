@@ -6,7 +6,6 @@ require github.com/stevegt/go-openai v0.0.0-20250731211715-61bacff90751
 
 require (
 	github.com/alecthomas/kong v0.7.1
-	github.com/fabiustech/openai v0.4.0
 	github.com/gofrs/flock v0.8.1
 	// github.com/sashabaranov/go-openai v1.24.1
 	github.com/stevegt/goadapt v0.7.0
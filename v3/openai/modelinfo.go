@@ -0,0 +1,93 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// ModelInfoTimeout is how long ContextWindow waits for the model list.
+var ModelInfoTimeout = 5 * time.Second
+
+// contextWindowFields are the fields that OpenAI-compatible servers
+// use for a model's context window in their model lists, e.g.
+// OpenRouter's context_length, LM Studio's max_context_length, and
+// vLLM's max_model_len.
+var contextWindowFields = []string{"context_window", "context_length", "max_context_length", "max_model_len"}
+
+// ContextWindow returns the context window in tokens of the named
+// model as listed by the API at OPENAI_BASE_URL.  OpenAI itself
+// doesn't list context windows, so nothing is sent and tokens is zero
+// if OPENAI_BASE_URL isn't set or points at OpenAI, but compatible
+// services such as OpenRouter do.  tokens is also zero if the API
+// answers without listing one for the model.  The request is sent
+// with hc if it isn't nil.
+func ContextWindow(upstreamName string, hc *http.Client) (tokens int, err error) {
+	if !compatibleBaseURL() {
+		return
+	}
+	err = CheckAPIKey()
+	if err != nil {
+		return
+	}
+	return contextWindow(hc, os.Getenv("OPENAI_BASE_URL"), os.Getenv("OPENAI_API_KEY"), upstreamName)
+}
+
+// LocalContextWindow is like ContextWindow, but asks the local API
+// used by NewLocalChatClient.
+func LocalContextWindow(upstreamName string, hc *http.Client) (tokens int, err error) {
+	baseURL := os.Getenv("GROKKER_LOCAL_URL")
+	if baseURL == "" {
+		baseURL = DefaultLocalURL
+	}
+	return contextWindow(hc, baseURL, os.Getenv("GROKKER_LOCAL_API_KEY"), upstreamName)
+}
+
+// contextWindow finds the named model in the model list of the
+// OpenAI-compatible API at baseURL and returns its context window,
+// using a copy of hc, if not nil, that gives up after
+// ModelInfoTimeout unless hc has a shorter timeout of its own.
+func contextWindow(hc *http.Client, baseURL, apiKey, upstreamName string) (tokens int, err error) {
+	defer Return(&err)
+	req, err := http.NewRequest("GET", strings.TrimSuffix(baseURL, "/")+"/models", nil)
+	Ck(err)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	httpClient := &http.Client{}
+	if hc != nil {
+		*httpClient = *hc
+	}
+	if httpClient.Timeout == 0 || httpClient.Timeout > ModelInfoTimeout {
+		httpClient.Timeout = ModelInfoTimeout
+	}
+	resp, err := httpClient.Do(req)
+	Ck(err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("listing models: %s", resp.Status)
+		return
+	}
+	var list struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	Ck(err, "listing models")
+	for _, m := range list.Data {
+		if m["id"] != upstreamName {
+			continue
+		}
+		for _, field := range contextWindowFields {
+			if n, ok := m[field].(float64); ok && n > 0 {
+				tokens = int(n)
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package openai
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrModelUnavailable is returned by UpstreamName for models this
+// version of grokker's OpenAI client doesn't know how to call.
+var ErrModelUnavailable = errors.New("model unavailable in this client version")
+
+// upstreamNames maps grokker's model names to the names the OpenAI API
+// expects.  The names are string literals rather than go-openai
+// constants so that grokker keeps building when the library renames or
+// removes the constants for retired models, e.g. gpt-4-32k.  To retire
+// a model, remove it here; callers then get ErrModelUnavailable
+// instead of a compile error or a request with a bad model string.
+var upstreamNames = map[string]string{
+	"gpt-3.5-turbo":       "gpt-3.5-turbo",
+	"gpt-4":               "gpt-4",
+	"gpt-4-32k":           "gpt-4-32k",
+	"gpt-4-turbo-preview": "gpt-4-turbo-preview",
+	"gpt-4o":              "gpt-4o",
+	"gpt-4o-mini":         "gpt-4o-mini",
+	"o1-preview":          "o1-preview",
+	"o1-mini":             "o1-mini",
+	"o1":                  "o1",
+	"o3":                  "o3",
+	"o3-mini":             "o3-mini",
+}
+
+// UpstreamName returns the OpenAI API name for the named model.  It
+// returns an error wrapping ErrModelUnavailable if the model isn't
+// known to this client version.
+func UpstreamName(name string) (upstreamName string, err error) {
+	upstreamName, ok := upstreamNames[name]
+	if !ok {
+		err = fmt.Errorf("%s: %w", name, ErrModelUnavailable)
+	}
+	return
+}
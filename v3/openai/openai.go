@@ -2,6 +2,11 @@ package openai
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
 	"os"
 	"strings"
 
@@ -14,6 +19,36 @@ import (
 type OpenAIChatClient struct {
 	client *gptLib.Client
 	model  string
+	// Options are sent with each chat request.
+	Options client.Options
+}
+
+// CompleteChat sends a chat request to the OpenAI API using c's
+// client and options.  This method implements the ChatClient
+// interface.
+func (c *OpenAIChatClient) CompleteChat(model string, msgs []client.ChatMsg) (results client.Results, err error) {
+	return completeChat(context.Background(), c.client, model, msgs, c.Options)
+}
+
+// Chat is like CompleteChat, but sends opts instead of c.Options,
+// except for opts.HTTPClient, which is fixed when c is created, and
+// gives up when ctx is done.  This method implements the
+// ChatProvider interface.
+func (c *OpenAIChatClient) Chat(ctx context.Context, model string, msgs []client.ChatMsg, opts client.Options) (results client.Results, err error) {
+	return completeChat(ctx, c.client, model, msgs, opts)
+}
+
+// ChatStream is like Chat, but writes the response to w as it
+// arrives.  The returned results hold the complete response.
+func (c *OpenAIChatClient) ChatStream(ctx context.Context, model string, msgs []client.ChatMsg, opts client.Options, w io.Writer) (results client.Results, err error) {
+	return completeChatStream(ctx, c.client, model, msgs, opts, w)
+}
+
+// NewChatClient returns an OpenAIChatClient for the OpenAI API, or
+// for OPENAI_BASE_URL if that is set, that sends requests with hc if
+// it isn't nil.
+func NewChatClient(hc *http.Client) *OpenAIChatClient {
+	return &OpenAIChatClient{client: NewClientWithHTTP(hc)}
 }
 
 // NewOpenAIChatClient creates a new OpenAIChatClient instance.
@@ -22,16 +57,185 @@ func NewOpenAIChatClient(apiKey, model string) *OpenAIChatClient {
 	return &OpenAIChatClient{client: c, model: model}
 }
 
+// ErrAPIKey means OPENAI_API_KEY is missing or obviously malformed,
+// so requests would only fail with a less helpful authentication
+// error.
+var ErrAPIKey = errors.New("bad OPENAI_API_KEY")
+
+// CheckAPIKey returns an error wrapping ErrAPIKey if the
+// OPENAI_API_KEY environment variable is not set, or if it holds
+// whitespace, quotes, or angle brackets, which no real key does but
+// which sneak in when a key is pasted from a shell script or the
+// README's placeholder.  The key may be left unset if
+// OPENAI_BASE_URL points at a compatible server other than OpenAI,
+// since many of those don't need one.
+func CheckAPIKey() error {
+	key := os.Getenv("OPENAI_API_KEY")
+	if key == "" {
+		if compatibleBaseURL() {
+			return nil
+		}
+		return fmt.Errorf("%w: OPENAI_API_KEY is not set -- create a key at https://platform.openai.com/api-keys and run 'export OPENAI_API_KEY=<your key>'", ErrAPIKey)
+	}
+	if strings.ContainsAny(key, " \t\r\n\"'<>") {
+		return fmt.Errorf("%w: OPENAI_API_KEY contains whitespace, quotes, or angle brackets -- set it to the key alone", ErrAPIKey)
+	}
+	return nil
+}
+
+// compatibleBaseURL returns true if OPENAI_BASE_URL sends requests
+// somewhere other than the OpenAI API.
+func compatibleBaseURL() bool {
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	return baseURL != "" && !strings.HasPrefix(baseURL, gptLib.DefaultConfig("").BaseURL)
+}
+
+// NewClient returns a go-openai client using the OPENAI_API_KEY
+// environment variable.  If OPENAI_BASE_URL is set, requests go there
+// instead of to the OpenAI API, e.g. to replay recorded responses in
+// tests.
+func NewClient() *gptLib.Client {
+	return NewClientWithHTTP(nil)
+}
+
+// NewClientWithHTTP is like NewClient, but sends requests with hc if
+// it isn't nil.
+func NewClientWithHTTP(hc *http.Client) *gptLib.Client {
+	authtoken := os.Getenv("OPENAI_API_KEY")
+	config := gptLib.DefaultConfig(authtoken)
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	if baseURL != "" {
+		config.BaseURL = baseURL
+	}
+	if hc != nil {
+		config.HTTPClient = hc
+	}
+	return gptLib.NewClientWithConfig(config)
+}
+
+// DefaultLocalURL is the base URL of the OpenAI-compatible API served
+// by a local Ollama install.
+const DefaultLocalURL = "http://localhost:11434/v1"
+
+// NewLocalChatClient returns a chat client for an OpenAI-compatible
+// API such as one served locally by Ollama or LM Studio.  Requests go
+// to GROKKER_LOCAL_URL, or DefaultLocalURL if that isn't set, and are
+// authenticated with GROKKER_LOCAL_API_KEY if set; most local servers
+// don't need a key.  The opts are sent with each request.
+func NewLocalChatClient(opts client.Options) *OpenAIChatClient {
+	config := gptLib.DefaultConfig(os.Getenv("GROKKER_LOCAL_API_KEY"))
+	config.BaseURL = DefaultLocalURL
+	baseURL := os.Getenv("GROKKER_LOCAL_URL")
+	if baseURL != "" {
+		config.BaseURL = baseURL
+	}
+	if opts.HTTPClient != nil {
+		config.HTTPClient = opts.HTTPClient
+	}
+	return &OpenAIChatClient{client: gptLib.NewClientWithConfig(config), Options: opts}
+}
+
 // CompleteChat sends a chat request to the OpenAI API and returns the response.
 // It converts core.ChatMsg messages into OpenAI's ChatCompletionMessage format.
-func CompleteChat(upstreamName string, inmsgs []client.ChatMsg) (results client.Results, err error) {
+// The opts set optional generation parameters such as the seed and
+// temperature.
+func CompleteChat(upstreamName string, inmsgs []client.ChatMsg, opts client.Options) (results client.Results, err error) {
+	err = CheckAPIKey()
+	if err != nil {
+		return
+	}
+	return NewChatClient(opts.HTTPClient).Chat(context.Background(), upstreamName, inmsgs, opts)
+}
+
+// completeChat sends a chat request using the given go-openai client.
+func completeChat(ctx context.Context, c *gptLib.Client, upstreamName string, inmsgs []client.ChatMsg, opts client.Options) (results client.Results, err error) {
 	defer Return(&err)
 
+	req := newRequest(upstreamName, inmsgs, opts)
+
+	var res gptLib.ChatCompletionResponse
+	res, err = c.CreateChatCompletion(ctx, req)
+	if err != nil {
+		Pf("model: %s\n", upstreamName)
+		Ck(err)
+	}
+
+	results.Body = res.Choices[0].Message.Content
+	results.FinishReason = string(res.Choices[0].FinishReason)
+	results.Usage = client.Usage{
+		PromptTokens:     res.Usage.PromptTokens,
+		CompletionTokens: res.Usage.CompletionTokens,
+		TotalTokens:      res.Usage.TotalTokens,
+	}
+	results.Raw = res
+	return
+}
+
+// CompleteChatStream is like CompleteChat, but writes the response to
+// w as it arrives.  The returned results hold the complete response.
+func CompleteChatStream(upstreamName string, inmsgs []client.ChatMsg, opts client.Options, w io.Writer) (results client.Results, err error) {
+	err = CheckAPIKey()
+	if err != nil {
+		return
+	}
+	return NewChatClient(opts.HTTPClient).ChatStream(context.Background(), upstreamName, inmsgs, opts, w)
+}
+
+// completeChatStream sends a streaming chat request using the given
+// go-openai client; see CompleteChatStream.
+func completeChatStream(ctx context.Context, c *gptLib.Client, upstreamName string, inmsgs []client.ChatMsg, opts client.Options, w io.Writer) (results client.Results, err error) {
+	defer Return(&err)
+
+	req := newRequest(upstreamName, inmsgs, opts)
+	req.StreamOptions = &gptLib.StreamOptions{IncludeUsage: true}
+
+	stream, err := c.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		Pf("model: %s\n", upstreamName)
+		Ck(err)
+	}
+	defer stream.Close()
+
+	var body strings.Builder
+	for {
+		var res gptLib.ChatCompletionStreamResponse
+		res, err = stream.Recv()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			break
+		}
+		Ck(err)
+		if res.Usage != nil {
+			results.Usage = client.Usage{
+				PromptTokens:     res.Usage.PromptTokens,
+				CompletionTokens: res.Usage.CompletionTokens,
+				TotalTokens:      res.Usage.TotalTokens,
+			}
+		}
+		if len(res.Choices) == 0 {
+			continue
+		}
+		if res.Choices[0].FinishReason != "" {
+			results.FinishReason = string(res.Choices[0].FinishReason)
+		}
+		delta := res.Choices[0].Delta.Content
+		body.WriteString(delta)
+		_, err = io.WriteString(w, delta)
+		Ck(err)
+	}
+	results.Body = body.String()
+	return
+}
+
+// newRequest returns a chat request for the given model, messages,
+// and options.  It converts core.ChatMsg messages into OpenAI's
+// ChatCompletionMessage format.
+func newRequest(upstreamName string, inmsgs []client.ChatMsg, opts client.Options) (req gptLib.ChatCompletionRequest) {
 	// convert the ChatMsg slice to an oai.ChatCompletionMessage slice
 	omsgs := []gptLib.ChatCompletionMessage{}
 	for _, msg := range inmsgs {
 		// skip empty messages
-		if len(strings.TrimSpace(msg.Content)) == 0 {
+		if len(strings.TrimSpace(msg.Content)) == 0 && len(msg.Images) == 0 {
 			continue
 		}
 		// convert msg.Role to uppercase
@@ -50,27 +254,52 @@ func CompleteChat(upstreamName string, inmsgs []client.ChatMsg) (results client.
 		default:
 			Assert(false, "unknown role: %q", msg)
 		}
-		omsgs = append(omsgs, gptLib.ChatCompletionMessage{
+		omsg := gptLib.ChatCompletionMessage{
 			Role:    role,
 			Content: msg.Content,
-		})
+		}
+		if len(msg.Images) > 0 {
+			// images need the multi-part message format
+			omsg.Content = ""
+			omsg.MultiContent = []gptLib.ChatMessagePart{{
+				Type: gptLib.ChatMessagePartTypeText,
+				Text: msg.Content,
+			}}
+			for _, url := range msg.Images {
+				omsg.MultiContent = append(omsg.MultiContent, gptLib.ChatMessagePart{
+					Type:     gptLib.ChatMessagePartTypeImageURL,
+					ImageURL: &gptLib.ChatMessageImageURL{URL: url},
+				})
+			}
+		}
+		omsgs = append(omsgs, omsg)
 	}
 
-	authtoken := os.Getenv("OPENAI_API_KEY")
-	client := gptLib.NewClient(authtoken)
-	var res gptLib.ChatCompletionResponse
-	res, err = client.CreateChatCompletion(
-		context.Background(),
-		gptLib.ChatCompletionRequest{
-			Model:    upstreamName,
-			Messages: omsgs,
-		},
-	)
-	if err != nil {
-		Pf("model: %s\n", upstreamName)
-		Ck(err)
+	req = gptLib.ChatCompletionRequest{
+		Model:    upstreamName,
+		Messages: omsgs,
+		Seed:     opts.Seed,
+	}
+	if opts.Temperature != nil {
+		req.Temperature = *opts.Temperature
+		if req.Temperature == 0 {
+			// the library omits a zero temperature from the
+			// request, which means the API default of 1
+			req.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	if len(opts.JSONSchema) > 0 {
+		req.ResponseFormat = &gptLib.ChatCompletionResponseFormat{
+			Type: gptLib.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &gptLib.ChatCompletionResponseFormatJSONSchema{
+				Name:   "result",
+				Schema: opts.JSONSchema,
+			},
+		}
+	} else if opts.ResponseFormat == client.ResponseFormatJSON {
+		req.ResponseFormat = &gptLib.ChatCompletionResponseFormat{
+			Type: gptLib.ChatCompletionResponseFormatTypeJSONObject,
+		}
 	}
-
-	results.Body = res.Choices[0].Message.Content
 	return
 }
@@ -1,6 +1,7 @@
 package perplexity
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -17,6 +18,9 @@ import (
 type Client struct {
 	APIKey   string
 	Endpoint string
+	// HTTPClient, if not nil, sends the requests instead of a
+	// default client.
+	HTTPClient *http.Client
 }
 
 // NewClient creates a new instance of the Perplexity chat client.
@@ -34,10 +38,24 @@ func NewClient() *Client {
 
 // Request defines the payload sent to Perplexity.ai.
 type Request struct {
-	Model    string    `json:"model"`
-	Messages []ChatMsg `json:"messages"`
+	Model          string          `json:"model"`
+	Messages       []ChatMsg       `json:"messages"`
+	Temperature    *float32        `json:"temperature,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
 }
 
+// ResponseFormat asks for a reply matching a JSON schema.
+type ResponseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema struct {
+		Schema json.RawMessage `json:"schema"`
+	} `json:"json_schema"`
+}
+
+// objectSchema is the JSON schema of any JSON object, sent when a
+// JSON object is asked for without a schema.
+var objectSchema = json.RawMessage(`{"type": "object"}`)
+
 // ChatMsg represents a single chat message.
 type ChatMsg struct {
 	Role    string `json:"role"`
@@ -46,8 +64,9 @@ type ChatMsg struct {
 
 // Response defines Perplexity.ai's response structure.
 type Response struct {
-	Citations []string `json:"citations"`
-	Choices   []Choice `json:"choices"`
+	Citations []string     `json:"citations"`
+	Choices   []Choice     `json:"choices"`
+	Usage     client.Usage `json:"usage"`
 	Error     *struct {
 		Message string `json:"message"`
 	} `json:"error,omitempty"`
@@ -63,11 +82,33 @@ type Choice struct {
 // CompleteChat sends a chat completion request to Perplexity.ai and returns the generated text.
 // This method conforms to the ChatClient interface.
 func (c *Client) CompleteChat(model string, messagesIn []client.ChatMsg) (results client.Results, err error) {
+	return c.Chat(context.Background(), model, messagesIn, client.Options{})
+}
+
+// Chat is like CompleteChat, but gives up when ctx is done and sends
+// opts with the request.  Perplexity.ai has no seed, so a seed is
+// ignored with a warning, and its structured output takes only a
+// schema, so a JSON object is asked for with a schema that matches
+// any object.  opts.HTTPClient, if not nil, is used instead of
+// c.HTTPClient.  This method conforms to the ChatProvider interface.
+func (c *Client) Chat(ctx context.Context, model string, messagesIn []client.ChatMsg, opts client.Options) (results client.Results, err error) {
 
 	// Prepare the request payload.
 	reqPayload := Request{
-		Model:    model,
-		Messages: []ChatMsg{},
+		Model:       model,
+		Messages:    []ChatMsg{},
+		Temperature: opts.Temperature,
+	}
+	if opts.Seed != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Perplexity does not support a seed; ignoring it")
+	}
+	schema := opts.JSONSchema
+	if len(schema) == 0 && opts.ResponseFormat == client.ResponseFormatJSON {
+		schema = objectSchema
+	}
+	if len(schema) > 0 {
+		reqPayload.ResponseFormat = &ResponseFormat{Type: "json_schema"}
+		reqPayload.ResponseFormat.JSONSchema.Schema = schema
 	}
 
 	// Convert ChatMsg (from client interface) to Message for Perplexity.ai.
@@ -86,7 +127,7 @@ func (c *Client) CompleteChat(model string, messagesIn []client.ChatMsg) (result
 	}
 
 	// Create the HTTP request.
-	req, err := http.NewRequest("POST", c.Endpoint, strings.NewReader(string(payloadBytes)))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Endpoint, strings.NewReader(string(payloadBytes)))
 	if err != nil {
 		return
 	}
@@ -94,7 +135,13 @@ func (c *Client) CompleteChat(model string, messagesIn []client.ChatMsg) (result
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
 
 	// Execute the HTTP request.
-	client := &http.Client{}
+	client := opts.HTTPClient
+	if client == nil {
+		client = c.HTTPClient
+	}
+	if client == nil {
+		client = &http.Client{}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return
@@ -126,7 +173,10 @@ func (c *Client) CompleteChat(model string, messagesIn []client.ChatMsg) (result
 
 	// Return the content of the first choice.
 	results.Body = response.Choices[0].Message.Content
+	results.FinishReason = response.Choices[0].FinishReason
 	results.Citations = response.Citations
+	results.Usage = response.Usage
+	results.Raw = response
 
 	return
 }
@@ -1,9 +1,12 @@
 package util
 
 import (
+	"fmt"
 	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"strings"
 
 	. "github.com/stevegt/goadapt"
 )
@@ -51,6 +54,9 @@ func CopyFile(src, dst string) (err error) {
 }
 
 // Similarity returns the cosine Similarity between two embeddings.
+// It returns 0 rather than NaN if the embeddings have different
+// lengths or either has zero magnitude, so that a corrupt embedding
+// can't outrank a good one.
 func Similarity(a, b []float64) float64 {
 	if len(a) != len(b) {
 		return 0
@@ -64,7 +70,56 @@ func Similarity(a, b []float64) float64 {
 		magA += a[i] * a[i]
 		magB += b[i] * b[i]
 	}
-	return dot / (math.Sqrt(magA) * math.Sqrt(magB))
+	if magA == 0 || magB == 0 {
+		return 0
+	}
+	sim := dot / (math.Sqrt(magA) * math.Sqrt(magB))
+	if math.IsNaN(sim) || math.IsInf(sim, 0) {
+		return 0
+	}
+	return sim
+}
+
+// Dot returns the dot product of two embeddings, skipping NaN
+// components.  It returns 0 if the embeddings have different lengths
+// or the product isn't finite.
+func Dot(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot float64
+	for i := range a {
+		if math.IsNaN(a[i]) || math.IsNaN(b[i]) {
+			continue
+		}
+		dot += a[i] * b[i]
+	}
+	if math.IsNaN(dot) || math.IsInf(dot, 0) {
+		return 0
+	}
+	return dot
+}
+
+// Distance returns the Euclidean distance between two embeddings,
+// skipping NaN components.  It returns +Inf if the embeddings have
+// different lengths.
+func Distance(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return math.Inf(1)
+	}
+	var sum float64
+	for i := range a {
+		if math.IsNaN(a[i]) || math.IsNaN(b[i]) {
+			continue
+		}
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	dist := math.Sqrt(sum)
+	if math.IsNaN(dist) {
+		return math.Inf(1)
+	}
+	return dist
 }
 
 // meanSimilarity returns the mean cosine similarity between two sets of embeddings.
@@ -108,3 +163,73 @@ func StringInSlice(str string, list []string) bool {
 	}
 	return false
 }
+
+// Ext2Lang derives language from file extension.  Extensions are
+// matched case-insensitively, and only the final segment of a
+// compound extension such as .tar.gz is used.
+func Ext2Lang(fn string) (lang string, known bool, err error) {
+	// split the base name on dots and take the last part
+	parts := strings.Split(filepath.Base(fn), ".")
+	if len(parts) < 2 {
+		err = fmt.Errorf("file %s missing language or extension", fn)
+		return
+	}
+	lang = strings.ToLower(parts[len(parts)-1])
+	// see if we can convert the file extension to a language name
+	known = true
+	switch lang {
+	case "md":
+		lang = "markdown"
+	case "py":
+		lang = "python"
+	case "rb":
+		lang = "ruby"
+	case "rs":
+		lang = "rust"
+	case "go":
+		lang = "go"
+	case "csv":
+		lang = "csv"
+	case "tsv":
+		lang = "tsv"
+	case "js":
+		lang = "javascript"
+	case "ts":
+		lang = "typescript"
+	case "java":
+		lang = "java"
+	case "c", "h":
+		lang = "c"
+	case "cpp", "cc", "cxx", "hpp":
+		lang = "cpp"
+	case "cs":
+		lang = "csharp"
+	case "php":
+		lang = "php"
+	case "sh":
+		lang = "bash"
+	case "sql":
+		lang = "sql"
+	case "yaml", "yml":
+		lang = "yaml"
+	case "json":
+		lang = "json"
+	case "toml":
+		lang = "toml"
+	case "html", "htm":
+		lang = "html"
+	case "css":
+		lang = "css"
+	case "kt":
+		lang = "kotlin"
+	case "swift":
+		lang = "swift"
+	case "scala":
+		lang = "scala"
+	case "hs":
+		lang = "haskell"
+	default:
+		known = false
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/stevegt/goadapt"
+)
+
+func TestSimilarity(t *testing.T) {
+	sim := Similarity([]float64{1, 0}, []float64{1, 0})
+	Tassert(t, math.Abs(sim-1) < 1e-9, "expected 1, got %f", sim)
+	sim = Similarity([]float64{1, 0}, []float64{0, 1})
+	Tassert(t, sim == 0, "expected 0, got %f", sim)
+	// mismatched lengths
+	sim = Similarity([]float64{1, 0}, []float64{1, 0, 0})
+	Tassert(t, sim == 0, "expected 0 for mismatched lengths, got %f", sim)
+	// zero vectors
+	sim = Similarity([]float64{0, 0}, []float64{1, 0})
+	Tassert(t, sim == 0, "expected 0 for zero vector, got %f", sim)
+	sim = Similarity(nil, nil)
+	Tassert(t, sim == 0, "expected 0 for empty vectors, got %f", sim)
+	// infinite values
+	sim = Similarity([]float64{math.Inf(1), 0}, []float64{1, 0})
+	Tassert(t, !math.IsNaN(sim), "expected a number for infinite vector, got %f", sim)
+}
+
+func TestDotDistance(t *testing.T) {
+	dot := Dot([]float64{1, 2}, []float64{3, 4})
+	Tassert(t, dot == 11, "expected 11, got %f", dot)
+	dot = Dot([]float64{1, 0}, []float64{1, 0, 0})
+	Tassert(t, dot == 0, "expected 0 for mismatched lengths, got %f", dot)
+	dist := Distance([]float64{0, 0}, []float64{3, 4})
+	Tassert(t, dist == 5, "expected 5, got %f", dist)
+	dist = Distance([]float64{1, math.NaN()}, []float64{1, 7})
+	Tassert(t, dist == 0, "expected NaN components to be skipped, got %f", dist)
+	dist = Distance([]float64{1, 0}, []float64{1, 0, 0})
+	Tassert(t, math.IsInf(dist, 1), "expected +Inf for mismatched lengths, got %f", dist)
+}
+
+func TestExt2Lang(t *testing.T) {
+	lang, known, err := Ext2Lang("notes.md")
+	Tassert(t, err == nil, "unexpected error: %v", err)
+	Tassert(t, known && lang == "markdown", "expected markdown, got %q %v", lang, known)
+	lang, known, err = Ext2Lang("data/sales.csv")
+	Tassert(t, err == nil, "unexpected error: %v", err)
+	Tassert(t, known && lang == "csv", "expected csv, got %q %v", lang, known)
+	lang, known, err = Ext2Lang("export.tsv")
+	Tassert(t, err == nil, "unexpected error: %v", err)
+	Tassert(t, known && lang == "tsv", "expected tsv, got %q %v", lang, known)
+	lang, known, err = Ext2Lang("file.xyz")
+	Tassert(t, err == nil, "unexpected error: %v", err)
+	Tassert(t, !known && lang == "xyz", "expected unknown xyz, got %q %v", lang, known)
+	_, _, err = Ext2Lang("Makefile")
+	Tassert(t, err != nil, "expected error for missing extension")
+	_, _, err = Ext2Lang("build.d/Makefile")
+	Tassert(t, err != nil, "expected error for dot in directory name")
+	// case-insensitive
+	lang, known, err = Ext2Lang("README.MD")
+	Tassert(t, err == nil, "unexpected error: %v", err)
+	Tassert(t, known && lang == "markdown", "expected markdown, got %q %v", lang, known)
+	// compound extensions use the final segment
+	lang, known, err = Ext2Lang("backup.tar.gz")
+	Tassert(t, err == nil, "unexpected error: %v", err)
+	Tassert(t, !known && lang == "gz", "expected unknown gz, got %q %v", lang, known)
+	lang, known, err = Ext2Lang("types.d.ts")
+	Tassert(t, err == nil, "unexpected error: %v", err)
+	Tassert(t, known && lang == "typescript", "expected typescript, got %q %v", lang, known)
+	for fn, want := range map[string]string{
+		"a.js": "javascript", "a.java": "java", "a.h": "c", "a.cpp": "cpp",
+		"a.cs": "csharp", "a.php": "php", "a.sh": "bash", "a.sql": "sql",
+		"a.yml": "yaml", "a.json": "json", "a.toml": "toml", "a.html": "html",
+		"a.css": "css", "a.kt": "kotlin", "a.swift": "swift",
+		"a.scala": "scala", "a.hs": "haskell",
+	} {
+		lang, known, err = Ext2Lang(fn)
+		Tassert(t, err == nil, "unexpected error: %v", err)
+		Tassert(t, known && lang == want, "expected %s for %s, got %q %v", want, fn, lang, known)
+	}
+}